@@ -0,0 +1,225 @@
+// Package analytics computes flow analytics from the transition logs of many machines, as
+// kept with rfsm.WithTransitionLog: throughput per transition, dwell time per state and
+// drop-off funnels between states.
+//
+//	logs := map[string][]rfsm.TransitionRecord{}
+//	for id, m := range orders {
+//		logs[id] = m.History(0)
+//	}
+//	report := analytics.Analyze(logs, "CART", "CHECKOUT", "PAID")
+//	_ = report.WriteMarkdown(os.Stdout)
+//
+// Only records that moved a machine count: successful transitions, and failures that moved it
+// to its error state (rfsm.TransitionRecord.Moved). Other failures are in the logs for
+// debugging.
+package analytics
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// Report is the result of Analyze.
+type Report struct {
+	// Machines is the number of machines analyzed.
+	Machines int
+	// From and To bound the records analyzed.
+	From, To time.Time
+	// Transitions is sorted by descending count, then by from, event and to.
+	Transitions []TransitionStats
+	// Dwell is sorted by state.
+	Dwell []DwellStats
+	// Funnel has a step per state passed to Analyze, in order.
+	Funnel []FunnelStep
+}
+
+// TransitionStats is the throughput of a transition.
+type TransitionStats struct {
+	From  rfsm.StateID
+	Event rfsm.EventID
+	To    rfsm.StateID
+	Count int
+	// PerHour is Count over the time between the first and the last record, or 0 if they
+	// coincide.
+	PerHour float64
+}
+
+// DwellStats is the time machines stayed in a state before leaving it for another one.
+// Internal and self transitions do not end a stay. Stays that had not ended by the last record
+// of their machine, or began before its first record, are not counted.
+type DwellStats struct {
+	State  rfsm.StateID
+	Count  int
+	Median time.Duration
+	P95    time.Duration
+}
+
+// FunnelStep is a step of a funnel.
+type FunnelStep struct {
+	State rfsm.StateID
+	// Reached is the number of machines that went through this state after the previous steps.
+	Reached int
+	// DropOff is the number of machines that reached the previous step but not this one; for
+	// the first step, the machines that never reached it.
+	DropOff int
+	// Conversion is Reached over the machines that reached the previous step, or all machines
+	// for the first step.
+	Conversion float64
+}
+
+type transitionKey struct {
+	from  rfsm.StateID
+	event rfsm.EventID
+	to    rfsm.StateID
+}
+
+// Analyze computes a report over logs, keyed by machine id, with the records of each machine
+// oldest first. funnel lists the states of a funnel to measure, if any.
+func Analyze(logs map[string][]rfsm.TransitionRecord, funnel ...rfsm.StateID) Report {
+	r := Report{Machines: len(logs)}
+	counts := make(map[transitionKey]int)
+	dwell := make(map[rfsm.StateID][]time.Duration)
+	reached := make([]int, len(funnel))
+	for _, records := range logs {
+		var ok []rfsm.TransitionRecord
+		for _, rec := range records {
+			if r.From.IsZero() || rec.At.Before(r.From) {
+				r.From = rec.At
+			}
+			if rec.At.After(r.To) {
+				r.To = rec.At
+			}
+			if rec.Moved() {
+				ok = append(ok, rec)
+			}
+		}
+		var entered time.Time
+		for _, rec := range ok {
+			counts[transitionKey{rec.From, rec.Event, rec.To}]++
+			if rec.From == rec.To {
+				continue
+			}
+			if !entered.IsZero() {
+				dwell[rec.From] = append(dwell[rec.From], rec.At.Sub(entered))
+			}
+			entered = rec.At
+		}
+		if len(funnel) > 0 && len(ok) > 0 {
+			step := 0
+			visit := func(s rfsm.StateID) {
+				if step < len(funnel) && s == funnel[step] {
+					reached[step]++
+					step++
+				}
+			}
+			visit(ok[0].From)
+			for _, rec := range ok {
+				visit(rec.To)
+			}
+		}
+	}
+
+	hours := r.To.Sub(r.From).Hours()
+	for k, n := range counts {
+		t := TransitionStats{From: k.from, Event: k.event, To: k.to, Count: n}
+		if hours > 0 {
+			t.PerHour = float64(n) / hours
+		}
+		r.Transitions = append(r.Transitions, t)
+	}
+	slices.SortFunc(r.Transitions, func(a, b TransitionStats) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.From, b.From), cmp.Compare(a.Event, b.Event), cmp.Compare(a.To, b.To))
+	})
+
+	for s, ds := range dwell {
+		slices.Sort(ds)
+		r.Dwell = append(r.Dwell, DwellStats{State: s, Count: len(ds), Median: percentile(ds, 50), P95: percentile(ds, 95)})
+	}
+	slices.SortFunc(r.Dwell, func(a, b DwellStats) int { return cmp.Compare(a.State, b.State) })
+
+	prev := r.Machines
+	for i, s := range funnel {
+		step := FunnelStep{State: s, Reached: reached[i], DropOff: prev - reached[i]}
+		if prev > 0 {
+			step.Conversion = float64(reached[i]) / float64(prev)
+		}
+		r.Funnel = append(r.Funnel, step)
+		prev = reached[i]
+	}
+	return r
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted, which must not be empty.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+// WriteMarkdown writes the report as Markdown tables.
+func (r Report) WriteMarkdown(w io.Writer) error {
+	ew := &errWriter{w: w}
+	ew.printf("# Flow report\n\n%d machines, %s to %s.\n\n", r.Machines, r.From.Format(time.RFC3339), r.To.Format(time.RFC3339))
+	ew.printf("## Transitions\n\n| From | Event | To | Count | Per hour |\n|---|---|---|---:|---:|\n")
+	for _, t := range r.Transitions {
+		ew.printf("| %s | %s | %s | %d | %.2f |\n", t.From, t.Event, t.To, t.Count, t.PerHour)
+	}
+	ew.printf("\n## Dwell time\n\n| State | Stays | Median | p95 |\n|---|---:|---:|---:|\n")
+	for _, d := range r.Dwell {
+		ew.printf("| %s | %d | %s | %s |\n", d.State, d.Count, d.Median, d.P95)
+	}
+	if len(r.Funnel) > 0 {
+		ew.printf("\n## Funnel\n\n| Step | Reached | Drop-off | Conversion |\n|---|---:|---:|---:|\n")
+		for _, f := range r.Funnel {
+			ew.printf("| %s | %d | %d | %.1f%% |\n", f.State, f.Reached, f.DropOff, 100*f.Conversion)
+		}
+	}
+	return ew.err
+}
+
+// WriteCSV writes the report as CSV rows of section, name, metric and value, e.g.
+// "dwell,PAID,median_ms,1500". Transitions are named "from -event-> to".
+func (r Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	rows := [][]string{{"section", "name", "metric", "value"}}
+	for _, t := range r.Transitions {
+		name := fmt.Sprintf("%s -%s-> %s", t.From, t.Event, t.To)
+		rows = append(rows,
+			[]string{"transition", name, "count", strconv.Itoa(t.Count)},
+			[]string{"transition", name, "per_hour", strconv.FormatFloat(t.PerHour, 'f', 2, 64)})
+	}
+	for _, d := range r.Dwell {
+		rows = append(rows,
+			[]string{"dwell", d.State, "count", strconv.Itoa(d.Count)},
+			[]string{"dwell", d.State, "median_ms", strconv.FormatInt(d.Median.Milliseconds(), 10)},
+			[]string{"dwell", d.State, "p95_ms", strconv.FormatInt(d.P95.Milliseconds(), 10)})
+	}
+	for _, f := range r.Funnel {
+		rows = append(rows,
+			[]string{"funnel", f.State, "reached", strconv.Itoa(f.Reached)},
+			[]string{"funnel", f.State, "drop_off", strconv.Itoa(f.DropOff)},
+			[]string{"funnel", f.State, "conversion", strconv.FormatFloat(f.Conversion, 'f', 4, 64)})
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// errWriter keeps the first write error, so a report is written without checking every line.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) printf(format string, args ...any) {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, args...)
+	}
+}
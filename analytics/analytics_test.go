@@ -0,0 +1,135 @@
+package analytics
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+func TestAnalyze(t *testing.T) {
+	base := time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	logs := map[string][]rfsm.TransitionRecord{
+		"o1": {
+			{From: "CART", Event: "checkout", To: "CHECKOUT", At: at(0)},
+			{From: "CHECKOUT", Event: "pay", To: "CHECKOUT", At: at(5), Error: "card declined"},
+			{From: "CHECKOUT", Event: "pay", To: "PAID", At: at(10)},
+		},
+		"o2": {
+			{From: "CART", Event: "checkout", To: "CHECKOUT", At: at(30)},
+			{From: "CHECKOUT", Event: "pay", To: "PAID", At: at(50)},
+			{From: "PAID", Event: "ship", To: "SHIPPED", At: at(120)},
+		},
+		"o3": {
+			{From: "CART", Event: "checkout", To: "CHECKOUT", At: at(60)},
+			{From: "CHECKOUT", Event: "abandon", To: "CART", At: at(90)},
+		},
+	}
+	r := Analyze(logs, "CART", "CHECKOUT", "PAID")
+
+	if r.Machines != 3 || !r.From.Equal(at(0)) || !r.To.Equal(at(120)) {
+		t.Fatalf("unexpected bounds %+v", r)
+	}
+	if len(r.Transitions) != 4 {
+		t.Fatalf("want 4 transitions got %+v", r.Transitions)
+	}
+	if top := r.Transitions[0]; top.Event != "checkout" || top.Count != 3 || top.PerHour != 1.5 {
+		t.Fatalf("unexpected top transition %+v", top)
+	}
+	if pay := r.Transitions[1]; pay.Event != "pay" || pay.Count != 2 {
+		t.Fatalf("failed transitions should not count: %+v", pay)
+	}
+
+	if len(r.Dwell) != 2 {
+		t.Fatalf("want dwell for CHECKOUT and PAID got %+v", r.Dwell)
+	}
+	checkout := r.Dwell[0]
+	if checkout.State != "CHECKOUT" || checkout.Count != 3 || checkout.Median != 20*time.Minute || checkout.P95 != 30*time.Minute {
+		t.Fatalf("unexpected CHECKOUT dwell %+v", checkout)
+	}
+	if paid := r.Dwell[1]; paid.State != "PAID" || paid.Count != 1 || paid.Median != 70*time.Minute {
+		t.Fatalf("unexpected PAID dwell %+v", paid)
+	}
+
+	want := []FunnelStep{
+		{State: "CART", Reached: 3, DropOff: 0, Conversion: 1},
+		{State: "CHECKOUT", Reached: 3, DropOff: 0, Conversion: 1},
+		{State: "PAID", Reached: 2, DropOff: 1, Conversion: 2.0 / 3},
+	}
+	for i, f := range r.Funnel {
+		if f != want[i] {
+			t.Fatalf("funnel step %d: want %+v got %+v", i, want[i], f)
+		}
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	base := time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)
+	r := Analyze(map[string][]rfsm.TransitionRecord{
+		"o1": {
+			{From: "A", Event: "go", To: "B", At: base},
+			{From: "B", Event: "done", To: "C", At: base.Add(1500 * time.Millisecond)},
+		},
+	}, "A", "C")
+
+	var md bytes.Buffer
+	if err := r.WriteMarkdown(&md); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"| A | go | B | 1 |", "| B | 1 | 1.5s | 1.5s |", "| C | 1 | 0 | 100.0% |"} {
+		if !strings.Contains(md.String(), want) {
+			t.Fatalf("markdown missing %q:\n%s", want, md.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := r.WriteCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, row := range rows {
+		if row[0] == "dwell" && row[1] == "B" && row[2] == "median_ms" && row[3] == "1500" {
+			found = true
+		}
+	}
+	if len(rows) != 1+2*2+3+2*3 || !found {
+		t.Fatalf("unexpected csv %v", rows)
+	}
+}
+
+func TestAnalyze_ErrorStateAndInternal(t *testing.T) {
+	base := time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	r := Analyze(map[string][]rfsm.TransitionRecord{
+		"o1": {
+			{From: "CART", Event: "checkout", To: "CHECKOUT", At: at(0)},
+			{From: "CHECKOUT", Event: "touch", To: "CHECKOUT", At: at(10)},
+			{From: "CHECKOUT", Event: "touch", To: "CHECKOUT", At: at(20)},
+			{From: "CHECKOUT", Event: "pay", To: "FAILED", At: at(40), Error: "card declined"},
+		},
+	}, "CART", "CHECKOUT", "FAILED")
+
+	var failed *TransitionStats
+	for i := range r.Transitions {
+		if r.Transitions[i].To == "FAILED" {
+			failed = &r.Transitions[i]
+		}
+	}
+	if failed == nil || failed.Count != 1 {
+		t.Fatalf("the move to the error state should count: %+v", r.Transitions)
+	}
+	if len(r.Dwell) != 1 || r.Dwell[0].State != "CHECKOUT" || r.Dwell[0].Count != 1 || r.Dwell[0].Median != 40*time.Minute {
+		t.Fatalf("internal transitions should not split the CHECKOUT stay: %+v", r.Dwell)
+	}
+	if f := r.Funnel[2]; f.State != "FAILED" || f.Reached != 1 {
+		t.Fatalf("the error state should be reached: %+v", f)
+	}
+}
@@ -0,0 +1,243 @@
+// Package archivestore tiers snapshot versions to object storage. A Store wraps a primary
+// rfsm.VersionedStore holding the current snapshots and recent versions, and its Archive
+// method copies them to a bucket, where they outlive the primary's retention:
+//
+//	hot := sqlstore.New(db, sqlstore.WithRetention(rfsm.Retention{MaxVersions: 20}))
+//	store := archivestore.New(hot, bucket, archivestore.WithLifecycle(rfsm.Retention{MaxAge: 365 * 24 * time.Hour}))
+//	m := rfsm.NewMachine(def, order, rfsm.WithVersionedPersist(store, orderID))
+//
+//	// in a periodic job
+//	for _, id := range recentlyActiveOrders {
+//		_ = store.Archive(ctx, id)
+//	}
+//
+// Saving a version only touches the primary store. Run Archive for a machine before the
+// primary drops versions it has not archived yet, e.g. at least every 20 transitions above;
+// versions dropped earlier are lost. ListVersions and LoadVersion see both tiers. Versions are stored as
+// "<prefix><machine id>/<version>-<saved at, in Unix nanoseconds>.json", with the version
+// zero-padded so keys sort in version order.
+//
+// The package does not depend on an object storage SDK; wrap your S3-compatible client in a
+// Bucket, e.g. for minio-go:
+//
+//	type bucket struct {
+//		c    *minio.Client
+//		name string
+//	}
+//
+//	func (b bucket) Put(ctx context.Context, key string, data []byte) error {
+//		_, err := b.c.PutObject(ctx, b.name, key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+//		return err
+//	}
+package archivestore
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// Bucket is the subset of an object storage client used by Store.
+type Bucket interface {
+	// Put stores data under key, replacing any previous object.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the object stored under key, and false if it does not exist.
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Delete removes the object stored under key, if any.
+	Delete(ctx context.Context, key string) error
+	// List returns the keys starting with prefix, in any order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithPrefix sets the key prefix, "rfsm/" by default.
+func WithPrefix(prefix string) Option {
+	return func(s *Store) { s.prefix = prefix }
+}
+
+// WithLifecycle sets which archived versions Archive keeps; the zero value, the default, keeps
+// all of them. Most object stores can also expire objects by age with their own lifecycle rules.
+func WithLifecycle(r rfsm.Retention) Option {
+	return func(s *Store) { s.lifecycle = r }
+}
+
+// Store is an rfsm.VersionedStore keeping recent versions in a primary store and the archived
+// ones, subject to its lifecycle, in a bucket.
+type Store struct {
+	primary   rfsm.VersionedStore
+	bucket    Bucket
+	prefix    string
+	lifecycle rfsm.Retention
+}
+
+var _ rfsm.VersionedStore = (*Store)(nil)
+
+// New creates a Store archiving the versions of primary to bucket.
+func New(primary rfsm.VersionedStore, bucket Bucket, opts ...Option) *Store {
+	s := &Store{primary: primary, bucket: bucket, prefix: "rfsm/"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Save stores snap in the primary store without creating a version.
+func (s *Store) Save(ctx context.Context, id string, snap *rfsm.Snapshot) error {
+	return s.primary.Save(ctx, id, snap)
+}
+
+// Load returns the current snapshot of id from the primary store.
+func (s *Store) Load(ctx context.Context, id string) (*rfsm.Snapshot, error) {
+	return s.primary.Load(ctx, id)
+}
+
+// SaveVersion saves snap as a new version in the primary store.
+func (s *Store) SaveVersion(ctx context.Context, id string, snap *rfsm.Snapshot) (int64, error) {
+	return s.primary.SaveVersion(ctx, id, snap)
+}
+
+// Archive copies the versions of id in the primary store newer than the last archived one to
+// the bucket, then drops the archived versions outside the lifecycle.
+func (s *Store) Archive(ctx context.Context, id string) error {
+	hot, err := s.primary.ListVersions(ctx, id)
+	if err != nil {
+		return err
+	}
+	archived, err := s.archived(ctx, id)
+	if err != nil {
+		return err
+	}
+	var last int64
+	if len(archived) > 0 {
+		last = archived[len(archived)-1].Version
+	}
+	for _, v := range hot {
+		if v.Version <= last {
+			continue
+		}
+		snap, err := s.primary.LoadVersion(ctx, id, v.Version)
+		if errors.Is(err, rfsm.ErrSnapshotNotFound) {
+			continue // dropped by the primary meanwhile
+		}
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(snap)
+		if err != nil {
+			return err
+		}
+		if err := s.bucket.Put(ctx, s.key(id, v), data); err != nil {
+			return err
+		}
+		archived = append(archived, v)
+	}
+	for _, old := range archived[:s.lifecycle.Expired(archived, time.Now())] {
+		if err := s.bucket.Delete(ctx, s.key(id, old)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListVersions returns the versions of id in either tier, oldest first.
+func (s *Store) ListVersions(ctx context.Context, id string) ([]rfsm.StoredVersion, error) {
+	hot, err := s.primary.ListVersions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := s.archived(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	out := slices.Clone(hot)
+	for _, v := range archived {
+		if _, found := slices.BinarySearchFunc(hot, v.Version, compareVersion); !found {
+			out = append(out, v)
+		}
+	}
+	slices.SortFunc(out, func(a, b rfsm.StoredVersion) int { return cmp.Compare(a.Version, b.Version) })
+	return out, nil
+}
+
+// LoadVersion returns a version of id from the primary store, or else from the bucket.
+func (s *Store) LoadVersion(ctx context.Context, id string, version int64) (*rfsm.Snapshot, error) {
+	snap, err := s.primary.LoadVersion(ctx, id, version)
+	if err == nil || !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		return snap, err
+	}
+	archived, err := s.archived(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	i, found := slices.BinarySearchFunc(archived, version, compareVersion)
+	if !found {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	data, ok, err := s.bucket.Get(ctx, s.key(id, archived[i]))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	var out rfsm.Snapshot
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q version %d: %w", id, version, err)
+	}
+	return &out, nil
+}
+
+// archived returns the versions of id in the bucket, oldest first.
+func (s *Store) archived(ctx context.Context, id string) ([]rfsm.StoredVersion, error) {
+	dir := s.prefix + id + "/"
+	keys, err := s.bucket.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]rfsm.StoredVersion, 0, len(keys))
+	for _, k := range keys {
+		if v, ok := parseKey(strings.TrimPrefix(k, dir)); ok {
+			out = append(out, v)
+		}
+	}
+	slices.SortFunc(out, func(a, b rfsm.StoredVersion) int { return cmp.Compare(a.Version, b.Version) })
+	return out, nil
+}
+
+func (s *Store) key(id string, v rfsm.StoredVersion) string {
+	return fmt.Sprintf("%s%s/%020d-%d.json", s.prefix, id, v.Version, v.SavedAt.UnixNano())
+}
+
+func parseKey(name string) (rfsm.StoredVersion, bool) {
+	base, ok := strings.CutSuffix(name, ".json")
+	if !ok {
+		return rfsm.StoredVersion{}, false
+	}
+	version, savedAt, ok := strings.Cut(base, "-")
+	if !ok {
+		return rfsm.StoredVersion{}, false
+	}
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return rfsm.StoredVersion{}, false
+	}
+	ns, err := strconv.ParseInt(savedAt, 10, 64)
+	if err != nil {
+		return rfsm.StoredVersion{}, false
+	}
+	return rfsm.StoredVersion{Version: v, SavedAt: time.Unix(0, ns)}, true
+}
+
+func compareVersion(v rfsm.StoredVersion, version int64) int {
+	return cmp.Compare(v.Version, version)
+}
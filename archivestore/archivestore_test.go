@@ -0,0 +1,143 @@
+package archivestore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/noru/rfsm"
+)
+
+// fakeBucket is an in-memory Bucket.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{objects: map[string][]byte{}}
+}
+
+func (b *fakeBucket) Put(_ context.Context, key string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (b *fakeBucket) Get(_ context.Context, key string) ([]byte, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.objects[key]
+	return data, ok, nil
+}
+
+func (b *fakeBucket) Delete(_ context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, key)
+	return nil
+}
+
+func (b *fakeBucket) List(_ context.Context, prefix string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var keys []string
+	for k := range b.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func TestStore(t *testing.T) {
+	def, err := rfsm.NewDef("counter").
+		State("S0", rfsm.WithInitial()).
+		State("S1").
+		State("S2").
+		State("S3").
+		State("S4").
+		State("S5").
+		State("S6", rfsm.WithFinal()).
+		Current("S0").
+		On("next", "S0", "S1").
+		On("next", "S1", "S2").
+		On("next", "S2", "S3").
+		On("next", "S3", "S4").
+		On("next", "S4", "S5").
+		On("next", "S5", "S6").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hot := rfsm.NewMemoryStore(rfsm.WithRetention(rfsm.Retention{MaxVersions: 2}))
+	bucket := newFakeBucket()
+	store := New(hot, bucket, WithPrefix("archive/"), WithLifecycle(rfsm.Retention{MaxVersions: 4}))
+	ctx := context.Background()
+
+	m := rfsm.NewMachine[any](def, nil, rfsm.WithVersionedPersist(store, "c1"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 6 {
+		if err := m.Dispatch(rfsm.Event{Name: "next"}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && len(bucket.objects) != 0 {
+			t.Fatal("saving a version must not write to the bucket")
+		}
+		// the primary keeps 2 versions, so archive every 2 transitions
+		if i%2 == 1 {
+			if err := store.Archive(ctx, "c1"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	_ = m.Stop()
+
+	if vs, _ := hot.ListVersions(ctx, "c1"); len(vs) != 2 || vs[0].Version != 5 {
+		t.Fatalf("primary should keep versions 5 and 6, got %+v", vs)
+	}
+	if len(bucket.objects) != 4 {
+		t.Fatalf("bucket should keep 4 versions, got %d", len(bucket.objects))
+	}
+	for k := range bucket.objects {
+		if !strings.HasPrefix(k, "archive/c1/") {
+			t.Fatalf("unexpected key %s", k)
+		}
+	}
+	vs, err := store.ListVersions(ctx, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 4 || vs[0].Version != 3 || vs[3].Version != 6 {
+		t.Fatalf("want versions 3 to 6 got %+v", vs)
+	}
+	snap, err := store.LoadVersion(ctx, "c1", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Current != "S3" {
+		t.Fatalf("want S3 from the archive got %s", snap.Current)
+	}
+	if snap, err := store.LoadVersion(ctx, "c1", 6); err != nil || snap.Current != "S6" {
+		t.Fatalf("version 6 = %v %v", snap, err)
+	}
+	if _, err := store.LoadVersion(ctx, "c1", 2); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	if snap, err := store.Load(ctx, "c1"); err != nil || snap.Current != "S6" {
+		t.Fatalf("current snapshot %v %v", snap, err)
+	}
+
+	// archiving again copies nothing new
+	if err := store.Archive(ctx, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(bucket.objects) != 4 {
+		t.Fatalf("want 4 archived versions got %d", len(bucket.objects))
+	}
+}
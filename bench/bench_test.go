@@ -0,0 +1,154 @@
+package bench
+
+import (
+	"os"
+	"testing"
+
+	rfsm "github.com/noru/rfsm"
+)
+
+func flatDef(tb testing.TB) *rfsm.Definition {
+	def, err := rfsm.NewDef("flat").
+		State("A", rfsm.WithInitial()).
+		State("B", rfsm.WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		On("back", "B", "A").
+		Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return def
+}
+
+// nestedDef has three levels; "go" leaves the innermost leaf and "back" re-enters the root composite.
+func nestedDef(tb testing.TB, guarded bool) *rfsm.Definition {
+	deny := rfsm.WithGuard[any](func(e rfsm.Event, ctx any) bool { return false })
+	inner, err := rfsm.NewDef("inner").
+		State("L3", rfsm.WithInitial(), rfsm.WithFinal()).
+		Current("L3").
+		Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	mid, err := rfsm.NewDef("mid").
+		State("L2", rfsm.WithSubDef(inner), rfsm.WithInitial(), rfsm.WithFinal()).
+		Current("L2").
+		Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b := rfsm.NewDef("nested").
+		State("L1", rfsm.WithSubDef(mid), rfsm.WithInitial()).
+		State("OUT", rfsm.WithFinal()).
+		Current("L1").
+		On("back", "OUT", "L1")
+	if guarded {
+		// the event is offered to every level; only the root accepts it
+		b = b.On("go", "L3", "OUT", deny).On("go", "L2", "OUT", deny).On("go", "L1", "OUT")
+	} else {
+		b = b.On("go", "L3", "OUT")
+	}
+	def, err := b.Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return def
+}
+
+type nopSub struct{}
+
+func (nopSub) OnTransition(from rfsm.StateID, to rfsm.StateID, e rfsm.Event, err error) {}
+
+func startMachines(tb testing.TB, def *rfsm.Definition, n, subs int) []*rfsm.Machine[any] {
+	ms := make([]*rfsm.Machine[any], n)
+	for i := range ms {
+		m := rfsm.NewMachine[any](def, nil)
+		for j := 0; j < subs; j++ {
+			m.Subscribe(nopSub{})
+		}
+		if err := m.Start(); err != nil {
+			tb.Fatal(err)
+		}
+		ms[i] = m
+	}
+	tb.Cleanup(func() {
+		for _, m := range ms {
+			_ = m.Stop()
+		}
+	})
+	return ms
+}
+
+// pingPong dispatches go/back pairs; one op is one dispatched event.
+func pingPong(b *testing.B, ms []*rfsm.Machine[any]) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := ms[(i/2)%len(ms)]
+		name := "go"
+		if i%2 == 1 {
+			name = "back"
+		}
+		if err := m.Dispatch(rfsm.Event{Name: name}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var workloads = map[string]func(b *testing.B){
+	"Flat":          func(b *testing.B) { pingPong(b, startMachines(b, flatDef(b), 1, 0)) },
+	"Nested":        func(b *testing.B) { pingPong(b, startMachines(b, nestedDef(b, false), 1, 0)) },
+	"GuardHeavy":    func(b *testing.B) { pingPong(b, startMachines(b, nestedDef(b, true), 1, 0)) },
+	"Subscribers50": func(b *testing.B) { pingPong(b, startMachines(b, flatDef(b), 1, 50)) },
+	"Machines_1000": func(b *testing.B) { pingPong(b, startMachines(b, flatDef(b), 1000, 0)) },
+}
+
+func BenchmarkFlat(b *testing.B)          { workloads["Flat"](b) }
+func BenchmarkNested(b *testing.B)        { workloads["Nested"](b) }
+func BenchmarkGuardHeavy(b *testing.B)    { workloads["GuardHeavy"](b) }
+func BenchmarkSubscribers50(b *testing.B) { workloads["Subscribers50"](b) }
+func BenchmarkMachines_1(b *testing.B)    { pingPong(b, startMachines(b, flatDef(b), 1, 0)) }
+func BenchmarkMachines_1000(b *testing.B) { workloads["Machines_1000"](b) }
+
+func BenchmarkMachines_100000(b *testing.B) {
+	if os.Getenv("RFSM_BENCH_LARGE") != "1" {
+		b.Skip("set RFSM_BENCH_LARGE=1 to run")
+	}
+	pingPong(b, startMachines(b, flatDef(b), 100000, 0))
+}
+
+func TestRegression(t *testing.T) {
+	if os.Getenv("RFSM_BENCH_CHECK") != "1" {
+		t.Skip("set RFSM_BENCH_CHECK=1 to run")
+	}
+	for name, base := range Baselines {
+		res := testing.Benchmark(workloads[name])
+		got := float64(res.NsPerOp())
+		t.Logf("%-14s %8.0f ns/op (baseline %.0f)", name, got, base)
+		if got > base*Tolerance {
+			t.Errorf("%s regressed: %.0f ns/op > %.0f * %.1f", name, got, base, Tolerance)
+		}
+	}
+}
+
+// TestDispatchAllocs keeps the default path (no budget, observer, log, dedup window or
+// timers) from allocating more than the first baseline did. Unlike timings, allocation
+// counts are stable enough to check on every build.
+func TestDispatchAllocs(t *testing.T) {
+	m := startMachines(t, flatDef(t), 1, 0)[0]
+	i := 0
+	allocs := testing.AllocsPerRun(1000, func() {
+		name := "go"
+		if i%2 == 1 {
+			name = "back"
+		}
+		i++
+		if err := m.Dispatch(rfsm.Event{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 7 {
+		t.Fatalf("Dispatch allocates %.0f times per event, want at most 7", allocs)
+	}
+}
@@ -0,0 +1,35 @@
+// Package bench contains dispatch throughput benchmarks for rfsm.
+//
+// Run them with:
+//
+//	go test -bench . -benchmem ./bench
+//
+// Workloads cover flat and nested definitions, guard-heavy bubbling, many subscribers
+// and fan-out across many machines (BenchmarkMachines_100000 only runs when
+// RFSM_BENCH_LARGE=1).
+//
+// Baseline (go1.27, linux/amd64, sync Dispatch, ns/op):
+//
+//	Flat                 ~1100
+//	Nested               ~1150
+//	GuardHeavy           ~1200
+//	Subscribers50        ~1400
+//	Machines_1000        ~1200
+//
+// TestRegression compares the workloads against Baselines and fails when one is
+// slower than Baselines * Tolerance. It is skipped unless RFSM_BENCH_CHECK=1 because
+// timings on shared CI runners are too noisy to gate every build; make bench-check sets
+// it and runs in the bench job of the CI workflow.
+package bench
+
+// Baselines are the reference ns/op figures used by the regression check.
+var Baselines = map[string]float64{
+	"Flat":          1100,
+	"Nested":        1150,
+	"GuardHeavy":    1200,
+	"Subscribers50": 1400,
+	"Machines_1000": 1200,
+}
+
+// Tolerance is the allowed slowdown factor relative to Baselines.
+const Tolerance = 2.0
@@ -68,7 +68,7 @@ func Actions() {
 		fmt.Printf("  New state: %s\n", m.Current())
 		fmt.Println()
 
-		if st, ok := def.States[m.Current()]; ok && st.Final {
+		if st, ok := def.State(m.Current()); ok && st.Final {
 			fmt.Printf("✅ Reached final state: %s\n", m.Current())
 			break
 		}
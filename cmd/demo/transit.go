@@ -69,7 +69,7 @@ func simulateMachine(def *rfsm.Definition) {
 		fmt.Println()
 
 		// Check if reached final state
-		if st, ok := def.States[m.Current()]; ok && st.Final {
+		if st, ok := def.State(m.Current()); ok && st.Final {
 			if st.Parent == "" {
 				fmt.Printf("✅ Reached final state: %s\n", m.Current())
 				break
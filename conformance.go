@@ -0,0 +1,56 @@
+package rfsm
+
+// Trace is a recorded sequence of events dispatched to one machine from its start.
+type Trace struct {
+	ID     string
+	Events []Event
+}
+
+// ConformanceFailure describes the first event of a trace that a definition rejects.
+type ConformanceFailure struct {
+	Trace string
+	Step  int // index of the event in Trace.Events
+	Event Event
+	State StateID // leaf state the event was dispatched in
+	Err   error
+	// GuardRejected is set when a transition for the event existed but its guard blocked it
+	GuardRejected bool
+}
+
+// Conformance replays each trace against def, from its initial state, and returns a failure
+// for every trace with an event def rejects, e.g. to check recorded production traffic against
+// an updated definition before rolling it out. Actions and entry/exit hooks are not run;
+// guards are, with a nil state context, so guards that need one should be prepared for it.
+func Conformance(def *Definition, traces []Trace) []ConformanceFailure {
+	var failures []ConformanceFailure
+	for _, tr := range traces {
+		if f, ok := conformTrace(def, tr); !ok {
+			failures = append(failures, f)
+		}
+	}
+	return failures
+}
+
+type guardRejections struct{ n int }
+
+func (g *guardRejections) OnTransition(StateID, StateID, Event, error) {}
+func (g *guardRejections) OnGuardRejected(StateID, StateID, Event)     { g.n++ }
+
+func conformTrace(def *Definition, tr Trace) (ConformanceFailure, bool) {
+	m := NewMachine[any](def, nil)
+	rejections := &guardRejections{}
+	m.Subscribe(rejections)
+	m.replay.Store(replaySkipEffects)
+	if err := m.Start(); err != nil {
+		return ConformanceFailure{Trace: tr.ID, Step: -1, Err: err}, false
+	}
+	defer m.Stop()
+	for i, e := range tr.Events {
+		state := m.Current()
+		rejections.n = 0
+		if err := m.Dispatch(e); err != nil {
+			return ConformanceFailure{Trace: tr.ID, Step: i, Event: e, State: state, Err: err, GuardRejected: rejections.n > 0}, false
+		}
+	}
+	return ConformanceFailure{}, true
+}
@@ -0,0 +1,54 @@
+package rfsm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	var actions int
+	v1, err := NewDef("order").
+		State("NEW", WithInitial()).
+		State("PAID").
+		State("SHIPPED", WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID", WithAction(func(e Event, ctx any) error { actions++; return nil })).
+		On("ship", "PAID", "SHIPPED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	traces := []Trace{
+		{ID: "ok", Events: []Event{{Name: "pay"}, {Name: "ship"}}},
+		{ID: "large", Events: []Event{{Name: "pay", Args: []any{5000}}, {Name: "ship"}}},
+		{ID: "unpaid", Events: []Event{{Name: "ship"}}},
+	}
+	if got := Conformance(v1, traces[:2]); len(got) != 0 || actions != 0 {
+		t.Fatalf("want no failures and no actions run, got %v (actions=%d)", got, actions)
+	}
+
+	// v2 requires a review for large payments
+	v2, err := NewDef("order").
+		State("NEW", WithInitial()).
+		State("PAID").
+		State("REVIEW").
+		State("SHIPPED", WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID", WithGuard(func(e Event, ctx any) bool { return len(e.Args) == 0 || e.Args[0].(int) < 1000 })).
+		On("ship", "PAID", "SHIPPED").
+		On("review", "PAID", "REVIEW").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Conformance(v2, traces)
+	if len(got) != 2 {
+		t.Fatalf("want 2 failures got %v", got)
+	}
+	if f := got[0]; f.Trace != "large" || f.Step != 0 || f.State != "NEW" || !f.GuardRejected || !errors.Is(f.Err, ErrNoTransition) {
+		t.Fatalf("unexpected failure %+v", f)
+	}
+	if f := got[1]; f.Trace != "unpaid" || f.Step != 0 || f.GuardRejected || !errors.Is(f.Err, ErrNoTransition) {
+		t.Fatalf("unexpected failure %+v", f)
+	}
+}
@@ -0,0 +1,70 @@
+package rfsm
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDuplicateEvent is returned for an event with the same Name and ID as one received within
+// the window set with WithDuplicateWindow.
+var ErrDuplicateEvent = errors.New("duplicate event")
+
+// WithDuplicateWindow rejects an event with ErrDuplicateEvent when an event with the same Name
+// and a non-empty Event.ID was received within the last d, e.g. to absorb double clicks and
+// webhook retries. Events without an ID are never rejected. Only events handled without error
+// are remembered, so a failed event can be retried with the same ID. Rejected events do not
+// move the window, and a rejection is reported to subscribers like any other failed event.
+func WithDuplicateWindow(d time.Duration) MachineOption {
+	return func(c *machineConfig) { c.dedupWindow = d }
+}
+
+type eventKey struct{ name, id string }
+
+// seenEvents remembers the events received within a sliding window. Receipts are appended in
+// time order, so expired ones are always at the front of order.
+type seenEvents struct {
+	window time.Duration
+
+	mu    sync.Mutex
+	at    map[eventKey]time.Time
+	order []eventKey
+}
+
+func newSeenEvents(window time.Duration) *seenEvents {
+	if window <= 0 {
+		return nil
+	}
+	return &seenEvents{window: window, at: make(map[eventKey]time.Time)}
+}
+
+// duplicate reports whether e was received within the window, pruning expired receipts.
+func (s *seenEvents) duplicate(e Event, now time.Time) bool {
+	if s == nil || e.ID == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.order) > 0 {
+		k := s.order[0]
+		if now.Sub(s.at[k]) < s.window {
+			break
+		}
+		delete(s.at, k)
+		s.order = s.order[1:]
+	}
+	_, ok := s.at[eventKey{e.Name, e.ID}]
+	return ok
+}
+
+// record remembers e as received at now, which must not be before earlier receipts.
+func (s *seenEvents) record(e Event, now time.Time) {
+	if s == nil || e.ID == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := eventKey{e.Name, e.ID}
+	s.at[k] = now
+	s.order = append(s.order, k)
+}
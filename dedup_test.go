@@ -0,0 +1,113 @@
+package rfsm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDuplicateWindow(t *testing.T) {
+	def, err := NewDef("toggle").
+		State("OFF", WithInitial()).
+		State("ON").
+		State("DONE", WithFinal()).
+		Current("OFF").
+		On("toggle", "OFF", "ON").
+		On("toggle", "ON", "OFF").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil, WithDuplicateWindow(50*time.Millisecond))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if err := m.Dispatch(Event{Name: "toggle", ID: "req-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "toggle", ID: "req-1"}); !errors.Is(err, ErrDuplicateEvent) {
+		t.Fatalf("want ErrDuplicateEvent got %v", err)
+	}
+	if got := m.Current(); got != "ON" {
+		t.Fatalf("duplicate must not transition, got %s", got)
+	}
+	// a different ID, and events without one, are not duplicates
+	if err := m.Dispatch(Event{Name: "toggle", ID: "req-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "toggle"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "toggle"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Current(); got != "OFF" {
+		t.Fatalf("want OFF got %s", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if err := m.Dispatch(Event{Name: "toggle", ID: "req-1"}); err != nil {
+		t.Fatalf("event after the window must be accepted: %v", err)
+	}
+	if got := m.Current(); got != "ON" {
+		t.Fatalf("want ON got %s", got)
+	}
+}
+
+func TestSeenEvents_Expiry(t *testing.T) {
+	s := newSeenEvents(time.Second)
+	now := time.Now()
+	if s.duplicate(Event{Name: "a", ID: "1"}, now) {
+		t.Fatal("first receipt is not a duplicate")
+	}
+	s.record(Event{Name: "a", ID: "1"}, now)
+	if !s.duplicate(Event{Name: "a", ID: "1"}, now.Add(500*time.Millisecond)) {
+		t.Fatal("want duplicate within the window")
+	}
+	if s.duplicate(Event{Name: "b", ID: "1"}, now.Add(500*time.Millisecond)) {
+		t.Fatal("same ID with another name is not a duplicate")
+	}
+	s.record(Event{Name: "b", ID: "1"}, now.Add(500*time.Millisecond))
+	if s.duplicate(Event{Name: "a", ID: "1"}, now.Add(time.Second)) {
+		t.Fatal("want expiry after the window")
+	}
+	if len(s.order) != 1 || len(s.at) != 1 {
+		t.Fatalf("expired receipts must be pruned, got %d/%d", len(s.order), len(s.at))
+	}
+}
+
+func TestDuplicateWindow_RetryAfterFailure(t *testing.T) {
+	fail := true
+	def, err := NewDef("orders").
+		State("PENDING", WithInitial()).
+		State("PAID", WithFinal()).
+		Current("PENDING").
+		On("pay", "PENDING", "PAID", WithAction(func(e Event, _ any) error {
+			if fail {
+				return errors.New("card declined")
+			}
+			return nil
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil, WithDuplicateWindow(time.Minute))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if err := m.Dispatch(Event{Name: "pay", ID: "req-1"}); err == nil || errors.Is(err, ErrDuplicateEvent) {
+		t.Fatalf("want the action error got %v", err)
+	}
+	fail = false
+	if err := m.Dispatch(Event{Name: "pay", ID: "req-1"}); err != nil {
+		t.Fatalf("a retry after a failure must be accepted: %v", err)
+	}
+	if got := m.Current(); got != "PAID" {
+		t.Fatalf("want PAID got %s", got)
+	}
+}
@@ -1,91 +1,501 @@
 package rfsm
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
 
 // Builder interfaces
 type DefinitionBuilder interface {
 	State(id StateID, opts ...StateOption) DefinitionBuilder
+	StateFrom(tmpl StateTemplate, id StateID, opts ...StateOption) DefinitionBuilder
 	On(event string, from, to StateID, opts ...TransitionOption) DefinitionBuilder
 	Current(id StateID) DefinitionBuilder
 	InitialChild(parent StateID, child StateID) DefinitionBuilder
+	Branch(junction, to StateID, opts ...TransitionOption) DefinitionBuilder
+	Alias(alias, event EventID) DefinitionBuilder
+	WithRetryPattern(state, target, failTarget StateID, maxAttempts int) DefinitionBuilder
+	OnTagged(tag string, event string, to StateID, opts ...TransitionOption) DefinitionBuilder
+	EffectOrder(o EffectOrder) DefinitionBuilder
+	BubbleOrder(o BubbleOrder) DefinitionBuilder
+	OnError(state StateID) DefinitionBuilder
 	Build() (*Definition, error)
 }
 
 type StateOption func(*StateDef)
 type TransitionOption func(*TransitionDef)
 
+// taggedTransition is an OnTagged declaration, expanded at Build once all states are known.
+type taggedTransition struct {
+	tag   string
+	event string
+	to    StateID
+	opts  []TransitionOption
+}
+
 // Internal implementation
 type builder struct {
 	name        string
 	states      map[StateID]StateDef
-	transitions map[TransitionKey]TransitionDef
+	transitions map[TransitionKey][]TransitionDef
+	branches    map[StateID][]TransitionDef
+	aliases     map[EventID]EventID
+	tagged      []taggedTransition
 	current     *StateID
 	hasInitial  bool
 	hasFinal    bool
+	effectOrder EffectOrder
+	bubbleOrder BubbleOrder
+	errorState  StateID
 }
 
 func NewDef(name string) DefinitionBuilder {
 	return &builder{
 		name:        name,
 		states:      make(map[StateID]StateDef),
-		transitions: make(map[TransitionKey]TransitionDef),
+		transitions: make(map[TransitionKey][]TransitionDef),
+		branches:    make(map[StateID][]TransitionDef),
+		aliases:     make(map[EventID]EventID),
 	}
 }
 
 // State options
 func WithEntry[C any](h HookFunc[C]) StateOption {
+	return WithEntryCtx(func(_ context.Context, e Event, c C) error { return h(e, c) })
+}
+
+func WithExit[C any](h HookFunc[C]) StateOption {
+	return WithExitCtx(func(_ context.Context, e Event, c C) error { return h(e, c) })
+}
+
+// WithEntryCtx is WithEntry for hooks that take the dispatch context.
+func WithEntryCtx[C any](h HookCtxFunc[C]) StateOption {
+	return func(s *StateDef) { s.OnEntry = eraseHook(h) }
+}
+
+// WithExitCtx is WithExit for hooks that take the dispatch context.
+func WithExitCtx[C any](h HookCtxFunc[C]) StateOption {
+	return func(s *StateDef) { s.OnExit = eraseHook(h) }
+}
+
+func eraseHook[C any](h HookCtxFunc[C]) hookFuncAny {
+	return func(cx context.Context, e Event, ctx any) error {
+		var c C
+		if ctx != nil {
+			c = ctx.(C)
+		}
+		return h(cx, e, c)
+	}
+}
+
+func WithDescription(desc string) StateOption { return func(s *StateDef) { s.Description = desc } }
+func WithSubDef(sub *Definition) StateOption  { return func(s *StateDef) { s.SubDef = sub } }
+func WithFinal() StateOption                  { return func(s *StateDef) { s.Final = true } }
+func WithInitial() StateOption                { return func(s *StateDef) { s.Initial = true } }
+
+// WithHistory makes a composite state remember its last active child and re-enter it,
+// instead of InitialChild, when it is transitioned back to.
+func WithHistory() StateOption { return func(s *StateDef) { s.History = ShallowHistory } }
+
+// WithDeepHistory makes a composite state remember its last active leaf and restore the
+// full nested path down to it when it is transitioned back to.
+func WithDeepHistory() StateOption { return func(s *StateDef) { s.History = DeepHistory } }
+
+// WithJunction marks the state as a junction pseudo-state; its outgoing segments are declared with Branch.
+func WithJunction() StateOption { return func(s *StateDef) { s.Junction = true } }
+
+// WithChoice marks the state as a choice pseudo-state: its Branch guards are evaluated after
+// the action of the incoming transition, in the same run-to-completion step.
+func WithChoice() StateOption { return func(s *StateDef) { s.Choice = true } }
+
+// pseudoKind names the pseudo-state kind of st, or returns "" for a regular state.
+func pseudoKind(st StateDef) string {
+	switch {
+	case st.Junction:
+		return "junction"
+	case st.Choice:
+		return "choice"
+	}
+	return ""
+}
+
+// State returns a copy of the definition of state id.
+func (d *Definition) State(id StateID) (StateDef, bool) {
+	st, ok := d.states[id]
+	if !ok {
+		return StateDef{}, false
+	}
+	return copyState(st), true
+}
+
+// StateIDs returns the IDs of all states, sorted.
+func (d *Definition) StateIDs() []StateID {
+	ids := make([]StateID, 0, len(d.states))
+	for id := range d.states {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Transitions returns copies of the transitions declared for event from state from,
+// in declaration order.
+func (d *Definition) Transitions(from StateID, event EventID) []TransitionDef {
+	return copyTransitions(d.transitions[TransitionKey{From: from, Event: event}])
+}
+
+// Outgoing returns the keys of the transitions declared from state from, sorted by event.
+func (d *Definition) Outgoing(from StateID) []TransitionKey {
+	keys := append([]TransitionKey(nil), d.outgoing[from]...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Event < keys[j].Event })
+	return keys
+}
+
+// Branches returns copies of the branches of a junction or choice, in priority order.
+func (d *Definition) Branches(id StateID) []TransitionDef {
+	return copyTransitions(d.branches[id])
+}
+
+// Alias returns the event an alias stands for.
+func (d *Definition) Alias(name EventID) (EventID, bool) {
+	event, ok := d.aliases[name]
+	return event, ok
+}
+
+// Clone returns a deep copy of the definition. Hooks, guards and actions are shared.
+func (d *Definition) Clone() *Definition {
+	c := &Definition{
+		Name:         d.Name,
+		Current:      d.Current,
+		EffectOrder:  d.EffectOrder,
+		BubbleOrder:  d.BubbleOrder,
+		ErrorState:   d.ErrorState,
+		states:       make(map[StateID]StateDef, len(d.states)),
+		transitions:  make(map[TransitionKey][]TransitionDef, len(d.transitions)),
+		branches:     make(map[StateID][]TransitionDef, len(d.branches)),
+		aliases:      make(map[EventID]EventID, len(d.aliases)),
+		outgoing:     make(map[StateID][]TransitionKey, len(d.outgoing)),
+		stateNames:   d.stateNames,
+		eventNames:   d.eventNames,
+		hasWildcards: d.hasWildcards,
+	}
+	for id, st := range d.states {
+		c.states[id] = copyState(st)
+	}
+	for k, alts := range d.transitions {
+		c.transitions[k] = copyTransitions(alts)
+	}
+	for id, segs := range d.branches {
+		c.branches[id] = copyTransitions(segs)
+	}
+	for alias, event := range d.aliases {
+		c.aliases[alias] = event
+	}
+	for id, keys := range d.outgoing {
+		c.outgoing[id] = append([]TransitionKey(nil), keys...)
+	}
+	c.indexHierarchy()
+	c.composeJunctions()
+	c.fingerprint = c.computeFingerprint()
+	return c
+}
+
+// Edit returns a builder pre-populated with the definition's states, transitions (including
+// hooks, guards and actions), branches, aliases, current state, effect and bubble order, so the flow
+// can be extended and built into a new definition. On adds alternatives after the existing
+// transitions rather than changing them. d itself is not modified.
+func (d *Definition) Edit() DefinitionBuilder {
+	b := NewDef(d.Name).(*builder)
+	for id, st := range d.states {
+		st = copyState(st)
+		b.states[id] = st
+		b.hasInitial = b.hasInitial || st.Initial
+		b.hasFinal = b.hasFinal || st.Final
+	}
+	for k, alts := range d.transitions {
+		b.transitions[k] = copyTransitions(alts)
+	}
+	for j, segs := range d.branches {
+		b.branches[j] = copyTransitions(segs)
+	}
+	for alias, event := range d.aliases {
+		b.aliases[alias] = event
+	}
+	if d.Current != "" {
+		current := d.Current
+		b.current = &current
+	}
+	b.effectOrder = d.EffectOrder
+	b.bubbleOrder = d.BubbleOrder
+	b.errorState = d.ErrorState
+	return b
+}
+
+// copyState detaches the slices and maps of st from the definition.
+func copyState(st StateDef) StateDef {
+	st.Children = append([]StateID(nil), st.Children...)
+	st.Tags = append([]string(nil), st.Tags...)
+	st.Recurring = append([]RecurringEvent(nil), st.Recurring...)
+	st.ResetCounters = append([]string(nil), st.ResetCounters...)
+	st.Metadata = copyMetadata(st.Metadata)
+	return st
+}
+
+// copyTransitions detaches the mutable parts of ts so callers and builder options cannot
+// alter the original.
+func copyTransitions(ts []TransitionDef) []TransitionDef {
+	if ts == nil {
+		return nil
+	}
+	out := make([]TransitionDef, len(ts))
+	for i, t := range ts {
+		t.Metadata = copyMetadata(t.Metadata)
+		t.counters = append([]counterOp(nil), t.counters...)
+		t.conditions = append([]guardFuncAny(nil), t.conditions...)
+		out[i] = t
+	}
+	return out
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+// StateTemplate is a reusable set of state options (hooks, metadata, tags, ...) that
+// concrete states extend with StateFrom.
+type StateTemplate struct {
+	opts []StateOption
+}
+
+// NewStateTemplate creates a template from state options.
+func NewStateTemplate(opts ...StateOption) StateTemplate {
+	return StateTemplate{opts: append([]StateOption(nil), opts...)}
+}
+
+// Extend returns a new template that applies t's options followed by opts.
+func (t StateTemplate) Extend(opts ...StateOption) StateTemplate {
+	return StateTemplate{opts: append(append([]StateOption(nil), t.opts...), opts...)}
+}
+
+// WithHookTimeout bounds how long the state's entry and exit hooks may run. A hook that
+// exceeds it fails the transition with ErrHookTimeout, rolling back like any failed hook.
+func WithHookTimeout(d time.Duration) StateOption { return func(s *StateDef) { s.HookTimeout = d } }
+
+// WithTimeout makes the machine dispatch event if the state is still active d after it was
+// entered. The timer is cancelled when the state is exited and survives Snapshot/Restore
+// with its remaining duration.
+func WithTimeout(d time.Duration, event EventID) StateOption {
+	return func(s *StateDef) {
+		s.Timeout = d
+		s.TimeoutEvent = event
+	}
+}
+
+// WithRecurring makes the machine dispatch event every interval while the state is active,
+// e.g. to poll an external system. The schedule starts when the state is entered, stops when
+// it is exited, and is suspended while the machine is stopped or PauseRecurring is in effect.
+func WithRecurring(every time.Duration, event EventID) StateOption {
 	return func(s *StateDef) {
-		s.OnEntry = func(e Event, ctx any) error {
+		s.Recurring = append(s.Recurring, RecurringEvent{Every: every, Event: event})
+	}
+}
+
+// WithCounterResetOnExit zeroes the named machine counters whenever the state is exited, before
+// the counter updates of the transition leaving it, e.g. to restart a retry budget each time a
+// region is left.
+func WithCounterResetOnExit(names ...string) StateOption {
+	return func(s *StateDef) { s.ResetCounters = append(s.ResetCounters, names...) }
+}
+
+// WithEntryDebounce skips the state's entry hook when the state is re-entered by a
+// self-transition, or when its entry hook already ran less than window ago (window 0 only
+// suppresses self-transitions), e.g. for notification hooks in a requote loop. Entry
+// subscribers are still notified.
+func WithEntryDebounce(window time.Duration) StateOption {
+	return func(s *StateDef) {
+		s.SuppressReentry = true
+		s.ReentryWindow = window
+	}
+}
+
+// WithTags adds tags to a state.
+func WithTags(tags ...string) StateOption {
+	return func(s *StateDef) { s.Tags = append(s.Tags, tags...) }
+}
+
+// WithMetadata attaches a metadata key/value pair to a state.
+func WithMetadata(key, value string) StateOption {
+	return func(s *StateDef) {
+		if s.Metadata == nil {
+			s.Metadata = make(map[string]string)
+		}
+		s.Metadata[key] = value
+	}
+}
+
+// Retry pattern events, see WithRetryPattern
+const (
+	RetrySuccess = "success" // the call succeeded
+	RetryFailed  = "failed"  // the call failed
+	RetryRequeue = "retry"   // re-run the call after a failure
+)
+
+// Transition options
+func WithGuard[C any](fn GuardFunc[C]) TransitionOption {
+	return func(t *TransitionDef) {
+		t.Guard = func(_ context.Context, e Event, g GuardContext, ctx any) bool {
 			var c C
 			if ctx != nil {
 				c = ctx.(C)
 			}
-			return h(e, c)
+			return fn(e, c)
 		}
 	}
 }
 
-func WithExit[C any](h HookFunc[C]) StateOption {
-	return func(s *StateDef) {
-		s.OnExit = func(e Event, ctx any) error {
+// WithGuardCtx is WithGuard for guards that take the dispatch context.
+func WithGuardCtx[C any](fn GuardCtxFunc[C]) TransitionOption {
+	return func(t *TransitionDef) {
+		t.Guard = func(cx context.Context, e Event, g GuardContext, ctx any) bool {
 			var c C
 			if ctx != nil {
 				c = ctx.(C)
 			}
-			return h(e, c)
+			return fn(cx, e, c)
 		}
 	}
 }
 
-func WithDescription(desc string) StateOption { return func(s *StateDef) { s.Description = desc } }
-func WithSubDef(sub *Definition) StateOption  { return func(s *StateDef) { s.SubDef = sub } }
-func WithFinal() StateOption                  { return func(s *StateDef) { s.Final = true } }
-func WithInitial() StateOption                { return func(s *StateDef) { s.Initial = true } }
-
-// Transition options
-func WithGuard[C any](fn GuardFunc[C]) TransitionOption {
+// WithGuardContext sets a guard that also receives the source, candidate target,
+// active path, machine ID and visited set through GuardContext.
+func WithGuardContext[C any](fn GuardContextFunc[C]) TransitionOption {
 	return func(t *TransitionDef) {
-		t.Guard = func(e Event, ctx any) bool {
+		t.Guard = func(_ context.Context, e Event, g GuardContext, ctx any) bool {
 			var c C
 			if ctx != nil {
 				c = ctx.(C)
 			}
-			return fn(e, c)
+			return fn(e, g, c)
 		}
 	}
 }
 func WithAction[C any](fn ActionFunc[C]) TransitionOption {
+	return WithActionCtx(func(_ context.Context, e Event, c C) error { return fn(e, c) })
+}
+
+// WithActionCtx is WithAction for actions that take the dispatch context, so long-running
+// actions can honor cancellation and deadlines.
+func WithActionCtx[C any](fn ActionCtxFunc[C]) TransitionOption {
 	return func(t *TransitionDef) {
-		t.Action = func(e Event, ctx any) error {
+		t.Action = func(cx context.Context, e Event, ctx any) error {
 			var c C
 			if ctx != nil {
 				c = ctx.(C)
 			}
-			return fn(e, c)
+			return fn(cx, e, c)
+		}
+	}
+}
+
+// WithGuardName names the transition's guard, e.g. "balance>=amount", so diagrams rendered
+// with VisualOptions.ShowGuards print it instead of a bare "[guard]" marker.
+func WithGuardName(name string) TransitionOption {
+	return func(t *TransitionDef) { t.GuardName = name }
+}
+
+// WithActionName names the transition's action, e.g. "executeHedge", so diagrams rendered
+// with VisualOptions.ShowActions print it instead of a bare "/ action" marker.
+func WithActionName(name string) TransitionOption {
+	return func(t *TransitionDef) { t.ActionName = name }
+}
+
+// WithTransitionMetadata attaches a metadata key/value pair to a transition.
+func WithTransitionMetadata(key, value string) TransitionOption {
+	return func(t *TransitionDef) {
+		if t.Metadata == nil {
+			t.Metadata = make(map[string]string)
 		}
+		t.Metadata[key] = value
+	}
+}
+
+// IfVisited only enables the transition if the machine has activated state since Start (see
+// GuardContext.HasVisited). It is combined with the transition's guard and other conditions.
+func IfVisited(state StateID) TransitionOption {
+	return withCondition(func(_ context.Context, _ Event, g GuardContext, _ any) bool { return g.HasVisited(state) })
+}
+
+// IfNotVisited only enables the transition if the machine has not activated state since Start.
+func IfNotVisited(state StateID) TransitionOption {
+	return withCondition(func(_ context.Context, _ Event, g GuardContext, _ any) bool { return !g.HasVisited(state) })
+}
+
+// IfCounterBelow only enables the transition while the named machine counter is below n, e.g.
+// to retry at most n times together with WithCounterIncrement.
+func IfCounterBelow(name string, n int) TransitionOption {
+	return withCondition(func(_ context.Context, _ Event, g GuardContext, _ any) bool { return g.Counter(name) < n })
+}
+
+// IfCounterAtLeast only enables the transition once the named machine counter reached n.
+func IfCounterAtLeast(name string, n int) TransitionOption {
+	return withCondition(func(_ context.Context, _ Event, g GuardContext, _ any) bool { return g.Counter(name) >= n })
+}
+
+func withCondition(c guardFuncAny) TransitionOption {
+	return func(t *TransitionDef) { t.conditions = append(t.conditions, c) }
+}
+
+// WithCounterIncrement increments the named machine counter when the transition commits.
+// Counters start at zero on Start, are kept in snapshots and are read by guards through
+// GuardContext.Counter.
+func WithCounterIncrement(name string) TransitionOption {
+	return func(t *TransitionDef) { t.counters = append(t.counters, counterOp{name: name}) }
+}
+
+// WithCounterReset zeroes the named machine counter when the transition commits.
+func WithCounterReset(name string) TransitionOption {
+	return func(t *TransitionDef) { t.counters = append(t.counters, counterOp{name: name, reset: true}) }
+}
+
+// WithRetry runs the transition's action up to attempts times while it returns an error,
+// waiting backoff(n) (if non-nil) before retry n, so transient failures are absorbed within
+// the transition. Retries stop early when the dispatch context is done; panics are not retried.
+func WithRetry(attempts int, backoff BackoffFunc) TransitionOption {
+	return func(t *TransitionDef) {
+		t.attempts = attempts
+		t.backoff = backoff
 	}
 }
 
+// WithOnFailure sets the failure policy of a transition, overriding the machine's.
+func WithOnFailure(p FailurePolicy) TransitionOption {
+	return func(t *TransitionDef) { t.OnFailure = p }
+}
+
+// WithPropagate lets the event continue to the source's still-active ancestors after this
+// transition completes, so parent-level transitions for the same event fire as well.
+func WithPropagate() TransitionOption { return func(t *TransitionDef) { t.Propagate = true } }
+
+// WithInternal makes a transition from a state to itself internal: its action and counter
+// updates run and subscribers, the transition log and AfterTransition callbacks see it, but
+// no exit or entry hook runs and the state's timers are not restarted. With no action, this
+// records an audited event, such as "customer_contacted", without changing state.
+func WithInternal() TransitionOption { return func(t *TransitionDef) { t.Internal = true } }
+
+// WithStopPropagation makes the transition consume the event (the default), overriding an
+// earlier WithPropagate in the same options, e.g. from a shared option list.
+func WithStopPropagation() TransitionOption { return func(t *TransitionDef) { t.Propagate = false } }
+
 func (b *builder) State(id StateID, opts ...StateOption) DefinitionBuilder {
 	var def StateDef
 	if existing, ok := b.states[id]; ok {
@@ -110,10 +520,12 @@ func (b *builder) State(id StateID, opts ...StateOption) DefinitionBuilder {
 		sub := def.SubDef
 		var children []StateID
 		// merge states
-		for sid, s := range sub.States {
+		for sid, s := range sub.states {
 			if _, ok := b.states[sid]; ok {
 				panic(fmt.Sprintf("duplicate state id %q when merging sub definition into %q", sid, id))
 			}
+			// copies keep later options from writing into the built sub definition
+			s = copyState(s)
 			if s.Parent == "" {
 				s.Parent = id
 				children = append(children, sid)
@@ -125,11 +537,25 @@ func (b *builder) State(id StateID, opts ...StateOption) DefinitionBuilder {
 			def.InitialChild = sub.Current
 		}
 		// merge transitions
-		for _, t := range sub.Transitions {
-			if _, ok := b.transitions[t.Key]; ok {
-				panic(fmt.Sprintf("duplicate transition key %q when merging sub definition into %q", t.Key, id))
+		for k, alts := range sub.transitions {
+			if _, ok := b.transitions[k]; ok {
+				panic(fmt.Sprintf("duplicate transition key %q when merging sub definition into %q", k, id))
+			}
+			b.transitions[k] = copyTransitions(alts)
+		}
+		// merge junction and choice branches
+		for j, segs := range sub.branches {
+			if _, ok := b.branches[j]; ok {
+				panic(fmt.Sprintf("duplicate branches of %q when merging sub definition into %q", j, id))
 			}
-			b.transitions[t.Key] = t
+			b.branches[j] = copyTransitions(segs)
+		}
+		// merge aliases
+		for alias, event := range sub.aliases {
+			if other, ok := b.aliases[alias]; ok && other != event {
+				panic(fmt.Sprintf("conflicting alias %q when merging sub definition into %q", alias, id))
+			}
+			b.aliases[alias] = event
 		}
 		// clear build-time field
 		def.SubDef = nil
@@ -139,21 +565,22 @@ func (b *builder) State(id StateID, opts ...StateOption) DefinitionBuilder {
 	return b
 }
 
+// StateFrom declares a state from a template: the template's options are applied first,
+// then opts, so a state can override a hook or metadata value it inherits.
+func (b *builder) StateFrom(tmpl StateTemplate, id StateID, opts ...StateOption) DefinitionBuilder {
+	return b.State(id, append(append([]StateOption(nil), tmpl.opts...), opts...)...)
+}
+
+// On adds a transition. Declaring the same event from the same state again adds an
+// alternative, even with the same target; alternatives are tried in declaration order with the
+// first whose guard passes taken.
 func (b *builder) On(event string, from, to StateID, opts ...TransitionOption) DefinitionBuilder {
 	tk := TransitionKey{From: from, Event: event}
-	t, ok := b.transitions[tk]
-	if !ok {
-		t = TransitionDef{Key: tk, To: to}
-	} else {
-		// fail early
-		if t.To != to {
-			panic(fmt.Sprintf("transition with event %q from %q already exists with different target state: %q != %q", event, from, t.To, to))
-		}
-	}
+	t := TransitionDef{Key: tk, To: to}
 	for _, opt := range opts {
 		opt(&t)
 	}
-	b.transitions[tk] = t
+	b.transitions[tk] = append(b.transitions[tk], t)
 	return b
 }
 
@@ -169,7 +596,127 @@ func (b *builder) InitialChild(parent StateID, child StateID) DefinitionBuilder
 	return b
 }
 
+// Branch adds an outgoing segment to a junction or choice. Segments are tried in declaration order
+// and the first whose guard passes is taken, so an unguarded "else" branch goes last.
+// Only WithGuard, WithGuardContext and WithAction are meaningful on a segment.
+func (b *builder) Branch(junction, to StateID, opts ...TransitionOption) DefinitionBuilder {
+	t := TransitionDef{Key: TransitionKey{From: junction}, To: to}
+	for _, opt := range opts {
+		opt(&t)
+	}
+	b.branches[junction] = append(b.branches[junction], t)
+	return b
+}
+
+// Alias declares alias as another name for event: dispatching alias behaves exactly like
+// dispatching event, and hooks, actions and subscribers see the event under its canonical name.
+func (b *builder) Alias(alias, event EventID) DefinitionBuilder {
+	b.aliases[alias] = event
+	return b
+}
+
+// WithRetryPattern expands the retry wiring around a state that performs an external call:
+//
+//	state --success--> target
+//	state --failed--> <state>_FAILED (junction)
+//	<state>_FAILED --> <state>_RETRY   while fewer than maxAttempts calls have failed
+//	<state>_FAILED --> failTarget      otherwise
+//	<state>_RETRY --retry--> state
+//
+// Attempts are tracked in the machine counter "<state>_attempts", which is reset when the
+// call succeeds or the attempts are exhausted. state, target and failTarget must be declared
+// separately.
+func (b *builder) WithRetryPattern(state, target, failTarget StateID, maxAttempts int) DefinitionBuilder {
+	if maxAttempts < 1 {
+		panic(fmt.Sprintf("retry pattern for %q needs at least one attempt", state))
+	}
+	counter := state + "_attempts"
+	failed := state + "_FAILED"
+	retry := state + "_RETRY"
+	return b.
+		State(failed, WithJunction()).
+		State(retry).
+		On(RetrySuccess, state, target, WithCounterReset(counter)).
+		On(RetryFailed, state, failed, WithCounterIncrement(counter)).
+		// counters are updated on commit, so the guard still sees the failures before this one
+		Branch(failed, retry, WithGuardContext(func(e Event, g GuardContext, _ any) bool {
+			return g.Counter(counter)+1 < maxAttempts
+		})).
+		Branch(failed, failTarget, WithCounterReset(counter)).
+		On(RetryRequeue, retry, state)
+}
+
+// OnTagged adds the transition event -> to from every state tagged with tag, e.g. wiring a
+// "timeout" event to EXPIRED for all "pending" states. It is expanded at Build, so states may
+// be tagged before or after the call; a state that already handles event keeps its own
+// transition, and the target itself is skipped.
+func (b *builder) OnTagged(tag string, event string, to StateID, opts ...TransitionOption) DefinitionBuilder {
+	b.tagged = append(b.tagged, taggedTransition{tag: tag, event: event, to: to, opts: opts})
+	return b
+}
+
+// expandTagged applies the OnTagged declarations in the order they were made.
+func (b *builder) expandTagged() {
+	for _, tt := range b.tagged {
+		ids := make([]StateID, 0, len(b.states))
+		for id, st := range b.states {
+			if id != tt.to && hasTag(st, tt.tag) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if _, ok := b.transitions[TransitionKey{From: id, Event: tt.event}]; !ok {
+				b.On(tt.event, id, tt.to, tt.opts...)
+			}
+		}
+	}
+	b.tagged = nil
+}
+
+func hasTag(st StateDef, tag string) bool {
+	for _, t := range st.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Tagged returns the IDs of the states carrying tag, sorted.
+func (d *Definition) Tagged(tag string) []StateID {
+	var ids []StateID
+	for id, st := range d.states {
+		if hasTag(st, tag) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// EffectOrder sets when transition actions run relative to exit hooks for the whole definition.
+func (b *builder) EffectOrder(o EffectOrder) DefinitionBuilder {
+	b.effectOrder = o
+	return b
+}
+
+// BubbleOrder sets in which order active states are offered events for the whole definition.
+func (b *builder) BubbleOrder(o BubbleOrder) DefinitionBuilder {
+	b.bubbleOrder = o
+	return b
+}
+
+// OnError makes failed transitions move the machine to state instead of rolling back: machines
+// default to FailureMoveToErrorState with state as their error state. The error state's entry
+// hooks receive the triggering event with the action's or hook's error appended to its Args.
+func (b *builder) OnError(state StateID) DefinitionBuilder {
+	b.errorState = state
+	return b
+}
+
 func (b *builder) Build() (*Definition, error) {
+	b.expandTagged()
 	if b.current == nil {
 		return nil, fmt.Errorf("current state not set")
 	}
@@ -177,6 +724,9 @@ func (b *builder) Build() (*Definition, error) {
 	if _, ok := b.states[*b.current]; !ok {
 		return nil, fmt.Errorf("current state %q not defined", *b.current)
 	}
+	if _, ok := b.states[b.errorState]; b.errorState != "" && !ok {
+		return nil, fmt.Errorf("error state %q not defined", b.errorState)
+	}
 	if !b.hasInitial {
 		return nil, fmt.Errorf("at least one state must be marked with WithInitial()")
 	}
@@ -184,18 +734,24 @@ func (b *builder) Build() (*Definition, error) {
 		return nil, fmt.Errorf("at least one state must be marked with WithFinal()")
 	}
 	// Validate: all transitions reference defined states
-	for k, t := range b.transitions {
-		if k != t.Key {
-			return nil, fmt.Errorf("transition key mismatch for transition %q from %q", t.Key.Event, k.From)
+	for k, alts := range b.transitions {
+		for _, t := range alts {
+			if err := b.validateTransition(k, t); err != nil {
+				return nil, err
+			}
 		}
-		if _, ok := b.states[k.From]; !ok {
-			return nil, fmt.Errorf("transition from undefined state %q", k.From)
+	}
+	for alias, event := range b.aliases {
+		if _, ok := b.aliases[event]; ok {
+			return nil, fmt.Errorf("alias %q refers to alias %q", alias, event)
 		}
-		if _, ok := b.states[t.To]; !ok {
-			return nil, fmt.Errorf("transition to undefined state %q", t.To)
+		if alias == "" || strings.Contains(alias, "*") || strings.Contains(event, "*") {
+			return nil, fmt.Errorf("invalid alias %q for %q", alias, event)
 		}
-		if t.Key.Event == "" {
-			return nil, fmt.Errorf("transition event is empty")
+	}
+	for k := range b.transitions {
+		if _, ok := b.aliases[k.Event]; ok {
+			return nil, fmt.Errorf("transition from %q uses alias %q as its event", k.From, k.Event)
 		}
 	}
 	// Validate: hierarchy
@@ -232,23 +788,287 @@ func (b *builder) Build() (*Definition, error) {
 				return nil, fmt.Errorf("state %q references missing parent %q", id, st.Parent)
 			}
 		}
+		for _, r := range st.Recurring {
+			if r.Every <= 0 || r.Event == "" {
+				return nil, fmt.Errorf("state %q has an invalid recurring event %q every %v", id, r.Event, r.Every)
+			}
+		}
 	}
+	if err := b.validateJunctions(); err != nil {
+		return nil, err
+	}
+	// Intern state and event names so every reference shares one backing string
+	states, transitions, stateNames, eventNames := intern(b.states, b.transitions)
+	aliases := make(map[EventID]EventID, len(b.aliases))
+	for alias, event := range b.aliases {
+		aliases[alias] = eventNames.canonical(event)
+	}
+	branches := make(map[StateID][]TransitionDef, len(b.branches))
+	for j, segs := range b.branches {
+		out := make([]TransitionDef, len(segs))
+		for i, t := range segs {
+			t.Key.From = stateNames.canonical(t.Key.From)
+			t.To = stateNames.canonical(t.To)
+			out[i] = t
+		}
+		branches[stateNames.canonical(j)] = out
+	}
+
 	// Build outgoing transitions index for fast lookup
 	outgoing := make(map[StateID][]TransitionKey)
-	for tk := range b.transitions {
+	for tk := range transitions {
 		outgoing[tk.From] = append(outgoing[tk.From], tk)
 	}
 
 	d := &Definition{
-		Name:               b.name,
-		States:             b.states,
-		Transitions:        b.transitions,
-		Current:            *b.current,
-		OutgoingTransitions: outgoing,
+		Name:        b.name,
+		Current:     stateNames.canonical(*b.current),
+		EffectOrder: b.effectOrder,
+		BubbleOrder: b.bubbleOrder,
+		ErrorState:  stateNames.canonical(b.errorState),
+		states:      states,
+		transitions: transitions,
+		branches:    branches,
+		aliases:     aliases,
+		outgoing:    outgoing,
+		stateNames:  stateNames,
+		eventNames:  eventNames,
+	}
+	for k := range transitions {
+		if isWildcard(k.Event) {
+			d.hasWildcards = true
+		}
 	}
+	d.indexHierarchy()
+	d.composeJunctions()
+	d.fingerprint = d.computeFingerprint()
 	return d, nil
 }
 
+// AnyEvent used as a transition event matches every event the state has no more specific
+// transition for, before the event bubbles to the parent.
+const AnyEvent = "*"
+
+// validEventPattern reports whether event is a plain name, AnyEvent or a namespace wildcard:
+// "*" may only appear as the last dot-separated segment ("fiat.*").
+func validEventPattern(event EventID) bool {
+	i := strings.IndexByte(event, '*')
+	return i < 0 || event == AnyEvent || (i == len(event)-1 && i >= 2 && event[i-1] == '.')
+}
+
+func isWildcard(event EventID) bool { return event == AnyEvent || strings.HasSuffix(event, ".*") }
+
+// canonicalEvent resolves an alias to the event it stands for.
+func (d *Definition) canonicalEvent(name EventID) EventID {
+	if event, ok := d.aliases[name]; ok {
+		return event
+	}
+	return name
+}
+
+// validateTransition checks that a transition is keyed consistently and references defined states.
+func (b *builder) validateTransition(k TransitionKey, t TransitionDef) error {
+	if k != t.Key {
+		return fmt.Errorf("transition key mismatch for transition %q from %q", t.Key.Event, k.From)
+	}
+	if _, ok := b.states[k.From]; !ok {
+		return fmt.Errorf("transition from undefined state %q", k.From)
+	}
+	if _, ok := b.states[t.To]; !ok {
+		return fmt.Errorf("transition to undefined state %q", t.To)
+	}
+	if t.Key.Event == "" {
+		return fmt.Errorf("transition event is empty")
+	}
+	if t.Internal && t.To != k.From {
+		return fmt.Errorf("internal transition %q from %q must target its source, not %q", k.Event, k.From, t.To)
+	}
+	if !validEventPattern(t.Key.Event) {
+		return fmt.Errorf("invalid event pattern %q, wildcards must be a trailing \".*\"", t.Key.Event)
+	}
+	return nil
+}
+
+// validateJunctions checks that junctions and choices are plain pseudo-states with at least
+// one branch, that branches only leave them, and that no chain of them loops back on itself.
+func (b *builder) validateJunctions() error {
+	for id, st := range b.states {
+		kind := pseudoKind(st)
+		if kind == "" {
+			continue
+		}
+		if st.Junction && st.Choice {
+			return fmt.Errorf("state %q cannot be both a junction and a choice", id)
+		}
+		if len(st.Children) > 0 {
+			return fmt.Errorf("%s %q cannot be a composite state", kind, id)
+		}
+		if id == *b.current {
+			return fmt.Errorf("%s %q cannot be the current state", kind, id)
+		}
+		if len(b.branches[id]) == 0 {
+			return fmt.Errorf("%s %q has no branches", kind, id)
+		}
+	}
+	for k := range b.transitions {
+		if kind := pseudoKind(b.states[k.From]); kind != "" {
+			return fmt.Errorf("%s %q cannot handle event %q, use Branch", kind, k.From, k.Event)
+		}
+	}
+	for j, segs := range b.branches {
+		if st, ok := b.states[j]; !ok || pseudoKind(st) == "" {
+			return fmt.Errorf("branch from %q which is not a junction or choice", j)
+		}
+		for _, t := range segs {
+			if _, ok := b.states[t.To]; !ok {
+				return fmt.Errorf("branch from %q to undefined state %q", j, t.To)
+			}
+		}
+	}
+	// detect cycles with a DFS over pseudo-state -> pseudo-state segments
+	const (
+		visiting = 1
+		done     = 2
+	)
+	mark := make(map[StateID]int)
+	var visit func(j StateID) error
+	visit = func(j StateID) error {
+		switch mark[j] {
+		case visiting:
+			return fmt.Errorf("branch cycle through %q", j)
+		case done:
+			return nil
+		}
+		mark[j] = visiting
+		for _, t := range b.branches[j] {
+			if pseudoKind(b.states[t.To]) != "" {
+				if err := visit(t.To); err != nil {
+					return err
+				}
+			}
+		}
+		mark[j] = done
+		return nil
+	}
+	junctions := make([]StateID, 0, len(b.branches))
+	for j := range b.branches {
+		junctions = append(junctions, j)
+	}
+	sort.Strings(junctions) // report the same cycle on every build
+	for _, j := range junctions {
+		if err := visit(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// composeJunctions flattens every junction chain into its candidate paths in priority order.
+// Chains are known to be acyclic once validateJunctions has passed.
+func (d *Definition) composeJunctions() {
+	if len(d.branches) == 0 {
+		return
+	}
+	d.junctions = make(map[StateID][]junctionPath, len(d.branches))
+	var expand func(j StateID) []junctionPath
+	expand = func(j StateID) []junctionPath {
+		if paths, ok := d.junctions[j]; ok {
+			return paths
+		}
+		var paths []junctionPath
+		for _, seg := range d.branches[j] {
+			if !d.states[seg.To].Junction {
+				paths = append(paths, junctionPath{seg})
+				continue
+			}
+			for _, rest := range expand(seg.To) {
+				p := make(junctionPath, 0, len(rest)+1)
+				paths = append(paths, append(append(p, seg), rest...))
+			}
+		}
+		d.junctions[j] = paths
+		return paths
+	}
+	for j := range d.branches {
+		if d.states[j].Junction {
+			expand(j)
+		}
+	}
+}
+
+// indexHierarchy precomputes root paths and initial drill-down paths for every state.
+// The resulting slices are shared by all machines and must never be mutated.
+func (d *Definition) indexHierarchy() {
+	d.paths = make(map[StateID][]StateID, len(d.states))
+	d.drillDown = make(map[StateID][]StateID, len(d.states))
+	for id, st := range d.states {
+		if st.History != NoHistory {
+			d.hasHistory = true
+		}
+		if st.Timeout > 0 || len(st.Recurring) > 0 {
+			d.hasTimers = true
+		}
+		if st.SuppressReentry {
+			d.hasReentry = true
+		}
+		if len(st.ResetCounters) > 0 {
+			d.hasCounterResets = true
+		}
+		d.paths[id] = d.computePath(id)
+		var drill []StateID
+		cur := id
+		for {
+			st := d.states[cur]
+			if len(st.Children) == 0 {
+				break
+			}
+			drill = append(drill, st.InitialChild)
+			cur = st.InitialChild
+		}
+		d.drillDown[id] = drill
+	}
+}
+
+// computePath returns path from root to s (inclusive)
+func (d *Definition) computePath(s StateID) []StateID {
+	// climb to root
+	var rev []StateID
+	cur := s
+	for {
+		rev = append(rev, cur)
+		p := d.states[cur].Parent
+		if p == "" {
+			break
+		}
+		cur = p
+	}
+	// reverse
+	for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
+		rev[i], rev[j] = rev[j], rev[i]
+	}
+	return rev
+}
+
+// pathTo returns the shared root path of s, computing it if the definition was not built by a builder.
+func (d *Definition) pathTo(s StateID) []StateID {
+	if p, ok := d.paths[s]; ok {
+		return p
+	}
+	return d.computePath(s)
+}
+
+// initialDescendants returns the states entered below s when drilling to its initial leaf.
+func (d *Definition) initialDescendants(s StateID) []StateID {
+	if p, ok := d.drillDown[s]; ok {
+		return p
+	}
+	var drill []StateID
+	for cur := s; len(d.states[cur].Children) > 0; cur = d.states[cur].InitialChild {
+		drill = append(drill, d.states[cur].InitialChild)
+	}
+	return drill
+}
+
 // IsBefore reports whether a appears before b in the definition's topological order.
 // Returns false with error if a cycle exists or states are missing.
 func (d *Definition) IsBefore(a, b StateID) (bool, error) {
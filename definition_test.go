@@ -2,6 +2,8 @@ package rfsm
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -132,6 +134,697 @@ func TestActionRollback(t *testing.T) {
 	}
 }
 
+func TestEffectOrder(t *testing.T) {
+	build := func(order EffectOrder, log *[]string, fail *bool) *Definition {
+		def, err := NewDef("order").
+			State("A", WithInitial(),
+				WithEntry[any](func(e Event, ctx any) error { *log = append(*log, "enter A"); return nil }),
+				WithExit[any](func(e Event, ctx any) error { *log = append(*log, "exit A"); return nil })).
+			State("B", WithFinal(),
+				WithEntry[any](func(e Event, ctx any) error { *log = append(*log, "enter B"); return nil })).
+			Current("A").
+			On("go", "A", "B", WithAction[any](func(e Event, ctx any) error {
+				*log = append(*log, "action")
+				if *fail {
+					return errors.New("boom")
+				}
+				return nil
+			})).
+			EffectOrder(order).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return def
+	}
+
+	cases := []struct {
+		order EffectOrder
+		fail  bool
+		want  string
+	}{
+		{ExitActionEntry, false, "[exit A action enter B]"},
+		{ActionExitEntry, false, "[action exit A enter B]"},
+		{ExitActionEntry, true, "[exit A action enter A]"},
+		{ActionExitEntry, true, "[action]"},
+	}
+	for _, c := range cases {
+		var log []string
+		fail := c.fail
+		m := NewMachine[any](build(c.order, &log, &fail), nil)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		log = nil
+		err := m.Dispatch(Event{Name: "go"})
+		if c.fail != errors.Is(err, ErrActionFailed) {
+			t.Fatalf("order %d fail=%v: unexpected error %v", c.order, c.fail, err)
+		}
+		if got := fmt.Sprint(log); got != c.want {
+			t.Fatalf("order %d fail=%v: want %s got %s", c.order, c.fail, c.want, got)
+		}
+		_ = m.Stop()
+	}
+}
+
+type order struct {
+	Amount int
+	VIP    bool
+	Log    []string
+}
+
+func TestJunction(t *testing.T) {
+	step := func(name string) ActionFunc[*order] {
+		return func(e Event, o *order) error { o.Log = append(o.Log, name); return nil }
+	}
+	def, err := NewDef("junction").
+		State("A", WithInitial()).
+		State("CHECK", WithJunction(),
+			WithEntry[*order](func(e Event, o *order) error { o.Log = append(o.Log, "enter CHECK"); return nil })).
+		State("TIER", WithJunction()).
+		State("FAST", WithFinal()).
+		State("NORMAL", WithFinal()).
+		Current("A").
+		On("pay", "A", "CHECK",
+			WithGuard[*order](func(e Event, o *order) bool { return o.Amount > 0 }),
+			WithAction(step("pay"))).
+		Branch("CHECK", "TIER", WithAction(step("check"))).
+		Branch("TIER", "FAST",
+			WithGuard[*order](func(e Event, o *order) bool { return o.VIP }),
+			WithAction(step("fast"))).
+		Branch("TIER", "NORMAL").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		o    order
+		want StateID
+		log  string
+	}{
+		{order{Amount: 0}, "A", "[]"},
+		{order{Amount: 10, VIP: true}, "FAST", "[pay check fast]"},
+		{order{Amount: 10}, "NORMAL", "[pay check]"},
+	}
+	for _, c := range cases {
+		o := c.o
+		m := NewMachine(def, &o)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		err := m.Dispatch(Event{Name: "pay"})
+		if (c.want == "A") != errors.Is(err, ErrNoTransition) {
+			t.Fatalf("%+v: unexpected error %v", c.o, err)
+		}
+		if got := m.Current(); got != c.want {
+			t.Fatalf("%+v: want %s got %s", c.o, c.want, got)
+		}
+		if got := fmt.Sprint(o.Log); got != c.log {
+			t.Fatalf("%+v: want log %s got %s", c.o, c.log, got)
+		}
+		if m.HasVisited("CHECK") || m.HasVisited("TIER") {
+			t.Fatal("junctions must never be entered")
+		}
+		_ = m.Stop()
+	}
+}
+
+func TestBuildValidation_Junctions(t *testing.T) {
+	base := func() DefinitionBuilder {
+		return NewDef("test").
+			State("A", WithInitial()).
+			State("J", WithJunction()).
+			State("B", WithFinal()).
+			Current("A").
+			On("go", "A", "J")
+	}
+	cases := map[string]DefinitionBuilder{
+		`junction "J" has no branches`:                      base(),
+		`branch cycle through "J"`:                          base().State("K", WithJunction()).Branch("J", "K").Branch("K", "J"),
+		`branch from "A" which is not a junction or choice`: base().Branch("J", "B").Branch("A", "B"),
+		`branch from "J" to undefined state "C"`:            base().Branch("J", "C"),
+		`junction "J" cannot handle event "x", use Branch`:  base().Branch("J", "B").On("x", "J", "B"),
+	}
+	for want, b := range cases {
+		if _, err := b.Build(); err == nil || err.Error() != want {
+			t.Fatalf("want %q got %v", want, err)
+		}
+	}
+}
+
+func TestEventNamespaces(t *testing.T) {
+	def, err := NewDef("ns").
+		State("A", WithInitial()).
+		State("ANY").
+		State("DEPOSIT").
+		State("OK", WithFinal()).
+		Current("A").
+		On("fiat.*", "A", "ANY").
+		On("fiat.deposit.*", "A", "DEPOSIT").
+		On("fiat.success", "A", "OK").
+		Alias("paid", "fiat.success").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		event string
+		want  StateID
+	}{
+		{"fiat.success", "OK"},
+		{"paid", "OK"},
+		{"fiat.deposit.failed", "DEPOSIT"},
+		{"fiat.refund", "ANY"},
+		{"fiat", "A"},
+		{"crypto.success", "A"},
+	}
+	for _, c := range cases {
+		m := NewMachine[any](def, nil)
+		sub := &eventSub{}
+		m.Subscribe(sub)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		err := m.Dispatch(Event{Name: c.event})
+		if (c.want == "A") != (err == ErrNoTransition) {
+			t.Fatalf("%s: unexpected error %v", c.event, err)
+		}
+		if got := m.Current(); got != c.want {
+			t.Fatalf("%s: want %s got %s", c.event, c.want, got)
+		}
+		if c.event == "paid" && sub.name != "fiat.success" {
+			t.Fatalf("alias should be delivered under its canonical name, got %q", sub.name)
+		}
+		_ = m.Stop()
+	}
+
+	for _, b := range []DefinitionBuilder{
+		NewDef("bad").State("A", WithInitial()).State("B", WithFinal()).Current("A").On("fi*at", "A", "B"),
+		NewDef("bad").State("A", WithInitial()).State("B", WithFinal()).Current("A").On("go", "A", "B").Alias("x", "y").Alias("y", "go"),
+		NewDef("bad").State("A", WithInitial()).State("B", WithFinal()).Current("A").On("go", "A", "B").Alias("go", "run"),
+	} {
+		if _, err := b.Build(); err == nil {
+			t.Fatal("want build error")
+		}
+	}
+}
+
+type eventSub struct{ name string }
+
+func (s *eventSub) OnTransition(from, to StateID, e Event, err error) { s.name = e.Name }
+
+func TestRetryPattern(t *testing.T) {
+	def, err := NewDef("retry").
+		State("CALL", WithInitial()).
+		State("DONE", WithFinal()).
+		State("GAVE_UP", WithFinal()).
+		Current("CALL").
+		WithRetryPattern("CALL", "DONE", "GAVE_UP", 3).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for attempt := 1; attempt < 3; attempt++ {
+		if err := m.Dispatch(Event{Name: RetryFailed}); err != nil {
+			t.Fatal(err)
+		}
+		if m.Current() != "CALL_RETRY" || m.Counter("CALL_attempts") != attempt {
+			t.Fatalf("attempt %d: at %s with counter %d", attempt, m.Current(), m.Counter("CALL_attempts"))
+		}
+		if err := m.Dispatch(Event{Name: RetryRequeue}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// counters survive a snapshot round trip
+	data, err := m.SnapshotJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+	m = NewMachine[any](def, nil)
+	if err := m.RestoreSnapshotJSON(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if m.Counter("CALL_attempts") != 2 {
+		t.Fatalf("restored counter: want 2 got %d", m.Counter("CALL_attempts"))
+	}
+
+	if err := m.Dispatch(Event{Name: RetryFailed}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Current() != "GAVE_UP" || m.Counter("CALL_attempts") != 0 {
+		t.Fatalf("exhausted: at %s with counter %d", m.Current(), m.Counter("CALL_attempts"))
+	}
+}
+
+func TestOnTagged(t *testing.T) {
+	def, err := NewDef("tagged").
+		OnTagged("pending", "timeout", "EXPIRED").
+		State("START", WithInitial()).
+		State("PENDING_FIAT", WithTags("pending")).
+		State("PENDING_HEDGE", WithTags("pending", "hedge")).
+		State("EXPIRED", WithFinal(), WithTags("pending")).
+		State("DONE", WithFinal()).
+		Current("START").
+		On("timeout", "PENDING_HEDGE", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(def.Tagged("pending")); got != "[EXPIRED PENDING_FIAT PENDING_HEDGE]" {
+		t.Fatalf("unexpected tagged states %s", got)
+	}
+	if alts := def.Transitions("PENDING_FIAT", "timeout"); len(alts) != 1 || alts[0].To != "EXPIRED" {
+		t.Fatalf("want generated timeout transition, got %+v", alts)
+	}
+	if alts := def.Transitions("PENDING_HEDGE", "timeout"); len(alts) != 1 || alts[0].To != "DONE" {
+		t.Fatalf("explicit transition must win, got %+v", alts)
+	}
+	if len(def.Transitions("EXPIRED", "timeout")) > 0 {
+		t.Fatal("target must not get a self transition")
+	}
+}
+
+func TestAnyEvent(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("any").
+		State("A", WithSubDef(sub), WithInitial()).
+		State("ERROR", WithFinal()).
+		State("DONE", WithFinal()).
+		Current("A").
+		On("next", "A1", "A2").
+		On(AnyEvent, "A1", "ERROR").
+		On("done", "A", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		event string
+		want  StateID
+	}{
+		{"next", "A2"},    // exact match wins over the wildcard
+		{"done", "ERROR"}, // the leaf wildcard catches the event before it bubbles
+		{"whatever", "ERROR"},
+	}
+	for _, c := range cases {
+		m := NewMachine[any](def, nil)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Dispatch(Event{Name: c.event}); err != nil {
+			t.Fatalf("%s: %v", c.event, err)
+		}
+		if got := m.Current(); got != c.want {
+			t.Fatalf("%s: want %s got %s", c.event, c.want, got)
+		}
+		_ = m.Stop()
+	}
+}
+
+func TestStateFrom(t *testing.T) {
+	var log []string
+	entry := func(name string) HookFunc[any] {
+		return func(e Event, _ any) error { log = append(log, name); return nil }
+	}
+	pending := NewStateTemplate(
+		WithEntry(entry("pending")),
+		WithTags("pending"),
+		WithMetadata(MetaTooltip, "waiting"),
+	)
+	fiat := pending.Extend(WithMetadata("rail", "fiat"))
+	def, err := NewDef("tmpl").
+		State("START", WithInitial()).
+		StateFrom(fiat, "PENDING_FIAT").
+		StateFrom(pending, "PENDING_HEDGE", WithEntry(entry("hedge")), WithMetadata(MetaTooltip, "hedging")).
+		State("DONE", WithFinal()).
+		Current("START").
+		On("fiat", "START", "PENDING_FIAT").
+		On("hedge", "PENDING_FIAT", "PENDING_HEDGE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := def.State("PENDING_FIAT")
+	h, _ := def.State("PENDING_HEDGE")
+	if f.Metadata[MetaTooltip] != "waiting" || f.Metadata["rail"] != "fiat" || fmt.Sprint(f.Tags) != "[pending]" {
+		t.Fatalf("PENDING_FIAT did not inherit the template: %+v", f)
+	}
+	if h.Metadata[MetaTooltip] != "hedging" || h.Metadata["rail"] != "" {
+		t.Fatalf("PENDING_HEDGE overrides not applied: %+v", h.Metadata)
+	}
+
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	_ = m.Dispatch(Event{Name: "fiat"})
+	_ = m.Dispatch(Event{Name: "hedge"})
+	if got := fmt.Sprint(log); got != "[pending hedge]" {
+		t.Fatalf("unexpected entry hooks %s", got)
+	}
+}
+
+func TestEdit(t *testing.T) {
+	var entered []string
+	orig, err := NewDef("flow").
+		State("A", WithInitial(), WithMetadata("owner", "payments")).
+		State("B", WithFinal(), WithEntry[any](func(e Event, _ any) error { entered = append(entered, "B"); return nil })).
+		Current("A").
+		On("go", "A", "B", WithGuard[any](func(e Event, _ any) bool { return true })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edited, err := orig.Edit().
+		State("A", WithMetadata("owner", "risk")).
+		State("C", WithFinal()).
+		On("skip", "A", "C").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := orig.State("C"); ok {
+		t.Fatal("editing must not modify the original definition")
+	}
+	origA, _ := orig.State("A")
+	editedA, _ := edited.State("A")
+	if origA.Metadata["owner"] != "payments" || editedA.Metadata["owner"] != "risk" {
+		t.Fatal("metadata must be copied, not shared")
+	}
+	if edited.Transitions("A", "go")[0].Guard == nil {
+		t.Fatal("guards must be carried over")
+	}
+
+	m := NewMachine[any](edited, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Current() != "B" || fmt.Sprint(entered) != "[B]" {
+		t.Fatalf("hooks not carried over: at %s, entered %v", m.Current(), entered)
+	}
+}
+
+func TestGuardedAlternatives(t *testing.T) {
+	def, err := NewDef("alts").
+		State("A", WithInitial()).
+		State("REVIEW", WithFinal()).
+		State("REJECTED", WithFinal()).
+		State("APPROVED", WithFinal()).
+		Current("A").
+		On("route", "A", "REVIEW", WithGuard[int](func(e Event, amount int) bool { return amount > 100 })).
+		On("route", "A", "REJECTED", WithGuard[int](func(e Event, amount int) bool { return amount < 0 })).
+		On("route", "A", "APPROVED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(def.Transitions("A", "route")); n != 3 {
+		t.Fatalf("want 3 alternatives got %d", n)
+	}
+	for amount, want := range map[int]StateID{500: "REVIEW", -1: "REJECTED", 50: "APPROVED"} {
+		m := NewMachine(def, amount)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Dispatch(Event{Name: "route"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Current(); got != want {
+			t.Fatalf("amount %d: want %s got %s", amount, want, got)
+		}
+		_ = m.Stop()
+	}
+}
+
+func TestGuardedAlternatives_SameTarget(t *testing.T) {
+	var log []string
+	def, err := NewDef("alts").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B", WithGuard[int](func(e Event, n int) bool { return n > 100 }), WithAction[int](func(e Event, n int) error {
+			log = append(log, "large")
+			return nil
+		})).
+		On("go", "A", "B", WithGuard[int](func(e Event, n int) bool { return n > 0 }), WithAction[int](func(e Event, n int) error {
+			log = append(log, "small")
+			return nil
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(def.Transitions("A", "go")); n != 2 {
+		t.Fatalf("each On should add an alternative, got %d", n)
+	}
+	for _, n := range []int{500, 50, -1} {
+		m := NewMachine(def, n)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		_ = m.Dispatch(Event{Name: "go"})
+		_ = m.Stop()
+	}
+	if got := strings.Join(log, ","); got != "large,small" {
+		t.Fatalf("want large,small got %s", got)
+	}
+}
+
+func TestChoice(t *testing.T) {
+	type scoring struct {
+		Score int
+		Log   []string
+	}
+	hook := func(name string) HookFunc[*scoring] {
+		return func(e Event, c *scoring) error { c.Log = append(c.Log, name); return nil }
+	}
+	sub, err := NewDef("sub").
+		State("P1", WithInitial(), WithExit(hook("exit P1")), WithEntry(hook("enter P1"))).
+		State("P2", WithFinal()).
+		Current("P1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("choice").
+		State("P", WithSubDef(sub), WithInitial(), WithExit(hook("exit P")), WithEntry(hook("enter P"))).
+		State("DECIDE", WithChoice()).
+		State("HIGH", WithFinal(), WithEntry(hook("enter HIGH"))).
+		State("LOW", WithFinal(), WithEntry(hook("enter LOW"))).
+		Current("P").
+		// the choice sees the score written by the action, unlike a junction
+		On("score", "P1", "DECIDE", WithAction[*scoring](func(e Event, c *scoring) error {
+			c.Score = e.Args[0].(int)
+			c.Log = append(c.Log, "action")
+			return nil
+		})).
+		Branch("DECIDE", "HIGH", WithGuard[*scoring](func(e Event, c *scoring) bool { return c.Score >= 50 })).
+		Branch("DECIDE", "LOW", WithGuard[*scoring](func(e Event, c *scoring) bool { return c.Score >= 0 })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		score int
+		want  StateID
+		err   error
+		log   string
+	}{
+		{80, "HIGH", nil, "[exit P1 exit P action enter HIGH]"},
+		{10, "LOW", nil, "[exit P1 exit P action enter LOW]"},
+		{-5, "P1", ErrNoChoiceBranch, "[exit P1 exit P action enter P enter P1]"},
+	}
+	for _, c := range cases {
+		ctx := &scoring{}
+		m := NewMachine(def, ctx)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		ctx.Log = nil
+		if err := m.Dispatch(Event{Name: "score", Args: []any{c.score}}); err != c.err {
+			t.Fatalf("score %d: want error %v got %v", c.score, c.err, err)
+		}
+		if got := m.Current(); got != c.want {
+			t.Fatalf("score %d: want %s got %s", c.score, c.want, got)
+		}
+		if got := fmt.Sprint(ctx.Log); got != c.log {
+			t.Fatalf("score %d: want %s got %s", c.score, c.log, got)
+		}
+		if m.HasVisited("DECIDE") {
+			t.Fatal("a choice is never entered")
+		}
+		_ = m.Stop()
+	}
+}
+
+func TestCloneAndAccessorsCopy(t *testing.T) {
+	def, err := NewDef("flow").
+		State("A", WithInitial(), WithMetadata("owner", "payments")).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B", WithTransitionMetadata("sla", "1h")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := def.State("A")
+	a.Metadata["owner"] = "someone else"
+	def.Transitions("A", "go")[0].Metadata["sla"] = "never"
+	if a, _ := def.State("A"); a.Metadata["owner"] != "payments" {
+		t.Fatal("State must return a copy")
+	}
+	if def.Transitions("A", "go")[0].Metadata["sla"] != "1h" {
+		t.Fatal("Transitions must return copies")
+	}
+
+	c := def.Clone()
+	if fmt.Sprint(c.StateIDs()) != "[A B]" || fmt.Sprint(c.Outgoing("A")) != "[{A go}]" {
+		t.Fatalf("clone lost states or transitions: %v %v", c.StateIDs(), c.Outgoing("A"))
+	}
+	m := NewMachine[any](c, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil || m.Current() != "B" {
+		t.Fatalf("clone not runnable: %v at %s", err, m.Current())
+	}
+}
+
+func TestSubDefMergeDoesNotModifySub(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial(), WithMetadata("k", "v")).
+		State("A2", WithFinal()).
+		Current("A1").
+		On("go", "A1", "A2").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewDef("parent").
+		State("A", WithInitial(), WithSubDef(sub)).
+		State("B", WithFinal()).
+		Current("A").
+		State("A1", WithMetadata("k", "changed")).
+		On("go", "A1", "A2", WithTransitionMetadata("x", "y")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a1, _ := sub.State("A1"); a1.Metadata["k"] != "v" || a1.Parent != "" {
+		t.Fatalf("merging changed the sub definition's state: %+v", a1)
+	}
+	if md := sub.Transitions("A1", "go")[0].Metadata; md["x"] != "" {
+		t.Fatalf("merging changed the sub definition's transition: %v", md)
+	}
+}
+
+func TestSubDefWithJunction(t *testing.T) {
+	sub, err := NewDef("review").
+		State("CHECK", WithInitial()).
+		State("ROUTE", WithJunction()).
+		State("AUTO", WithFinal()).
+		State("MANUAL", WithFinal()).
+		Current("CHECK").
+		On("submit", "CHECK", "ROUTE").
+		Branch("ROUTE", "AUTO", WithGuard(func(e Event, _ any) bool { return len(e.Args) == 0 })).
+		Branch("ROUTE", "MANUAL").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("order").
+		State("REVIEW", WithInitial(), WithSubDef(sub)).
+		State("DONE", WithFinal()).
+		Current("REVIEW").
+		On("approve", "REVIEW", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segs := def.Branches("ROUTE"); len(segs) != 2 || segs[0].To != "AUTO" {
+		t.Fatalf("want the sub definition's branches got %+v", segs)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "submit", Args: []any{"flagged"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Current(); got != "MANUAL" {
+		t.Fatalf("want MANUAL got %s", got)
+	}
+	if segs := sub.Branches("ROUTE"); len(segs) != 2 {
+		t.Fatalf("merging changed the sub definition's branches: %+v", segs)
+	}
+}
+
+func TestSubDefWithChoiceAndAlias(t *testing.T) {
+	sub, err := NewDef("payment").
+		State("CHARGE", WithInitial()).
+		State("DECIDE", WithChoice()).
+		State("CAPTURED", WithFinal()).
+		State("DECLINED", WithFinal()).
+		Current("CHARGE").
+		On("charge", "CHARGE", "DECIDE", WithAction(func(e Event, c *int) error {
+			*c = 42
+			return nil
+		})).
+		Branch("DECIDE", "CAPTURED", WithGuard(func(e Event, c *int) bool { return *c > 0 })).
+		Branch("DECIDE", "DECLINED").
+		Alias("pay", "charge").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("order").
+		State("PAYMENT", WithInitial(), WithSubDef(sub)).
+		State("DONE", WithFinal()).
+		Current("PAYMENT").
+		On("ship", "PAYMENT", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var amount int
+	m := NewMachine(def, &amount)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "pay"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Current(); got != "CAPTURED" {
+		t.Fatalf("the choice should see the action's effect, want CAPTURED got %s", got)
+	}
+}
+
 type recSub struct {
 	from, to StateID
 	count    int32
@@ -265,11 +958,13 @@ func TestWithDescription(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if def.States["A"].Description != "Initial state" {
-		t.Fatalf("expected 'Initial state', got %q", def.States["A"].Description)
+	a, _ := def.State("A")
+	b, _ := def.State("B")
+	if a.Description != "Initial state" {
+		t.Fatalf("expected 'Initial state', got %q", a.Description)
 	}
-	if def.States["B"].Description != "Final state" {
-		t.Fatalf("expected 'Final state', got %q", def.States["B"].Description)
+	if b.Description != "Final state" {
+		t.Fatalf("expected 'Final state', got %q", b.Description)
 	}
 }
 
@@ -294,10 +989,11 @@ func TestInitialChild(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if def.States["A"].InitialChild != "A2" {
-		t.Fatalf("expected InitialChild 'A2', got %q", def.States["A"].InitialChild)
+	a, _ := def.State("A")
+	if a.InitialChild != "A2" {
+		t.Fatalf("expected InitialChild 'A2', got %q", a.InitialChild)
 	}
-	if len(def.States["A"].Children) == 0 {
+	if len(a.Children) == 0 {
 		t.Fatal("A should have children")
 	}
 }
@@ -0,0 +1,177 @@
+package rfsm
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Notification is a transition notification recorded for durable delivery.
+type Notification struct {
+	Seq   uint64    `json:"seq"`
+	From  StateID   `json:"from"`
+	To    StateID   `json:"to"`
+	Event Event     `json:"event"`
+	Err   string    `json:"err,omitempty"` // error message of a failed transition
+	Time  time.Time `json:"time"`
+}
+
+// NotificationStore persists notifications until they are acknowledged.
+// Implementations backed by durable storage let pending notifications survive a crash.
+type NotificationStore interface {
+	// Append stores n and returns the sequence number assigned to it.
+	Append(n Notification) (uint64, error)
+	// Pending returns all unacknowledged notifications in sequence order.
+	Pending() ([]Notification, error)
+	// Ack removes the notification with the given sequence number.
+	Ack(seq uint64) error
+}
+
+// DeliverFunc delivers a notification; returning nil acknowledges it.
+type DeliverFunc func(n Notification) error
+
+// DurableSubscriber is an at-least-once Subscriber: every notification is persisted to a
+// NotificationStore before OnTransition returns, then delivered in order by a background
+// goroutine and redelivered every retry interval until the DeliverFunc succeeds.
+type DurableSubscriber struct {
+	store   NotificationStore
+	deliver DeliverFunc
+	retry   time.Duration
+
+	mu      sync.Mutex // serializes delivery rounds
+	wake    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+	errMu   sync.Mutex
+	lastErr error
+}
+
+// NewDurableSubscriber creates a durable subscriber. retry defaults to one second if <= 0.
+// Call Start to begin delivering, including notifications left pending by a previous process.
+func NewDurableSubscriber(store NotificationStore, deliver DeliverFunc, retry time.Duration) *DurableSubscriber {
+	if retry <= 0 {
+		retry = time.Second
+	}
+	return &DurableSubscriber{
+		store:   store,
+		deliver: deliver,
+		retry:   retry,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// OnTransition implements Subscriber by persisting the notification and scheduling delivery.
+func (d *DurableSubscriber) OnTransition(from StateID, to StateID, e Event, err error) {
+	n := Notification{From: from, To: to, Event: e, Time: time.Now()}
+	if err != nil {
+		n.Err = err.Error()
+	}
+	if _, aerr := d.store.Append(n); aerr != nil {
+		d.setErr(aerr)
+		return
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start launches the delivery goroutine.
+func (d *DurableSubscriber) Start() {
+	d.wg.Add(1)
+	go d.run()
+}
+
+// Close stops the delivery goroutine; undelivered notifications stay in the store.
+func (d *DurableSubscriber) Close() {
+	close(d.done)
+	d.wg.Wait()
+}
+
+// Redeliver attempts to deliver all pending notifications now, in order, stopping at the first failure.
+func (d *DurableSubscriber) Redeliver() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	pending, err := d.store.Pending()
+	if err != nil {
+		return err
+	}
+	for _, n := range pending {
+		if err := d.deliver(n); err != nil {
+			return err
+		}
+		if err := d.store.Ack(n.Seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LastError returns the most recent store or delivery error, if any.
+func (d *DurableSubscriber) LastError() error {
+	d.errMu.Lock()
+	defer d.errMu.Unlock()
+	return d.lastErr
+}
+
+func (d *DurableSubscriber) setErr(err error) {
+	d.errMu.Lock()
+	d.lastErr = err
+	d.errMu.Unlock()
+}
+
+func (d *DurableSubscriber) run() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.retry)
+	defer ticker.Stop()
+	for {
+		if err := d.Redeliver(); err != nil {
+			d.setErr(err)
+		}
+		select {
+		case <-d.done:
+			return
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// MemoryNotificationStore is an in-memory NotificationStore, useful for tests and as a reference implementation.
+type MemoryNotificationStore struct {
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]Notification
+}
+
+func NewMemoryNotificationStore() *MemoryNotificationStore {
+	return &MemoryNotificationStore{pending: make(map[uint64]Notification)}
+}
+
+func (s *MemoryNotificationStore) Append(n Notification) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	n.Seq = s.seq
+	s.pending[n.Seq] = n
+	return n.Seq, nil
+}
+
+func (s *MemoryNotificationStore) Pending() ([]Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Notification, 0, len(s.pending))
+	for _, n := range s.pending {
+		out = append(out, n)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Seq < out[j].Seq })
+	return out, nil
+}
+
+func (s *MemoryNotificationStore) Ack(seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, seq)
+	return nil
+}
@@ -0,0 +1,81 @@
+package rfsm
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDurableSubscriber_RedeliversUntilAck(t *testing.T) {
+	def, err := NewDef("durable").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	failing := true
+	var delivered []Notification
+	deliver := func(n Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			return errors.New("webhook down")
+		}
+		delivered = append(delivered, n)
+		return nil
+	}
+
+	store := NewMemoryNotificationStore()
+	sub := NewDurableSubscriber(store, deliver, 10*time.Millisecond)
+	sub.Start()
+	defer sub.Close()
+
+	m := NewMachine[any](def, nil)
+	m.Subscribe(sub)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Dispatch(Event{Name: "nope"})
+
+	// persisted before OnTransition returned, still pending while delivery fails
+	if pending, _ := store.Pending(); len(pending) != 2 {
+		t.Fatalf("want 2 pending got %d", len(pending))
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if pending, _ := store.Pending(); len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("notifications not redelivered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 2 {
+		t.Fatalf("want 2 deliveries got %d", len(delivered))
+	}
+	if delivered[0].To != "B" || delivered[0].Err != "" {
+		t.Fatalf("unexpected first notification %+v", delivered[0])
+	}
+	if delivered[1].Err != ErrNoTransition.Error() || delivered[0].Seq >= delivered[1].Seq {
+		t.Fatalf("unexpected second notification %+v", delivered[1])
+	}
+}
@@ -0,0 +1,275 @@
+// Package dynamostore implements rfsm.Store on DynamoDB with optimistic concurrency, for
+// services that run on AWS without a SQL database.
+//
+// All machines share one table (single-table design) with a string partition key "pk" and a
+// string sort key "sk". The snapshot of a machine is the item ("<prefix><machine id>",
+// "snapshot"), carrying a version that every save increments with a conditional write, so when
+// two workers restore the same machine, the second to persist a transition gets ErrConflict
+// instead of overwriting the first:
+//
+//	store := dynamostore.New(client, dynamostore.WithTTL(30*24*time.Hour))
+//	snap, err := store.Load(ctx, orderID)
+//	m := rfsm.NewMachine(def, order, rfsm.WithAutoPersist(store, orderID))
+//	_ = m.RestoreSnapshot(snap, 0)
+//	if err := m.Dispatch(e); errors.Is(err, dynamostore.ErrConflict) {
+//		// another worker moved the order on: discard m and reload
+//	}
+//
+// Use one Store per worker; workers sharing a Store share its versions and are not protected
+// from each other.
+//
+// With WithTTL, items carry their expiry in the number attribute "expires_at" (Unix seconds);
+// enable TTL on that attribute of the table. DynamoDB deletes expired items late, so Load and
+// ListVersions skip them.
+//
+// Store is also an rfsm.VersionedStore: SaveVersion writes the snapshot and a copy of it, the
+// item ("<prefix><machine id>", "version#<version>"), in one transaction, for
+// rfsm.WithVersionedPersist.
+//
+// The package does not depend on the AWS SDK; wrap your client in a Client, e.g. with
+// aws-sdk-go-v2, whose expression builder writes the conditions:
+//
+//	func (c client) Write(ctx context.Context, puts []dynamostore.Put) error {
+//		in := &dynamodb.TransactWriteItemsInput{}
+//		for _, p := range puts {
+//			cond := expression.AttributeNotExists(expression.Name("pk"))
+//			if p.Expected > 0 {
+//				cond = expression.Name("version").Equal(expression.Value(p.Expected))
+//			}
+//			// marshal p.Item with attributevalue and add a Put with the condition to in
+//		}
+//		_, err := c.db.TransactWriteItems(ctx, in)
+//		var canceled *types.TransactionCanceledException
+//		if errors.As(err, &canceled) {
+//			return dynamostore.ErrConditionFailed
+//		}
+//		return err
+//	}
+package dynamostore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// ErrConflict is returned by Save when the stored snapshot changed since this Store loaded or
+// saved it, or when it saves a new id that another Store created meanwhile.
+var ErrConflict = errors.New("snapshot was modified concurrently")
+
+// ErrConditionFailed is returned by Client.Write when the condition of a Put does not hold.
+var ErrConditionFailed = errors.New("condition failed")
+
+// Item is a table item. Clients store each field as the attribute named in its tag; Data and
+// the keys are strings, the others numbers.
+type Item struct {
+	PK        string `dynamodbav:"pk"`
+	SK        string `dynamodbav:"sk"`
+	Version   int64  `dynamodbav:"version"`
+	SavedAt   int64  `dynamodbav:"saved_at"`             // Unix nanoseconds
+	ExpiresAt int64  `dynamodbav:"expires_at,omitempty"` // Unix seconds, 0 if the item does not expire
+	Data      string `dynamodbav:"data"`                 // the snapshot as JSON
+}
+
+// Put writes an item if the item stored under its keys has version Expected, or, for an
+// Expected of 0, if there is none.
+type Put struct {
+	Item     Item
+	Expected int64
+}
+
+// Client is the subset of a DynamoDB client used by Store.
+type Client interface {
+	// GetItem returns the item under pk and sk, and false if it does not exist.
+	GetItem(ctx context.Context, pk, sk string) (Item, bool, error)
+	// Write writes puts in one transaction, or none of them and ErrConditionFailed if the
+	// condition of one does not hold.
+	Write(ctx context.Context, puts []Put) error
+	// Query returns the items under pk whose sort key starts with prefix, by sort key.
+	Query(ctx context.Context, pk, prefix string) ([]Item, error)
+	// DeleteItem deletes the item under pk and sk, if any.
+	DeleteItem(ctx context.Context, pk, sk string) error
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithPrefix sets the partition key prefix, "rfsm#" by default, so several kinds of items
+// can share the table.
+func WithPrefix(prefix string) Option {
+	return func(s *Store) { s.prefix = prefix }
+}
+
+// WithTTL expires snapshots and versions ttl after they were saved, e.g. to drop finished
+// workflows.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Store) { s.ttl = ttl }
+}
+
+// WithRetention sets which versions SaveVersion keeps.
+func WithRetention(r rfsm.Retention) Option {
+	return func(s *Store) { s.retention = r }
+}
+
+// Store is an rfsm.Store backed by a DynamoDB table.
+type Store struct {
+	client    Client
+	prefix    string
+	ttl       time.Duration
+	retention rfsm.Retention
+
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+var _ rfsm.VersionedStore = (*Store)(nil)
+
+const (
+	snapshotKey   = "snapshot"
+	versionPrefix = "version#"
+)
+
+// New creates a Store on client.
+func New(client Client, opts ...Option) *Store {
+	s := &Store{client: client, prefix: "rfsm#", versions: make(map[string]int64)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Load returns the snapshot stored under id and remembers its version for the next Save.
+// It returns rfsm.ErrSnapshotNotFound if there is none or it expired.
+func (s *Store) Load(ctx context.Context, id string) (*rfsm.Snapshot, error) {
+	item, ok, err := s.client.GetItem(ctx, s.prefix+id, snapshotKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	// an expired item not deleted yet is overwritten by the next Save
+	s.remember(id, item.Version)
+	if expired(item, time.Now()) {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	return decode(id, item)
+}
+
+// Save stores snap under id if the item is still at the version this Store last saw, creating
+// it if this Store never saw id. It returns ErrConflict otherwise.
+func (s *Store) Save(ctx context.Context, id string, snap *rfsm.Snapshot) error {
+	_, err := s.write(ctx, id, snap, false)
+	return err
+}
+
+// SaveVersion saves snap like Save and keeps it under the snapshot's new version, in one
+// transaction, then drops the versions outside the retention. Version numbers skip the saves
+// made with Save.
+func (s *Store) SaveVersion(ctx context.Context, id string, snap *rfsm.Snapshot) (int64, error) {
+	version, err := s.write(ctx, id, snap, true)
+	if err != nil {
+		return 0, err
+	}
+	if s.retention == (rfsm.Retention{}) {
+		return version, nil
+	}
+	vs, err := s.ListVersions(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range vs[:s.retention.Expired(vs, time.Now())] {
+		if err := s.client.DeleteItem(ctx, s.prefix+id, versionKey(v.Version)); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// write saves snap under id, with a version item if versioned, and returns the new version.
+func (s *Store) write(ctx context.Context, id string, snap *rfsm.Snapshot, versioned bool) (int64, error) {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	expected := s.versions[id]
+	s.mu.Unlock()
+	now := time.Now()
+	item := Item{PK: s.prefix + id, SK: snapshotKey, Version: expected + 1, SavedAt: now.UnixNano(), Data: string(data)}
+	if s.ttl > 0 {
+		item.ExpiresAt = now.Add(s.ttl).Unix()
+	}
+	puts := []Put{{Item: item, Expected: expected}}
+	if versioned {
+		v := item
+		v.SK = versionKey(item.Version)
+		puts = append(puts, Put{Item: v})
+	}
+	if err := s.client.Write(ctx, puts); err != nil {
+		if errors.Is(err, ErrConditionFailed) {
+			return 0, ErrConflict
+		}
+		return 0, err
+	}
+	s.remember(id, item.Version)
+	return item.Version, nil
+}
+
+// remember records version as the one the next Save of id expects.
+func (s *Store) remember(id string, version int64) {
+	s.mu.Lock()
+	s.versions[id] = version
+	s.mu.Unlock()
+}
+
+// ListVersions returns the versions kept for id, oldest first.
+func (s *Store) ListVersions(ctx context.Context, id string) ([]rfsm.StoredVersion, error) {
+	items, err := s.client.Query(ctx, s.prefix+id, versionPrefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var out []rfsm.StoredVersion
+	for _, item := range items {
+		if !expired(item, now) {
+			out = append(out, rfsm.StoredVersion{Version: item.Version, SavedAt: time.Unix(0, item.SavedAt)})
+		}
+	}
+	return out, nil
+}
+
+// LoadVersion returns a kept version of id, or rfsm.ErrSnapshotNotFound.
+func (s *Store) LoadVersion(ctx context.Context, id string, version int64) (*rfsm.Snapshot, error) {
+	item, ok, err := s.client.GetItem(ctx, s.prefix+id, versionKey(version))
+	if err != nil {
+		return nil, err
+	}
+	if !ok || expired(item, time.Now()) {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	return decode(id, item)
+}
+
+// versionKey is the sort key of a version; zero padding makes the keys sort by version.
+func versionKey(version int64) string {
+	return fmt.Sprintf("%s%020d", versionPrefix, version)
+}
+
+// expired reports whether item's TTL passed, before DynamoDB got to delete it.
+func expired(item Item, now time.Time) bool {
+	return item.ExpiresAt > 0 && now.Unix() >= item.ExpiresAt
+}
+
+func decode(id string, item Item) (*rfsm.Snapshot, error) {
+	var snap rfsm.Snapshot
+	if err := json.Unmarshal([]byte(item.Data), &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q: %w", id, err)
+	}
+	return &snap, nil
+}
@@ -0,0 +1,201 @@
+package dynamostore
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// fakeDynamo is an in-memory Client with conditional transactional writes.
+type fakeDynamo struct {
+	mu    sync.Mutex
+	items map[[2]string]Item
+}
+
+func newFakeDynamo() *fakeDynamo {
+	return &fakeDynamo{items: map[[2]string]Item{}}
+}
+
+func (f *fakeDynamo) GetItem(_ context.Context, pk, sk string) (Item, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[[2]string{pk, sk}]
+	return item, ok, nil
+}
+
+func (f *fakeDynamo) Write(_ context.Context, puts []Put) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, p := range puts {
+		stored, ok := f.items[[2]string{p.Item.PK, p.Item.SK}]
+		if p.Expected == 0 && ok || p.Expected > 0 && (!ok || stored.Version != p.Expected) {
+			return ErrConditionFailed
+		}
+	}
+	for _, p := range puts {
+		f.items[[2]string{p.Item.PK, p.Item.SK}] = p.Item
+	}
+	return nil
+}
+
+func (f *fakeDynamo) Query(_ context.Context, pk, prefix string) ([]Item, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []Item
+	for k, item := range f.items {
+		if k[0] == pk && strings.HasPrefix(k[1], prefix) {
+			out = append(out, item)
+		}
+	}
+	slices.SortFunc(out, func(a, b Item) int { return strings.Compare(a.SK, b.SK) })
+	return out, nil
+}
+
+func (f *fakeDynamo) DeleteItem(_ context.Context, pk, sk string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.items, [2]string{pk, sk})
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	def, err := rfsm.NewDef("order").
+		State("NEW", rfsm.WithInitial()).
+		State("PAID").
+		State("SHIPPED", rfsm.WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID").
+		On("ship", "PAID", "SHIPPED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newFakeDynamo()
+	ctx := context.Background()
+	worker1, worker2 := New(db, WithTTL(time.Hour)), New(db, WithTTL(time.Hour))
+	if _, err := worker1.Load(ctx, "o1"); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(worker1, "o1"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(rfsm.Event{Name: "pay"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+	item := db.items[[2]string{"rfsm#o1", "snapshot"}]
+	if item.Version != 1 || item.ExpiresAt <= time.Now().Unix() {
+		t.Fatalf("unexpected item %+v", item)
+	}
+
+	// both workers restore the machine; the second to persist loses
+	restore := func(store *Store) *rfsm.Machine[any] {
+		snap, err := store.Load(ctx, "o1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(store, "o1"))
+		if err := m.RestoreSnapshot(snap, 0); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m1, m2 := restore(worker1), restore(worker2)
+	defer m1.Stop()
+	defer m2.Stop()
+	if err := m1.Dispatch(rfsm.Event{Name: "ship"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.Dispatch(rfsm.Event{Name: "ship"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+	if snap, err := worker2.Load(ctx, "o1"); err != nil || snap.Current != "SHIPPED" {
+		t.Fatalf("latest snapshot %v %v", snap, err)
+	}
+
+	// a new id created by another store meanwhile conflicts too
+	if err := worker1.Save(ctx, "o2", &rfsm.Snapshot{Current: "NEW"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker2.Save(ctx, "o2", &rfsm.Snapshot{Current: "NEW"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+}
+
+func TestStore_Expired(t *testing.T) {
+	db := newFakeDynamo()
+	store := New(db, WithPrefix("orders#"), WithTTL(time.Hour))
+	ctx := context.Background()
+	if err := store.Save(ctx, "o1", &rfsm.Snapshot{Current: "NEW"}); err != nil {
+		t.Fatal(err)
+	}
+	// DynamoDB has not deleted the item yet
+	k := [2]string{"orders#o1", "snapshot"}
+	item := db.items[k]
+	item.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	db.items[k] = item
+
+	other := New(db, WithPrefix("orders#"))
+	if _, err := other.Load(ctx, "o1"); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	if err := other.Save(ctx, "o1", &rfsm.Snapshot{Current: "PAID"}); err != nil {
+		t.Fatalf("an expired snapshot should be overwritten: %v", err)
+	}
+	if snap, err := other.Load(ctx, "o1"); err != nil || snap.Current != "PAID" {
+		t.Fatalf("latest snapshot %v %v", snap, err)
+	}
+	if db.items[k].ExpiresAt != 0 {
+		t.Fatalf("a store without TTL should not expire items, got %d", db.items[k].ExpiresAt)
+	}
+}
+
+func TestStore_Versions(t *testing.T) {
+	db := newFakeDynamo()
+	store := New(db, WithRetention(rfsm.Retention{MaxVersions: 2}))
+	ctx := context.Background()
+	for _, current := range []rfsm.StateID{"NEW", "PAID", "SHIPPED"} {
+		if _, err := store.SaveVersion(ctx, "o1", &rfsm.Snapshot{Current: current}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vs, err := store.ListVersions(ctx, "o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || vs[0].Version != 2 || vs[1].Version != 3 {
+		t.Fatalf("want versions 2 and 3 got %+v", vs)
+	}
+	snap, err := store.LoadVersion(ctx, "o1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Current != "PAID" {
+		t.Fatalf("want PAID got %s", snap.Current)
+	}
+	if _, err := store.LoadVersion(ctx, "o1", 1); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	if snap, err := store.Load(ctx, "o1"); err != nil || snap.Current != "SHIPPED" {
+		t.Fatalf("latest snapshot %v %v", snap, err)
+	}
+
+	// a conflicting save writes neither the snapshot nor its version
+	stale := New(db)
+	if _, err := stale.SaveVersion(ctx, "o1", &rfsm.Snapshot{Current: "NEW"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+	if vs, err := store.ListVersions(ctx, "o1"); err != nil || len(vs) != 2 {
+		t.Fatalf("want 2 versions got %v %v", vs, err)
+	}
+	if vs, err := store.ListVersions(ctx, "o2"); err != nil || len(vs) != 0 {
+		t.Fatalf("want no versions got %v %v", vs, err)
+	}
+}
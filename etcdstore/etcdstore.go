@@ -0,0 +1,199 @@
+// Package etcdstore implements rfsm.Store on etcd, with optimistic concurrency and lease-based
+// ownership of machines, e.g. for Kubernetes operators that already run etcd.
+//
+// The snapshot of a machine is stored as JSON under "<prefix>snapshots/<machine id>". A Store
+// remembers the mod revision of every key it loaded or saved, and a Save is a transaction that
+// only puts the snapshot if the key still has that revision, so when two workers restore the
+// same machine, the second to persist a transition gets ErrConflict instead of overwriting the
+// first.
+//
+// A worker owns a machine while "<prefix>owners/<machine id>" holds its name, attached to a
+// lease the worker keeps alive (see WithOwner). When the worker releases the machine or dies
+// and its lease expires, the key is deleted, and WatchReleased tells the other workers, which
+// Claim the machine and rehydrate it:
+//
+//	store := etcdstore.New(kv, etcdstore.WithOwner(podName, int64(session.Lease())))
+//	go store.WatchReleased(ctx, func(id string) {
+//		if ok, err := store.Claim(ctx, id); err == nil && ok {
+//			snap, _ := store.Load(ctx, id)
+//			// restore the machine from snap and run it here
+//		}
+//	})
+//
+// The package does not depend on the etcd client; wrap a clientv3.Client in a KV, e.g. for
+// CompareAndPut:
+//
+//	func (c kv) CompareAndPut(ctx context.Context, key, value string, rev, lease int64) (int64, bool, error) {
+//		resp, err := c.cli.Txn(ctx).
+//			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+//			Then(clientv3.OpPut(key, value, clientv3.WithLease(clientv3.LeaseID(lease)))).
+//			Commit()
+//		if err != nil || !resp.Succeeded {
+//			return 0, false, err
+//		}
+//		return resp.Header.Revision, true, nil
+//	}
+package etcdstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/noru/rfsm"
+)
+
+// ErrConflict is returned by Save when the stored snapshot changed since this Store loaded or
+// saved it, or when it saves a new id that another Store created meanwhile.
+var ErrConflict = errors.New("snapshot was modified concurrently")
+
+// ErrNoOwner is returned by Claim and Release on a Store without WithOwner.
+var ErrNoOwner = errors.New("store has no owner name")
+
+// KV is the subset of an etcd client used by Store.
+type KV interface {
+	// Get returns the value and mod revision of key, or a revision of 0 if it does not exist.
+	Get(ctx context.Context, key string) (string, int64, error)
+	// CompareAndPut puts value under key, attached to lease if it is not 0, if the mod revision
+	// of key is rev, 0 meaning that key does not exist. It returns the new mod revision, or
+	// false if the comparison failed.
+	CompareAndPut(ctx context.Context, key, value string, rev, lease int64) (int64, bool, error)
+	// CompareAndDelete deletes key if its mod revision is rev, reporting false otherwise.
+	CompareAndDelete(ctx context.Context, key string, rev int64) (bool, error)
+	// WatchDeletes returns the keys under prefix deleted from now on, until ctx is done and
+	// the channel is closed.
+	WatchDeletes(ctx context.Context, prefix string) <-chan string
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithPrefix sets the key prefix, "/rfsm/" by default.
+func WithPrefix(prefix string) Option {
+	return func(s *Store) { s.prefix = prefix }
+}
+
+// WithOwner names the worker the Store claims machines for, and the etcd lease its claims are
+// attached to; keep the lease alive while the worker runs, e.g. with a concurrency.Session.
+func WithOwner(name string, lease int64) Option {
+	return func(s *Store) { s.owner, s.lease = name, lease }
+}
+
+// Store is an rfsm.Store backed by etcd.
+type Store struct {
+	kv     KV
+	prefix string
+	owner  string
+	lease  int64
+
+	mu        sync.Mutex
+	revisions map[string]int64
+}
+
+var _ rfsm.Store = (*Store)(nil)
+
+// New creates a Store on kv.
+func New(kv KV, opts ...Option) *Store {
+	s := &Store{kv: kv, prefix: "/rfsm/", revisions: make(map[string]int64)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Load returns the snapshot stored under id and remembers its revision for the next Save.
+func (s *Store) Load(ctx context.Context, id string) (*rfsm.Snapshot, error) {
+	data, rev, err := s.kv.Get(ctx, s.snapshotKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if rev == 0 {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	var snap rfsm.Snapshot
+	if err := json.Unmarshal([]byte(data), &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q: %w", id, err)
+	}
+	s.remember(id, rev)
+	return &snap, nil
+}
+
+// Save stores snap under id if the key is still at the revision this Store last saw, creating
+// it if this Store never saw id. It returns ErrConflict otherwise.
+func (s *Store) Save(ctx context.Context, id string, snap *rfsm.Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	rev := s.revisions[id]
+	s.mu.Unlock()
+	rev, ok, err := s.kv.CompareAndPut(ctx, s.snapshotKey(id), string(data), rev, 0)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrConflict
+	}
+	s.remember(id, rev)
+	return nil
+}
+
+// remember records rev as the one the next Save of id expects.
+func (s *Store) remember(id string, rev int64) {
+	s.mu.Lock()
+	s.revisions[id] = rev
+	s.mu.Unlock()
+}
+
+// Claim makes the Store's owner the owner of id, unless another worker owns it. It reports
+// whether the owner of id is now the Store's.
+func (s *Store) Claim(ctx context.Context, id string) (bool, error) {
+	if s.owner == "" {
+		return false, ErrNoOwner
+	}
+	key := s.ownerKey(id)
+	owner, rev, err := s.kv.Get(ctx, key)
+	if err != nil || rev != 0 {
+		return err == nil && owner == s.owner, err
+	}
+	_, ok, err := s.kv.CompareAndPut(ctx, key, s.owner, 0, s.lease)
+	return ok, err
+}
+
+// Owner returns the worker owning id, or "" if none does.
+func (s *Store) Owner(ctx context.Context, id string) (string, error) {
+	owner, _, err := s.kv.Get(ctx, s.ownerKey(id))
+	return owner, err
+}
+
+// Release gives up the ownership of id, if the Store's owner has it, so another worker can
+// claim it.
+func (s *Store) Release(ctx context.Context, id string) error {
+	if s.owner == "" {
+		return ErrNoOwner
+	}
+	key := s.ownerKey(id)
+	owner, rev, err := s.kv.Get(ctx, key)
+	if err != nil || rev == 0 || owner != s.owner {
+		return err
+	}
+	_, err = s.kv.CompareAndDelete(ctx, key, rev)
+	return err
+}
+
+// WatchReleased calls fn with every machine id whose owner released it or lost its lease,
+// until ctx is done.
+func (s *Store) WatchReleased(ctx context.Context, fn func(id string)) {
+	prefix := s.prefix + "owners/"
+	for key := range s.kv.WatchDeletes(ctx, prefix) {
+		fn(strings.TrimPrefix(key, prefix))
+	}
+}
+
+func (s *Store) snapshotKey(id string) string { return s.prefix + "snapshots/" + id }
+
+func (s *Store) ownerKey(id string) string { return s.prefix + "owners/" + id }
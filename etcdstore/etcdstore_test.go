@@ -0,0 +1,254 @@
+package etcdstore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+type fakeEntry struct {
+	value string
+	rev   int64
+	lease int64
+}
+
+type fakeWatch struct {
+	prefix string
+	ch     chan string
+}
+
+// fakeEtcd is an in-memory KV with revisions, leases and delete watches.
+type fakeEtcd struct {
+	mu      sync.Mutex
+	rev     int64
+	keys    map[string]fakeEntry
+	watches []fakeWatch
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{keys: map[string]fakeEntry{}}
+}
+
+func (f *fakeEtcd) Get(_ context.Context, key string) (string, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e := f.keys[key]
+	return e.value, e.rev, nil
+}
+
+func (f *fakeEtcd) CompareAndPut(_ context.Context, key, value string, rev, lease int64) (int64, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.keys[key].rev != rev {
+		return 0, false, nil
+	}
+	f.rev++
+	f.keys[key] = fakeEntry{value: value, rev: f.rev, lease: lease}
+	return f.rev, true, nil
+}
+
+func (f *fakeEtcd) CompareAndDelete(_ context.Context, key string, rev int64) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if e, ok := f.keys[key]; !ok || e.rev != rev {
+		return false, nil
+	}
+	f.delete(key)
+	return true, nil
+}
+
+// expire drops the keys attached to lease, as etcd does once it is not kept alive.
+func (f *fakeEtcd) expire(lease int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, e := range f.keys {
+		if e.lease == lease {
+			f.delete(key)
+		}
+	}
+}
+
+func (f *fakeEtcd) delete(key string) {
+	f.rev++
+	delete(f.keys, key)
+	for _, w := range f.watches {
+		if strings.HasPrefix(key, w.prefix) {
+			w.ch <- key
+		}
+	}
+}
+
+func (f *fakeEtcd) WatchDeletes(ctx context.Context, prefix string) <-chan string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	in := make(chan string, 16)
+	f.watches = append(f.watches, fakeWatch{prefix: prefix, ch: in})
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case key := <-in:
+				select {
+				case out <- key:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func TestStore(t *testing.T) {
+	def, err := rfsm.NewDef("job").
+		State("PENDING", rfsm.WithInitial()).
+		State("RUNNING").
+		State("DONE", rfsm.WithFinal()).
+		Current("PENDING").
+		On("run", "PENDING", "RUNNING").
+		On("finish", "RUNNING", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := newFakeEtcd()
+	ctx := context.Background()
+	worker1, worker2 := New(kv), New(kv)
+	if _, err := worker1.Load(ctx, "j1"); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(worker1, "j1"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(rfsm.Event{Name: "run"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+	if _, ok := kv.keys["/rfsm/snapshots/j1"]; !ok {
+		t.Fatalf("snapshot not stored, keys %v", kv.keys)
+	}
+
+	// both workers restore the machine; the second to persist loses
+	restore := func(store *Store) *rfsm.Machine[any] {
+		snap, err := store.Load(ctx, "j1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(store, "j1"))
+		if err := m.RestoreSnapshot(snap, 0); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m1, m2 := restore(worker1), restore(worker2)
+	defer m1.Stop()
+	defer m2.Stop()
+	if err := m1.Dispatch(rfsm.Event{Name: "finish"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.Dispatch(rfsm.Event{Name: "finish"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+	if snap, err := worker2.Load(ctx, "j1"); err != nil || snap.Current != "DONE" {
+		t.Fatalf("latest snapshot %v %v", snap, err)
+	}
+
+	// a new id created by another store meanwhile conflicts too
+	if err := worker1.Save(ctx, "j2", &rfsm.Snapshot{Current: "PENDING"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker2.Save(ctx, "j2", &rfsm.Snapshot{Current: "PENDING"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+	if _, err := worker1.Claim(ctx, "j1"); !errors.Is(err, ErrNoOwner) {
+		t.Fatalf("want ErrNoOwner got %v", err)
+	}
+}
+
+func TestStore_Ownership(t *testing.T) {
+	kv := newFakeEtcd()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pod1 := New(kv, WithPrefix("/jobs/"), WithOwner("pod-1", 1))
+	pod2 := New(kv, WithPrefix("/jobs/"), WithOwner("pod-2", 2))
+	if err := pod1.Save(ctx, "j1", &rfsm.Snapshot{Current: "RUNNING"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := pod1.Claim(ctx, "j1"); err != nil || !ok {
+		t.Fatalf("pod-1 should claim j1: %v %v", ok, err)
+	}
+	if ok, err := pod1.Claim(ctx, "j1"); err != nil || !ok {
+		t.Fatalf("claiming an owned machine again should succeed: %v %v", ok, err)
+	}
+	if ok, err := pod2.Claim(ctx, "j1"); err != nil || ok {
+		t.Fatalf("pod-2 should not claim j1: %v %v", ok, err)
+	}
+	if err := pod2.Release(ctx, "j1"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, err := pod1.Owner(ctx, "j1"); err != nil || owner != "pod-1" {
+		t.Fatalf("releasing another worker's machine should not change its owner, got %q %v", owner, err)
+	}
+
+	// pod-2 takes over j1 once pod-1 dies
+	rehydrated := make(chan rfsm.StateID, 1)
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		pod2.WatchReleased(watchCtx, func(id string) {
+			if ok, err := pod2.Claim(ctx, id); err != nil || !ok {
+				return
+			}
+			snap, err := pod2.Load(ctx, id)
+			if err == nil {
+				rehydrated <- snap.Current
+			}
+		})
+	}()
+	// wait for the watch to open
+	for deadline := time.Now().Add(time.Second); ; {
+		kv.mu.Lock()
+		n := len(kv.watches)
+		kv.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watch not opened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	kv.expire(1)
+	select {
+	case current := <-rehydrated:
+		if current != "RUNNING" {
+			t.Fatalf("want RUNNING got %s", current)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("j1 was not taken over")
+	}
+	if owner, err := pod1.Owner(ctx, "j1"); err != nil || owner != "pod-2" {
+		t.Fatalf("want pod-2 to own j1 got %q %v", owner, err)
+	}
+	stopWatch()
+	<-watching
+	if err := pod2.Release(ctx, "j1"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, err := pod1.Owner(ctx, "j1"); err != nil || owner != "" {
+		t.Fatalf("want no owner got %q %v", owner, err)
+	}
+	if ok, err := pod1.Claim(ctx, "j1"); err != nil || !ok {
+		t.Fatalf("a released machine should be claimable: %v %v", ok, err)
+	}
+}
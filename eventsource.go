@@ -0,0 +1,206 @@
+package rfsm
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// EventRecord is an accepted event appended to an EventStore.
+type EventRecord struct {
+	Seq   uint64    `json:"seq"`
+	Event Event     `json:"event"`
+	Time  time.Time `json:"time"`
+}
+
+// EventStore persists the events accepted by a machine, in order, so its state can be rebuilt
+// with ReplayFrom. Event args must be encodable by the store's backend.
+type EventStore interface {
+	// Append stores r and returns the sequence number assigned to it.
+	Append(r EventRecord) (uint64, error)
+	// Events returns all stored records in sequence order.
+	Events() ([]EventRecord, error)
+}
+
+// CompactableEventStore is an EventStore whose oldest records can be folded into a snapshot,
+// see Machine.CompactEvents.
+type CompactableEventStore interface {
+	EventStore
+	// Compact records snap as the state reached after record upTo and drops the records up to
+	// upTo that keep does not retain. Events keeps returning the retained ones.
+	Compact(snap *Snapshot, upTo uint64, keep Retention) error
+	// Base returns the snapshot of the last Compact and its record number, or nil and 0.
+	Base() (*Snapshot, uint64, error)
+}
+
+// WithEventStore appends every event whose transitions succeeded, including events raised
+// with Raise, to store before Dispatch returns. If the append fails, the transition stands
+// and Dispatch returns the store's error.
+func WithEventStore(store EventStore) MachineOption {
+	return func(c *machineConfig) { c.eventStore = store }
+}
+
+// replay modes, see ReplayFrom
+const (
+	replayOff int32 = iota
+	replayOn
+	replaySkipEffects
+)
+
+// ReplayFrom starts the stopped machine and rebuilds its state by dispatching the events of
+// store with a sequence number up to upTo (all if upTo is 0), without appending them again.
+// Events raised by actions are dropped, as they were recorded themselves. With skipEffects,
+// actions and entry/exit hooks are not run; guards always are, and must be deterministic.
+// If an event fails, replay stops there and the error is returned; the machine keeps running
+// in the state reached. If store was compacted, the machine is restored from its base snapshot
+// and only later events are dispatched; upTo cannot precede the base.
+func (m *Machine[C]) ReplayFrom(store EventStore, upTo uint64, skipEffects bool) error {
+	m.statusMu.RLock()
+	busy := m.started || m.starting
+	m.statusMu.RUnlock()
+	if busy {
+		return fmt.Errorf("replay requires a stopped machine")
+	}
+	var base *Snapshot
+	var baseSeq uint64
+	if cs, ok := store.(CompactableEventStore); ok {
+		var err error
+		if base, baseSeq, err = cs.Base(); err != nil {
+			return err
+		}
+		if upTo > 0 && upTo < baseSeq {
+			return fmt.Errorf("events up to %d were compacted", baseSeq)
+		}
+	}
+	records, err := store.Events()
+	if err != nil {
+		return err
+	}
+	mode := replayOn
+	if skipEffects {
+		mode = replaySkipEffects
+	}
+	m.replay.Store(mode)
+	defer m.replay.Store(replayOff)
+	if base != nil {
+		err = m.RestoreSnapshot(base, 0)
+	} else {
+		err = m.Start()
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if r.Seq <= baseSeq {
+			continue
+		}
+		if upTo > 0 && r.Seq > upTo {
+			break
+		}
+		if err := m.Dispatch(r.Event); err != nil {
+			return fmt.Errorf("replay of event %d (%s): %w", r.Seq, r.Event.Name, err)
+		}
+	}
+	return nil
+}
+
+// CompactEvents folds the records of the machine's event store, which must implement
+// CompactableEventStore, into a snapshot of its current state, so ReplayFrom restores that
+// and replays only later events. The folded records are kept as long as keep allows, e.g. for
+// auditing. A running machine is paused meanwhile, so no event is handled in between.
+func (m *Machine[C]) CompactEvents(keep Retention) error {
+	store, ok := m.eventStore.(CompactableEventStore)
+	if !ok {
+		return fmt.Errorf("event store does not support compaction")
+	}
+	if !m.Paused() && m.Pause() == nil {
+		defer m.Resume()
+	}
+	records, err := store.Events()
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	return store.Compact(m.Snapshot(), records[len(records)-1].Seq, keep)
+}
+
+// skipEffects reports whether actions and hooks are suppressed by ReplayFrom.
+func (m *Machine[C]) skipEffects() bool { return m.replay.Load() == replaySkipEffects }
+
+// appendEvent records an accepted event in the machine's event store, if any.
+func (m *Machine[C]) appendEvent(e Event) error {
+	if m.eventStore == nil || m.replay.Load() != replayOff {
+		return nil
+	}
+	_, err := m.eventStore.Append(EventRecord{Event: userEvent(e), Time: time.Now()})
+	return err
+}
+
+// MemoryEventStore is an in-memory CompactableEventStore, useful for tests and as a reference
+// implementation.
+type MemoryEventStore struct {
+	mu      sync.Mutex
+	records []EventRecord
+	last    uint64 // sequence number of the last record appended
+	base    []byte // JSON snapshot of the last Compact
+	baseSeq uint64
+}
+
+var _ CompactableEventStore = (*MemoryEventStore)(nil)
+
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{}
+}
+
+func (s *MemoryEventStore) Append(r EventRecord) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last++
+	r.Seq = s.last
+	r.Event.Args = append([]any(nil), r.Event.Args...)
+	s.records = append(s.records, r)
+	return r.Seq, nil
+}
+
+func (s *MemoryEventStore) Events() ([]EventRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]EventRecord(nil), s.records...), nil
+}
+
+func (s *MemoryEventStore) Compact(snap *Snapshot, upTo uint64, keep Retention) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if upTo < s.baseSeq || upTo > s.last {
+		return fmt.Errorf("cannot compact up to record %d of %d, last compacted %d", upTo, s.last, s.baseSeq)
+	}
+	folded := make([]StoredVersion, 0, len(s.records))
+	for _, r := range s.records {
+		if r.Seq > upTo {
+			break
+		}
+		folded = append(folded, StoredVersion{Version: int64(r.Seq), SavedAt: r.Time})
+	}
+	s.records = slices.Delete(s.records, 0, keep.Expired(folded, time.Now()))
+	s.base, s.baseSeq = data, upTo
+	return nil
+}
+
+func (s *MemoryEventStore) Base() (*Snapshot, uint64, error) {
+	s.mu.Lock()
+	data, seq := s.base, s.baseSeq
+	s.mu.Unlock()
+	if data == nil {
+		return nil, 0, nil
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, 0, err
+	}
+	return &snap, seq, nil
+}
@@ -0,0 +1,151 @@
+package rfsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type failingEventStore struct{ MemoryEventStore }
+
+func (s *failingEventStore) Append(EventRecord) (uint64, error) { return 0, errors.New("disk full") }
+
+func TestEventSourcing(t *testing.T) {
+	var actions, entries int
+	def, err := NewDef("orders").
+		State("NEW", WithInitial()).
+		State("PAID", WithEntry[any](func(e Event, ctx any) error { entries++; return nil })).
+		State("SHIPPED").
+		State("DONE", WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID", WithActionCtx[any](func(cx context.Context, e Event, ctx any) error {
+			actions++
+			return Raise(cx, Event{Name: "ship"})
+		})).
+		On("ship", "PAID", "SHIPPED").
+		On("close", "SHIPPED", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryEventStore()
+	m := NewMachine[any](def, nil, WithEventStore(store))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "close"}); !errors.Is(err, ErrNoTransition) {
+		t.Fatalf("want ErrNoTransition got %v", err)
+	}
+	if err := m.Dispatch(Event{Name: "pay", Args: []any{42}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "close"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+	records, _ := store.Events()
+	if len(records) != 3 || records[0].Event.Name != "pay" || records[1].Event.Name != "ship" || records[2].Seq != 3 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	if len(records[0].Event.Args) != 1 || records[0].Event.Args[0] != 42 {
+		t.Fatalf("internal args leaked into the store: %v", records[0].Event.Args)
+	}
+
+	// replay without effects, up to the raised event
+	actions, entries = 0, 0
+	r := NewMachine[any](def, nil, WithEventStore(store))
+	if err := r.ReplayFrom(store, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != "SHIPPED" || actions != 0 || entries != 0 {
+		t.Fatalf("want SHIPPED without effects, got %s actions=%d entries=%d", r.Current(), actions, entries)
+	}
+	if err := r.ReplayFrom(store, 0, true); err == nil {
+		t.Fatal("want error replaying a running machine")
+	}
+	_ = r.Stop()
+	if n, _ := store.Events(); len(n) != 3 {
+		t.Fatalf("replay appended to the store: %d records", len(n))
+	}
+
+	// full replay with effects; the raised event is not raised twice
+	r = NewMachine[any](def, nil)
+	if err := r.ReplayFrom(store, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+	if r.Current() != "DONE" || actions != 1 || entries != 1 {
+		t.Fatalf("want DONE with effects once, got %s actions=%d entries=%d", r.Current(), actions, entries)
+	}
+
+	f := NewMachine[any](def, nil, WithEventStore(&failingEventStore{}))
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Stop()
+	if err := f.Dispatch(Event{Name: "pay"}); err == nil || f.Current() != "SHIPPED" {
+		t.Fatalf("want the store error after the transition, got %v at %s", err, f.Current())
+	}
+}
+
+func TestCompactEvents(t *testing.T) {
+	var actions int
+	def, err := NewDef("orders").
+		State("NEW", WithInitial()).
+		State("PAID").
+		State("SHIPPED").
+		State("DONE", WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID", WithAction[any](func(e Event, ctx any) error { actions++; return nil })).
+		On("ship", "PAID", "SHIPPED").
+		On("close", "SHIPPED", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryEventStore()
+	m := NewMachine[any](def, nil, WithEventStore(store))
+	if err := NewMachine[any](def, nil).CompactEvents(Retention{}); err == nil {
+		t.Fatal("want error without a compactable event store")
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []EventID{"pay", "ship"} {
+		if err := m.Dispatch(Event{Name: e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.CompactEvents(Retention{MaxVersions: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Paused() {
+		t.Fatal("CompactEvents should resume the machine")
+	}
+	if err := m.Dispatch(Event{Name: "close"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+
+	records, _ := store.Events()
+	if len(records) != 2 || records[0].Seq != 2 || records[1].Seq != 3 {
+		t.Fatalf("want the last folded record and the tail, got %v", records)
+	}
+	if snap, seq, err := store.Base(); err != nil || seq != 2 || snap.Current != "SHIPPED" {
+		t.Fatalf("unexpected base %v %d %v", snap, seq, err)
+	}
+
+	actions = 0
+	r := NewMachine[any](def, nil)
+	if err := r.ReplayFrom(store, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if r.Current() != "DONE" || actions != 0 {
+		t.Fatalf("want DONE without replaying compacted events, got %s actions=%d", r.Current(), actions)
+	}
+	_ = r.Stop()
+	if err := NewMachine[any](def, nil).ReplayFrom(store, 1, true); err == nil {
+		t.Fatal("want error replaying up to a compacted event")
+	}
+}
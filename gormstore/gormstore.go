@@ -0,0 +1,82 @@
+// Package gormstore persists machines through a GORM connection, for applications already
+// using GORM:
+//
+//	store, err := gormstore.Open(ctx, gormDB)
+//	m := rfsm.NewMachine(def, order, rfsm.WithAutoPersist(store, orderID))
+//
+// Open takes the database/sql pool under the *gorm.DB, creates the snapshot, version and inbox
+// tables if they do not exist and returns a sqlstore.Store on them, so the store has the
+// optimistic locking, history and inbox of sqlstore. It uses $1, $2, ... parameters when the
+// GORM dialector is PostgreSQL.
+//
+// Snapshot, Version and InboxEntry are GORM models of the default tables, to query them with
+// GORM or to migrate them with the rest of the schema instead of in Open:
+//
+//	err := gormDB.AutoMigrate(&gormstore.Snapshot{}, &gormstore.Version{}, &gormstore.InboxEntry{})
+//
+// The package does not depend on GORM; a *gorm.DB is a DB.
+package gormstore
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/noru/rfsm/sqlstore"
+)
+
+// DB is the subset of a *gorm.DB used by Open.
+type DB interface {
+	// DB returns the underlying connection pool.
+	DB() (*sql.DB, error)
+	// Name returns the name of the dialector, e.g. "postgres" or "mysql".
+	Name() string
+}
+
+// Open creates the tables of a sqlstore.Store on the connection pool of db, if they do not
+// exist, and returns the Store.
+func Open(ctx context.Context, db DB, opts ...sqlstore.Option) (*sqlstore.Store, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if db.Name() == "postgres" {
+		opts = append([]sqlstore.Option{sqlstore.WithDollarParams()}, opts...)
+	}
+	store := sqlstore.New(sqlDB, opts...)
+	if err := store.CreateTable(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Snapshot is the GORM model of the snapshot table: the latest snapshot of each machine as
+// JSON, with the version Save compares.
+type Snapshot struct {
+	ID       string `gorm:"primaryKey;size:255"`
+	Version  int64  `gorm:"not null"`
+	Snapshot string `gorm:"type:text;not null"`
+}
+
+// TableName returns the default table of sqlstore.
+func (Snapshot) TableName() string { return "rfsm_snapshots" }
+
+// Version is the GORM model of the version table, written by SaveVersion.
+type Version struct {
+	ID       string `gorm:"primaryKey;size:255"`
+	Version  int64  `gorm:"primaryKey;autoIncrement:false"`
+	SavedAt  int64  `gorm:"not null"` // Unix nanoseconds
+	Snapshot string `gorm:"type:text;not null"`
+}
+
+// TableName returns the default version table of sqlstore.
+func (Version) TableName() string { return "rfsm_snapshots_versions" }
+
+// InboxEntry is the GORM model of the inbox table, see sqlstore.WithInboxEvent.
+type InboxEntry struct {
+	ID          string `gorm:"primaryKey;size:255"`
+	EventID     string `gorm:"primaryKey;size:255"`
+	ProcessedAt int64  `gorm:"not null"` // Unix nanoseconds
+}
+
+// TableName returns the default inbox table of sqlstore.
+func (InboxEntry) TableName() string { return "rfsm_snapshots_inbox" }
@@ -0,0 +1,94 @@
+package gormstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/noru/rfsm"
+	"github.com/noru/rfsm/sqlstore"
+)
+
+// fakeDriver records the statements it runs and succeeds at all of them.
+type fakeDriver struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d}, nil }
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c fakeConn) Prepare(q string) (driver.Stmt, error) { return fakeStmt{c.d, q}, nil }
+func (c fakeConn) Close() error                          { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)             { return nil, errors.New("not supported") }
+
+type connector struct{ d *fakeDriver }
+
+func (c connector) Connect(context.Context) (driver.Conn, error) { return fakeConn{c.d}, nil }
+func (c connector) Driver() driver.Driver                        { return c.d }
+
+type fakeStmt struct {
+	d *fakeDriver
+	q string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.queries = append(s.d.queries, s.q)
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+// fakeGorm stands in for a *gorm.DB.
+type fakeGorm struct {
+	db      *sql.DB
+	dialect string
+}
+
+func (g fakeGorm) DB() (*sql.DB, error) { return g.db, nil }
+func (g fakeGorm) Name() string         { return g.dialect }
+
+func TestOpen(t *testing.T) {
+	for _, tc := range []struct {
+		dialect, insert string
+	}{
+		{"postgres", "INSERT INTO orders (id, version, snapshot) VALUES ($1, 1, $2)"},
+		{"mysql", "INSERT INTO orders (id, version, snapshot) VALUES (?, 1, ?)"},
+	} {
+		t.Run(tc.dialect, func(t *testing.T) {
+			d := &fakeDriver{}
+			db := sql.OpenDB(connector{d})
+			defer db.Close()
+			store, err := Open(context.Background(), fakeGorm{db, tc.dialect}, sqlstore.WithTable("orders"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Save(context.Background(), "o1", &rfsm.Snapshot{Current: "NEW"}); err != nil {
+				t.Fatal(err)
+			}
+			if len(d.queries) != 4 {
+				t.Fatalf("want 3 tables created and 1 insert got %q", d.queries)
+			}
+			for _, q := range d.queries[:3] {
+				if !strings.HasPrefix(q, "CREATE TABLE IF NOT EXISTS orders") {
+					t.Fatalf("want the tables created got %q", q)
+				}
+			}
+			if d.queries[3] != tc.insert {
+				t.Fatalf("want %q got %q", tc.insert, d.queries[3])
+			}
+		})
+	}
+}
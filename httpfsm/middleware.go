@@ -0,0 +1,146 @@
+// Package httpfsm models the lifecycle of an HTTP request as an rfsm state machine.
+//
+// Each request runs its own machine through AUTHN -> VALIDATE -> HANDLE -> RESPOND,
+// moving to ERROR when authentication or validation fails. The machine only tracks the
+// lifecycle: the phases and the wrapped handler run on the request goroutine, so handler
+// panics, including http.ErrAbortHandler, reach net/http as they would without it:
+//
+//	h := httpfsm.Middleware(httpfsm.Phases{Authenticate: checkToken})(mux)
+package httpfsm
+
+import (
+	"errors"
+	"net/http"
+
+	rfsm "github.com/noru/rfsm"
+)
+
+// Lifecycle states
+const (
+	StateAuthN    rfsm.StateID = "AUTHN"
+	StateValidate rfsm.StateID = "VALIDATE"
+	StateHandle   rfsm.StateID = "HANDLE"
+	StateRespond  rfsm.StateID = "RESPOND"
+	StateError    rfsm.StateID = "ERROR"
+)
+
+// Lifecycle events
+const (
+	EventAuthenticated = "authenticated"
+	EventValidated     = "validated"
+	EventHandled       = "handled"
+	EventFail          = "fail"
+)
+
+// Phases are the per-phase hooks of the lifecycle. Nil phases pass through.
+type Phases struct {
+	// Authenticate runs in AUTHN; an error moves the request to ERROR.
+	Authenticate func(r *http.Request) error
+	// Validate runs in VALIDATE; an error moves the request to ERROR.
+	Validate func(r *http.Request) error
+	// OnRespond runs once the request is in RESPOND, after the wrapped handler returned.
+	OnRespond func(r *http.Request)
+	// OnError renders the error response once the request is in ERROR. The default writes
+	// 401 for authentication and 400 for validation failures with the status text only, so
+	// phase errors, which may carry internal details, do not reach the client.
+	OnError func(w http.ResponseWriter, r *http.Request, failed rfsm.StateID, err error)
+}
+
+// Request is the state context of a per-request machine.
+type Request struct {
+	W      http.ResponseWriter
+	R      *http.Request
+	Err    error        // failure that moved the request to ERROR
+	Failed rfsm.StateID // state in which the failure occurred
+}
+
+// Definition returns the request lifecycle definition.
+func Definition() *rfsm.Definition {
+	def, err := rfsm.NewDef("http_request").
+		State(StateAuthN, rfsm.WithInitial()).
+		State(StateValidate).
+		State(StateHandle).
+		State(StateRespond, rfsm.WithFinal()).
+		State(StateError, rfsm.WithFinal()).
+		Current(StateAuthN).
+		On(EventAuthenticated, StateAuthN, StateValidate).
+		On(EventValidated, StateValidate, StateHandle).
+		On(EventHandled, StateHandle, StateRespond).
+		On(EventFail, StateAuthN, StateError).
+		On(EventFail, StateValidate, StateError).
+		Build()
+	if err != nil {
+		panic(err) // static definition
+	}
+	return def
+}
+
+// Middleware wraps next so every request is driven through the lifecycle machine.
+func Middleware(p Phases) func(http.Handler) http.Handler {
+	def := Definition()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req := &Request{W: w, R: r}
+			m := rfsm.NewMachine(def, req)
+			if err := m.Start(); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			defer m.Stop()
+			if err := run(m, req, p, next); err != nil && !errors.Is(err, errPhaseFailed) {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		})
+	}
+}
+
+var errPhaseFailed = errors.New("phase failed")
+
+// run drives the machine through the lifecycle, running each phase and the handler on the
+// calling goroutine once the machine is in the matching state.
+func run(m *rfsm.Machine[*Request], req *Request, p Phases, next http.Handler) error {
+	steps := []struct {
+		state rfsm.StateID
+		phase func(*http.Request) error
+		event string
+	}{
+		{StateAuthN, p.Authenticate, EventAuthenticated},
+		{StateValidate, p.Validate, EventValidated},
+	}
+	for _, s := range steps {
+		if s.phase != nil {
+			if err := s.phase(req.R); err != nil {
+				req.Err, req.Failed = err, s.state
+				if derr := m.Dispatch(rfsm.Event{Name: EventFail}); derr != nil {
+					return derr
+				}
+				writeError(req, p)
+				return errPhaseFailed
+			}
+		}
+		if err := m.Dispatch(rfsm.Event{Name: s.event}); err != nil {
+			return err
+		}
+	}
+	next.ServeHTTP(req.W, req.R)
+	if err := m.Dispatch(rfsm.Event{Name: EventHandled}); err != nil {
+		return err
+	}
+	if p.OnRespond != nil {
+		p.OnRespond(req.R)
+	}
+	return nil
+}
+
+// writeError writes the response of a request that moved to ERROR.
+func writeError(req *Request, p Phases) {
+	if p.OnError != nil {
+		p.OnError(req.W, req.R, req.Failed, req.Err)
+		return
+	}
+	code := http.StatusBadRequest
+	if req.Failed == StateAuthN {
+		code = http.StatusUnauthorized
+	}
+	http.Error(req.W, http.StatusText(code), code)
+}
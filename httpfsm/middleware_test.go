@@ -0,0 +1,88 @@
+package httpfsm
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	rfsm "github.com/noru/rfsm"
+)
+
+func TestMiddleware_Lifecycle(t *testing.T) {
+	var responded int
+	phases := Phases{
+		Authenticate: func(r *http.Request) error {
+			if r.Header.Get("Authorization") == "" {
+				return errors.New("token store at 10.0.0.7 unreachable")
+			}
+			return nil
+		},
+		Validate: func(r *http.Request) error {
+			if r.URL.Query().Get("id") == "" {
+				return errors.New("missing id")
+			}
+			return nil
+		},
+		OnRespond: func(r *http.Request) { responded++ },
+	}
+	h := Middleware(phases)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	cases := []struct {
+		name string
+		auth string
+		url  string
+		code int
+		body string
+	}{
+		{"unauthenticated", "", "/?id=1", http.StatusUnauthorized, "Unauthorized\n"},
+		{"invalid", "token", "/", http.StatusBadRequest, "Bad Request\n"},
+		{"ok", "token", "/?id=1", http.StatusTeapot, ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, c.url, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Fatalf("%s: want %d got %d", c.name, c.code, rec.Code)
+		}
+		if rec.Body.String() != c.body {
+			t.Fatalf("%s: want body %q got %q", c.name, c.body, rec.Body.String())
+		}
+	}
+	if responded != 1 {
+		t.Fatalf("OnRespond want 1 call got %d", responded)
+	}
+}
+
+func TestMiddleware_OnError(t *testing.T) {
+	h := Middleware(Phases{
+		Validate: func(r *http.Request) error { return errors.New("missing id") },
+		OnError: func(w http.ResponseWriter, r *http.Request, failed rfsm.StateID, err error) {
+			http.Error(w, string(failed)+": "+err.Error(), http.StatusUnprocessableEntity)
+		},
+	})(http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusUnprocessableEntity || rec.Body.String() != "VALIDATE: missing id\n" {
+		t.Fatalf("want the renderer's response got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMiddleware_HandlerRunsOnRequestGoroutine(t *testing.T) {
+	h := Middleware(Phases{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Fatalf("want the handler's panic to reach the caller, got %v", r)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	t.Fatal("ServeHTTP should not return normally")
+}
@@ -0,0 +1,110 @@
+package rfsm
+
+import "sort"
+
+// internTable holds one canonical copy of every state or event name of a definition.
+// Names are indexed in sorted order so indices are stable for a given definition.
+type internTable struct {
+	names []string
+	index map[string]int
+}
+
+func newInternTable(ids map[string]struct{}) *internTable {
+	names := make([]string, 0, len(ids))
+	for id := range ids {
+		names = append(names, id)
+	}
+	sort.Strings(names)
+	index := make(map[string]int, len(names))
+	for i, n := range names {
+		index[n] = i
+	}
+	return &internTable{names: names, index: index}
+}
+
+// canonical returns the interned copy of s, or s itself if unknown.
+func (t *internTable) canonical(s string) string {
+	if i, ok := t.index[s]; ok {
+		return t.names[i]
+	}
+	return s
+}
+
+// intern rewrites every state and event reference in states/transitions to the canonical copy,
+// so machines sharing the definition do not hold duplicated string data.
+func intern(states map[StateID]StateDef, transitions map[TransitionKey][]TransitionDef) (map[StateID]StateDef, map[TransitionKey][]TransitionDef, *internTable, *internTable) {
+	stateSet := make(map[string]struct{}, len(states))
+	eventSet := make(map[string]struct{})
+	for id := range states {
+		stateSet[id] = struct{}{}
+	}
+	for k := range transitions {
+		eventSet[k.Event] = struct{}{}
+	}
+	st := newInternTable(stateSet)
+	ev := newInternTable(eventSet)
+
+	outStates := make(map[StateID]StateDef, len(states))
+	for id, s := range states {
+		s.ID = st.canonical(s.ID)
+		s.Parent = st.canonical(s.Parent)
+		s.InitialChild = st.canonical(s.InitialChild)
+		if len(s.Children) > 0 {
+			children := make([]StateID, len(s.Children))
+			for i, c := range s.Children {
+				children[i] = st.canonical(c)
+			}
+			s.Children = children
+		}
+		outStates[st.canonical(id)] = s
+	}
+	outTransitions := make(map[TransitionKey][]TransitionDef, len(transitions))
+	for k, alts := range transitions {
+		k = TransitionKey{From: st.canonical(k.From), Event: ev.canonical(k.Event)}
+		out := make([]TransitionDef, len(alts))
+		for i, t := range alts {
+			t.Key = k
+			t.To = st.canonical(t.To)
+			out[i] = t
+		}
+		outTransitions[k] = out
+	}
+	return outStates, outTransitions, st, ev
+}
+
+// StateIndex returns the interned index of a state, stable for the lifetime of the definition.
+// Indices are dense, from 0 to the number of states - 1, so callers can key their own tables by
+// them; machines still look transitions up by name.
+func (d *Definition) StateIndex(id StateID) (int, bool) {
+	return d.stateNames.lookup(id)
+}
+
+// EventIndex returns the interned index of an event name used by any transition.
+func (d *Definition) EventIndex(e EventID) (int, bool) {
+	return d.eventNames.lookup(e)
+}
+
+// StateName returns the state ID for an interned index; false if the index is out of range.
+func (d *Definition) StateName(i int) (StateID, bool) {
+	return d.stateNames.name(i)
+}
+
+// EventName returns the event name for an interned index; false if the index is out of range.
+func (d *Definition) EventName(i int) (EventID, bool) {
+	return d.eventNames.name(i)
+}
+
+func (t *internTable) lookup(s string) (int, bool) {
+	if t == nil {
+		return 0, false
+	}
+	i, ok := t.index[s]
+	return i, ok
+}
+
+func (t *internTable) name(i int) (string, bool) {
+	if t == nil || i < 0 || i >= len(t.names) {
+		return "", false
+	}
+	return t.names[i], true
+}
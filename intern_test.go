@@ -0,0 +1,63 @@
+package rfsm
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func TestIntern_IndicesAndSharedStrings(t *testing.T) {
+	// build IDs at runtime so the compiler cannot share literal backing arrays
+	a := strings.Repeat("A", 1)
+	b := strings.Repeat("B", 1)
+	def, err := NewDef("intern").
+		State(a, WithInitial()).
+		State(b, WithFinal()).
+		Current(strings.Repeat("A", 1)).
+		On("go", strings.Repeat("A", 1), strings.Repeat("B", 1)).
+		On("back", strings.Repeat("B", 1), strings.Repeat("A", 1)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ia, ok := def.StateIndex("A")
+	if name, found := def.StateName(ia); !ok || !found || name != "A" {
+		t.Fatalf("state index for A not found")
+	}
+	if _, ok := def.StateIndex("missing"); ok {
+		t.Fatalf("unexpected index for unknown state")
+	}
+	ie, ok := def.EventIndex("go")
+	if name, found := def.EventName(ie); !ok || !found || name != "go" {
+		t.Fatalf("event index for go not found")
+	}
+	for _, i := range []int{-1, 2} {
+		if _, ok := def.StateName(i); ok {
+			t.Fatalf("unexpected state for index %d", i)
+		}
+		if _, ok := def.EventName(i); ok {
+			t.Fatalf("unexpected event for index %d", i)
+		}
+	}
+	// definitions not built by a builder have no intern tables
+	if _, ok := new(Definition).StateName(0); ok {
+		t.Fatal("unexpected state name without intern table")
+	}
+	if _, ok := new(Definition).EventIndex("go"); ok {
+		t.Fatal("unexpected event index without intern table")
+	}
+
+	name, _ := def.StateName(ia)
+	canonical := unsafe.StringData(name)
+	if unsafe.StringData(def.Current) != canonical {
+		t.Fatalf("Current not interned")
+	}
+	if a, _ := def.State("A"); unsafe.StringData(a.ID) != canonical {
+		t.Fatalf("StateDef.ID not interned")
+	}
+	back := def.Transitions("B", "back")[0]
+	if unsafe.StringData(back.To) != canonical {
+		t.Fatalf("TransitionDef.To not interned")
+	}
+}
@@ -0,0 +1,63 @@
+package rfsm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ShadowedTransition reports an event handled both by a state and by one of its ancestors.
+// While Child is active the event is taken by Child's transition and never bubbles to
+// Ancestor's, unless the child transition uses WithPropagate. With RootFirst the roles are
+// reversed: Ancestor's transition wins.
+type ShadowedTransition struct {
+	Event    EventID
+	Child    StateID
+	Ancestor StateID
+}
+
+func (s ShadowedTransition) String() string {
+	return fmt.Sprintf("event %q on %q shadows the transition of its ancestor %q", s.Event, s.Child, s.Ancestor)
+}
+
+// ShadowedTransitions lists, sorted by child and event, every event name declared from both a
+// state and one of its ancestors where the transitions offered first do not all propagate.
+// Wildcard patterns are compared by name only. The result is meant for tests and linting;
+// such overrides are valid and Build does not reject them.
+func (d *Definition) ShadowedTransitions() []ShadowedTransition {
+	stops := func(alts []TransitionDef) bool {
+		for _, t := range alts {
+			if !t.Propagate {
+				return true
+			}
+		}
+		return false
+	}
+	var out []ShadowedTransition
+	for k, alts := range d.transitions {
+		path := d.pathTo(k.From)
+		for i := len(path) - 2; i >= 0; i-- {
+			outer := d.transitions[TransitionKey{From: path[i], Event: k.Event}]
+			if len(outer) == 0 {
+				continue
+			}
+			winner := alts
+			if d.BubbleOrder == RootFirst {
+				winner = outer
+			}
+			if stops(winner) {
+				out = append(out, ShadowedTransition{Event: k.Event, Child: k.From, Ancestor: path[i]})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Child != b.Child {
+			return a.Child < b.Child
+		}
+		if a.Event != b.Event {
+			return a.Event < b.Event
+		}
+		return a.Ancestor < b.Ancestor
+	})
+	return out
+}
@@ -0,0 +1,62 @@
+package rfsm
+
+import "testing"
+
+func TestShadowedTransitions(t *testing.T) {
+	inner, err := NewDef("inner").
+		State("X1", WithInitial()).
+		State("X2", WithFinal()).
+		Current("X1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := NewDef("sub").
+		State("A1", WithSubDef(inner), WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("stages").
+		State("A", WithSubDef(sub), WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("success", "A", "B").
+		On("success", "A1", "A2").
+		On("success", "X1", "X2").
+		On("retry", "A", "B").
+		On("retry", "X1", "X2", WithPropagate()).
+		On("next", "X1", "X2").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := def.ShadowedTransitions()
+	want := []ShadowedTransition{
+		{Event: "success", Child: "A1", Ancestor: "A"},
+		{Event: "success", Child: "X1", Ancestor: "A"},
+		{Event: "success", Child: "X1", Ancestor: "A1"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %v got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("want %v got %v", want, got)
+		}
+	}
+	// with RootFirst the propagating child no longer matters, the ancestor wins
+	rootFirst, err := def.Edit().BubbleOrder(RootFirst).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rootFirst.ShadowedTransitions(); len(got) != 4 || got[1] != (ShadowedTransition{Event: "retry", Child: "X1", Ancestor: "A"}) {
+		t.Fatalf("unexpected root-first shadowing %v", got)
+	}
+	if s := got[0].String(); s != `event "success" on "A1" shadows the transition of its ancestor "A"` {
+		t.Fatalf("unexpected message %s", s)
+	}
+}
@@ -1,7 +1,14 @@
 package rfsm
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Subscriber interface
@@ -9,79 +16,309 @@ type Subscriber interface {
 	OnTransition(from StateID, to StateID, e Event, err error)
 }
 
+// Optional subscriber interfaces. A Subscriber that also implements any of them is notified
+// of the corresponding step of every transition, on the event loop and before OnTransition.
+
+// StateEnteredSubscriber is notified after a state's entry hook succeeded, including states
+// re-entered while rolling back a failed transition.
+type StateEnteredSubscriber interface {
+	OnStateEntered(s StateID, e Event)
+}
+
+// StateExitedSubscriber is notified after a state's exit hook succeeded.
+type StateExitedSubscriber interface {
+	OnStateExited(s StateID, e Event)
+}
+
+// GuardRejectedSubscriber is notified whenever a guard returns false, with the state owning
+// the transition and the target it guarded. Next and AvailableEvents also evaluate guards to
+// find candidates.
+type GuardRejectedSubscriber interface {
+	OnGuardRejected(source, target StateID, e Event)
+}
+
+// ActionSubscriber is notified around a transition action, with the state owning the
+// transition and its target.
+type ActionSubscriber interface {
+	OnActionStarted(source, target StateID, e Event)
+	OnActionFinished(source, target StateID, e Event, err error)
+}
+
 type Machine[C any] struct {
-	def    *Definition
-	ctx    C
+	def *Definition
+	// ctx holds the current state context. Readers (hooks, guards, actions, Snapshot)
+	// load it without locking; writers are serialized by ctxMu and publish a new value
+	// atomically, so every read observes the value of a completed SetStateContext.
+	ctx    atomic.Pointer[C]
+	ctxMu  sync.Mutex
 	events chan Event
+	custom Queue         // see WithQueue
+	wake   chan struct{} // signalled when custom has events
 	done   chan struct{}
+	exited chan struct{} // closed when the loop has exited, see DispatchContext
 	wg     sync.WaitGroup
+	// pauseCh hands the loop the channel Resume closes (see Pause)
+	pauseCh chan chan struct{}
+	stepCh  chan chan stepReply
 
+	// statusMu guards the runtime status below. It is only held for short reads and
+	// commits, never while user hooks, guards or actions run, so status readers are
+	// not blocked by slow hooks and hooks may call Current()/CurrentPath() freely.
 	statusMu   sync.RWMutex
 	current    StateID
 	activePath []StateID
 	visited    map[StateID]bool
+	history    map[StateID]StateID // composite with history -> child (shallow) or leaf (deep) to re-enter
+	counters   map[string]int
+	timers     map[StateID]*stateTimer  // armed state timeouts
+	delayed    map[uint64]*delayedEvent // pending DispatchAfter events
+	recurring  map[StateID]*recurringSchedule
+	timerSeq   uint64
+	lastEntry  map[StateID]time.Time // last entry hook run of states with SuppressReentry
 	started    bool
+	starting   bool // Start is running entry hooks
+	paused     bool
+	resume     chan struct{} // closed by Resume
+
+	recurringPaused bool
+
+	raised  *raiseQueue     // internal events, see Raise
+	raiseCx context.Context // background context carrying raised
+
+	// subsMu serializes changes to subs, before and after, which are read without it
+	subsMu            sync.Mutex
+	subs              atomic.Pointer[subscriberLists]
+	before            atomic.Pointer[[]func(from, to StateID, e Event)]
+	after             atomic.Pointer[[]func(from, to StateID, e Event, err error)]
+	subscriberPanics  atomic.Uint64
+	onSubscriberPanic func(s Subscriber, v any)
+
+	id            string
+	currentMode   CurrentMode
+	observer      DispatchObserver
+	failurePolicy FailurePolicy
+	errorState    StateID
+	configErr     error // options that do not fit the definition; returned by Start and restores
+
+	log            *transitionLog // nil unless WithTransitionLog
+	logInSnapshots bool
+
+	eventStore EventStore
+	replay     atomic.Int32 // replayOff, or the mode of a running ReplayFrom
+	store      Store        // see WithAutoPersist
+	storeID    string
+	versioned  bool // see WithVersionedPersist
 
-	subsMu      sync.RWMutex
-	subscribers []Subscriber
+	onSnapshotMismatch func(snap *Snapshot) error
+	stopPolicy         StopPolicy
+	guardErrors        bool // see WithGuardRejectedErrors
+	stepMode           bool // see WithStepMode
+	newQueue           func() Queue
+	seen               *seenEvents // nil unless WithDuplicateWindow
 }
 
-func NewMachine[C any](def *Definition, ctx C) *Machine[C] {
-	return &Machine[C]{
-		def:         def,
-		ctx:         ctx,
-		events:      make(chan Event, 8), // default buffer size， increase if needed
-		done:        make(chan struct{}),
-		activePath:  make([]StateID, 0),
-		visited:     make(map[StateID]bool),
-		subscribers: make([]Subscriber, 0),
+// MachineOption configures a machine at construction time.
+type MachineOption func(*machineConfig)
+
+type machineConfig struct {
+	id            string
+	currentMode   CurrentMode
+	observer      DispatchObserver
+	failurePolicy FailurePolicy
+	errorState    StateID
+
+	onSubscriberPanic func(s Subscriber, v any)
+
+	logSize        int
+	logInSnapshots bool
+	eventStore     EventStore
+	store          Store
+	storeID        string
+	versioned      bool
+
+	onSnapshotMismatch func(snap *Snapshot) error
+	stopPolicy         StopPolicy
+	guardErrors        bool
+	stepMode           bool
+	newQueue           func() Queue
+	dedupWindow        time.Duration
+}
+
+// CurrentMode selects which active state Machine.Current reports for nested machines.
+type CurrentMode int
+
+const (
+	// CurrentModeLeaf reports the innermost active state (default).
+	CurrentModeLeaf CurrentMode = iota
+	// CurrentModeTop reports the top-level active state, i.e. the stage the machine is in.
+	CurrentModeTop
+)
+
+// WithCurrentMode sets what Current returns. Subscribers, snapshots and guards always see leaves.
+func WithCurrentMode(mode CurrentMode) MachineOption {
+	return func(c *machineConfig) { c.currentMode = mode }
+}
+
+// WithFailurePolicy sets how the machine handles a failed action or hook (default FailureRollback).
+// Transitions can override it with WithOnFailure.
+func WithFailurePolicy(p FailurePolicy) MachineOption {
+	return func(c *machineConfig) { c.failurePolicy = p }
+}
+
+// WithErrorState sets the state FailureMoveToErrorState moves the machine to. A state the
+// definition does not have makes Start and the restore methods fail.
+func WithErrorState(s StateID) MachineOption { return func(c *machineConfig) { c.errorState = s } }
+
+// WithSubscriberPanicHandler is called with the subscriber and panic value whenever a
+// subscriber panics. Panics are always recovered; see Machine.SubscriberPanics.
+func WithSubscriberPanicHandler(fn func(s Subscriber, v any)) MachineOption {
+	return func(c *machineConfig) { c.onSubscriberPanic = fn }
+}
+
+// StopPolicy decides what Stop does when an exit hook fails.
+type StopPolicy int
+
+const (
+	// StopAbortOnError stops running exit hooks at the first failure, leaving the failing
+	// state's ancestors un-exited (default).
+	StopAbortOnError StopPolicy = iota
+	// StopExitAll runs the exit hooks of every active state and reports all their errors.
+	StopExitAll
+)
+
+// WithStopPolicy sets how Stop handles failing exit hooks (default StopAbortOnError).
+func WithStopPolicy(p StopPolicy) MachineOption { return func(c *machineConfig) { c.stopPolicy = p } }
+
+// StopError is returned by Stop when exit hooks failed. Its message is that of Err.
+type StopError struct {
+	Exited []StateID // states whose exit hooks succeeded, leaf first
+	Failed []StateID // states whose exit hooks failed, leaf first
+	Err    error     // the hook error, or all of them joined with errors.Join under StopExitAll
+}
+
+func (e *StopError) Error() string { return e.Err.Error() }
+
+func (e *StopError) Unwrap() error { return e.Err }
+
+// WithGuardRejectedErrors makes Dispatch return a *GuardRejectedError (matching
+// ErrGuardRejected) instead of ErrNoTransition when transitions for the event exist but their
+// guards rejected them all. It describes the first rejection in bubbling order.
+func WithGuardRejectedErrors() MachineOption { return func(c *machineConfig) { c.guardErrors = true } }
+
+// WithMachineID sets an identifier for the machine, exposed to guards through GuardContext.
+func WithMachineID(id string) MachineOption { return func(c *machineConfig) { c.id = id } }
+
+func NewMachine[C any](def *Definition, ctx C, opts ...MachineOption) *Machine[C] {
+	var cfg machineConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if def.ErrorState != "" {
+		if cfg.errorState == "" {
+			cfg.errorState = def.ErrorState
+		}
+		if cfg.failurePolicy == FailureDefault {
+			cfg.failurePolicy = FailureMoveToErrorState
+		}
+	}
+	var configErr error
+	if _, ok := def.states[cfg.errorState]; cfg.errorState != "" && !ok {
+		configErr = fmt.Errorf("unknown error state %q", cfg.errorState)
 	}
+	m := &Machine[C]{
+		def:           def,
+		configErr:     configErr,
+		id:            cfg.id,
+		currentMode:   cfg.currentMode,
+		observer:      cfg.observer,
+		failurePolicy: cfg.failurePolicy,
+		errorState:    cfg.errorState,
+		eventStore:    cfg.eventStore,
+		store:         cfg.store,
+		storeID:       cfg.storeID,
+		versioned:     cfg.versioned,
+
+		onSnapshotMismatch: cfg.onSnapshotMismatch,
+		stopPolicy:         cfg.stopPolicy,
+		guardErrors:        cfg.guardErrors,
+
+		onSubscriberPanic: cfg.onSubscriberPanic,
+		events:            make(chan Event, 8), // default buffer size， increase if needed
+		done:              make(chan struct{}),
+		pauseCh:           make(chan chan struct{}),
+		stepCh:            make(chan chan stepReply),
+		stepMode:          cfg.stepMode,
+		newQueue:          cfg.newQueue,
+		seen:              newSeenEvents(cfg.dedupWindow),
+		activePath:        make([]StateID, 0),
+		visited:           make(map[StateID]bool),
+	}
+	if cfg.logSize > 0 {
+		m.log = &transitionLog{size: cfg.logSize}
+		m.logInSnapshots = cfg.logInSnapshots
+	}
+	m.raised = &raiseQueue{}
+	m.raiseCx = context.WithValue(context.Background(), raiseKey{}, m.raised)
+	m.ctx.Store(&ctx)
+	m.subs.Store(&subscriberLists{})
+	return m
 }
 
 func (m *Machine[C]) Start() error {
+	if m.configErr != nil {
+		return m.configErr
+	}
 	m.statusMu.Lock()
-	defer m.statusMu.Unlock()
-	if m.started {
+	if m.started || m.starting {
+		m.statusMu.Unlock()
 		return nil
 	}
 	// compute initial active path and enter hooks from root to leaf
 	root := m.def.Current
-	path := []StateID{root}
-	cur := root
-	for {
-		st := m.def.States[cur]
-		if len(st.Children) == 0 {
-			break
-		}
-		child := st.InitialChild
-		path = append(path, child)
-		cur = child
-	}
-	m.current = cur
+	path := append([]StateID{root}, m.def.initialDescendants(root)...)
+	m.current = path[len(path)-1]
 	m.activePath = path
 	m.visited = make(map[StateID]bool, len(path))
+	m.history = nil
+	m.counters = nil
+	m.lastEntry = nil
 	// recreate channels to support restart; clear any stale events
 	buf := cap(m.events)
 	if buf <= 0 {
 		buf = 8
 	}
-	m.events = make(chan Event, buf)
-	m.done = make(chan struct{})
-	m.started = true
-	for _, sid := range m.activePath {
-		if st, ok := m.def.States[sid]; ok && st.OnEntry != nil {
-			if err := st.OnEntry(Event{}, any(m.ctx)); err != nil {
-				m.started = false
-				return err
-			}
+	m.openQueue(buf)
+	m.setPaused(m.stepMode)
+	m.starting = true
+	m.statusMu.Unlock()
+	m.raised.reset()
+
+	// run entry hooks without holding statusMu; dispatches are rejected until started.
+	// Events they raise are handled first by the loop.
+	for _, sid := range path {
+		if err := m.enter(m.raiseCx, sid, Event{}); err != nil {
+			m.statusMu.Lock()
+			m.starting = false
+			m.statusMu.Unlock()
+			return err
 		}
+		m.statusMu.Lock()
 		m.visited[sid] = true
+		m.statusMu.Unlock()
 	}
+
+	m.statusMu.Lock()
+	m.starting = false
+	m.started = true
+	m.armTimers(path, nil)
 	m.wg.Add(1)
+	m.statusMu.Unlock()
 	go m.loop()
 	return nil
 }
 
+// Stop stops the event loop and runs the exit hooks of the active states, leaf first. If hooks
+// fail, it returns a *StopError; see WithStopPolicy.
 func (m *Machine[C]) Stop() error {
 	m.statusMu.Lock()
 	if !m.started {
@@ -89,22 +326,70 @@ func (m *Machine[C]) Stop() error {
 		return nil
 	}
 	m.started = false
+	m.paused = false
+	m.disarmAllTimers()
 	close(m.done)
 	m.statusMu.Unlock()
 	m.wg.Wait()
 	// Execute exit hooks from leaf to root
 	path := m.CurrentPath()
+	var exited, failed []StateID
+	var errs []error
 	for i := len(path) - 1; i >= 0; i-- {
-		if st, ok := m.def.States[path[i]]; ok && st.OnExit != nil {
-			if err := st.OnExit(Event{}, any(m.ctx)); err != nil {
-				return err
+		if err := m.exit(context.Background(), path[i], Event{}); err != nil {
+			failed, errs = append(failed, path[i]), append(errs, err)
+			if m.stopPolicy != StopExitAll {
+				break
 			}
+			continue
 		}
+		exited = append(exited, path[i])
 	}
-	return nil
+	if len(errs) == 0 {
+		return nil
+	}
+	err := errs[0]
+	if len(errs) > 1 {
+		err = errors.Join(errs...)
+	}
+	return &StopError{Exited: exited, Failed: failed, Err: err}
 }
 
+// ID returns the identifier set with WithMachineID.
+func (m *Machine[C]) ID() string { return m.id }
+
+// Current returns the active leaf state, or the top-level active state with CurrentModeTop.
 func (m *Machine[C]) Current() StateID {
+	if m.currentMode == CurrentModeTop {
+		return m.CurrentTop()
+	}
+	return m.leaf()
+}
+
+// CurrentTop returns the top-level ancestor of the active leaf (the leaf itself if it has no parent).
+func (m *Machine[C]) CurrentTop() StateID {
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	if len(m.activePath) == 0 {
+		return m.current
+	}
+	return m.activePath[0]
+}
+
+// activeBelow returns the active descendants of s, leaf first; nil if s is not active.
+// Must be called with statusMu held.
+func (m *Machine[C]) activeBelow(s StateID) []StateID {
+	i := slices.Index(m.activePath, s)
+	if i < 0 || i == len(m.activePath)-1 {
+		return nil
+	}
+	below := slices.Clone(m.activePath[i+1:])
+	slices.Reverse(below)
+	return below
+}
+
+// leaf returns the active leaf state regardless of the current mode.
+func (m *Machine[C]) leaf() StateID {
 	m.statusMu.RLock()
 	defer m.statusMu.RUnlock()
 	return m.current
@@ -131,6 +416,84 @@ func (m *Machine[C]) IsActive(s StateID) bool {
 	return false
 }
 
+// Configuration is a consistent view of a machine's active states, taken under one lock.
+type Configuration struct {
+	// Path is the active path from root to leaf.
+	Path []StateID
+	// Leaf is the innermost active state.
+	Leaf StateID
+	// Children maps every active composite state to its active child.
+	Children map[StateID]StateID
+	// History holds the recorded history of composites with WithHistory/WithDeepHistory.
+	History map[StateID]StateID
+	// Final reports whether the leaf is a final state; Finals lists the final states on Path.
+	Final  bool
+	Finals []StateID
+	// Running reports whether the machine's event loop is running.
+	Running bool
+}
+
+// IsActive reports whether s is on the active path.
+func (c Configuration) IsActive(s StateID) bool {
+	for _, id := range c.Path {
+		if id == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Configuration returns the machine's active configuration. Unlike separate calls to Current,
+// CurrentPath and IsActive, all fields are read together and cannot observe different transitions.
+func (m *Machine[C]) Configuration() Configuration {
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	cfg := Configuration{
+		Path:     make([]StateID, len(m.activePath)),
+		Leaf:     m.current,
+		Children: make(map[StateID]StateID, len(m.activePath)),
+		Running:  m.started,
+	}
+	copy(cfg.Path, m.activePath)
+	for i, sid := range m.activePath {
+		if i+1 < len(m.activePath) {
+			cfg.Children[sid] = m.activePath[i+1]
+		}
+		if m.def.states[sid].Final {
+			cfg.Finals = append(cfg.Finals, sid)
+		}
+	}
+	cfg.Final = m.def.states[m.current].Final
+	if len(m.history) > 0 {
+		cfg.History = make(map[StateID]StateID, len(m.history))
+		for k, v := range m.history {
+			cfg.History[k] = v
+		}
+	}
+	return cfg
+}
+
+// Counter returns the value of a machine counter (see WithCounterIncrement).
+func (m *Machine[C]) Counter(name string) int {
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	return m.counters[name]
+}
+
+// applyCounters applies a committed transition's counter updates. Must be called with statusMu held.
+func (m *Machine[C]) applyCounters(ops []counterOp) {
+	for _, op := range ops {
+		if op.reset {
+			delete(m.counters, op.name)
+			continue
+		}
+		if m.counters == nil {
+			m.counters = make(map[string]int)
+		}
+		m.counters[op.name]++
+	}
+}
+
 // HasVisited reports whether the machine has ever activated the given state since Start.
 func (m *Machine[C]) HasVisited(s StateID) bool {
 	m.statusMu.RLock()
@@ -140,15 +503,27 @@ func (m *Machine[C]) HasVisited(s StateID) bool {
 
 // GetStateContext returns the machine's state context.
 func (m *Machine[C]) GetStateContext() C {
-	return m.ctx
+	return *m.ctx.Load()
 }
 
 // SetStateContext updates the machine's state context using the provided setter function.
 // The setter function receives the current context and returns the new context.
+//
+// Memory model: setters are serialized with each other and the returned value is
+// published atomically; hooks, guards and actions observe either the old or the new
+// value, never a partial update, and may call SetStateContext themselves. For pointer
+// contexts only the pointer is synchronized: setters should return a modified copy
+// rather than mutating the shared value in place while the machine is running.
 func (m *Machine[C]) SetStateContext(setter func(C) C) {
-	m.statusMu.Lock()
-	defer m.statusMu.Unlock()
-	m.ctx = setter(m.ctx)
+	m.ctxMu.Lock()
+	defer m.ctxMu.Unlock()
+	next := setter(*m.ctx.Load())
+	m.ctx.Store(&next)
+}
+
+// stateContext returns the current context boxed for the internal hook signatures.
+func (m *Machine[C]) stateContext() any {
+	return any(*m.ctx.Load())
 }
 
 // Next automatically advances to the next state if there is exactly one available transition.
@@ -170,7 +545,7 @@ func (m *Machine[C]) Next() error {
 	for i := len(path) - 1; i >= 0; i-- {
 		s := path[i]
 		// Use outgoing transitions index for fast lookup
-		outgoing, ok := m.def.OutgoingTransitions[s]
+		outgoing, ok := m.def.outgoing[s]
 		if !ok || len(outgoing) == 0 {
 			continue
 		}
@@ -180,12 +555,11 @@ func (m *Machine[C]) Next() error {
 			return ErrMultipleTransitions
 		}
 
-		// Exactly one outgoing transition, check guard
+		// Exactly one outgoing event, check guards; Dispatch takes the first enabled alternative
 		tk := outgoing[0]
-		t := m.def.Transitions[tk]
 		e := Event{Name: tk.Event}
-		if t.Guard == nil || t.Guard(e, any(m.ctx)) {
-			foundTransition = &t
+		if r := m.firstEnabled(context.Background(), e, s, m.def.transitions[tk], path); r != nil {
+			foundTransition = r
 			foundEvent = tk.Event
 			break
 		}
@@ -200,166 +574,752 @@ func (m *Machine[C]) Next() error {
 	return m.Dispatch(Event{Name: foundEvent})
 }
 
+// AvailableEvents returns, sorted, the events that have a transition from an active state,
+// including those inherited from ancestors by bubbling. Namespace wildcards such as "fiat.*"
+// and AnyEvent are returned as declared. With evaluateGuards, events whose alternatives are
+// all rejected by their guards (evaluated against the current state context) are left out.
+// It returns nil if the machine is not started.
+func (m *Machine[C]) AvailableEvents(evaluateGuards bool) []EventID {
+	m.statusMu.RLock()
+	started := m.started
+	m.statusMu.RUnlock()
+	if !started {
+		return nil
+	}
+	path := m.CurrentPath()
+	var events []EventID
+	for _, s := range path {
+		for _, tk := range m.def.outgoing[s] {
+			if slices.Contains(events, tk.Event) {
+				continue
+			}
+			if evaluateGuards && m.firstEnabled(context.Background(), Event{Name: tk.Event}, s, m.def.transitions[tk], path) == nil {
+				continue
+			}
+			events = append(events, tk.Event)
+		}
+	}
+	slices.Sort(events)
+	return events
+}
+
 func (m *Machine[C]) Subscribe(s Subscriber) {
 	m.subsMu.Lock()
-	m.subscribers = append(m.subscribers, s)
+	m.subs.Store(newSubscriberLists(append(slices.Clip(m.subs.Load().all), s)))
+	m.subsMu.Unlock()
+}
+
+// unsubscribe removes s, registered with Subscribe.
+func (m *Machine[C]) unsubscribe(s Subscriber) {
+	m.subsMu.Lock()
+	m.subs.Store(newSubscriberLists(slices.DeleteFunc(slices.Clone(m.subs.Load().all), func(x Subscriber) bool { return x == s })))
 	m.subsMu.Unlock()
 }
 
+// subscriberLists holds the registered subscribers, and those implementing each optional
+// interface, so notifying them neither copies the list nor type-asserts every subscriber.
+// It is replaced, never modified, when a subscriber is added or removed.
+type subscriberLists struct {
+	all     []Subscriber
+	entered []StateEnteredSubscriber
+	exited  []StateExitedSubscriber
+	guards  []GuardRejectedSubscriber
+	actions []ActionSubscriber
+}
+
+func newSubscriberLists(all []Subscriber) *subscriberLists {
+	l := &subscriberLists{all: all}
+	for _, s := range all {
+		if x, ok := s.(StateEnteredSubscriber); ok {
+			l.entered = append(l.entered, x)
+		}
+		if x, ok := s.(StateExitedSubscriber); ok {
+			l.exited = append(l.exited, x)
+		}
+		if x, ok := s.(GuardRejectedSubscriber); ok {
+			l.guards = append(l.guards, x)
+		}
+		if x, ok := s.(ActionSubscriber); ok {
+			l.actions = append(l.actions, x)
+		}
+	}
+	return l
+}
+
+// subscribers returns the current subscriber lists.
+func (m *Machine[C]) subscribers() *subscriberLists {
+	return m.subs.Load()
+}
+
+// BeforeTransition registers fn to run, on the event loop, once a transition for e has been
+// matched from leaf state from, before any exit hook or action runs; to is the declared
+// target. Callbacks run in registration order.
+func (m *Machine[C]) BeforeTransition(fn func(from, to StateID, e Event)) {
+	m.subsMu.Lock()
+	m.before.Store(appendFunc(m.before.Load(), fn))
+	m.subsMu.Unlock()
+}
+
+// AfterTransition registers fn to run after every transition a BeforeTransition callback
+// was called for, with the resulting leaf state and error (to is from if the transition
+// rolled back). It runs before subscribers are notified and before the event is persisted,
+// so it sees the outcome first. Events no transition matched reach subscribers only.
+func (m *Machine[C]) AfterTransition(fn func(from, to StateID, e Event, err error)) {
+	m.subsMu.Lock()
+	m.after.Store(appendFunc(m.after.Load(), fn))
+	m.subsMu.Unlock()
+}
+
+// beforeTransition runs the BeforeTransition callbacks.
+func (m *Machine[C]) beforeTransition(from, to StateID, e Event) {
+	if fns := m.before.Load(); fns != nil {
+		for _, fn := range *fns {
+			fn(from, to, e)
+		}
+	}
+}
+
+// appendFunc returns a new list of the functions in fns, if any, and fn; the lists in use
+// are never modified.
+func appendFunc[F any](fns *[]F, fn F) *[]F {
+	var l []F
+	if fns != nil {
+		l = slices.Clip(*fns)
+	}
+	l = append(l, fn)
+	return &l
+}
+
+// finish runs the AfterTransition callbacks for a matched transition, then notifies subscribers.
+func (m *Machine[C]) finish(from, to StateID, e Event, err error) {
+	if fns := m.after.Load(); fns != nil {
+		for _, fn := range *fns {
+			fn(from, to, e, err)
+		}
+	}
+	m.notify(from, to, e, err)
+}
+
 func (m *Machine[C]) Dispatch(e Event) error {
-	m.statusMu.RLock()
-	started := m.started
-	m.statusMu.RUnlock()
-	if !started {
+	return m.DispatchContext(context.Background(), e)
+}
+
+// dispatchContext carries the context of a DispatchContext call to the event loop.
+type dispatchContext struct{ cx context.Context }
+
+// DispatchContext is Dispatch with a context that is passed to the guards, actions and hooks
+// run for e (see WithActionCtx). If cx is done before the event is queued, or before its
+// transition starts, the event is skipped and cx.Err() is returned. Once a transition has
+// started, DispatchContext waits for it to finish; long-running actions and hooks are expected
+// to honor cx themselves.
+//
+// If the machine is stopped while the event is queued, DispatchContext returns
+// ErrMachineStopped without the event being handled; an event already being handled completes
+// first, and Stop waits for it.
+func (m *Machine[C]) DispatchContext(cx context.Context, e Event) error {
+	q, ok := m.queue()
+	if !ok {
 		return ErrMachineNotStarted
 	}
 	// Use a result channel to wait for completion
 	done := make(chan error, 1)
 	// Wrap the event with a sync wait mechanism
-	wrapper := Event{
-		Name: e.Name,
-		Args: append([]any{}, e.Args...),
+	wrapper := e
+	wrapper.Args = append([]any{}, e.Args...)
+	if cx != context.Background() {
+		wrapper.Args = append(wrapper.Args, dispatchContext{cx})
 	}
 	// Wait for processing completion signal
 	// The completion signal is returned through the done channel (see loop implementation)
 	wrapper.Args = append(wrapper.Args, done)
-	select {
-	case m.events <- wrapper:
+	queued := m.stamp(wrapper, e)
+	if cx.Done() == nil && m.trySend(queued) {
 		return <-done
-	case <-m.done:
-		return ErrMachineStopped
+	}
+	if err := q.push(queued, cx.Done()); err != nil {
+		if err == errPushCanceled {
+			return cx.Err()
+		}
+		return err
+	}
+	// The loop answers events still queued when it stops; exited covers an event queued
+	// after that, which nothing will ever reply to
+	select {
+	case err := <-done:
+		return err
+	case <-q.exited:
+		select {
+		case err := <-done:
+			return err
+		default:
+			return ErrMachineStopped
+		}
 	}
 }
 
 func (m *Machine[C]) DispatchAsync(e Event) error {
-	m.statusMu.RLock()
-	started := m.started
-	m.statusMu.RUnlock()
-	if !started {
+	q, ok := m.queue()
+	if !ok {
 		return ErrMachineNotStarted
 	}
-	select {
-	case m.events <- e:
-		return nil
-	case <-m.done:
-		return ErrMachineStopped
+	return q.push(m.stamp(e, e), nil)
+}
+
+// asyncCallback carries the result callback of a DispatchAsyncCb call to the event loop.
+type asyncCallback func(error)
+
+// DispatchAsyncCb is DispatchAsync with a callback that receives the event's result, the
+// error Dispatch would have returned, once it was handled. cb runs on the event loop: it must
+// not block or Dispatch synchronously to the same machine. If the machine stops before the
+// event is handled, cb is called with ErrMachineStopped as the loop exits. A panic in cb is
+// recovered.
+func (m *Machine[C]) DispatchAsyncCb(e Event, cb func(err error)) error {
+	q, ok := m.queue()
+	if !ok {
+		return ErrMachineNotStarted
+	}
+	wrapper := e
+	wrapper.Args = append(append([]any{}, e.Args...), asyncCallback(cb))
+	return q.push(m.stamp(wrapper, e), nil)
+}
+
+// takeReply strips the reply channel of a sync dispatch, or the callback of DispatchAsyncCb,
+// from a dequeued event.
+func takeReply(e *Event) (chan error, asyncCallback) {
+	n := len(e.Args)
+	if n == 0 {
+		return nil, nil
+	}
+	switch reply := e.Args[n-1].(type) {
+	case chan error:
+		e.Args = e.Args[:n-1]
+		return reply, nil
+	case asyncCallback:
+		e.Args = e.Args[:n-1]
+		return nil, reply
+	}
+	return nil, nil
+}
+
+// answerQueued replies ErrMachineStopped to the events left in the queue of a stopped loop,
+// then closes a custom queue.
+func (m *Machine[C]) answerQueued(q runQueue) {
+	for e, ok := q.next(); ok; e, ok = q.next() {
+		wait := m.unstamp(&e)
+		syncCh, cb := takeReply(&e)
+		if m.observer != nil {
+			m.observer.OnComplete(userEvent(e), wait, 0, ErrMachineStopped)
+		}
+		if syncCh != nil {
+			syncCh <- ErrMachineStopped
+		}
+		if cb != nil {
+			_ = recovered(func() error { cb(ErrMachineStopped); return nil })
+		}
+	}
+	if q.custom != nil {
+		_ = q.custom.Close()
 	}
 }
 
 func (m *Machine[C]) loop() {
+	q := m.run()
 	defer m.wg.Done()
+	defer close(q.exited)
+	defer m.answerQueued(q)
+	_ = m.drainRaised(m.raiseCx)
+	m.statusMu.RLock()
+	paused, resume := m.paused, m.resume
+	m.statusMu.RUnlock()
+	if paused && !m.wait(resume) {
+		return
+	}
 	for {
 		select {
 		case <-m.done:
 			return
-		case e := <-m.events:
-			var syncCh chan error
-			// If the last arg is chan error, treat this as sync dispatch
-			if n := len(e.Args); n > 0 {
-				if ch, ok := e.Args[n-1].(chan error); ok {
-					syncCh = ch
-					e.Args = e.Args[:n-1]
+		case resume := <-m.pauseCh:
+			if !m.wait(resume) {
+				return
+			}
+		case e := <-q.events:
+			m.process(e)
+		case <-q.wake:
+			if e, ok := q.custom.Dequeue(); ok {
+				if q.custom.Len() > 0 {
+					q.signal()
 				}
+				m.process(e)
 			}
-			err := m.handleEvent(e)
-			if syncCh != nil {
-				syncCh <- err
+		}
+	}
+}
+
+// process handles a dequeued event and replies to its dispatcher. It returns the event
+// without internal args and the error reported for it.
+func (m *Machine[C]) process(e Event) (Event, error) {
+	wait := m.unstamp(&e)
+	syncCh, cb := takeReply(&e)
+	cx := context.Background()
+	if n := len(e.Args); n > 0 {
+		if dc, ok := e.Args[n-1].(dispatchContext); ok {
+			cx = dc.cx
+			e.Args = e.Args[:n-1]
+		}
+	}
+	// A state timeout or recurring event that fired after its state was exited is dropped
+	if n := len(e.Args); n > 0 {
+		stale := false
+		switch tick := e.Args[n-1].(type) {
+		case timeoutTick:
+			e.Args = e.Args[:n-1]
+			stale = !m.takeTimeout(tick)
+		case recurringTick:
+			e.Args = e.Args[:n-1]
+			stale = !m.recurringActive(tick)
+		}
+		if stale {
+			if m.observer != nil {
+				m.observer.OnComplete(e, wait, 0, nil)
 			}
+			return e, nil
 		}
 	}
+	// the clock is only read for the budget and the observer
+	var start, deadline time.Time
+	if m.observer != nil || e.Budget > 0 {
+		start = time.Now()
+	}
+	if e.Budget > 0 {
+		deadline = start.Add(e.Budget - wait)
+	}
+	// a panic in a guard is returned to the dispatcher instead of killing the loop
+	cx = m.stepContext(cx)
+	err := recovered(func() error { return m.handleEvent(cx, e, deadline) })
+	if err == nil {
+		err = m.appendEvent(e)
+	}
+	if rerr := m.drainRaised(cx); err == nil {
+		err = rerr
+	}
+	if err == nil {
+		err = m.persist(cx)
+	}
+	if m.observer != nil {
+		m.observer.OnComplete(e, wait, time.Since(start), err)
+	}
+	if syncCh != nil {
+		syncCh <- err
+	}
+	if cb != nil {
+		_ = recovered(func() error { cb(err); return nil })
+	}
+	return e, err
 }
 
 func (m *Machine[C]) notify(from, to StateID, e Event, err error) {
-	m.subsMu.RLock()
-	subs := append([]Subscriber(nil), m.subscribers...)
-	m.subsMu.RUnlock()
-	for _, s := range subs {
-		s.OnTransition(from, to, e, err)
+	m.record(from, to, e, err)
+	notifyEach(m, m.subscribers().all, func(s Subscriber) { s.OnTransition(from, to, e, err) })
+}
+
+// notifyEach calls fn for every subscriber in subs. A panicking subscriber is counted,
+// reported to the handler set with WithSubscriberPanicHandler, and does not stop the others.
+func notifyEach[C, S any](m *Machine[C], subs []S, fn func(S)) {
+	for i := 0; i < len(subs); {
+		i = notifyFrom(m, subs, i, fn)
 	}
 }
 
-func (m *Machine[C]) handleEvent(e Event) error {
+// notifyFrom calls fn for subs[i:] under a single recover and returns where to continue:
+// len(subs), or the index after a subscriber that panicked.
+func notifyFrom[C, S any](m *Machine[C], subs []S, i int, fn func(S)) (next int) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.subscriberPanics.Add(1)
+			if m.onSubscriberPanic != nil {
+				// every list holds registered subscribers
+				m.onSubscriberPanic(any(subs[next]).(Subscriber), r)
+			}
+			next++
+		}
+	}()
+	for next = i; next < len(subs); next++ {
+		fn(subs[next])
+	}
+	return next
+}
+
+// SubscriberPanics returns the number of panics recovered from subscribers.
+func (m *Machine[C]) SubscriberPanics() uint64 { return m.subscriberPanics.Load() }
+
+// runAction runs a transition action owned by source, notifying ActionSubscribers.
+func (m *Machine[C]) runAction(cx context.Context, action actionFuncAny, source, target StateID, e Event) error {
+	if m.skipEffects() {
+		return nil
+	}
+	subs := m.subscribers().actions
+	notifyEach(m, subs, func(a ActionSubscriber) { a.OnActionStarted(source, target, e) })
+	err := recovered(func() error { return action(cx, e, m.stateContext()) })
+	notifyEach(m, subs, func(a ActionSubscriber) { a.OnActionFinished(source, target, e, err) })
+	return err
+}
+
+// runTransitionAction runs t's action, retrying it as configured with WithRetry.
+func (m *Machine[C]) runTransitionAction(cx context.Context, t *TransitionDef, source StateID, e Event) error {
+	err := m.runAction(cx, t.Action, source, t.To, e)
+	for retry := 1; err != nil && retry < t.attempts && !errors.Is(err, ErrActionPanicked); retry++ {
+		if t.backoff != nil {
+			timer := time.NewTimer(t.backoff(retry))
+			select {
+			case <-timer.C:
+			case <-cx.Done():
+				timer.Stop()
+				return err
+			}
+		}
+		err = m.runAction(cx, t.Action, source, t.To, e)
+	}
+	return err
+}
+
+// handleEvent runs the transitions matched by e. A non-zero deadline is the end of e's Budget.
+func (m *Machine[C]) handleEvent(cx context.Context, e Event, deadline time.Time) (err error) {
 	m.statusMu.RLock()
 	if !m.started {
 		m.statusMu.RUnlock()
 		return ErrMachineStopped
 	}
-	from := m.current
+	from, path := m.current, slices.Clone(m.activePath)
 	m.statusMu.RUnlock()
+	e.Name = m.def.canonicalEvent(e.Name)
+	expired := func() error {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return ErrEventExpired
+		}
+		return cx.Err()
+	}
+	if err := expired(); err != nil {
+		m.notify(from, from, e, err)
+		return err
+	}
+	if m.seen != nil && e.ID != "" {
+		now := time.Now()
+		if m.seen.duplicate(e, now) {
+			m.notify(from, from, e, ErrDuplicateEvent)
+			return ErrDuplicateEvent
+		}
+		// a failed event may be retried with the same ID
+		defer func() {
+			if err == nil {
+				m.seen.record(e, now)
+			}
+		}()
+	}
 
-	// Bubble from leaf to root to find matching transition
-	path := m.CurrentPath()
-	var matched *TransitionDef
-	var source StateID
-	for i := len(path) - 1; i >= 0 && matched == nil; i-- {
-		s := path[i]
-		tk := TransitionKey{From: s, Event: e.Name}
-		if t, ok := m.def.Transitions[tk]; ok {
-			if t.Guard == nil || t.Guard(e, any(m.ctx)) {
-				matched = &t
-				source = s
+	// Bubble from leaf to root (or root to leaf, see RootFirst) to find matching transition
+	var rejected **GuardRejectedError // only allocated with WithGuardRejectedErrors
+	if m.guardErrors {
+		rejected = new(*GuardRejectedError)
+		cx = context.WithValue(cx, rejectionKey{}, rejected)
+	}
+	matched, source := m.match(cx, e, scoped(e, path), path)
+	if matched == nil {
+		var err error = ErrNoTransition
+		if rejected != nil && *rejected != nil {
+			err = *rejected
+		}
+		m.notify(from, from, e, err)
+		return err
+	}
+	// guards may be slow; do not start the transition once the budget or context is spent
+	if err := expired(); err != nil {
+		m.notify(from, from, e, err)
+		return err
+	}
+	for {
+		if err := m.execute(cx, e, source, matched); err != nil {
+			return err
+		}
+		if !matched.Propagate {
+			return nil
+		}
+		// offer the event to the states after the source in bubbling order that are still
+		// active: its ancestors, or with RootFirst its descendants
+		var candidates []StateID
+		if m.def.BubbleOrder == RootFirst {
+			path := m.CurrentPath()
+			for i, s := range path {
+				if s == source {
+					candidates = path[i+1:]
+					break
+				}
+			}
+		} else {
+			ancestors := m.pathTo(source)
+			for _, a := range ancestors[:len(ancestors)-1] {
+				if m.IsActive(a) {
+					candidates = append(candidates, a)
+				}
+			}
+		}
+		if matched, source = m.match(cx, e, scoped(e, candidates), m.CurrentPath()); matched == nil {
+			return nil
+		}
+	}
+}
+
+// scoped trims candidates (ordered root to leaf) to the states nested inside e.Scope.
+func scoped(e Event, candidates []StateID) []StateID {
+	if e.Scope == "" {
+		return candidates
+	}
+	for i, s := range candidates {
+		if s == e.Scope {
+			return candidates[i+1:]
+		}
+	}
+	return nil
+}
+
+// match returns the first enabled transition for e, walking candidates (ordered root to leaf)
+// in the definition's BubbleOrder.
+func (m *Machine[C]) match(cx context.Context, e Event, candidates, activePath []StateID) (*TransitionDef, StateID) {
+	n := len(candidates)
+	for i := range candidates {
+		s := candidates[n-1-i]
+		if m.def.BubbleOrder == RootFirst {
+			s = candidates[i]
+		}
+		if r := m.matchState(cx, e, s, activePath); r != nil {
+			return r, s
+		}
+	}
+	return nil, ""
+}
+
+// matchState returns the first enabled transition owned by s: exact event alternatives first,
+// then namespace wildcards from the most to the least specific ("a.b.*" before "a.*"), then AnyEvent.
+func (m *Machine[C]) matchState(cx context.Context, e Event, s StateID, activePath []StateID) *TransitionDef {
+	if r := m.firstEnabled(cx, e, s, m.def.transitions[TransitionKey{From: s, Event: e.Name}], activePath); r != nil {
+		return r
+	}
+	if !m.def.hasWildcards {
+		return nil
+	}
+	for i := strings.LastIndexByte(e.Name, '.'); i > 0; i = strings.LastIndexByte(e.Name[:i], '.') {
+		if r := m.firstEnabled(cx, e, s, m.def.transitions[TransitionKey{From: s, Event: e.Name[:i] + ".*"}], activePath); r != nil {
+			return r
+		}
+	}
+	return m.firstEnabled(cx, e, s, m.def.transitions[TransitionKey{From: s, Event: AnyEvent}], activePath)
+}
+
+// firstEnabled returns the first alternative in alts that resolve enables, or nil.
+func (m *Machine[C]) firstEnabled(cx context.Context, e Event, source StateID, alts []TransitionDef, activePath []StateID) *TransitionDef {
+	for i := range alts {
+		if r, ok := m.resolve(cx, e, source, &alts[i], activePath); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// resolve returns def if its guard passes. For a junction target it returns a copy of def with
+// the target replaced by the end of the first junction path whose segment guards all pass and
+// the segment actions chained after its own action. It reports false if no path through the
+// junction is enabled. def belongs to the definition and is never modified.
+func (m *Machine[C]) resolve(cx context.Context, e Event, source StateID, def *TransitionDef, activePath []StateID) (*TransitionDef, bool) {
+	if !m.guardAllows(cx, e, source, def, activePath) {
+		return nil, false
+	}
+	paths, ok := m.def.junctions[def.To]
+	if !ok {
+		return def, true
+	}
+	t := *def
+	for _, p := range paths {
+		enabled := true
+		for i := range p {
+			if !m.guardAllows(cx, e, source, &p[i], activePath) {
+				enabled = false
 				break
 			}
 		}
+		if enabled {
+			t.To = p[len(p)-1].To
+			t.Action = m.chainActions(t.Action, p)
+			for _, seg := range p {
+				if len(seg.counters) > 0 {
+					t.counters = append(t.counters[:len(t.counters):len(t.counters)], seg.counters...)
+				}
+			}
+			return &t, true
+		}
 	}
-	if matched == nil {
-		m.notify(from, from, e, ErrNoTransition)
-		return ErrNoTransition
+	return nil, false
+}
+
+// chainActions composes first with the segment actions of p, stopping at the first error.
+// Each action sees the state context as left by the previous one.
+func (m *Machine[C]) chainActions(first actionFuncAny, p junctionPath) actionFuncAny {
+	var actions []actionFuncAny
+	if first != nil {
+		actions = append(actions, first)
+	}
+	for _, seg := range p {
+		if seg.Action != nil {
+			actions = append(actions, seg.Action)
+		}
+	}
+	switch len(actions) {
+	case 0:
+		return nil
+	case 1:
+		return actions[0]
+	}
+	return func(cx context.Context, e Event, _ any) error {
+		for _, a := range actions {
+			if err := a(cx, e, m.stateContext()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rejectionKey is the context key under which handleEvent collects the first guard rejection
+// of an event for WithGuardRejectedErrors.
+type rejectionKey struct{}
+
+// guardAllows evaluates t's guard (if any) for a transition owned by source.
+func (m *Machine[C]) guardAllows(cx context.Context, e Event, source StateID, t *TransitionDef, activePath []StateID) bool {
+	if !t.hasGuard() {
+		return true
+	}
+	g := GuardContext{
+		Source:     source,
+		Target:     t.To,
+		ActivePath: activePath,
+		MachineID:  m.id,
+		machine:    m,
+	}
+	if m.guardErrors {
+		g.reason = new(string)
+	}
+	ctx := m.stateContext()
+	allowed := t.Guard == nil || t.Guard(cx, e, g, ctx)
+	for _, c := range t.conditions {
+		allowed = allowed && c(cx, e, g, ctx)
 	}
+	if allowed {
+		return true
+	}
+	if r, ok := cx.Value(rejectionKey{}).(**GuardRejectedError); ok && *r == nil {
+		*r = &GuardRejectedError{Source: source, Target: t.To, Event: e.Name, Reason: *g.reason}
+	}
+	notifyEach(m, m.subscribers().guards, func(r GuardRejectedSubscriber) { r.OnGuardRejected(source, t.To, e) })
+	return false
+}
+
+// execute runs a matched transition from source: exit hooks, action, entry hooks, then commit.
+func (m *Machine[C]) execute(cx context.Context, e Event, source StateID, matched *TransitionDef) error {
+	m.statusMu.RLock()
+	from, below := m.current, m.activeBelow(source)
+	m.statusMu.RUnlock()
+	m.beforeTransition(from, matched.To, e)
 
-	// Compute sequences via LCA between source and target
+	// Compute sequences via LCA between source and target; the states active below the
+	// source are exited first, leaf first
 	exitSeq, entrySeq := m.computeTransitionSequences(source, matched.To)
-	// Exit
-	for _, sid := range exitSeq {
-		if st, ok := m.def.States[sid]; ok && st.OnExit != nil {
-			if err := st.OnExit(e, any(m.ctx)); err != nil {
-				m.notify(from, from, e, ErrHookFailed)
-				return ErrHookFailed
+	kept := len(m.pathTo(source)) - len(exitSeq)
+	if len(below) > 0 {
+		exitSeq = append(below, exitSeq...)
+	}
+
+	policy := matched.OnFailure
+	if policy == FailureDefault {
+		policy = m.failurePolicy
+	}
+	fail := func(exited, entered []StateID, err, cause error) error {
+		return m.fail(cx, e, from, policy, exited, entered, err, cause)
+	}
+
+	if matched.Internal {
+		if matched.Action != nil {
+			if err := m.runTransitionAction(cx, matched, source, e); err != nil {
+				return fail(nil, nil, actionError(err), err)
 			}
 		}
+		m.statusMu.Lock()
+		m.applyCounters(matched.counters)
+		m.statusMu.Unlock()
+		m.finish(from, from, e, nil)
+		return nil
 	}
 
-	if matched.Action != nil {
-		if err := matched.Action(e, any(m.ctx)); err != nil {
-			// Rollback: re-enter exited states in reverse order
-			for i := len(exitSeq) - 1; i >= 0; i-- {
-				if st, ok := m.def.States[exitSeq[i]]; ok && st.OnEntry != nil {
-					_ = st.OnEntry(Event{}, any(m.ctx))
-				}
-			}
-			m.notify(from, from, e, ErrActionFailed)
-			return ErrActionFailed
+	actionFirst := m.def.EffectOrder == ActionExitEntry
+	if actionFirst && matched.Action != nil {
+		if err := m.runTransitionAction(cx, matched, source, e); err != nil {
+			// nothing has been exited yet, so there is nothing to roll back
+			return fail(nil, nil, actionError(err), err)
 		}
 	}
 
-	// Entry
-	for _, sid := range entrySeq {
-		if st, ok := m.def.States[sid]; ok && st.OnEntry != nil {
-			if err := st.OnEntry(e, any(m.ctx)); err != nil {
-				// Rollback: exit entered and re-enter exited
-				for i := len(entrySeq) - 1; i >= 0; i-- {
-					if entrySeq[i] == sid {
-						break
-					}
-					if st2, ok2 := m.def.States[entrySeq[i]]; ok2 && st2.OnExit != nil {
-						_ = st2.OnExit(e, any(m.ctx))
-					}
-				}
-				for i := len(exitSeq) - 1; i >= 0; i-- {
-					if st2, ok2 := m.def.States[exitSeq[i]]; ok2 && st2.OnEntry != nil {
-						_ = st2.OnEntry(Event{}, any(m.ctx))
-					}
-				}
-				m.notify(from, from, e, ErrHookFailed)
-				return ErrHookFailed
+	// Exit
+	for i, sid := range exitSeq {
+		if err := m.exit(cx, sid, e); err != nil {
+			return fail(exitSeq[:i], nil, hookError(err), err)
+		}
+	}
+
+	if !actionFirst && matched.Action != nil {
+		if err := m.runTransitionAction(cx, matched, source, e); err != nil {
+			return fail(exitSeq, nil, actionError(err), err)
+		}
+	}
+
+	// A choice is decided now, after the action, and the transition continues to its target
+	counters := matched.counters
+	if m.def.states[matched.To].Choice {
+		to, branch, err := m.choose(cx, e, source, matched.To)
+		cause := err
+		if err == nil && branch.Action != nil {
+			if cause = m.runAction(cx, branch.Action, matched.To, to, e); cause != nil {
+				err = actionError(cause)
 			}
 		}
+		if err != nil {
+			return fail(exitSeq, nil, err, cause)
+		}
+		counters = append(counters[:len(counters):len(counters)], branch.counters...)
+		// leave whatever the choice's target is not nested in, then enter it
+		prefix := m.pathTo(source)[:kept]
+		var moreExits []StateID
+		moreExits, entrySeq = m.sequencesFrom(prefix, to)
+		for i, sid := range moreExits {
+			if err := m.exit(cx, sid, e); err != nil {
+				return fail(append(exitSeq[:len(exitSeq):len(exitSeq)], moreExits[:i]...), nil, hookError(err), err)
+			}
+		}
+		exitSeq = append(exitSeq[:len(exitSeq):len(exitSeq)], moreExits...)
+	}
+
+	// Entry; states in entrySeq that are still active are re-entered by a self-transition
+	for i, sid := range entrySeq {
+		reentry := m.def.hasReentry && m.def.states[sid].SuppressReentry && m.IsActive(sid) && !slices.Contains(exitSeq, sid)
+		if err := m.enterState(cx, sid, e, reentry); err != nil {
+			return fail(exitSeq, entrySeq[:i], hookError(err), err)
+		}
 	}
 
 	// Commit new state
 	m.statusMu.Lock()
 	// final leaf is the last in entrySeq
 	leaf := entrySeq[len(entrySeq)-1]
+	m.recordHistory(exitSeq)
+	m.leave(exitSeq)
+	m.applyCounters(counters)
+	m.armTimers(entrySeq, nil)
 	m.current = leaf
 	m.activePath = m.pathTo(leaf)
 	for _, sid := range entrySeq {
@@ -367,14 +1327,231 @@ func (m *Machine[C]) handleEvent(e Event) error {
 	}
 	m.statusMu.Unlock()
 
-	m.notify(from, m.current, e, nil)
+	m.finish(from, leaf, e, nil)
 	return nil
 }
 
+// fail applies policy to a transition that failed after exiting exited and entering entered
+// (each in the order they ran), notifies subscribers and returns err, the error reported for
+// the transition; cause is the error returned by the failing action or hook.
+func (m *Machine[C]) fail(cx context.Context, e Event, from StateID, policy FailurePolicy, exited, entered []StateID, err, cause error) error {
+	switch policy {
+	case FailureStayAndIgnore:
+	case FailureMoveToErrorState:
+		if m.errorState == "" {
+			m.rollback(cx, e, exited, entered)
+			break
+		}
+		// the error state's entry hooks see the original error as the last event arg
+		failed := e
+		failed.Args = append(e.Args[:len(e.Args):len(e.Args)], cause)
+		leaf := m.moveTo(cx, failed, from, m.errorState)
+		m.finish(from, leaf, e, err)
+		return err
+	case FailureAbort:
+		m.statusMu.Lock()
+		if m.started {
+			m.started = false
+			m.disarmAllTimers()
+			close(m.done)
+		}
+		m.statusMu.Unlock()
+	default:
+		m.rollback(cx, e, exited, entered)
+	}
+	m.finish(from, from, e, err)
+	return err
+}
+
+// rollback undoes a failed transition as FailureRollback does: it exits the states entered
+// so far and re-enters the exited ones.
+func (m *Machine[C]) rollback(cx context.Context, e Event, exited, entered []StateID) {
+	for i := len(entered) - 1; i >= 0; i-- {
+		_ = m.exit(cx, entered[i], e)
+	}
+	m.reenter(cx, exited)
+}
+
+// moveTo commits the machine to target without running exit hooks, entering target and the
+// ancestors not active at from; entry hook errors are ignored. It returns the new leaf.
+func (m *Machine[C]) moveTo(cx context.Context, e Event, from, target StateID) StateID {
+	exitSeq, entrySeq := m.computeTransitionSequences(from, target)
+	for _, sid := range entrySeq {
+		_ = m.enter(cx, sid, e)
+	}
+	leaf := entrySeq[len(entrySeq)-1]
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	m.leave(exitSeq)
+	m.armTimers(entrySeq, nil)
+	m.current = leaf
+	m.activePath = m.pathTo(leaf)
+	for _, sid := range entrySeq {
+		m.visited[sid] = true
+	}
+	return leaf
+}
+
+// leave disarms the timers and resets the exit counters of the exited states. Must be called
+// with statusMu held.
+func (m *Machine[C]) leave(exitSeq []StateID) {
+	for _, sid := range exitSeq {
+		m.disarmTimer(sid)
+		if !m.def.hasCounterResets {
+			continue
+		}
+		for _, name := range m.def.states[sid].ResetCounters {
+			delete(m.counters, name)
+		}
+	}
+}
+
+// reenter rolls back a failed transition by re-entering the exited states in reverse order.
+func (m *Machine[C]) reenter(cx context.Context, exitSeq []StateID) {
+	for i := len(exitSeq) - 1; i >= 0; i-- {
+		_ = m.enter(cx, exitSeq[i], Event{})
+	}
+}
+
+// enter runs the entry hook of sid, if any, within the state's hook timeout.
+func (m *Machine[C]) enter(cx context.Context, sid StateID, e Event) error {
+	return m.enterState(cx, sid, e, false)
+}
+
+// enterState is enter for a state that may be re-entered by a self-transition.
+func (m *Machine[C]) enterState(cx context.Context, sid StateID, e Event, reentry bool) error {
+	st := m.def.states[sid]
+	if !m.entrySuppressed(st, reentry) {
+		if err := m.runHook(cx, st.OnEntry, st.HookTimeout, e); err != nil {
+			return err
+		}
+	}
+	if subs := m.subscribers().entered; len(subs) > 0 {
+		notifyEach(m, subs, func(l StateEnteredSubscriber) { l.OnStateEntered(sid, e) })
+	}
+	return nil
+}
+
+// entrySuppressed reports whether WithEntryDebounce skips st's entry hook now, recording
+// the run otherwise.
+func (m *Machine[C]) entrySuppressed(st StateDef, reentry bool) bool {
+	if !st.SuppressReentry || st.OnEntry == nil {
+		return false
+	}
+	if reentry {
+		return true
+	}
+	now := time.Now()
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	if last, ok := m.lastEntry[st.ID]; ok && now.Sub(last) < st.ReentryWindow {
+		return true
+	}
+	if m.lastEntry == nil {
+		m.lastEntry = make(map[StateID]time.Time)
+	}
+	m.lastEntry[st.ID] = now
+	return false
+}
+
+// exit runs the exit hook of sid, if any, within the state's hook timeout.
+func (m *Machine[C]) exit(cx context.Context, sid StateID, e Event) error {
+	st := m.def.states[sid]
+	if err := m.runHook(cx, st.OnExit, st.HookTimeout, e); err != nil {
+		return err
+	}
+	if subs := m.subscribers().exited; len(subs) > 0 {
+		notifyEach(m, subs, func(l StateExitedSubscriber) { l.OnStateExited(sid, e) })
+	}
+	return nil
+}
+
+// runHook calls h, giving up with ErrHookTimeout after timeout (if > 0). A hook that times
+// out cannot be interrupted: its context is cancelled, but it keeps running in the background
+// until it returns and its result is discarded.
+func (m *Machine[C]) runHook(cx context.Context, h hookFuncAny, timeout time.Duration, e Event) error {
+	if h == nil || m.skipEffects() {
+		return nil
+	}
+	if timeout <= 0 {
+		return recovered(func() error { return h(cx, e, m.stateContext()) })
+	}
+	return m.runHookTimeout(cx, h, timeout, e)
+}
+
+// runHookTimeout runs h on its own goroutine, bounded by timeout. It is kept apart from
+// runHook so hooks without a timeout do not move their arguments to the heap.
+func (m *Machine[C]) runHookTimeout(cx context.Context, h hookFuncAny, timeout time.Duration, e Event) error {
+	cx, cancel := context.WithTimeout(cx, timeout)
+	defer cancel()
+	res := make(chan error, 1)
+	ctx := m.stateContext()
+	go func() { res <- recovered(func() error { return h(cx, e, ctx) }) }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-res:
+		return err
+	case <-timer.C:
+		return ErrHookTimeout
+	}
+}
+
+// hookError maps a failed entry/exit hook to the error reported for the transition.
+func hookError(err error) error {
+	if err == ErrHookTimeout || errors.Is(err, ErrActionPanicked) {
+		return err
+	}
+	return ErrHookFailed
+}
+
+// actionError maps a failed action to the error reported for the transition.
+func actionError(err error) error {
+	if errors.Is(err, ErrActionPanicked) {
+		return err
+	}
+	return ErrActionFailed
+}
+
+// recovered calls fn, converting a panic into a *PanicError.
+func recovered(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r}
+		}
+	}()
+	return fn()
+}
+
+// choose evaluates the branches of a choice in order and returns the final target with the
+// taken branch; its Action and counters include those of any junctions or further choices
+// it passed through. Returns ErrNoChoiceBranch if no branch is enabled.
+func (m *Machine[C]) choose(cx context.Context, e Event, source, choice StateID) (StateID, TransitionDef, error) {
+	var taken TransitionDef
+	activePath := m.CurrentPath()
+	for {
+		r := m.firstEnabled(cx, e, source, m.def.branches[choice], activePath)
+		if r == nil {
+			return "", TransitionDef{}, ErrNoChoiceBranch
+		}
+		taken.Action = m.chainActions(taken.Action, junctionPath{*r})
+		taken.counters = append(taken.counters, r.counters...)
+		if !m.def.states[r.To].Choice {
+			return r.To, taken, nil
+		}
+		choice = r.To
+	}
+}
+
 // computeTransitionSequences returns exit sequence (leaf->up excluding LCA)
 // and entry sequence (LCA->down including drilling to leaf)
 func (m *Machine[C]) computeTransitionSequences(from StateID, to StateID) ([]StateID, []StateID) {
-	fromPath := m.pathTo(from)
+	return m.sequencesFrom(m.pathTo(from), to)
+}
+
+// sequencesFrom is computeTransitionSequences for an arbitrary active prefix fromPath
+// (root first): it exits the part of fromPath that is not an ancestor of to and enters to.
+func (m *Machine[C]) sequencesFrom(fromPath []StateID, to StateID) ([]StateID, []StateID) {
 	toPath := m.pathTo(to)
 	// find LCA index
 	i := 0
@@ -394,36 +1571,71 @@ func (m *Machine[C]) computeTransitionSequences(from StateID, to StateID) ([]Sta
 	} else {
 		entrySeq = append(entrySeq, to)
 	}
-	// drill down from target to its initial descendants
-	cur := to
-	for {
-		st := m.def.States[cur]
-		if len(st.Children) == 0 {
-			break
-		}
-		child := st.InitialChild
-		entrySeq = append(entrySeq, child)
-		cur = child
-	}
+	// drill down from target to its initial (or remembered) descendants
+	entrySeq = append(entrySeq, m.descendants(to)...)
 	return exitSeq, entrySeq
 }
 
-// pathTo returns path from root to s (inclusive)
-func (m *Machine[C]) pathTo(s StateID) []StateID {
-	// climb to root
-	var rev []StateID
-	cur := s
-	for {
-		rev = append(rev, cur)
-		p := m.def.States[cur].Parent
-		if p == "" {
-			break
+// descendants returns the states entered below s, following recorded history where the
+// composite asks for it and InitialChild otherwise.
+func (m *Machine[C]) descendants(s StateID) []StateID {
+	if !m.def.hasHistory {
+		return m.def.initialDescendants(s)
+	}
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	var drill []StateID
+	for cur := s; len(m.def.states[cur].Children) > 0; {
+		h, ok := m.history[cur]
+		if !ok {
+			h = m.def.states[cur].InitialChild
+		}
+		if m.def.states[cur].History == DeepHistory && ok {
+			// h is a leaf below cur: enter everything between them
+			p := m.pathTo(h)
+			for i, sid := range p {
+				if sid == cur {
+					drill = append(drill, p[i+1:]...)
+					break
+				}
+			}
+		} else {
+			drill = append(drill, h)
 		}
-		cur = p
+		cur = h
 	}
-	// reverse
-	for i, j := 0, len(rev)-1; i < j; i, j = i+1, j-1 {
-		rev[i], rev[j] = rev[j], rev[i]
+	return drill
+}
+
+// recordHistory remembers, for every exited composite with history, the child (shallow)
+// or leaf (deep) it had active.
+// Must be called with statusMu held, before activePath is replaced.
+func (m *Machine[C]) recordHistory(exitSeq []StateID) {
+	if !m.def.hasHistory {
+		return
+	}
+	for _, sid := range exitSeq {
+		if m.def.states[sid].History == NoHistory {
+			continue
+		}
+		for i, s := range m.activePath[:len(m.activePath)-1] {
+			if s == sid {
+				if m.history == nil {
+					m.history = make(map[StateID]StateID)
+				}
+				if m.def.states[sid].History == DeepHistory {
+					m.history[sid] = m.activePath[len(m.activePath)-1]
+				} else {
+					m.history[sid] = m.activePath[i+1]
+				}
+				break
+			}
+		}
 	}
-	return rev
+}
+
+// pathTo returns path from root to s (inclusive).
+// The returned slice is shared with the definition and must not be modified.
+func (m *Machine[C]) pathTo(s StateID) []StateID {
+	return m.def.pathTo(s)
 }
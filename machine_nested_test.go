@@ -1,6 +1,7 @@
 package rfsm
 
 import (
+	"sync/atomic"
 	"testing"
 )
 
@@ -129,3 +130,542 @@ func TestNested_MultiLevel(t *testing.T) {
 		t.Fatalf("want B got %v", m.Current())
 	}
 }
+
+func nestedBenchDef(tb testing.TB) *Definition {
+	tb.Helper()
+	inner, err := NewDef("inner").
+		State("X1", WithInitial()).
+		State("X2", WithFinal()).
+		Current("X1").
+		Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("X", WithSubDef(inner)).
+		State("A2", WithFinal()).
+		Current("X").
+		Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	def, err := NewDef("bench").
+		State("A", WithSubDef(sub), WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "X1", "B").
+		On("back", "B", "A").
+		Build()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return def
+}
+
+// Hierarchy paths are precomputed on the definition; resolving them must not allocate per machine.
+func TestNested_SharedPathsDoNotAllocate(t *testing.T) {
+	def := nestedBenchDef(t)
+	m := NewMachine[any](def, nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = m.pathTo("X1")
+		_ = m.def.initialDescendants("A")
+	})
+	if allocs != 0 {
+		t.Fatalf("path lookups allocated %v times per run", allocs)
+	}
+	if p := m.pathTo("X1"); len(p) != 3 || p[0] != "A" || p[1] != "X" || p[2] != "X1" {
+		t.Fatalf("unexpected path %v", p)
+	}
+}
+
+func BenchmarkNested_Dispatch(b *testing.B) {
+	def := nestedBenchDef(b)
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		b.Fatal(err)
+	}
+	defer m.Stop()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.Dispatch(Event{Name: "go"}); err != nil {
+			b.Fatal(err)
+		}
+		if err := m.Dispatch(Event{Name: "back"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestNested_EventPropagation(t *testing.T) {
+	build := func(opts ...TransitionOption) *Definition {
+		sub, err := NewDef("sub").
+			State("A1", WithInitial()).
+			State("A2", WithFinal()).
+			Current("A1").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		def, err := NewDef("prop").
+			State("A", WithSubDef(sub), WithInitial()).
+			State("B", WithFinal()).
+			Current("A").
+			On("log", "A1", "A2", opts...).
+			On("log", "A", "B").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return def
+	}
+
+	cases := []struct {
+		name string
+		opts []TransitionOption
+		want StateID
+		n    int32 // transitions notified
+	}{
+		{"consumed by default", nil, "A2", 1},
+		{"propagated to parent", []TransitionOption{WithPropagate()}, "B", 2},
+		{"stop overrides propagate", []TransitionOption{WithPropagate(), WithStopPropagation()}, "A2", 1},
+	}
+	for _, c := range cases {
+		m := NewMachine[any](build(c.opts...), nil)
+		var rec recSub
+		m.Subscribe(&rec)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Dispatch(Event{Name: "log"}); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := m.Current(); got != c.want {
+			t.Fatalf("%s: want %s got %s", c.name, c.want, got)
+		}
+		if got := atomic.LoadInt32(&rec.count); got != c.n {
+			t.Fatalf("%s: want %d notifications got %d", c.name, c.n, got)
+		}
+		_ = m.Stop()
+	}
+}
+
+func TestNested_RootFirst(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentAllowed := true
+	def, err := NewDef("root-first").
+		State("A", WithSubDef(sub), WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		BubbleOrder(RootFirst).
+		On("log", "A1", "A2").
+		On("log", "A", "B", WithGuard[any](func(e Event, ctx any) bool { return parentAllowed })).
+		On("reset", "A", "A", WithPropagate()).
+		On("reset", "A1", "A2").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Edit().(*builder).bubbleOrder != RootFirst || def.Clone().BubbleOrder != RootFirst {
+		t.Fatal("bubble order not preserved")
+	}
+
+	run := func(event EventID, want StateID, n int32) {
+		t.Helper()
+		m := NewMachine[any](def, nil)
+		var rec recSub
+		m.Subscribe(&rec)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer m.Stop()
+		if err := m.Dispatch(Event{Name: event}); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Current(); got != want {
+			t.Fatalf("%s: want %s got %s", event, want, got)
+		}
+		if got := atomic.LoadInt32(&rec.count); got != n {
+			t.Fatalf("%s: want %d notifications got %d", event, n, got)
+		}
+	}
+	// the parent overrides the child
+	run("log", "B", 1)
+	// a disabled parent transition falls through to the child
+	parentAllowed = false
+	run("log", "A2", 1)
+	// propagation continues to the re-entered descendants
+	run("reset", "A2", 2)
+}
+
+func TestNested_GuardContext(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("C1", WithInitial()).
+		State("C2", WithFinal()).
+		Current("C1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen GuardContext
+	def, err := NewDef("gc").
+		State("INIT", WithInitial()).
+		State("HEDGE").
+		State("CRYPTO", WithSubDef(sub)).
+		State("UNWIND", WithFinal()).
+		Current("INIT").
+		On("to_crypto", "INIT", "CRYPTO").
+		On("hedge", "INIT", "HEDGE").
+		On("to_crypto", "HEDGE", "CRYPTO").
+		On("unwind", "CRYPTO", "UNWIND", WithGuardContext[any](func(e Event, g GuardContext, ctx any) bool {
+			seen = g
+			return g.HasVisited("HEDGE")
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMachine[any](def, nil, WithMachineID("order-1"))
+	if m.ID() != "order-1" {
+		t.Fatalf("want id order-1 got %q", m.ID())
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "to_crypto"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "unwind"}); err != ErrNoTransition {
+		t.Fatalf("unwind without hedge want ErrNoTransition got %v", err)
+	}
+	if seen.Source != "CRYPTO" || seen.Target != "UNWIND" || seen.MachineID != "order-1" {
+		t.Fatalf("unexpected guard context %+v", seen)
+	}
+	if len(seen.ActivePath) != 2 || seen.ActivePath[1] != "C1" {
+		t.Fatalf("unexpected active path %v", seen.ActivePath)
+	}
+	_ = m.Stop()
+
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	for _, ev := range []string{"hedge", "to_crypto", "unwind"} {
+		if err := m.Dispatch(Event{Name: ev}); err != nil {
+			t.Fatalf("%s: %v", ev, err)
+		}
+	}
+	if m.Current() != "UNWIND" {
+		t.Fatalf("want UNWIND got %v", m.Current())
+	}
+}
+
+func historyDef(t *testing.T, opts ...StateOption) *Definition {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("history").
+		State("A", append([]StateOption{WithSubDef(sub), WithInitial()}, opts...)...).
+		State("P", WithFinal()).
+		Current("A").
+		On("next", "A1", "A2").
+		On("pause", "A", "P").
+		On("resume", "P", "A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return def
+}
+
+func TestNested_ShallowHistory(t *testing.T) {
+	for _, c := range []struct {
+		opts []StateOption
+		want StateID
+	}{
+		{nil, "A1"},
+		{[]StateOption{WithHistory()}, "A2"},
+	} {
+		m := NewMachine[any](historyDef(t, c.opts...), nil)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range []string{"next", "pause", "resume"} {
+			if err := m.Dispatch(Event{Name: ev}); err != nil {
+				t.Fatalf("%s: %v", ev, err)
+			}
+		}
+		if got := m.Current(); got != c.want {
+			t.Fatalf("want %s got %s", c.want, got)
+		}
+		_ = m.Stop()
+	}
+}
+
+func TestNested_HistorySnapshot(t *testing.T) {
+	def := historyDef(t, WithHistory())
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Dispatch(Event{Name: "next"})
+	_ = m.Dispatch(Event{Name: "pause"})
+	data, err := m.SnapshotJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+
+	m2 := NewMachine[any](def, nil)
+	if err := m2.RestoreSnapshotJSON(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	if err := m2.Dispatch(Event{Name: "resume"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m2.Current(); got != "A2" {
+		t.Fatalf("restored history: want A2 got %s", got)
+	}
+
+	bad := &Snapshot{Current: "P", ActivePath: []StateID{"P"}, History: map[StateID]StateID{"A": "P"}}
+	if err := NewMachine[any](def, nil).RestoreSnapshot(bad, 0); err == nil {
+		t.Fatal("want error for history entry outside the composite")
+	}
+}
+
+func TestNested_DeepHistory(t *testing.T) {
+	level3, err := NewDef("level3").
+		State("A1a", WithInitial()).
+		State("A1b", WithFinal()).
+		Current("A1a").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	level2, err := NewDef("level2").
+		State("A1", WithSubDef(level3), WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		opt  StateOption
+		want []StateID
+	}{
+		{WithHistory(), []StateID{"A", "A1", "A1a"}},
+		{WithDeepHistory(), []StateID{"A", "A1", "A1b"}},
+	} {
+		def, err := NewDef("deep").
+			State("A", WithSubDef(level2), WithInitial(), c.opt).
+			State("P", WithFinal()).
+			Current("A").
+			On("next", "A1a", "A1b").
+			On("pause", "A", "P").
+			On("resume", "P", "A").
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewMachine[any](def, nil)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range []string{"next", "pause"} {
+			if err := m.Dispatch(Event{Name: ev}); err != nil {
+				t.Fatalf("%s: %v", ev, err)
+			}
+		}
+		// the history survives a snapshot round trip
+		data, err := m.SnapshotJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = m.Stop()
+		m = NewMachine[any](def, nil)
+		if err := m.RestoreSnapshotJSON(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Dispatch(Event{Name: "resume"}); err != nil {
+			t.Fatal(err)
+		}
+		path := m.CurrentPath()
+		if len(path) != len(c.want) || path[0] != c.want[0] || path[1] != c.want[1] || path[2] != c.want[2] {
+			t.Fatalf("want %v got %v", c.want, path)
+		}
+		if !m.HasVisited("A1b") {
+			t.Fatal("A1b should be visited")
+		}
+		_ = m.Stop()
+	}
+}
+
+func TestNested_HistoryOfNestedComposite(t *testing.T) {
+	level3, err := NewDef("level3").
+		State("Q1", WithInitial()).
+		State("Q2", WithFinal()).
+		Current("Q1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	level2, err := NewDef("level2").
+		State("Q", WithSubDef(level3), WithInitial(), WithHistory()).
+		State("R", WithFinal()).
+		Current("Q").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("outer").
+		State("P", WithSubDef(level2), WithInitial()).
+		State("B", WithFinal()).
+		Current("P").
+		On("next", "Q1", "Q2").
+		On("pause", "P", "B").
+		On("resume", "B", "P").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	for _, ev := range []EventID{"next", "pause", "resume"} {
+		if err := m.Dispatch(Event{Name: ev}); err != nil {
+			t.Fatalf("%s: %v", ev, err)
+		}
+	}
+	// leaving P exits Q too, so Q remembers Q2
+	if got := m.Current(); got != "Q2" {
+		t.Fatalf("want Q2 got %s", got)
+	}
+}
+
+func TestNested_ScopedEvents(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("scoped").
+		State("A", WithSubDef(sub), WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("next", "A1", "A2").
+		On("success", "A2", "A1").
+		On("success", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	// A1 has no local "success": the scoped event must not reach A's own transition
+	if err := m.Dispatch(Event{Name: "success", Scope: "A"}); err != ErrNoTransition {
+		t.Fatalf("want ErrNoTransition got %v", err)
+	}
+	if err := m.Dispatch(Event{Name: "success", Scope: "B"}); err != ErrNoTransition {
+		t.Fatalf("inactive scope: want ErrNoTransition got %v", err)
+	}
+	_ = m.Dispatch(Event{Name: "next"})
+	if err := m.Dispatch(Event{Name: "success", Scope: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Current() != "A1" {
+		t.Fatalf("want A1 got %s", m.Current())
+	}
+	if err := m.Dispatch(Event{Name: "success"}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Current() != "B" {
+		t.Fatalf("want B got %s", m.Current())
+	}
+}
+
+func TestNested_CurrentTop(t *testing.T) {
+	def := historyDef(t)
+	for _, c := range []struct {
+		opts []MachineOption
+		want StateID
+	}{
+		{nil, "A1"},
+		{[]MachineOption{WithCurrentMode(CurrentModeTop)}, "A"},
+	} {
+		m := NewMachine[any](def, nil, c.opts...)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Current(); got != c.want {
+			t.Fatalf("Current: want %s got %s", c.want, got)
+		}
+		if got := m.CurrentTop(); got != "A" {
+			t.Fatalf("CurrentTop: want A got %s", got)
+		}
+		if snap := m.Snapshot(); snap.Current != "A1" {
+			t.Fatalf("snapshots always record the leaf, got %s", snap.Current)
+		}
+		_ = m.Stop()
+	}
+}
+
+func TestNested_Configuration(t *testing.T) {
+	m := NewMachine[any](historyDef(t, WithHistory()), nil)
+	if cfg := m.Configuration(); cfg.Running || len(cfg.Path) != 0 {
+		t.Fatalf("unstarted machine: %+v", cfg)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	_ = m.Dispatch(Event{Name: "next"})
+
+	cfg := m.Configuration()
+	if !cfg.Running || cfg.Leaf != "A2" || len(cfg.Path) != 2 || cfg.Path[0] != "A" {
+		t.Fatalf("unexpected configuration %+v", cfg)
+	}
+	if cfg.Children["A"] != "A2" || len(cfg.Children) != 1 {
+		t.Fatalf("children: %v", cfg.Children)
+	}
+	if !cfg.Final || len(cfg.Finals) != 1 || cfg.Finals[0] != "A2" {
+		t.Fatalf("finals: %v %v", cfg.Final, cfg.Finals)
+	}
+	if !cfg.IsActive("A") || cfg.IsActive("P") {
+		t.Fatal("IsActive disagrees with Path")
+	}
+
+	_ = m.Dispatch(Event{Name: "pause"})
+	cfg = m.Configuration()
+	if cfg.Leaf != "P" || cfg.History["A"] != "A2" || len(cfg.Children) != 0 {
+		t.Fatalf("after pause: %+v", cfg)
+	}
+	cfg.Path[0] = "X"
+	if m.CurrentPath()[0] != "P" {
+		t.Fatal("Configuration must return copies")
+	}
+}
@@ -1,7 +1,10 @@
 package rfsm
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -207,6 +210,61 @@ func TestMachine_Stop_ExitHookFailure(t *testing.T) {
 	}
 }
 
+func TestMachine_StopPolicy(t *testing.T) {
+	var exits []StateID
+	exit := func(id StateID, fail bool) StateOption {
+		return WithExit[any](func(e Event, ctx any) error {
+			exits = append(exits, id)
+			if fail {
+				return errors.New(id + " failed")
+			}
+			return nil
+		})
+	}
+	sub, err := NewDef("sub").
+		State("LEAF", WithInitial(), WithFinal(), exit("LEAF", true)).
+		Current("LEAF").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mid, err := NewDef("mid").
+		State("MID", WithInitial(), WithFinal(), WithSubDef(sub), exit("MID", false)).
+		Current("MID").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("test").
+		State("ROOT", WithInitial(), WithFinal(), WithSubDef(mid), exit("ROOT", true)).
+		Current("ROOT").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMachine[any](def, nil)
+	_ = m.Start()
+	var se *StopError
+	if err := m.Stop(); !errors.As(err, &se) || err.Error() != "LEAF failed" {
+		t.Fatalf("want StopError for LEAF got %v", err)
+	}
+	if len(se.Exited) != 0 || fmt.Sprint(se.Failed) != "[LEAF]" || fmt.Sprint(exits) != "[LEAF]" {
+		t.Fatalf("abort should stop at LEAF: exited %v failed %v hooks %v", se.Exited, se.Failed, exits)
+	}
+
+	exits = nil
+	m = NewMachine[any](def, nil, WithStopPolicy(StopExitAll))
+	_ = m.Start()
+	err = m.Stop()
+	if !errors.As(err, &se) || !strings.Contains(err.Error(), "LEAF failed") || !strings.Contains(err.Error(), "ROOT failed") {
+		t.Fatalf("want both errors joined got %v", err)
+	}
+	if fmt.Sprint(se.Exited) != "[MID]" || fmt.Sprint(se.Failed) != "[LEAF ROOT]" || fmt.Sprint(exits) != "[LEAF MID ROOT]" {
+		t.Fatalf("unexpected exited %v failed %v hooks %v", se.Exited, se.Failed, exits)
+	}
+}
+
 func TestMachine_StartTwice(t *testing.T) {
 	def, err := NewDef("test").
 		State("A", WithInitial(), WithFinal()).
@@ -249,6 +307,69 @@ func TestMachine_StopTwice(t *testing.T) {
 	}
 }
 
+func TestMachine_StopDuringDispatch(t *testing.T) {
+	handled := make(chan struct{}, 1)
+	def, err := NewDef("test").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("flip", "A", "B", WithAction[any](func(e Event, ctx any) error {
+			select {
+			case handled <- struct{}{}:
+			default:
+			}
+			time.Sleep(50 * time.Microsecond)
+			return nil
+		})).
+		On("flip", "B", "A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 50; round++ {
+		m := NewMachine[any](def, nil)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 16*20)
+		for g := 0; g < 16; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					if g%2 == 0 {
+						errs <- m.Dispatch(Event{Name: "flip"})
+						continue
+					}
+					if err := m.DispatchAsyncCb(Event{Name: "flip"}, func(err error) { errs <- err }); err != nil {
+						errs <- err
+					}
+				}
+			}()
+		}
+		<-handled
+		time.Sleep(time.Duration(round%5) * 100 * time.Microsecond)
+		if err := m.Stop(); err != nil {
+			t.Fatal(err)
+		}
+		finished := make(chan struct{})
+		go func() { wg.Wait(); close(finished) }()
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Dispatch blocked after Stop")
+		}
+		close(errs)
+		for err := range errs {
+			// dispatches made once Stop returned are rejected as not started
+			if err != nil && !errors.Is(err, ErrMachineStopped) && !errors.Is(err, ErrMachineNotStarted) {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+	}
+}
+
 func TestMachine_EntryHookFailure_Rollback(t *testing.T) {
 	var entryA, exitA, entryB int32
 	def, err := NewDef("test").
@@ -661,6 +782,48 @@ func TestMachine_Next_BeforeStart(t *testing.T) {
 	}
 }
 
+func TestMachine_AvailableEvents(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		On("next", "A1", "A2").
+		On("cancel", "A1", "A2", WithGuard(func(e Event, open *bool) bool { return *open })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("avail").
+		State("A", WithInitial(), WithSubDef(sub)).
+		State("B", WithFinal()).
+		Current("A").
+		On("cancel", "A", "B").
+		On("close", "A", "B", WithGuard(func(e Event, open *bool) bool { return !*open })).
+		On("fiat.*", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := true
+	m := NewMachine(def, &open)
+	if got := m.AvailableEvents(false); got != nil {
+		t.Fatalf("want nil before start got %v", got)
+	}
+	_ = m.Start()
+	defer m.Stop()
+	if got := fmt.Sprint(m.AvailableEvents(false)); got != "[cancel close fiat.* next]" {
+		t.Fatalf("unexpected events %s", got)
+	}
+	if got := fmt.Sprint(m.AvailableEvents(true)); got != "[cancel fiat.* next]" {
+		t.Fatalf("unexpected enabled events %s", got)
+	}
+	// cancel stays available through A once the child's guard rejects it
+	m.SetStateContext(func(*bool) *bool { closed := false; return &closed })
+	if got := fmt.Sprint(m.AvailableEvents(true)); got != "[cancel close fiat.* next]" {
+		t.Fatalf("unexpected enabled events %s", got)
+	}
+}
+
 func TestMachine_SetStateContext_ValueType(t *testing.T) {
 	type Counter struct {
 		Value int
@@ -866,3 +1029,1010 @@ func TestMachine_SetStateContext_WithHooks(t *testing.T) {
 		t.Fatalf("exit hooks want 1 got %d", atomic.LoadInt32(&exitCounter))
 	}
 }
+
+func TestMachine_SlowHooksDoNotBlockStatusReaders(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan []StateID, 1)
+	var m *Machine[any]
+	def, err := NewDef("slow").
+		State("A", WithInitial(), WithEntry[any](func(e Event, ctx any) error {
+			// reading status from inside a hook must not deadlock
+			entered <- m.CurrentPath()
+			<-release
+			return nil
+		})).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B", WithAction[any](func(e Event, ctx any) error {
+			<-release
+			return nil
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = NewMachine[any](def, nil)
+
+	startErr := make(chan error, 1)
+	go func() { startErr <- m.Start() }()
+	select {
+	case p := <-entered:
+		if len(p) != 1 || p[0] != "A" {
+			t.Fatalf("hook saw path %v", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("entry hook could not read CurrentPath during Start")
+	}
+
+	readersDone := make(chan struct{})
+	go func() {
+		_ = m.Current()
+		_ = m.IsActive("A")
+		close(readersDone)
+	}()
+	select {
+	case <-readersDone:
+	case <-time.After(time.Second):
+		t.Fatal("status readers blocked by slow entry hook")
+	}
+	if err := m.Dispatch(Event{Name: "go"}); !errors.Is(err, ErrMachineNotStarted) {
+		t.Fatalf("dispatch during start want ErrMachineNotStarted got %v", err)
+	}
+
+	release <- struct{}{}
+	if err := <-startErr; err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	dispatchErr := make(chan error, 1)
+	go func() { dispatchErr <- m.Dispatch(Event{Name: "go"}) }()
+	time.Sleep(10 * time.Millisecond)
+	readersDone = make(chan struct{})
+	go func() {
+		_ = m.CurrentPath()
+		close(readersDone)
+	}()
+	select {
+	case <-readersDone:
+	case <-time.After(time.Second):
+		t.Fatal("status readers blocked by slow action")
+	}
+	close(release)
+	if err := <-dispatchErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Run with -race: hooks on the loop goroutine read the context while other goroutines replace it.
+func TestMachine_SetStateContext_RaceWithHooks(t *testing.T) {
+	type Ctx struct {
+		N    int
+		Tags []string
+	}
+	var seen int64
+	read := func(e Event, c Ctx) error {
+		atomic.AddInt64(&seen, int64(c.N+len(c.Tags)))
+		return nil
+	}
+	def, err := NewDef("race").
+		State("A", WithInitial(), WithEntry(read), WithExit(read)).
+		State("B", WithFinal(), WithEntry(read), WithExit(read)).
+		Current("A").
+		On("go", "A", "B").
+		On("back", "B", "A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine(def, Ctx{})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			m.SetStateContext(func(c Ctx) Ctx {
+				c.N++
+				c.Tags = append(append([]string(nil), c.Tags...), "t")
+				return c
+			})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = m.Dispatch(Event{Name: "go"})
+			_ = m.Dispatch(Event{Name: "back"})
+			_ = m.Snapshot()
+		}
+	}()
+	wg.Wait()
+	if got := m.GetStateContext(); got.N != 200 || len(got.Tags) != 200 {
+		t.Fatalf("lost updates: %d %d", got.N, len(got.Tags))
+	}
+}
+
+func TestMachine_SetStateContext_FromAction(t *testing.T) {
+	var m *Machine[int]
+	def, err := NewDef("self").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B", WithAction(func(e Event, c int) error {
+			m.SetStateContext(func(c int) int { return c + 1 })
+			return nil
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = NewMachine(def, 41)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetStateContext(); got != 42 {
+		t.Fatalf("want 42 got %d", got)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	def, err := NewDef("timeout").
+		State("A", WithInitial()).
+		State("B", WithFinal(), WithHookTimeout(20*time.Millisecond),
+			WithEntry[any](func(e Event, _ any) error { <-release; return nil })).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	start := time.Now()
+	if err := m.Dispatch(Event{Name: "go"}); err != ErrHookTimeout {
+		t.Fatalf("want ErrHookTimeout got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("hung hook blocked the machine for %v", elapsed)
+	}
+	if m.Current() != "A" {
+		t.Fatalf("want rollback to A got %s", m.Current())
+	}
+}
+
+type ctxKey struct{}
+
+func TestDispatchContext(t *testing.T) {
+	var seen []string
+	record := func(cx context.Context, what string) {
+		if v, _ := cx.Value(ctxKey{}).(string); v != "" {
+			seen = append(seen, what+":"+v)
+		}
+	}
+	cancelled := make(chan struct{})
+	def, err := NewDef("ctx").
+		State("A", WithInitial(), WithExitCtx[any](func(cx context.Context, e Event, _ any) error {
+			record(cx, "exit")
+			return nil
+		})).
+		State("B", WithEntryCtx[any](func(cx context.Context, e Event, _ any) error {
+			record(cx, "entry")
+			return nil
+		})).
+		State("C", WithFinal(), WithHookTimeout(10*time.Millisecond),
+			WithEntryCtx[any](func(cx context.Context, e Event, _ any) error {
+				<-cx.Done()
+				close(cancelled)
+				return cx.Err()
+			})).
+		Current("A").
+		On("go", "A", "B",
+			WithGuardCtx[any](func(cx context.Context, e Event, _ any) bool { record(cx, "guard"); return true }),
+			WithActionCtx[any](func(cx context.Context, e Event, _ any) error { record(cx, "action"); return nil })).
+		On("hang", "B", "C").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.DispatchContext(done, Event{Name: "go"}); err != context.Canceled {
+		t.Fatalf("want context.Canceled got %v", err)
+	}
+	if m.Current() != "A" || len(seen) != 0 {
+		t.Fatalf("cancelled event was processed: %s %v", m.Current(), seen)
+	}
+
+	cx := context.WithValue(context.Background(), ctxKey{}, "req-1")
+	if err := m.DispatchContext(cx, Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"guard:req-1", "exit:req-1", "action:req-1", "entry:req-1"}
+	if len(seen) != len(want) {
+		t.Fatalf("want %v got %v", want, seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Fatalf("want %v got %v", want, seen)
+		}
+	}
+
+	// a hook timeout cancels the hook's context
+	if err := m.Dispatch(Event{Name: "hang"}); err != ErrHookTimeout {
+		t.Fatalf("want ErrHookTimeout got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("timed out hook's context was not cancelled")
+	}
+}
+
+type lifecycleSub struct{ log []string }
+
+func (s *lifecycleSub) OnTransition(from StateID, to StateID, e Event, err error) {
+	s.log = append(s.log, "transition:"+from+">"+to)
+}
+func (s *lifecycleSub) OnStateEntered(st StateID, e Event) { s.log = append(s.log, "entered:"+st) }
+func (s *lifecycleSub) OnStateExited(st StateID, e Event)  { s.log = append(s.log, "exited:"+st) }
+func (s *lifecycleSub) OnGuardRejected(source, target StateID, e Event) {
+	s.log = append(s.log, "rejected:"+source+">"+target)
+}
+func (s *lifecycleSub) OnActionStarted(source, target StateID, e Event) {
+	s.log = append(s.log, "action:"+source+">"+target)
+}
+func (s *lifecycleSub) OnActionFinished(source, target StateID, e Event, err error) {
+	s.log = append(s.log, "done:"+source+">"+target)
+}
+
+func TestLifecycleSubscriber(t *testing.T) {
+	def, err := NewDef("lifecycle").
+		State("A", WithInitial()).
+		State("B").
+		State("C", WithFinal()).
+		Current("A").
+		On("go", "A", "C", WithGuard(func(e Event, _ any) bool { return false })).
+		On("go", "A", "B", WithAction(func(e Event, _ any) error { return nil })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	sub := &lifecycleSub{}
+	m.Subscribe(sub)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+
+	want := []string{
+		"entered:A",
+		"rejected:A>C", "exited:A", "action:A>B", "done:A>B", "entered:B", "transition:A>B",
+		"exited:B",
+	}
+	if len(sub.log) != len(want) {
+		t.Fatalf("want %v got %v", want, sub.log)
+	}
+	for i := range want {
+		if sub.log[i] != want[i] {
+			t.Fatalf("want %v got %v", want, sub.log)
+		}
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var entries int32
+	errBoom := errors.New("boom")
+	def, err := NewDef("panics").
+		State("A", WithInitial(), WithEntry[any](func(e Event, _ any) error { atomic.AddInt32(&entries, 1); return nil })).
+		State("B", WithEntry[any](func(e Event, _ any) error { panic(errBoom) })).
+		State("C", WithFinal()).
+		Current("A").
+		On("action", "A", "C", WithAction(func(e Event, _ any) error { panic("bad input") })).
+		On("hook", "A", "B").
+		On("guard", "A", "C", WithGuard(func(e Event, _ any) bool { panic("guard") })).
+		On("ok", "A", "C").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	sub := &errSub{}
+	m.Subscribe(sub)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	err = m.Dispatch(Event{Name: "action"})
+	var pe *PanicError
+	if !errors.Is(err, ErrActionPanicked) || !errors.As(err, &pe) || pe.Value != "bad input" {
+		t.Fatalf("want a PanicError for the action, got %v", err)
+	}
+	if sub.lastErr != err {
+		t.Fatalf("subscribers should see the panic, got %v", sub.lastErr)
+	}
+	if m.Current() != "A" || atomic.LoadInt32(&entries) != 2 {
+		t.Fatalf("want rollback into A, at %s with %d entries", m.Current(), entries)
+	}
+
+	if err := m.Dispatch(Event{Name: "hook"}); !errors.Is(err, ErrActionPanicked) || !errors.Is(err, errBoom) {
+		t.Fatalf("want a PanicError wrapping errBoom for the hook, got %v", err)
+	}
+	if err := m.Dispatch(Event{Name: "guard"}); !errors.Is(err, ErrActionPanicked) {
+		t.Fatalf("want a PanicError for the guard, got %v", err)
+	}
+	if m.Current() != "A" {
+		t.Fatalf("want A got %s", m.Current())
+	}
+	if err := m.Dispatch(Event{Name: "ok"}); err != nil {
+		t.Fatalf("machine should keep working after panics: %v", err)
+	}
+}
+
+func TestFailurePolicy(t *testing.T) {
+	type counts struct{ entryA, exitA, entryErr int32 }
+	build := func(c *counts, opts ...TransitionOption) *Definition {
+		def, err := NewDef("failure").
+			State("A", WithInitial(),
+				WithEntry[any](func(e Event, _ any) error { atomic.AddInt32(&c.entryA, 1); return nil }),
+				WithExit[any](func(e Event, _ any) error { atomic.AddInt32(&c.exitA, 1); return nil })).
+			State("B", WithEntry[any](func(e Event, _ any) error { return errors.New("down") })).
+			State("ERROR", WithFinal(), WithEntry[any](func(e Event, _ any) error { atomic.AddInt32(&c.entryErr, 1); return nil })).
+			Current("A").
+			On("go", "A", "B", opts...).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return def
+	}
+
+	for _, tc := range []struct {
+		name     string
+		machine  FailurePolicy
+		override FailurePolicy
+		want     StateID
+		entriesA int32
+		entryErr int32
+		stopped  bool
+	}{
+		{"default rolls back", FailureDefault, FailureDefault, "A", 2, 0, false},
+		{"rollback", FailureRollback, FailureDefault, "A", 2, 0, false},
+		{"stay", FailureStayAndIgnore, FailureDefault, "A", 1, 0, false},
+		{"error state", FailureMoveToErrorState, FailureDefault, "ERROR", 1, 1, false},
+		{"abort", FailureAbort, FailureDefault, "A", 1, 0, true},
+		{"transition override", FailureRollback, FailureStayAndIgnore, "A", 1, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c counts
+			var topts []TransitionOption
+			if tc.override != FailureDefault {
+				topts = append(topts, WithOnFailure(tc.override))
+			}
+			m := NewMachine[any](build(&c, topts...), nil, WithFailurePolicy(tc.machine), WithErrorState("ERROR"))
+			if err := m.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer m.Stop()
+			if err := m.Dispatch(Event{Name: "go"}); err != ErrHookFailed {
+				t.Fatalf("want ErrHookFailed got %v", err)
+			}
+			if m.Current() != tc.want {
+				t.Fatalf("want %s got %s", tc.want, m.Current())
+			}
+			if c.exitA != 1 || c.entryA != tc.entriesA || c.entryErr != tc.entryErr {
+				t.Fatalf("unexpected hook counts %+v", c)
+			}
+			if err := m.Dispatch(Event{Name: "noop"}); (err == ErrMachineNotStarted) != tc.stopped {
+				t.Fatalf("stopped=%v, next dispatch got %v", tc.stopped, err)
+			}
+		})
+	}
+}
+
+func TestFailurePolicy_ErrorStateFallback(t *testing.T) {
+	var entriesA, exitsB int32
+	sub, err := NewDef("sub").
+		State("B1", WithInitial()).
+		State("B2", WithFinal(), WithEntry[any](func(e Event, _ any) error { return errors.New("down") })).
+		Current("B1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("fallback").
+		State("B", WithInitial(), WithSubDef(sub), WithExit[any](func(e Event, _ any) error { atomic.AddInt32(&exitsB, 1); return nil })).
+		State("A", WithEntry[any](func(e Event, _ any) error { atomic.AddInt32(&entriesA, 1); return nil })).
+		State("DONE", WithFinal()).
+		Current("B").
+		On("go", "B", "A").
+		On("fail", "A", "B2").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewMachine[any](def, nil, WithErrorState("NOWHERE")).Start(); err == nil {
+		t.Fatal("want Start to reject an unknown error state")
+	}
+	snap := &Snapshot{Current: "B1", ActivePath: []StateID{"B", "B1"}}
+	if err := NewMachine[any](def, nil, WithErrorState("NOWHERE")).RestoreSnapshot(snap, 0); err == nil {
+		t.Fatal("want RestoreSnapshot to reject an unknown error state")
+	}
+
+	// without an error state, the transition is rolled back
+	m := NewMachine[any](def, nil, WithFailurePolicy(FailureMoveToErrorState))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "fail"}); err != ErrHookFailed {
+		t.Fatalf("want ErrHookFailed got %v", err)
+	}
+	if got := m.CurrentPath(); len(got) != 1 || got[0] != "A" {
+		t.Fatalf("want rollback into A, at %v", got)
+	}
+	if n := atomic.LoadInt32(&entriesA); n != 2 {
+		t.Fatalf("A should be re-entered by the rollback, entered %d times", n)
+	}
+	// B was exited by go, then entered and exited again by the rollback
+	if n := atomic.LoadInt32(&exitsB); n != 2 {
+		t.Fatalf("entered states should be exited again, B exited %d times", n)
+	}
+}
+
+type panicSub struct{}
+
+func (panicSub) OnTransition(from StateID, to StateID, e Event, err error) { panic("listener bug") }
+
+func TestSubscriberPanicIsolation(t *testing.T) {
+	def, err := NewDef("subs").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported any
+	m := NewMachine[any](def, nil, WithSubscriberPanicHandler(func(s Subscriber, v any) { reported = v }))
+	after := &errSub{lastErr: errors.New("not notified")}
+	m.Subscribe(panicSub{})
+	m.Subscribe(after)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatalf("a subscriber panic must not fail the transition: %v", err)
+	}
+	if m.Current() != "B" {
+		t.Fatalf("want B got %s", m.Current())
+	}
+	if after.lastErr != nil {
+		t.Fatalf("later subscribers should still be notified, got %v", after.lastErr)
+	}
+	if reported != "listener bug" || m.SubscriberPanics() != 1 {
+		t.Fatalf("panic not reported: %v, count %d", reported, m.SubscriberPanics())
+	}
+}
+
+func TestSubscriberPanicIsolation_Consecutive(t *testing.T) {
+	def, err := NewDef("subs").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported []Subscriber
+	m := NewMachine[any](def, nil, WithSubscriberPanicHandler(func(s Subscriber, v any) { reported = append(reported, s) }))
+	first, last := &errSub{lastErr: errors.New("not notified")}, &errSub{lastErr: errors.New("not notified")}
+	m.Subscribe(first)
+	m.Subscribe(panicSub{})
+	m.Subscribe(panicSub{})
+	m.Subscribe(last)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if first.lastErr != nil || last.lastErr != nil {
+		t.Fatalf("subscribers around the panicking ones must be notified: %v, %v", first.lastErr, last.lastErr)
+	}
+	if len(reported) != 2 || m.SubscriberPanics() != 2 {
+		t.Fatalf("want 2 reported panics, got %v (count %d)", reported, m.SubscriberPanics())
+	}
+	if _, ok := reported[0].(panicSub); !ok {
+		t.Fatalf("panic reported for the wrong subscriber: %T", reported[0])
+	}
+}
+
+func TestNotify_DoesNotAllocate(t *testing.T) {
+	def, err := NewDef("subs").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	for range 50 {
+		m.Subscribe(&errSub{})
+	}
+	e := Event{Name: "go"}
+	allocs := testing.AllocsPerRun(100, func() {
+		m.notify("A", "B", e, nil)
+		notifyEach(m, m.subscribers().entered, func(l StateEnteredSubscriber) { l.OnStateEntered("B", e) })
+	})
+	if allocs != 0 {
+		t.Fatalf("notifying subscribers allocated %v times per run", allocs)
+	}
+}
+
+func TestOnErrorState(t *testing.T) {
+	errDown := errors.New("down")
+	var got error
+	def, err := NewDef("on-error").
+		State("A", WithInitial()).
+		State("B").
+		State("FAILED", WithFinal(), WithEntry[any](func(e Event, _ any) error {
+			got, _ = e.Args[len(e.Args)-1].(error)
+			return nil
+		})).
+		Current("A").
+		On("go", "A", "B", WithAction(func(e Event, _ any) error { return errDown })).
+		On("retry", "A", "B", WithAction(func(e Event, _ any) error { return errDown }), WithOnFailure(FailureRollback)).
+		OnError("FAILED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.ErrorState != "FAILED" || def.Edit().(*builder).errorState != "FAILED" {
+		t.Fatalf("unexpected error state %q", def.ErrorState)
+	}
+	if _, err := def.Edit().OnError("MISSING").Build(); err == nil {
+		t.Fatal("want error for an undefined error state")
+	}
+
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "retry", Args: []any{1}}); err != ErrActionFailed || m.Current() != "A" {
+		t.Fatalf("transition override should roll back: %v, at %s", err, m.Current())
+	}
+	if err := m.Dispatch(Event{Name: "go", Args: []any{1}}); err != ErrActionFailed {
+		t.Fatalf("want ErrActionFailed got %v", err)
+	}
+	if m.Current() != "FAILED" {
+		t.Fatalf("want FAILED got %s", m.Current())
+	}
+	if got != errDown {
+		t.Fatalf("error state should receive the original error in its event args, got %v", got)
+	}
+	_ = m.Stop()
+
+	// a machine-level policy still wins
+	m = NewMachine[any](def, nil, WithFailurePolicy(FailureStayAndIgnore))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	_ = m.Dispatch(Event{Name: "go"})
+	if m.Current() != "A" {
+		t.Fatalf("want A got %s", m.Current())
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var calls, failed int
+	flaky := WithAction(func(e Event, ctx any) error {
+		if calls++; calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	down := WithAction(func(e Event, ctx any) error { failed++; return errors.New("down") })
+	def, err := NewDef("retry").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B", WithRetry(3, ConstantBackoff(time.Millisecond)), flaky).
+		On("fail", "A", "B", down, WithRetry(2, nil)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "fail"}); err != ErrActionFailed || failed != 2 {
+		t.Fatalf("want ErrActionFailed after 2 attempts, got %v after %d", err, failed)
+	}
+	if err := m.Dispatch(Event{Name: "go"}); err != nil || m.Current() != "B" {
+		t.Fatalf("want success on the third attempt, got %v at %s", err, m.Current())
+	}
+	if calls != 3 {
+		t.Fatalf("want 3 attempts got %d", calls)
+	}
+
+	if d := ExponentialBackoff(time.Millisecond, 5*time.Millisecond); d(1) != time.Millisecond || d(3) != 4*time.Millisecond || d(10) != 5*time.Millisecond {
+		t.Fatal("unexpected exponential backoff")
+	}
+}
+
+func TestDispatchAsyncCb(t *testing.T) {
+	def, err := NewDef("async").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.DispatchAsyncCb(Event{Name: "go"}, func(error) {}); !errors.Is(err, ErrMachineNotStarted) {
+		t.Fatalf("want ErrMachineNotStarted got %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	results := make(chan error, 3)
+	args := []any{1}
+	_ = m.DispatchAsyncCb(Event{Name: "nope", Args: args}, func(err error) { results <- err })
+	_ = m.DispatchAsyncCb(Event{Name: "go"}, func(err error) { panic("callback") })
+	_ = m.DispatchAsyncCb(Event{Name: "go"}, func(err error) { results <- err })
+	if err := <-results; !errors.Is(err, ErrNoTransition) {
+		t.Fatalf("want ErrNoTransition got %v", err)
+	}
+	if err := <-results; !errors.Is(err, ErrNoTransition) {
+		t.Fatalf("second go should fail from B, got %v", err)
+	}
+	if m.Current() != "B" || len(args) != 1 || cap(args) != 1 {
+		t.Fatalf("unexpected state %s or caller args modified", m.Current())
+	}
+}
+
+func TestIfVisited(t *testing.T) {
+	def, err := NewDef("unwind").
+		State("INIT", WithInitial()).
+		State("HEDGED").
+		State("CRYPTO").
+		State("UNWIND_HEDGE", WithFinal()).
+		State("CLOSED", WithFinal()).
+		Current("INIT").
+		On("hedge", "INIT", "HEDGED").
+		On("buy", "INIT", "CRYPTO").
+		On("buy", "HEDGED", "CRYPTO").
+		On("fail", "CRYPTO", "UNWIND_HEDGE", IfVisited("HEDGED"), WithGuard(func(e Event, ctx any) bool { return true })).
+		On("fail", "CRYPTO", "CLOSED", IfNotVisited("HEDGED")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := def.ToMermaidOpts(VisualOptions{ShowGuards: true}); !strings.Contains(out, "fail [guard]") {
+		t.Fatalf("conditions should be rendered as guards:\n%s", out)
+	}
+
+	run := func(want StateID, events ...EventID) {
+		t.Helper()
+		m := NewMachine[any](def, nil)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer m.Stop()
+		for _, ev := range events {
+			if err := m.Dispatch(Event{Name: ev}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if m.Current() != want {
+			t.Fatalf("want %s got %s", want, m.Current())
+		}
+	}
+	run("UNWIND_HEDGE", "hedge", "buy", "fail")
+	run("CLOSED", "buy", "fail")
+}
+
+func TestCounterHelpers(t *testing.T) {
+	def, err := NewDef("counters").
+		State("IDLE", WithInitial()).
+		State("CALLING", WithCounterResetOnExit("other")).
+		State("GAVE_UP", WithCounterResetOnExit("attempts")).
+		State("DONE", WithFinal()).
+		Current("IDLE").
+		On("start", "IDLE", "CALLING", WithCounterIncrement("other")).
+		On("fail", "CALLING", "CALLING", IfCounterBelow("attempts", 2), WithCounterIncrement("attempts")).
+		On("fail", "CALLING", "GAVE_UP", IfCounterAtLeast("attempts", 2)).
+		On("reset", "GAVE_UP", "IDLE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	dispatch := func(ev EventID, want StateID) {
+		t.Helper()
+		if err := m.Dispatch(Event{Name: ev}); err != nil {
+			t.Fatal(err)
+		}
+		if m.Current() != want {
+			t.Fatalf("%s: want %s got %s", ev, want, m.Current())
+		}
+	}
+	dispatch("start", "CALLING")
+	dispatch("fail", "CALLING")
+	// self-transitions do not exit the state
+	if m.Counter("other") != 1 || m.Counter("attempts") != 1 {
+		t.Fatalf("unexpected counters other=%d attempts=%d", m.Counter("other"), m.Counter("attempts"))
+	}
+	dispatch("fail", "CALLING")
+	dispatch("fail", "GAVE_UP")
+	if m.Counter("other") != 0 || m.Counter("attempts") != 2 {
+		t.Fatalf("unexpected counters other=%d attempts=%d", m.Counter("other"), m.Counter("attempts"))
+	}
+	dispatch("reset", "IDLE")
+	if m.Counter("attempts") != 0 {
+		t.Fatalf("counter not reset on exit: %d", m.Counter("attempts"))
+	}
+}
+
+func TestCounterResetOnExit_Nested(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("CALLING", WithInitial(), WithCounterResetOnExit("attempts")).
+		State("DONE", WithFinal()).
+		Current("CALLING").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("nested-counters").
+		State("ORDER", WithInitial(), WithSubDef(sub)).
+		State("CANCELLED", WithFinal()).
+		Current("ORDER").
+		On("fail", "CALLING", "CALLING", WithInternal(), WithCounterIncrement("attempts")).
+		On("cancel", "ORDER", "CANCELLED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	for _, ev := range []EventID{"fail", "cancel"} {
+		if err := m.Dispatch(Event{Name: ev}); err != nil {
+			t.Fatalf("%s: %v", ev, err)
+		}
+	}
+	if n := m.Counter("attempts"); n != 0 {
+		t.Fatalf("counter of CALLING not reset when its parent was exited: %d", n)
+	}
+}
+
+func TestEntryDebounce(t *testing.T) {
+	var quoted, notified int
+	def, err := NewDef("requote").
+		State("IDLE", WithInitial()).
+		State("QUOTED", WithEntryDebounce(0), WithEntry[any](func(e Event, ctx any) error { quoted++; return nil })).
+		State("NOTIFY", WithEntryDebounce(time.Hour), WithEntry[any](func(e Event, ctx any) error { notified++; return nil })).
+		State("DONE", WithFinal()).
+		Current("IDLE").
+		On("quote", "IDLE", "QUOTED").
+		On("requote", "QUOTED", "QUOTED").
+		On("cancel", "QUOTED", "IDLE").
+		On("notify", "IDLE", "NOTIFY").
+		On("back", "NOTIFY", "IDLE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	for _, ev := range []EventID{"quote", "requote", "requote", "cancel", "quote", "cancel", "notify", "back", "notify"} {
+		if err := m.Dispatch(Event{Name: ev}); err != nil {
+			t.Fatalf("%s: %v", ev, err)
+		}
+	}
+	// self-transitions are suppressed, entering from another state is not
+	if quoted != 2 {
+		t.Fatalf("want 2 QUOTED entries got %d", quoted)
+	}
+	// re-entered within the window
+	if notified != 1 {
+		t.Fatalf("want 1 NOTIFY entry got %d", notified)
+	}
+}
+
+type orderSub struct{ log *[]string }
+
+func (s orderSub) OnTransition(from, to StateID, e Event, err error) {
+	*s.log = append(*s.log, "subscriber "+to)
+}
+
+type orderStore struct {
+	MemoryEventStore
+	log *[]string
+}
+
+func (s *orderStore) Append(r EventRecord) (uint64, error) {
+	*s.log = append(*s.log, "persist "+r.Event.Name)
+	return s.MemoryEventStore.Append(r)
+}
+
+func TestBeforeAfterTransition(t *testing.T) {
+	var log []string
+	def, err := NewDef("hooks").
+		State("A", WithInitial()).
+		State("B", WithExit[any](func(e Event, ctx any) error { log = append(log, "exit B"); return nil })).
+		State("C", WithFinal()).
+		Current("A").
+		On("go", "A", "B", WithAction(func(e Event, ctx any) error { log = append(log, "action"); return nil })).
+		On("fail", "B", "C", WithAction(func(e Event, ctx any) error { return errors.New("boom") })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil, WithEventStore(&orderStore{log: &log}))
+	m.BeforeTransition(func(from, to StateID, e Event) { log = append(log, "before "+from+"->"+to) })
+	m.AfterTransition(func(from, to StateID, e Event, err error) {
+		log = append(log, fmt.Sprintf("after %s->%s %v", from, to, err))
+	})
+	m.Subscribe(orderSub{log: &log})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	_ = m.Dispatch(Event{Name: "nope"})
+	_ = m.Dispatch(Event{Name: "go"})
+	_ = m.Dispatch(Event{Name: "fail"})
+	want := []string{
+		"subscriber A", // unmatched events skip the callbacks
+		"before A->B", "action", "after A->B <nil>", "subscriber B", "persist go",
+		"before B->C", "exit B", "after B->B action failed", "subscriber B",
+	}
+	if fmt.Sprint(log) != fmt.Sprint(want) {
+		t.Fatalf("want %v\ngot  %v", want, log)
+	}
+}
+
+func TestGuardRejectedErrors(t *testing.T) {
+	type wallet struct{ Balance int }
+	def, err := NewDef("pay").
+		State("OPEN", WithInitial()).
+		State("PAID", WithFinal()).
+		Current("OPEN").
+		On("pay", "OPEN", "PAID", WithGuardContext(func(e Event, g GuardContext, w *wallet) bool {
+			return w.Balance >= 10 || g.Reject("insufficient funds")
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := NewMachine(def, &wallet{})
+	_ = plain.Start()
+	defer plain.Stop()
+	if err := plain.Dispatch(Event{Name: "pay"}); !errors.Is(err, ErrNoTransition) {
+		t.Fatalf("want ErrNoTransition by default got %v", err)
+	}
+
+	m := NewMachine(def, &wallet{}, WithGuardRejectedErrors())
+	_ = m.Start()
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "refund"}); !errors.Is(err, ErrNoTransition) {
+		t.Fatalf("want ErrNoTransition for an unknown event got %v", err)
+	}
+	err = m.Dispatch(Event{Name: "pay"})
+	var gr *GuardRejectedError
+	if !errors.As(err, &gr) || errors.Is(err, ErrNoTransition) || !errors.Is(err, ErrGuardRejected) {
+		t.Fatalf("want GuardRejectedError got %v", err)
+	}
+	if gr.Source != "OPEN" || gr.Target != "PAID" || gr.Event != "pay" || gr.Reason != "insufficient funds" {
+		t.Fatalf("unexpected rejection %+v", gr)
+	}
+	m.SetStateContext(func(*wallet) *wallet { return &wallet{Balance: 10} })
+	if err := m.Dispatch(Event{Name: "pay"}); err != nil || m.Current() != "PAID" {
+		t.Fatalf("want PAID got %s (%v)", m.Current(), err)
+	}
+}
+
+func TestInternalTransition(t *testing.T) {
+	var entries, exits, contacts int32
+	def, err := NewDef("case").
+		State("OPEN", WithInitial(),
+			WithEntry[any](func(e Event, ctx any) error { atomic.AddInt32(&entries, 1); return nil }),
+			WithExit[any](func(e Event, ctx any) error { atomic.AddInt32(&exits, 1); return nil })).
+		State("CLOSED", WithFinal()).
+		Current("OPEN").
+		On("customer_contacted", "OPEN", "OPEN", WithInternal(), WithCounterIncrement("contacts")).
+		On("note", "OPEN", "OPEN", WithInternal(), WithAction[any](func(e Event, ctx any) error {
+			atomic.AddInt32(&contacts, 1)
+			return errors.New("notes unavailable")
+		})).
+		On("close", "OPEN", "CLOSED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil, WithTransitionLog(10))
+	_ = m.Start()
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "customer_contacted"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "note"}); !errors.Is(err, ErrActionFailed) {
+		t.Fatalf("want ErrActionFailed got %v", err)
+	}
+	if entries != 1 || exits != 0 || contacts != 1 || m.Counter("contacts") != 1 || m.Current() != "OPEN" {
+		t.Fatalf("internal transitions ran hooks: entries %d exits %d", entries, exits)
+	}
+	h := m.History(0)
+	if len(h) != 2 || h[0].Event != "customer_contacted" || h[0].From != "OPEN" || h[0].To != "OPEN" || h[0].Error != "" {
+		t.Fatalf("unexpected history %+v", h)
+	}
+
+	if _, err := NewDef("bad").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("x", "A", "B", WithInternal()).
+		Build(); err == nil {
+		t.Fatal("want error for an internal transition to another state")
+	}
+	internal, _ := NewDef("f").State("A", WithInitial(), WithFinal()).Current("A").On("x", "A", "A", WithInternal()).Build()
+	self, _ := NewDef("f").State("A", WithInitial(), WithFinal()).Current("A").On("x", "A", "A").Build()
+	if internal.Fingerprint() == self.Fingerprint() {
+		t.Fatal("internal should be part of the fingerprint")
+	}
+}
@@ -0,0 +1,201 @@
+// Package mongostore implements rfsm.Store on MongoDB with optimistic concurrency.
+//
+// Each machine is one document, {_id: <machine id>, version, saved_at, snapshot}, whose
+// snapshot is the JSON of the rfsm.Snapshot. A Store remembers the version of every document it
+// loaded or saved, and replaces a document with findAndModify filtered on that version, so
+// when two workers restore the same machine, the second to persist a transition gets
+// ErrConflict instead of overwriting the first:
+//
+//	store := mongostore.New(collection{db.Collection("machines")})
+//	snap, err := store.Load(ctx, orderID)
+//	m := rfsm.NewMachine(def, order, rfsm.WithAutoPersist(store, orderID))
+//	_ = m.RestoreSnapshot(snap, 0)
+//	if err := m.Dispatch(e); errors.Is(err, mongostore.ErrConflict) {
+//		// another worker moved the order on: discard m and reload
+//	}
+//
+// Use one Store per worker; workers sharing a Store share its versions and are not protected
+// from each other.
+//
+// Watch follows a change stream of the collection, so other processes see every saved
+// snapshot, and WatchTransitions turns them into the transitions recorded by machines
+// persisted with rfsm.WithTransitionLogInSnapshots.
+//
+// The package does not depend on the MongoDB driver; wrap a *mongo.Collection in a Collection,
+// e.g. for FindOneAndReplace:
+//
+//	func (c collection) FindOneAndReplace(ctx context.Context, doc mongostore.Document, version int64) (bool, error) {
+//		err := c.coll.FindOneAndReplace(ctx, bson.D{{"_id", doc.ID}, {"version", version}}, doc).Err()
+//		if errors.Is(err, mongo.ErrNoDocuments) {
+//			return false, nil
+//		}
+//		return err == nil, err
+//	}
+package mongostore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// ErrConflict is returned by Save when the stored snapshot changed since this Store loaded or
+// saved it, or when it saves a new id that another Store created meanwhile.
+var ErrConflict = errors.New("snapshot was modified concurrently")
+
+// ErrDuplicateKey is returned by Collection.Insert when a document with the same _id exists.
+var ErrDuplicateKey = errors.New("duplicate key")
+
+// Document is the document of a machine.
+type Document struct {
+	ID       string    `bson:"_id"`
+	Version  int64     `bson:"version"`
+	SavedAt  time.Time `bson:"saved_at"`
+	Snapshot string    `bson:"snapshot"` // the snapshot as JSON
+}
+
+// Collection is the subset of a MongoDB collection used by Store.
+type Collection interface {
+	// FindOne returns the document with _id id, and false if there is none.
+	FindOne(ctx context.Context, id string) (Document, bool, error)
+	// Insert inserts doc, or returns ErrDuplicateKey if its _id is taken.
+	Insert(ctx context.Context, doc Document) error
+	// FindOneAndReplace replaces the document with doc's _id and the given version by doc,
+	// reporting false if there is none.
+	FindOneAndReplace(ctx context.Context, doc Document, version int64) (bool, error)
+	// Watch opens a change stream of the inserted and replaced documents, delivering each
+	// full document.
+	Watch(ctx context.Context) (ChangeStream, error)
+}
+
+// ChangeStream is a change stream opened by Collection.Watch, as *mongo.ChangeStream.
+type ChangeStream interface {
+	// Next waits for the next change and reports false once the stream ends or fails.
+	Next(ctx context.Context) bool
+	// Document returns the document of the current change.
+	Document() Document
+	// Err returns the error that ended the stream, if any.
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// Store is an rfsm.Store backed by a MongoDB collection.
+type Store struct {
+	coll Collection
+
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+var _ rfsm.Store = (*Store)(nil)
+
+// New creates a Store on coll.
+func New(coll Collection) *Store {
+	return &Store{coll: coll, versions: make(map[string]int64)}
+}
+
+// Load returns the snapshot stored under id and remembers its version for the next Save.
+func (s *Store) Load(ctx context.Context, id string) (*rfsm.Snapshot, error) {
+	doc, ok, err := s.coll.FindOne(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	snap, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	s.remember(id, doc.Version)
+	return snap, nil
+}
+
+// Save stores snap under id if the document is still at the version this Store last saw,
+// inserting it if this Store never saw id. It returns ErrConflict otherwise.
+func (s *Store) Save(ctx context.Context, id string, snap *rfsm.Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	version, known := s.versions[id]
+	s.mu.Unlock()
+	doc := Document{ID: id, Version: version + 1, SavedAt: time.Now(), Snapshot: string(data)}
+	if !known {
+		if err := s.coll.Insert(ctx, doc); err != nil {
+			if errors.Is(err, ErrDuplicateKey) {
+				return ErrConflict
+			}
+			return err
+		}
+	} else {
+		ok, err := s.coll.FindOneAndReplace(ctx, doc, version)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrConflict
+		}
+	}
+	s.remember(id, doc.Version)
+	return nil
+}
+
+// remember records version as the one the next Save of id expects.
+func (s *Store) remember(id string, version int64) {
+	s.mu.Lock()
+	s.versions[id] = version
+	s.mu.Unlock()
+}
+
+// Watch calls fn with every snapshot saved to the collection, by any Store, until ctx is done
+// or the change stream fails. It returns the error of the stream, or nil once ctx is done.
+func (s *Store) Watch(ctx context.Context, fn func(id string, snap *rfsm.Snapshot)) error {
+	cs, err := s.coll.Watch(ctx)
+	if err != nil {
+		return err
+	}
+	defer cs.Close(context.WithoutCancel(ctx))
+	for cs.Next(ctx) {
+		doc := cs.Document()
+		snap, err := decode(doc)
+		if err != nil {
+			return err
+		}
+		fn(doc.ID, snap)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return cs.Err()
+}
+
+// WatchTransitions is Watch calling fn with each transition record of a saved snapshot not
+// delivered before, oldest first. Snapshots only carry records with
+// rfsm.WithTransitionLogInSnapshots, and only as many as the transition log keeps, so records
+// are lost if more transitions happen between two saves.
+func (s *Store) WatchTransitions(ctx context.Context, fn func(id string, r rfsm.TransitionRecord)) error {
+	last := make(map[string]time.Time)
+	return s.Watch(ctx, func(id string, snap *rfsm.Snapshot) {
+		for _, r := range snap.Transitions {
+			if r.At.After(last[id]) {
+				fn(id, r)
+				last[id] = r.At
+			}
+		}
+	})
+}
+
+func decode(doc Document) (*rfsm.Snapshot, error) {
+	var snap rfsm.Snapshot
+	if err := json.Unmarshal([]byte(doc.Snapshot), &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q: %w", doc.ID, err)
+	}
+	return &snap, nil
+}
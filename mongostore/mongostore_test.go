@@ -0,0 +1,213 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// fakeCollection is an in-memory Collection whose change streams see every write.
+type fakeCollection struct {
+	mu      sync.Mutex
+	docs    map[string]Document
+	streams []chan Document
+}
+
+func newFakeCollection() *fakeCollection {
+	return &fakeCollection{docs: map[string]Document{}}
+}
+
+func (f *fakeCollection) FindOne(_ context.Context, id string) (Document, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc, ok := f.docs[id]
+	return doc, ok, nil
+}
+
+func (f *fakeCollection) Insert(_ context.Context, doc Document) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.docs[doc.ID]; ok {
+		return ErrDuplicateKey
+	}
+	f.write(doc)
+	return nil
+}
+
+func (f *fakeCollection) FindOneAndReplace(_ context.Context, doc Document, version int64) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if stored, ok := f.docs[doc.ID]; !ok || stored.Version != version {
+		return false, nil
+	}
+	f.write(doc)
+	return true, nil
+}
+
+func (f *fakeCollection) write(doc Document) {
+	f.docs[doc.ID] = doc
+	for _, ch := range f.streams {
+		ch <- doc
+	}
+}
+
+func (f *fakeCollection) Watch(context.Context) (ChangeStream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan Document, 16)
+	f.streams = append(f.streams, ch)
+	return &fakeStream{ch: ch}, nil
+}
+
+type fakeStream struct {
+	ch  chan Document
+	doc Document
+}
+
+func (s *fakeStream) Next(ctx context.Context) bool {
+	select {
+	case s.doc = <-s.ch:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *fakeStream) Document() Document          { return s.doc }
+func (s *fakeStream) Err() error                  { return nil }
+func (s *fakeStream) Close(context.Context) error { return nil }
+
+func orderDef(t *testing.T) *rfsm.Definition {
+	t.Helper()
+	def, err := rfsm.NewDef("order").
+		State("NEW", rfsm.WithInitial()).
+		State("PAID").
+		State("SHIPPED", rfsm.WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID").
+		On("ship", "PAID", "SHIPPED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return def
+}
+
+func TestStore(t *testing.T) {
+	def := orderDef(t)
+	coll := newFakeCollection()
+	ctx := context.Background()
+	worker1, worker2 := New(coll), New(coll)
+	if _, err := worker1.Load(ctx, "o1"); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(worker1, "o1"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(rfsm.Event{Name: "pay"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+	if doc := coll.docs["o1"]; doc.Version != 1 {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+
+	// both workers restore the machine; the second to persist loses
+	restore := func(store *Store) *rfsm.Machine[any] {
+		snap, err := store.Load(ctx, "o1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(store, "o1"))
+		if err := m.RestoreSnapshot(snap, 0); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m1, m2 := restore(worker1), restore(worker2)
+	defer m1.Stop()
+	defer m2.Stop()
+	if err := m1.Dispatch(rfsm.Event{Name: "ship"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.Dispatch(rfsm.Event{Name: "ship"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+	if snap, err := worker2.Load(ctx, "o1"); err != nil || snap.Current != "SHIPPED" {
+		t.Fatalf("latest snapshot %v %v", snap, err)
+	}
+
+	// a new id created by another store meanwhile conflicts too
+	if err := worker1.Save(ctx, "o2", &rfsm.Snapshot{Current: "NEW"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker2.Save(ctx, "o2", &rfsm.Snapshot{Current: "NEW"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+}
+
+func TestStore_WatchTransitions(t *testing.T) {
+	def := orderDef(t)
+	coll := newFakeCollection()
+	store := New(coll)
+	ctx, cancel := context.WithCancel(context.Background())
+	type delivery struct {
+		id string
+		r  rfsm.TransitionRecord
+	}
+	got := make(chan delivery, 16)
+	watching := make(chan error, 1)
+	go func() {
+		watching <- store.WatchTransitions(ctx, func(id string, r rfsm.TransitionRecord) { got <- delivery{id, r} })
+	}()
+	// wait for the change stream to open
+	for deadline := time.Now().Add(time.Second); ; {
+		coll.mu.Lock()
+		n := len(coll.streams)
+		coll.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("change stream not opened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(store, "o1"),
+		rfsm.WithTransitionLog(10), rfsm.WithTransitionLogInSnapshots())
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	for _, name := range []rfsm.EventID{"pay", "ship"} {
+		if err := m.Dispatch(rfsm.Event{Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// each saved snapshot carries the whole log; every record is delivered once
+	for _, want := range []rfsm.StateID{"PAID", "SHIPPED"} {
+		select {
+		case d := <-got:
+			if d.id != "o1" || d.r.To != want {
+				t.Fatalf("want o1 to %s got %+v", want, d)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no transition to %s delivered", want)
+		}
+	}
+	select {
+	case d := <-got:
+		t.Fatalf("unexpected delivery %+v", d)
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancel()
+	if err := <-watching; err != nil {
+		t.Fatalf("want nil once ctx is done got %v", err)
+	}
+}
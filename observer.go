@@ -0,0 +1,75 @@
+package rfsm
+
+import "time"
+
+// DispatchObserver receives queue-level callbacks for every event sent to a machine, so the
+// time an event spends waiting behind others can be measured separately from its handling.
+// Callbacks run synchronously on the dispatching goroutine (OnEnqueue) or the event loop
+// (OnDequeue, OnComplete) and must not block.
+type DispatchObserver interface {
+	// OnEnqueue is called just before e is queued. An event queued while the machine
+	// stops may never be dequeued.
+	OnEnqueue(e Event)
+	// OnDequeue is called when the loop takes e off the queue, wait after it was enqueued.
+	OnDequeue(e Event, wait time.Duration)
+	// OnComplete is called once e was handled, with the queue wait, the handling time and
+	// the result returned to Dispatch.
+	OnComplete(e Event, wait, handling time.Duration, err error)
+}
+
+// WithDispatchObserver installs a DispatchObserver on the machine.
+func WithDispatchObserver(o DispatchObserver) MachineOption {
+	return func(c *machineConfig) { c.observer = o }
+}
+
+// queueStamp is appended to queued events' Args when an observer is installed or the event
+// has a Budget.
+type queueStamp struct{ at time.Time }
+
+// stamp reports orig to the observer and marks queued, the form of orig actually sent to the
+// loop, with the enqueue time. Args are copied so the caller's slice is never written to.
+func (m *Machine[C]) stamp(queued, orig Event) Event {
+	if m.observer == nil && queued.Budget <= 0 {
+		return queued
+	}
+	if m.observer != nil {
+		m.observer.OnEnqueue(orig)
+	}
+	n := len(queued.Args)
+	queued.Args = append(queued.Args[:n:n], queueStamp{at: time.Now()})
+	return queued
+}
+
+// unstamp strips the enqueue mark from a dequeued event and reports the dequeue. It returns
+// the queue wait, zero for unmarked events.
+func (m *Machine[C]) unstamp(e *Event) time.Duration {
+	n := len(e.Args)
+	if n == 0 {
+		return 0
+	}
+	qs, ok := e.Args[n-1].(queueStamp)
+	if !ok {
+		return 0
+	}
+	e.Args = e.Args[:n-1]
+	wait := time.Since(qs.at)
+	if m.observer != nil {
+		m.observer.OnDequeue(userEvent(*e), wait)
+	}
+	return wait
+}
+
+// userEvent returns e without the machine's internal trailing args (sync reply channel or callback, dispatch context, timer ticks).
+func userEvent(e Event) Event {
+	n := len(e.Args)
+	for n > 0 {
+		switch e.Args[n-1].(type) {
+		case chan error, asyncCallback, dispatchContext, timeoutTick, recurringTick, queueStamp:
+			n--
+			continue
+		}
+		break
+	}
+	e.Args = e.Args[:n]
+	return e
+}
@@ -0,0 +1,156 @@
+package rfsm
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu     sync.Mutex
+	log    []string
+	waits  []time.Duration
+	errors []error
+}
+
+func (o *recordingObserver) OnEnqueue(e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.log = append(o.log, "enqueue:"+e.Name)
+}
+
+func (o *recordingObserver) OnDequeue(e Event, wait time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.log = append(o.log, "dequeue:"+e.Name)
+}
+
+func (o *recordingObserver) OnComplete(e Event, wait, handling time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.log = append(o.log, "complete:"+e.Name)
+	o.waits = append(o.waits, wait)
+	o.errors = append(o.errors, err)
+}
+
+func TestDispatchObserver(t *testing.T) {
+	release := make(chan struct{})
+	def, err := NewDef("observed").
+		State("A", WithInitial()).
+		State("B").
+		State("C", WithFinal()).
+		Current("A").
+		On("slow", "A", "B", WithAction(func(e Event, ctx any) error {
+			<-release
+			return nil
+		})).
+		On("back", "B", "A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &recordingObserver{}
+	m := NewMachine[any](def, nil, WithDispatchObserver(o))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	args := make([]any, 1, 4)
+	if err := m.DispatchAsync(Event{Name: "slow", Args: args}); err != nil {
+		t.Fatal(err)
+	}
+	if args[:2][1] != nil {
+		t.Fatal("stamping wrote into the caller's Args")
+	}
+	time.Sleep(5 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- m.Dispatch(Event{Name: "back"}) }()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(Event{Name: "missing"}); err != ErrNoTransition {
+		t.Fatalf("want ErrNoTransition, got %v", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	want := []string{
+		"enqueue:slow", "dequeue:slow", "enqueue:back", "complete:slow",
+		"dequeue:back", "complete:back",
+		"enqueue:missing", "dequeue:missing", "complete:missing",
+	}
+	if len(o.log) != len(want) {
+		t.Fatalf("want %v got %v", want, o.log)
+	}
+	for i := range want {
+		if o.log[i] != want[i] {
+			t.Fatalf("want %v got %v", want, o.log)
+		}
+	}
+	if o.waits[1] < 15*time.Millisecond {
+		t.Fatalf("back waited behind slow but reported wait %v", o.waits[1])
+	}
+	if o.errors[2] != ErrNoTransition {
+		t.Fatalf("complete should report the dispatch error, got %v", o.errors[2])
+	}
+}
+
+func TestEventBudget(t *testing.T) {
+	release := make(chan struct{})
+	def, err := NewDef("budget").
+		State("A", WithInitial()).
+		State("B").
+		State("C", WithFinal()).
+		Current("A").
+		On("slow", "A", "B", WithAction(func(e Event, ctx any) error {
+			<-release
+			return nil
+		})).
+		On("next", "B", "C").
+		On("guarded", "B", "C", WithGuard(func(e Event, ctx any) bool {
+			time.Sleep(20 * time.Millisecond)
+			return true
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	sub := &errSub{}
+	m.Subscribe(sub)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if err := m.DispatchAsync(Event{Name: "slow"}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	// queued behind slow for longer than its budget
+	if err := m.Dispatch(Event{Name: "next", Budget: 5 * time.Millisecond}); err != ErrEventExpired {
+		t.Fatalf("want ErrEventExpired, got %v", err)
+	}
+	if m.Current() != "B" {
+		t.Fatalf("expired event was processed, now at %s", m.Current())
+	}
+	if sub.lastErr != ErrEventExpired {
+		t.Fatalf("subscribers should see the expiry, got %v", sub.lastErr)
+	}
+	// a slow guard uses up the budget before the transition starts
+	if err := m.Dispatch(Event{Name: "guarded", Budget: 10 * time.Millisecond}); err != ErrEventExpired {
+		t.Fatalf("want ErrEventExpired, got %v", err)
+	}
+	if err := m.Dispatch(Event{Name: "next", Budget: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if m.Current() != "C" {
+		t.Fatalf("want C got %s", m.Current())
+	}
+}
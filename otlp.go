@@ -0,0 +1,148 @@
+package rfsm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// WriteOTLP writes the transition records of machine machineID, e.g. from Machine.History or
+// a snapshot, to w as an OTLP/JSON trace export request. POST it to a collector's /v1/traces
+// endpoint with Content-Type application/json to look at old incidents in Jaeger or Tempo.
+//
+// The trace has a root span for the machine, a child span for each state occupancy, and
+// under each occupancy a span for each transition attempted in it. Failed transitions have an
+// error status. Any change of state ends an occupancy, including a failure moving the machine
+// to its error state; internal and self transitions do not. The first occupancy starts at the
+// first record, and the last one ends at the last record. Ids are derived from machineID and the records, so exporting the same history
+// again produces the same trace.
+func WriteOTLP(w io.Writer, machineID string, records []TransitionRecord) error {
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{}}
+	if len(records) > 0 {
+		req.ResourceSpans = append(req.ResourceSpans, otlpResourceSpans{
+			Resource: otlpResource{Attributes: []otlpAttribute{
+				otlpString("service.name", "rfsm"),
+				otlpString("rfsm.machine.id", machineID),
+			}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/noru/rfsm"},
+				Spans: otlpSpans(machineID, records),
+			}},
+		})
+	}
+	return json.NewEncoder(w).Encode(req)
+}
+
+// otlpSpans builds the spans of WriteOTLP.
+func otlpSpans(machineID string, records []TransitionRecord) []otlpSpan {
+	first, last := records[0].At, records[len(records)-1].At
+	seed := sha256.Sum256([]byte(machineID + "\x00" + strconv.FormatInt(first.UnixNano(), 10)))
+	traceID := hex.EncodeToString(seed[:16])
+	n := uint64(0)
+	nextID := func() string {
+		var b [8 + sha256.Size]byte
+		copy(b[8:], seed[:])
+		binary.BigEndian.PutUint64(b[:8], n)
+		n++
+		sum := sha256.Sum256(b[:])
+		return hex.EncodeToString(sum[:8])
+	}
+
+	root := otlpSpan{TraceID: traceID, SpanID: nextID(), Name: machineID, Kind: otlpSpanKindInternal,
+		Start: otlpTime(first), End: otlpTime(last),
+		Attributes: []otlpAttribute{otlpString("rfsm.machine.id", machineID)}}
+	spans := []otlpSpan{root}
+	stay := otlpSpan{TraceID: traceID, SpanID: nextID(), ParentSpanID: root.SpanID,
+		Name: string(records[0].From), Kind: otlpSpanKindInternal, Start: otlpTime(first),
+		Attributes: []otlpAttribute{otlpString("rfsm.state", string(records[0].From))}}
+	for _, r := range records {
+		t := otlpSpan{TraceID: traceID, SpanID: nextID(), ParentSpanID: stay.SpanID,
+			Name: string(r.Event), Kind: otlpSpanKindInternal, Start: otlpTime(r.At), End: otlpTime(r.At),
+			Attributes: []otlpAttribute{
+				otlpString("rfsm.event", string(r.Event)),
+				otlpString("rfsm.from", string(r.From)),
+				otlpString("rfsm.to", string(r.To)),
+			}}
+		if r.Error != "" {
+			t.Status = &otlpStatus{Code: otlpStatusError, Message: r.Error}
+		}
+		spans = append(spans, t)
+		if r.From == r.To {
+			continue
+		}
+		stay.End = otlpTime(r.At)
+		spans = append(spans, stay)
+		stay = otlpSpan{TraceID: traceID, SpanID: nextID(), ParentSpanID: root.SpanID,
+			Name: string(r.To), Kind: otlpSpanKindInternal, Start: otlpTime(r.At),
+			Attributes: []otlpAttribute{otlpString("rfsm.state", string(r.To))}}
+	}
+	stay.End = otlpTime(last)
+	return append(spans, stay)
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest, limited to the fields WriteOTLP sets.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+// otlpTime encodes t as OTLP/JSON does 64-bit integers: a decimal string.
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
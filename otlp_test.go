@@ -0,0 +1,166 @@
+package rfsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteOTLP(t *testing.T) {
+	base := time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	records := []TransitionRecord{
+		{From: "NEW", To: "PAID", Event: "pay", At: at(10)},
+		{From: "PAID", To: "PAID", Event: "ship", At: at(20), Error: "guard rejected"},
+		{From: "PAID", To: "SHIPPED", Event: "ship", At: at(30)},
+	}
+	var buf bytes.Buffer
+	if err := WriteOTLP(&buf, "order-1", records); err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Start        string `json:"startTimeUnixNano"`
+					End          string `json:"endTimeUnixNano"`
+					Status       *struct {
+						Code    int    `json:"code"`
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatal(err)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 7 {
+		t.Fatalf("want 7 spans (root, 3 occupancies, 3 transitions) got %d", len(spans))
+	}
+	byName := map[string][]int{}
+	ids := map[string]string{}
+	for i, s := range spans {
+		if len(s.TraceID) != 32 || len(s.SpanID) != 16 || s.TraceID != spans[0].TraceID {
+			t.Fatalf("bad ids %+v", s)
+		}
+		if _, dup := ids[s.SpanID]; dup {
+			t.Fatalf("duplicate span id %s", s.SpanID)
+		}
+		ids[s.SpanID] = s.Name
+		byName[s.Name] = append(byName[s.Name], i)
+	}
+	nano := func(min int) string { return strconv.FormatInt(at(min).UnixNano(), 10) }
+
+	root := spans[byName["order-1"][0]]
+	if root.ParentSpanID != "" || root.Start != nano(10) || root.End != nano(30) {
+		t.Fatalf("bad root %+v", root)
+	}
+	for _, c := range []struct {
+		state      string
+		start, end int
+	}{{"NEW", 10, 10}, {"PAID", 10, 30}, {"SHIPPED", 30, 30}} {
+		s := spans[byName[c.state][0]]
+		if s.ParentSpanID != root.SpanID || s.Start != nano(c.start) || s.End != nano(c.end) {
+			t.Fatalf("bad occupancy of %s: %+v", c.state, s)
+		}
+	}
+	if pay := spans[byName["pay"][0]]; ids[pay.ParentSpanID] != "NEW" || pay.Status != nil {
+		t.Fatalf("pay should be an ok child of NEW: %+v", pay)
+	}
+	ships := byName["ship"]
+	if len(ships) != 2 {
+		t.Fatalf("want 2 ship spans got %d", len(ships))
+	}
+	failed, shipped := spans[ships[0]], spans[ships[1]]
+	if ids[failed.ParentSpanID] != "PAID" || failed.Status == nil || failed.Status.Code != 2 || failed.Status.Message != "guard rejected" {
+		t.Fatalf("failed ship should be an error child of PAID: %+v", failed)
+	}
+	if ids[shipped.ParentSpanID] != "PAID" || shipped.Status != nil {
+		t.Fatalf("ship should be an ok child of PAID: %+v", shipped)
+	}
+
+	var again bytes.Buffer
+	if err := WriteOTLP(&again, "order-1", records); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), again.Bytes()) {
+		t.Fatal("exporting the same history twice should produce the same trace")
+	}
+
+	buf.Reset()
+	if err := WriteOTLP(&buf, "order-2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "{\"resourceSpans\":[]}\n" {
+		t.Fatalf("unexpected empty export %q", got)
+	}
+}
+
+func TestWriteOTLP_ErrorStateAndInternal(t *testing.T) {
+	base := time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	var buf bytes.Buffer
+	err := WriteOTLP(&buf, "order-1", []TransitionRecord{
+		{From: "NEW", To: "PAID", Event: "pay", At: at(10)},
+		{From: "PAID", To: "PAID", Event: "touch", At: at(15)},
+		{From: "PAID", To: "FAILED", Event: "ship", At: at(20), Error: "carrier down"},
+		{From: "FAILED", To: "NEW", Event: "reset", At: at(30)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Start        string `json:"startTimeUnixNano"`
+					End          string `json:"endTimeUnixNano"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &req); err != nil {
+		t.Fatal(err)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	names := map[string]string{}
+	var stays []string
+	for _, s := range spans {
+		names[s.SpanID] = s.Name
+		if s.ParentSpanID == spans[0].SpanID {
+			stays = append(stays, s.Name)
+		}
+	}
+	if got := strings.Join(stays, ","); got != "NEW,PAID,FAILED,NEW" {
+		t.Fatalf("want occupancies NEW,PAID,FAILED,NEW got %s", got)
+	}
+	nano := func(min int) string { return strconv.FormatInt(at(min).UnixNano(), 10) }
+	for _, s := range spans {
+		switch s.Name {
+		case "touch", "ship":
+			if names[s.ParentSpanID] != "PAID" {
+				t.Fatalf("%s should be a child of PAID: %+v", s.Name, s)
+			}
+		case "reset":
+			if names[s.ParentSpanID] != "FAILED" {
+				t.Fatalf("reset should be a child of FAILED: %+v", s)
+			}
+		case "FAILED":
+			if s.Start != nano(20) || s.End != nano(30) {
+				t.Fatalf("bad occupancy of FAILED: %+v", s)
+			}
+		}
+	}
+}
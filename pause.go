@@ -0,0 +1,68 @@
+package rfsm
+
+// Pause stops the machine from handling events without stopping it: the active path, timers
+// and queued events are kept, and Dispatch keeps queueing events (a synchronous Dispatch waits
+// until they are handled after Resume). Pause returns once the event being handled, if any,
+// has completed. It must not be called from a guard, action or hook of the same machine.
+func (m *Machine[C]) Pause() error {
+	m.statusMu.Lock()
+	if !m.started {
+		m.statusMu.Unlock()
+		return ErrMachineNotStarted
+	}
+	if m.paused {
+		m.statusMu.Unlock()
+		return nil
+	}
+	m.setPaused(true)
+	resume, done := m.resume, m.done
+	m.statusMu.Unlock()
+	// the loop only takes this between events
+	select {
+	case m.pauseCh <- resume:
+	case <-done:
+	}
+	return nil
+}
+
+// setPaused resets the pause state of a machine being started. Must be called with statusMu held.
+func (m *Machine[C]) setPaused(paused bool) {
+	m.paused = paused
+	if paused {
+		m.resume = make(chan struct{})
+	}
+}
+
+// Resume continues handling events after Pause, without running any hooks.
+func (m *Machine[C]) Resume() {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	if m.paused {
+		m.paused = false
+		close(m.resume)
+	}
+}
+
+// Paused reports whether the machine is paused.
+func (m *Machine[C]) Paused() bool {
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	return m.paused
+}
+
+// wait blocks the loop until resume is closed, handling Step requests meanwhile; it reports
+// false if the machine stopped first.
+func (m *Machine[C]) wait(resume chan struct{}) bool {
+	for {
+		select {
+		case <-resume:
+			return true
+		case <-m.done:
+			return false
+		case reply := <-m.stepCh:
+			reply <- m.step()
+		case <-m.pauseCh:
+			// a Pause that raced with the loop starting paused
+		}
+	}
+}
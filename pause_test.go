@@ -0,0 +1,83 @@
+package rfsm
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	var entries int32
+	def, err := NewDef("p").
+		State("A", WithInitial(), WithEntry[any](func(e Event, ctx any) error { atomic.AddInt32(&entries, 1); return nil })).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Pause(); !errors.Is(err, ErrMachineNotStarted) {
+		t.Fatalf("want ErrMachineNotStarted got %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Pause(); err != nil || !m.Paused() {
+		t.Fatalf("pause failed: %v", err)
+	}
+	_ = m.Pause() // no-op
+	result := make(chan error, 1)
+	go func() { result <- m.Dispatch(Event{Name: "go"}) }()
+	select {
+	case err := <-result:
+		t.Fatalf("dispatch handled while paused: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if m.Current() != "A" {
+		t.Fatalf("want A while paused got %s", m.Current())
+	}
+	m.Resume()
+	if err := <-result; err != nil || m.Current() != "B" || m.Paused() {
+		t.Fatalf("want B after resume got %s (%v)", m.Current(), err)
+	}
+	if entries != 1 {
+		t.Fatalf("resume must not re-run entry hooks, got %d entries", entries)
+	}
+}
+
+func TestPauseStop(t *testing.T) {
+	def, err := NewDef("p").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	_ = m.Start()
+	_ = m.Pause()
+	queued := make(chan error, 1)
+	if err := m.DispatchAsyncCb(Event{Name: "go"}, func(err error) { queued <- err }); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-queued; !errors.Is(err, ErrMachineStopped) {
+		t.Fatalf("queued event should be answered with ErrMachineStopped, got %v", err)
+	}
+	if m.Paused() {
+		t.Fatal("Stop should clear the pause")
+	}
+	_ = m.Start()
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+}
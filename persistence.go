@@ -1,16 +1,37 @@
 package rfsm
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"time"
 )
 
+// SnapshotVersion is the version of the snapshot format written by this package. Snapshots
+// with a newer version are rejected on restore; version 0 marks snapshots written before
+// versioning.
+const SnapshotVersion = 1
+
 // Snapshot captures the minimal runtime needed to resume a machine
 type Snapshot struct {
-	Current     StateID         `json:"current"`
-	ActivePath  []StateID       `json:"active_path"`
-	Visited     []StateID       `json:"visited,omitempty"`
-	StateContextJSON json.RawMessage `json:"context,omitempty"`
+	Version          int                       `json:"version,omitempty"`
+	Fingerprint      string                    `json:"fingerprint,omitempty"` // of the definition, see Definition.Fingerprint
+	Current          StateID                   `json:"current"`
+	ActivePath       []StateID                 `json:"active_path"`
+	Visited          []StateID                 `json:"visited,omitempty"`
+	History          map[StateID]StateID       `json:"history,omitempty"` // composite -> child (shallow) or leaf (deep) to re-enter
+	Counters         map[string]int            `json:"counters,omitempty"`
+	Timers           map[StateID]time.Duration `json:"timers,omitempty"`  // remaining time of armed state timeouts at TakenAt
+	Delayed          []ScheduledEvent          `json:"delayed,omitempty"` // pending DispatchAfter events
+	TakenAt          time.Time                 `json:"taken_at,omitzero"`
+	Transitions      []TransitionRecord        `json:"transitions,omitempty"` // see WithTransitionLogInSnapshots
+	StateContextJSON json.RawMessage           `json:"context,omitempty"`
 }
 
 // Snapshot returns an in-memory snapshot of the current machine runtime state.
@@ -23,19 +44,46 @@ func (m *Machine[C]) Snapshot() *Snapshot {
 	}
 	cp := make([]StateID, len(m.activePath))
 	copy(cp, m.activePath)
+	var history map[StateID]StateID
+	if len(m.history) > 0 {
+		history = make(map[StateID]StateID, len(m.history))
+		for k, v := range m.history {
+			history[k] = v
+		}
+	}
+	var counters map[string]int
+	if len(m.counters) > 0 {
+		counters = make(map[string]int, len(m.counters))
+		for k, v := range m.counters {
+			counters[k] = v
+		}
+	}
 
 	var ctxJSON json.RawMessage
-	ctxAny := any(m.ctx)
-	if ctxAny != nil {
-		if data, err := json.Marshal(m.ctx); err == nil {
+	ctx := m.GetStateContext()
+	if any(ctx) != nil {
+		if data, err := json.Marshal(ctx); err == nil {
 			ctxJSON = data
 		}
 	}
 
+	var transitions []TransitionRecord
+	if m.logInSnapshots {
+		transitions = m.History(0)
+	}
+
 	return &Snapshot{
-		Current:     m.current,
-		ActivePath:  cp,
-		Visited:     visited,
+		Version:          SnapshotVersion,
+		Fingerprint:      m.def.Fingerprint(),
+		Current:          m.current,
+		ActivePath:       cp,
+		Visited:          visited,
+		History:          history,
+		Counters:         counters,
+		Timers:           m.remainingTimeouts(),
+		Delayed:          m.pendingDelayed(),
+		TakenAt:          time.Now(),
+		Transitions:      transitions,
 		StateContextJSON: ctxJSON,
 	}
 }
@@ -51,15 +99,92 @@ func (m *Machine[C]) SnapshotJSON() ([]byte, error) {
 // buf controls the capacity of the internal events queue; if <=0, defaults to 64.
 // If the snapshot contains state context data, it will be restored into the machine's state context.
 func (m *Machine[C]) RestoreSnapshot(snap *Snapshot, buf int) error {
+	return m.RestoreSnapshotWithOptions(snap, buf, RestoreOptions{})
+}
+
+// RestoreOptions tunes RestoreSnapshotWithOptions.
+type RestoreOptions struct {
+	// ReplayEntryHooks runs the entry hooks of the restored active path, root to leaf, before
+	// the event loop starts, e.g. so states can re-subscribe to external feeds. Events they
+	// raise are handled first. If a hook fails, the machine is left stopped and its error is
+	// returned.
+	ReplayEntryHooks bool
+	// ReplayEntryHooksOf replays, as ReplayEntryHooks does, only the entry hooks of these
+	// states, if they are on the restored active path; the others stay silent.
+	ReplayEntryHooksOf []StateID
+}
+
+// RestoreSnapshotWithOptions is RestoreSnapshot with options.
+func (m *Machine[C]) RestoreSnapshotWithOptions(snap *Snapshot, buf int, opts RestoreOptions) error {
+	if err := m.validateSnapshot(snap); err != nil {
+		return err
+	}
+	if err := m.restoreContext(snap); err != nil {
+		return err
+	}
+	for _, sid := range opts.ReplayEntryHooksOf {
+		if _, ok := m.def.states[sid]; !ok {
+			return fmt.Errorf("replay entry hooks of unknown state %q", sid)
+		}
+	}
+	if opts.ReplayEntryHooks || len(opts.ReplayEntryHooksOf) > 0 {
+		m.statusMu.Lock()
+		m.installSnapshot(snap)
+		m.starting = true
+		m.statusMu.Unlock()
+		m.raised.reset()
+		for _, sid := range snap.ActivePath {
+			if !opts.ReplayEntryHooks && !slices.Contains(opts.ReplayEntryHooksOf, sid) {
+				continue
+			}
+			if err := m.enter(m.raiseCx, sid, Event{}); err != nil {
+				m.statusMu.Lock()
+				m.starting = false
+				m.statusMu.Unlock()
+				return err
+			}
+		}
+	}
+	m.applySnapshot(snap)
+	return nil
+}
+
+// restoreContext restores the state context from the snapshot, if it contains one.
+func (m *Machine[C]) restoreContext(snap *Snapshot) error {
+	if len(snap.StateContextJSON) > 0 {
+		if err := m.decodeContext(func(ctx *C) error { return json.Unmarshal(snap.StateContextJSON, ctx) }); err != nil {
+			return fmt.Errorf("failed to restore state context: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateSnapshot checks that the snapshot refers to known states and a consistent active path.
+func (m *Machine[C]) validateSnapshot(snap *Snapshot) error {
+	if m.configErr != nil {
+		return m.configErr
+	}
 	if snap == nil {
 		return fmt.Errorf("nil snapshot")
 	}
+	if snap.Version > SnapshotVersion {
+		return fmt.Errorf("snapshot version %d is newer than the supported version %d", snap.Version, SnapshotVersion)
+	}
+	if snap.Fingerprint != "" && snap.Fingerprint != m.def.Fingerprint() {
+		err := fmt.Errorf("%w: %s", ErrDefinitionMismatch, m.def.Name)
+		if m.onSnapshotMismatch != nil {
+			err = m.onSnapshotMismatch(snap)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	// Validate states exist
-	if _, ok := m.def.States[snap.Current]; !ok {
+	if _, ok := m.def.states[snap.Current]; !ok {
 		return fmt.Errorf("snapshot refers to unknown current state %q", snap.Current)
 	}
 	for _, s := range snap.ActivePath {
-		if _, ok := m.def.States[s]; !ok {
+		if _, ok := m.def.states[s]; !ok {
 			return fmt.Errorf("snapshot refers to unknown state in active_path: %q", s)
 		}
 	}
@@ -73,18 +198,121 @@ func (m *Machine[C]) RestoreSnapshot(snap *Snapshot, buf int) error {
 			return fmt.Errorf("active_path does not match hierarchy")
 		}
 	}
+	for composite, s := range snap.History {
+		if err := m.validateHistory(composite, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Restore state context if present
-	if len(snap.StateContextJSON) > 0 {
-		if err := json.Unmarshal(snap.StateContextJSON, &m.ctx); err != nil {
-			return fmt.Errorf("failed to restore state context: %w", err)
+// validateHistory checks that s can be remembered as the history of composite.
+func (m *Machine[C]) validateHistory(composite, s StateID) error {
+	st, ok := m.def.states[composite]
+	if !ok || st.History == NoHistory {
+		return fmt.Errorf("snapshot history for %q which has no history", composite)
+	}
+	if st.History == DeepHistory {
+		below := false
+		for _, a := range m.pathTo(s) {
+			below = below || (a == composite && a != s)
+		}
+		if !below || len(m.def.states[s].Children) > 0 {
+			return fmt.Errorf("snapshot history %q is not a leaf below %q", s, composite)
 		}
+	} else if m.def.states[s].Parent != composite {
+		return fmt.Errorf("snapshot history %q is not a child of %q", s, composite)
+	}
+	return nil
+}
+
+// RestoreSnapshotWithMigration restores a snapshot taken with an older definition whose states
+// were since renamed or removed. renames maps old state IDs to their new ones; map a removed
+// state to the state that replaces it. After renaming, the active path is recomputed from the
+// current state (drilling down to the initial leaf if it is now a composite), and visited states,
+// history and timers that no longer fit the definition are dropped. The migrated snapshot is
+// accepted regardless of its fingerprint; snap itself is not modified.
+func (m *Machine[C]) RestoreSnapshotWithMigration(snap *Snapshot, buf int, renames map[StateID]StateID) error {
+	if snap == nil {
+		return fmt.Errorf("nil snapshot")
 	}
+	return m.RestoreSnapshot(m.migrateSnapshot(snap, renames), buf)
+}
 
+// migrateSnapshot returns a copy of snap with renames applied and fitted to the definition.
+func (m *Machine[C]) migrateSnapshot(snap *Snapshot, renames map[StateID]StateID) *Snapshot {
+	rename := func(s StateID) StateID {
+		if to, ok := renames[s]; ok {
+			return to
+		}
+		return s
+	}
+	known := func(s StateID) bool {
+		_, ok := m.def.states[s]
+		return ok
+	}
+	out := *snap
+	out.Fingerprint = m.def.Fingerprint()
+	out.Current = rename(snap.Current)
+	out.ActivePath = nil
+	if known(out.Current) {
+		out.ActivePath = append(slices.Clone(m.pathTo(out.Current)), m.def.initialDescendants(out.Current)...)
+		out.Current = out.ActivePath[len(out.ActivePath)-1]
+	}
+	out.Visited = nil
+	for _, s := range snap.Visited {
+		if s = rename(s); known(s) && !slices.Contains(out.Visited, s) {
+			out.Visited = append(out.Visited, s)
+		}
+	}
+	out.History = nil
+	for composite, s := range snap.History {
+		composite, s = rename(composite), rename(s)
+		if !known(composite) || !known(s) || m.validateHistory(composite, s) != nil {
+			continue
+		}
+		if out.History == nil {
+			out.History = make(map[StateID]StateID)
+		}
+		out.History[composite] = s
+	}
+	out.Timers = nil
+	for s, d := range snap.Timers {
+		if s = rename(s); known(s) && m.def.states[s].Timeout > 0 {
+			if out.Timers == nil {
+				out.Timers = make(map[StateID]time.Duration)
+			}
+			out.Timers[s] = d
+		}
+	}
+	return &out
+}
+
+// applySnapshot installs the snapshot's runtime state and starts the event loop.
+func (m *Machine[C]) applySnapshot(snap *Snapshot) {
 	// Apply under lock
 	m.statusMu.Lock()
-	m.events = make(chan Event, 8) // default buffer size， increase if needed
-	m.done = make(chan struct{})
+	m.openQueue(8) // default buffer size， increase if needed
+	m.installSnapshot(snap)
+	m.setPaused(m.stepMode)
+	m.starting = false
+	m.started = true
+	m.disarmAllTimers()
+	// timers missing from the snapshot start over with their full duration; the others lose
+	// the time elapsed since the snapshot was taken
+	m.armTimers(m.activePath, elapsedTimers(snap))
+	for _, d := range snap.Delayed {
+		m.scheduleDelayed(d.At, d.Event)
+	}
+	m.statusMu.Unlock()
+
+	// start loop
+	m.wg.Add(1)
+	go m.loop()
+}
+
+// installSnapshot copies the snapshot's runtime state into the machine. statusMu must be held.
+func (m *Machine[C]) installSnapshot(snap *Snapshot) {
 	m.current = snap.Current
 	m.activePath = make([]StateID, len(snap.ActivePath))
 	copy(m.activePath, snap.ActivePath)
@@ -92,15 +320,128 @@ func (m *Machine[C]) RestoreSnapshot(snap *Snapshot, buf int) error {
 	for _, s := range snap.Visited {
 		m.visited[s] = true
 	}
-	m.started = true
-	m.statusMu.Unlock()
+	m.history = nil
+	if len(snap.History) > 0 {
+		m.history = make(map[StateID]StateID, len(snap.History))
+		for k, v := range snap.History {
+			m.history[k] = v
+		}
+	}
+	m.counters = nil
+	if len(snap.Counters) > 0 {
+		m.counters = make(map[string]int, len(snap.Counters))
+		for k, v := range snap.Counters {
+			m.counters[k] = v
+		}
+	}
+	if m.logInSnapshots {
+		m.log.replace(snap.Transitions)
+	}
+}
 
-	// start loop
-	m.wg.Add(1)
-	go m.loop()
+// Hydrate loads a snapshot into a stopped machine without starting its event loop or timers,
+// so Current, CurrentPath, HasVisited and the state context can be inspected cheaply, e.g.
+// to answer a read-only query. A hydrated machine needs no Stop; dispatching to it fails with
+// ErrMachineNotStarted, and Start begins again from the initial state (use RestoreSnapshot to
+// resume instead).
+func (m *Machine[C]) Hydrate(snap *Snapshot) error {
+	m.statusMu.RLock()
+	started := m.started
+	m.statusMu.RUnlock()
+	if started {
+		return fmt.Errorf("cannot hydrate a started machine")
+	}
+	if err := m.validateSnapshot(snap); err != nil {
+		return err
+	}
+	if err := m.restoreContext(snap); err != nil {
+		return err
+	}
+	m.statusMu.Lock()
+	m.installSnapshot(snap)
+	m.statusMu.Unlock()
 	return nil
 }
 
+// elapsedTimers returns the snapshot's remaining timeouts less the time since it was taken.
+func elapsedTimers(snap *Snapshot) map[StateID]time.Duration {
+	if snap.TakenAt.IsZero() || len(snap.Timers) == 0 {
+		return snap.Timers
+	}
+	elapsed := time.Since(snap.TakenAt)
+	out := make(map[StateID]time.Duration, len(snap.Timers))
+	for sid, r := range snap.Timers {
+		out[sid] = max(r-elapsed, 0)
+	}
+	return out
+}
+
+// WithSnapshotMismatchHandler is called when a snapshot being restored was taken with a
+// definition whose Fingerprint differs from the machine's. Returning nil accepts the snapshot,
+// e.g. after logging a warning, as long as it still refers to valid states; returning an error
+// rejects it. Without a handler such snapshots fail with ErrDefinitionMismatch.
+func WithSnapshotMismatchHandler(fn func(snap *Snapshot) error) MachineOption {
+	return func(c *machineConfig) { c.onSnapshotMismatch = fn }
+}
+
+// Fingerprint returns a hash of the definition's structure: its states and hierarchy, its
+// transitions and branches (targets, whether they are guarded and propagate), aliases and
+// ordering settings. Hooks, guards and actions themselves are not part of it, and neither
+// are descriptions, tags and metadata. Snapshots record it to detect restores onto a changed
+// definition.
+func (d *Definition) Fingerprint() string {
+	if d.fingerprint == "" {
+		return d.computeFingerprint()
+	}
+	return d.fingerprint
+}
+
+func (d *Definition) computeFingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "current %q effect %d bubble %d error %q\n", d.Current, d.EffectOrder, d.BubbleOrder, d.ErrorState)
+	ids := d.StateIDs()
+	for _, id := range ids {
+		st := d.states[id]
+		fmt.Fprintf(h, "state %q parent %q initial %q history %d flags %t %t %t %t\n",
+			id, st.Parent, st.InitialChild, st.History, st.Initial, st.Final, st.Junction, st.Choice)
+	}
+	writeAlts := func(kind string, from StateID, event EventID, alts []TransitionDef) {
+		for _, t := range alts {
+			fmt.Fprintf(h, "%s %q %q -> %q guard %t propagate %t", kind, from, event, t.To, t.hasGuard(), t.Propagate)
+			// appended only when set, so existing fingerprints are unchanged
+			if t.Internal {
+				fmt.Fprint(h, " internal")
+			}
+			fmt.Fprintln(h)
+		}
+	}
+	keys := make([]TransitionKey, 0, len(d.transitions))
+	for k := range d.transitions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].From != keys[j].From {
+			return keys[i].From < keys[j].From
+		}
+		return keys[i].Event < keys[j].Event
+	})
+	for _, k := range keys {
+		writeAlts("on", k.From, k.Event, d.transitions[k])
+	}
+	for _, id := range ids {
+		writeAlts("branch", id, "", d.branches[id])
+	}
+	aliases := make([]EventID, 0, len(d.aliases))
+	for a := range d.aliases {
+		aliases = append(aliases, a)
+	}
+	sort.Strings(aliases)
+	for _, a := range aliases {
+		fmt.Fprintf(h, "alias %q %q\n", a, d.aliases[a])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // RestoreSnapshotJSON restores from JSON snapshot
 func (m *Machine[C]) RestoreSnapshotJSON(data []byte, buf int) error {
 	var snap Snapshot
@@ -109,3 +450,87 @@ func (m *Machine[C]) RestoreSnapshotJSON(data []byte, buf int) error {
 	}
 	return m.RestoreSnapshot(&snap, buf)
 }
+
+// gobSnapshot is the binary wire form of Snapshot; the state context is gob-encoded instead of JSON.
+type gobSnapshot struct {
+	Version     int
+	Fingerprint string
+	Current     StateID
+	ActivePath  []StateID
+	Visited     []StateID
+	History     map[StateID]StateID
+	Counters    map[string]int
+	Timers      map[StateID]time.Duration
+	Delayed     []ScheduledEvent
+	TakenAt     time.Time
+	Transitions []TransitionRecord
+	Context     []byte
+}
+
+// SnapshotGob serializes the machine runtime with encoding/gob, which avoids JSON
+// encoding cost for large state contexts. The context type must be gob-encodable;
+// contexts held in interface types must be registered with gob.Register.
+func (m *Machine[C]) SnapshotGob() ([]byte, error) {
+	snap := m.Snapshot()
+	wire := gobSnapshot{Version: snap.Version, Fingerprint: snap.Fingerprint, Current: snap.Current, ActivePath: snap.ActivePath, Visited: snap.Visited, History: snap.History, Counters: snap.Counters, Timers: snap.Timers, Delayed: snap.Delayed, TakenAt: snap.TakenAt, Transitions: snap.Transitions}
+
+	ctx := m.GetStateContext()
+	if !isNilContext(ctx) {
+		var cbuf bytes.Buffer
+		if err := gob.NewEncoder(&cbuf).Encode(&ctx); err != nil {
+			return nil, fmt.Errorf("failed to encode state context: %w", err)
+		}
+		wire.Context = cbuf.Bytes()
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&wire); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RestoreSnapshotGob restores from a snapshot produced by SnapshotGob and starts the event loop.
+// Like RestoreSnapshot, it does not call entry/exit hooks.
+func (m *Machine[C]) RestoreSnapshotGob(data []byte, buf int) error {
+	var wire gobSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wire); err != nil {
+		return err
+	}
+	snap := &Snapshot{Version: wire.Version, Fingerprint: wire.Fingerprint, Current: wire.Current, ActivePath: wire.ActivePath, Visited: wire.Visited, History: wire.History, Counters: wire.Counters, Timers: wire.Timers, Delayed: wire.Delayed, TakenAt: wire.TakenAt, Transitions: wire.Transitions}
+	if err := m.validateSnapshot(snap); err != nil {
+		return err
+	}
+	if len(wire.Context) > 0 {
+		if err := m.decodeContext(func(ctx *C) error { return gob.NewDecoder(bytes.NewReader(wire.Context)).Decode(ctx) }); err != nil {
+			return fmt.Errorf("failed to restore state context: %w", err)
+		}
+	}
+	m.applySnapshot(snap)
+	return nil
+}
+
+// decodeContext decodes into a copy of the current context and publishes the result.
+// Pointer contexts are decoded into the existing pointee, as before.
+func (m *Machine[C]) decodeContext(decode func(*C) error) error {
+	m.ctxMu.Lock()
+	defer m.ctxMu.Unlock()
+	ctx := *m.ctx.Load()
+	if err := decode(&ctx); err != nil {
+		return err
+	}
+	m.ctx.Store(&ctx)
+	return nil
+}
+
+// isNilContext reports whether ctx is nil or a nil pointer/map/slice/interface value.
+func isNilContext(ctx any) bool {
+	if ctx == nil {
+		return true
+	}
+	switch v := reflect.ValueOf(ctx); v.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
@@ -2,6 +2,8 @@ package rfsm
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"sync/atomic"
 	"testing"
 )
@@ -215,3 +217,372 @@ func TestPersistence_RestoreSnapshot_InvalidContext(t *testing.T) {
 		t.Fatalf("context value want 42 got %d", ctx2.Value)
 	}
 }
+
+func TestPersistence_GobSnapshot(t *testing.T) {
+	type testContext struct {
+		Counter int
+		Tags    []string
+	}
+
+	def, err := NewDef("gob_test").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m1 := NewMachine(def, &testContext{Counter: 7, Tags: []string{"x"}})
+	if err := m1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m1.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := m1.SnapshotGob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m1.Stop()
+
+	ctx2 := &testContext{}
+	m2 := NewMachine(def, ctx2)
+	if err := m2.RestoreSnapshotGob(data, 4); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	if m2.Current() != "B" || !m2.HasVisited("A") {
+		t.Fatalf("runtime not restored: current=%v", m2.Current())
+	}
+	if ctx2.Counter != 7 || len(ctx2.Tags) != 1 || ctx2.Tags[0] != "x" {
+		t.Fatalf("context not restored: %+v", ctx2)
+	}
+
+	// nil context is skipped rather than failing the encode
+	m3 := NewMachine[*testContext](def, nil)
+	if err := m3.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m3.Stop()
+	if _, err := m3.SnapshotGob(); err != nil {
+		t.Fatalf("nil context snapshot: %v", err)
+	}
+
+	if err := NewMachine[any](def, nil).RestoreSnapshotGob([]byte("garbage"), 4); err == nil {
+		t.Fatalf("expected decode error")
+	}
+}
+
+func TestPersistence_Fingerprint(t *testing.T) {
+	def, err := NewDef("p").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := def.Edit().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Fingerprint() != rebuilt.Fingerprint() || def.Fingerprint() != def.Clone().Fingerprint() {
+		t.Fatal("fingerprint not stable across Edit and Clone")
+	}
+	described, _ := def.Edit().State("B", WithFinal(), WithDescription("done")).Build()
+	if described.Fingerprint() != def.Fingerprint() {
+		t.Fatal("descriptions should not change the fingerprint")
+	}
+	changed, err := def.Edit().State("C", WithFinal()).On("skip", "A", "C").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Fingerprint() == def.Fingerprint() {
+		t.Fatal("fingerprint did not change with the definition")
+	}
+
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	snap := m.Snapshot()
+	_ = m.Stop()
+	if snap.Version != SnapshotVersion || snap.Fingerprint != def.Fingerprint() {
+		t.Fatalf("unexpected snapshot version %d fingerprint %q", snap.Version, snap.Fingerprint)
+	}
+
+	if err := NewMachine[any](changed, nil).RestoreSnapshot(snap, 0); !errors.Is(err, ErrDefinitionMismatch) {
+		t.Fatalf("want ErrDefinitionMismatch got %v", err)
+	}
+	var warned bool
+	lenient := NewMachine[any](changed, nil, WithSnapshotMismatchHandler(func(s *Snapshot) error { warned = true; return nil }))
+	if err := lenient.RestoreSnapshot(snap, 0); err != nil || !warned {
+		t.Fatalf("handler should accept the snapshot: %v", err)
+	}
+	_ = lenient.Stop()
+
+	// snapshots written before versioning restore as before
+	legacy := *snap
+	legacy.Version, legacy.Fingerprint = 0, ""
+	old := NewMachine[any](changed, nil)
+	if err := old.RestoreSnapshot(&legacy, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = old.Stop()
+	future := *snap
+	future.Version = SnapshotVersion + 1
+	if err := NewMachine[any](def, nil).RestoreSnapshot(&future, 0); err == nil {
+		t.Fatal("want error for a newer snapshot version")
+	}
+}
+
+func TestPersistence_RestoreSnapshotWithMigration(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		On("next", "A1", "A2").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := NewDef("v1").
+		State("A", WithInitial(), WithSubDef(sub), WithHistory()).
+		State("OLD").
+		State("B", WithFinal()).
+		Current("A").
+		On("next", "A2", "OLD").
+		On("go", "OLD", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](v1, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Dispatch(Event{Name: "next"})
+	_ = m.Dispatch(Event{Name: "next"})
+	snap := m.Snapshot()
+	_ = m.Stop()
+	if snap.Current != "OLD" || snap.History["A"] != "A2" {
+		t.Fatalf("unexpected snapshot %+v", snap)
+	}
+
+	// OLD was renamed to WAITING and A2 was removed
+	sub2, err := NewDef("sub").
+		State("A1", WithInitial(), WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := NewDef("v2").
+		State("A", WithInitial(), WithSubDef(sub2), WithHistory()).
+		State("WAITING").
+		State("B", WithFinal()).
+		Current("A").
+		On("next", "A1", "WAITING").
+		On("go", "WAITING", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewMachine[any](v2, nil).RestoreSnapshot(snap, 0); err == nil {
+		t.Fatal("want error restoring without migration")
+	}
+	m2 := NewMachine[any](v2, nil)
+	if err := m2.RestoreSnapshotWithMigration(snap, 0, map[StateID]StateID{"OLD": "WAITING"}); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	if m2.Current() != "WAITING" || !m2.HasVisited("WAITING") || m2.HasVisited("A2") {
+		t.Fatalf("unexpected state %s after migration", m2.Current())
+	}
+	if m2.Snapshot().History != nil || snap.Current != "OLD" {
+		t.Fatal("history of a removed state should be dropped and the input left untouched")
+	}
+	if err := m2.Dispatch(Event{Name: "go"}); err != nil || m2.Current() != "B" {
+		t.Fatalf("migrated machine should run: %v", err)
+	}
+
+	// a state renamed to a composite resumes at its initial leaf
+	m3 := NewMachine[any](v2, nil)
+	if err := m3.RestoreSnapshotWithMigration(snap, 0, map[StateID]StateID{"OLD": "A"}); err != nil {
+		t.Fatal(err)
+	}
+	defer m3.Stop()
+	if m3.Current() != "A1" {
+		t.Fatalf("want A1 got %s", m3.Current())
+	}
+	if err := NewMachine[any](v2, nil).RestoreSnapshotWithMigration(snap, 0, nil); err == nil {
+		t.Fatal("want error for a removed current state without a rename")
+	}
+}
+
+func TestPersistence_MigrationDoesNotShareDefinitionPaths(t *testing.T) {
+	level3, err := NewDef("level3").
+		State("L1", WithInitial()).
+		State("L2", WithFinal()).
+		Current("L1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	level2, err := NewDef("level2").
+		State("C", WithInitial(), WithSubDef(level3)).
+		State("D", WithFinal()).
+		Current("C").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	level1, err := NewDef("level1").
+		State("B", WithInitial(), WithSubDef(level2)).
+		State("E", WithFinal()).
+		Current("B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("deep").
+		State("A", WithInitial(), WithSubDef(level1)).
+		State("Z", WithFinal()).
+		Current("A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	snap := &Snapshot{Current: "OLD", ActivePath: []StateID{"OLD"}}
+	// C's cached root path has spare capacity; extending it in place would let concurrent
+	// migrations write into the definition
+	p := m.pathTo("C")
+	if cap(p) == len(p) {
+		t.Skip("path has no spare capacity")
+	}
+	migrated := m.migrateSnapshot(snap, map[StateID]StateID{"OLD": "C"})
+	if got := fmt.Sprint(migrated.ActivePath); got != "[A B C L1]" {
+		t.Fatalf("unexpected migrated path %s", got)
+	}
+	if &migrated.ActivePath[0] == &p[0] {
+		t.Fatal("migrated active path shares the definition's path")
+	}
+}
+
+func TestPersistence_Hydrate(t *testing.T) {
+	type order struct{ Amount int }
+	def, err := NewDef("p").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine(def, &order{Amount: 7})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Dispatch(Event{Name: "go"})
+	data, _ := m.SnapshotJSON()
+	_ = m.Stop()
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	view := NewMachine(def, &order{})
+	if err := view.Hydrate(&snap); err != nil {
+		t.Fatal(err)
+	}
+	if view.Current() != "B" || !view.HasVisited("A") || view.GetStateContext().Amount != 7 {
+		t.Fatalf("unexpected hydrated state %s", view.Current())
+	}
+	if err := view.Dispatch(Event{Name: "go"}); !errors.Is(err, ErrMachineNotStarted) {
+		t.Fatalf("want ErrMachineNotStarted got %v", err)
+	}
+	bad := snap
+	bad.Current = "X"
+	if err := view.Hydrate(&bad); err == nil {
+		t.Fatal("want error for unknown state")
+	}
+
+	running := NewMachine(def, &order{})
+	_ = running.Start()
+	defer running.Stop()
+	if err := running.Hydrate(&snap); err == nil {
+		t.Fatal("want error hydrating a started machine")
+	}
+}
+
+func TestPersistence_RestoreReplayEntryHooks(t *testing.T) {
+	var entered []StateID
+	var failB bool
+	entry := func(id StateID) StateOption {
+		return WithEntry[any](func(e Event, ctx any) error {
+			entered = append(entered, id)
+			if failB && id == "B1" {
+				return errors.New("feed unavailable")
+			}
+			return nil
+		})
+	}
+	sub, err := NewDef("sub").
+		State("B1", WithInitial(), WithFinal(), entry("B1")).
+		Current("B1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("p").
+		State("A", WithInitial(), entry("A")).
+		State("B", WithFinal(), WithSubDef(sub), entry("B")).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1 := NewMachine[any](def, nil)
+	_ = m1.Start()
+	_ = m1.Dispatch(Event{Name: "go"})
+	snap := m1.Snapshot()
+	_ = m1.Stop()
+
+	entered = nil
+	m2 := NewMachine[any](def, nil)
+	if err := m2.RestoreSnapshotWithOptions(snap, 0, RestoreOptions{ReplayEntryHooks: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	if len(entered) != 2 || entered[0] != "B" || entered[1] != "B1" || m2.Current() != "B1" {
+		t.Fatalf("want entry hooks B, B1 got %v", entered)
+	}
+
+	entered = nil
+	m4 := NewMachine[any](def, nil)
+	if err := m4.RestoreSnapshotWithOptions(snap, 0, RestoreOptions{ReplayEntryHooksOf: []StateID{"B1", "A"}}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m4.Stop()
+	if len(entered) != 1 || entered[0] != "B1" {
+		t.Fatalf("want only the B1 entry hook got %v", entered)
+	}
+	if err := NewMachine[any](def, nil).RestoreSnapshotWithOptions(snap, 0, RestoreOptions{ReplayEntryHooksOf: []StateID{"X"}}); err == nil {
+		t.Fatal("want error for an unknown state")
+	}
+
+	failB = true
+	m3 := NewMachine[any](def, nil)
+	if err := m3.RestoreSnapshotWithOptions(snap, 0, RestoreOptions{ReplayEntryHooks: true}); err == nil {
+		t.Fatal("want entry hook error")
+	}
+	if err := m3.Dispatch(Event{Name: "go"}); !errors.Is(err, ErrMachineNotStarted) {
+		t.Fatalf("machine should stay stopped, got %v", err)
+	}
+}
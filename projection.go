@@ -0,0 +1,113 @@
+package rfsm
+
+import "sync"
+
+// ProjectFunc folds a committed transition of machine machineID into a read model.
+type ProjectFunc[T any] func(model *T, machineID string, from, to StateID, e Event)
+
+// Projection maintains a read model T derived from the transitions of any number of
+// machines. Subscribers returned by Subscriber apply each transition that moved the machine
+// before its Dispatch returns, so a dispatcher reading the projection afterwards sees its own
+// transition. Failed transitions are not projected, unless they moved the machine to its
+// error state.
+type Projection[T any] struct {
+	mu    sync.RWMutex
+	model T
+	apply ProjectFunc[T]
+}
+
+// NewProjection creates a projection starting from model.
+func NewProjection[T any](model T, apply ProjectFunc[T]) *Projection[T] {
+	return &Projection[T]{model: model, apply: apply}
+}
+
+// Subscriber returns a Subscriber that feeds the transitions of machine machineID into p.
+func (p *Projection[T]) Subscriber(machineID string) Subscriber {
+	return &projectionSub[T]{p: p, id: machineID}
+}
+
+// Update applies fn to the model under the projection's lock, e.g. to seed it.
+func (p *Projection[T]) Update(fn func(model *T)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn(&p.model)
+}
+
+// Read calls fn with the model under a read lock. fn must not retain or modify maps or
+// slices reachable from the model.
+func (p *Projection[T]) Read(fn func(model T)) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	fn(p.model)
+}
+
+type projectionSub[T any] struct {
+	p  *Projection[T]
+	id string
+}
+
+func (s *projectionSub[T]) OnTransition(from StateID, to StateID, e Event, err error) {
+	if err != nil && from == to {
+		return
+	}
+	s.p.Update(func(model *T) { s.p.apply(model, s.id, from, to, e) })
+}
+
+// StateDirectory is a ready-made projection of the latest state of each machine, including its
+// error state, and the number of machines in each state.
+type StateDirectory struct {
+	p *Projection[stateDirectory]
+}
+
+type stateDirectory struct {
+	latest map[string]StateID
+	counts map[StateID]int
+}
+
+// NewStateDirectory creates an empty StateDirectory.
+func NewStateDirectory() *StateDirectory {
+	idx := stateDirectory{latest: make(map[string]StateID), counts: make(map[StateID]int)}
+	return &StateDirectory{p: NewProjection(idx, func(x *stateDirectory, id string, from, to StateID, e Event) {
+		x.move(id, to)
+	})}
+}
+
+func (x *stateDirectory) move(id string, to StateID) {
+	if prev, ok := x.latest[id]; ok {
+		if x.counts[prev]--; x.counts[prev] == 0 {
+			delete(x.counts, prev)
+		}
+	}
+	x.latest[id] = to
+	x.counts[to]++
+}
+
+// Attach records the machine's current leaf state under machineID and subscribes the index
+// to its transitions. Attach a machine after Start or a restore, before events are dispatched to it.
+func (x *StateDirectory) Attach(machineID string, m interface {
+	Subscribe(Subscriber)
+	Configuration() Configuration
+}) {
+	leaf := m.Configuration().Leaf
+	x.p.Update(func(idx *stateDirectory) { idx.move(machineID, leaf) })
+	m.Subscribe(x.p.Subscriber(machineID))
+}
+
+// Latest returns the last known state of machineID.
+func (x *StateDirectory) Latest(machineID string) (StateID, bool) {
+	var s StateID
+	var ok bool
+	x.p.Read(func(idx stateDirectory) { s, ok = idx.latest[machineID] })
+	return s, ok
+}
+
+// Counts returns the number of attached machines in each state.
+func (x *StateDirectory) Counts() map[StateID]int {
+	out := make(map[StateID]int)
+	x.p.Read(func(idx stateDirectory) {
+		for s, n := range idx.counts {
+			out[s] = n
+		}
+	})
+	return out
+}
@@ -0,0 +1,111 @@
+package rfsm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestStateDirectory(t *testing.T) {
+	def, err := NewDef("orders").
+		State("PENDING", WithInitial()).
+		State("PAID", WithFinal()).
+		Current("PENDING").
+		On("pay", "PENDING", "PAID").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := NewStateDirectory()
+	var machines []*Machine[any]
+	for i := 0; i < 3; i++ {
+		m := NewMachine[any](def, nil)
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer m.Stop()
+		idx.Attach(fmt.Sprintf("order-%d", i), m)
+		machines = append(machines, m)
+	}
+	if c := idx.Counts(); c["PENDING"] != 3 || len(c) != 1 {
+		t.Fatalf("unexpected counts %v", c)
+	}
+
+	if err := machines[1].Dispatch(Event{Name: "pay"}); err != nil {
+		t.Fatal(err)
+	}
+	// a failed transition is not projected
+	_ = machines[0].Dispatch(Event{Name: "refund"})
+
+	if s, ok := idx.Latest("order-1"); !ok || s != "PAID" {
+		t.Fatalf("want PAID got %q %v", s, ok)
+	}
+	if s, _ := idx.Latest("order-0"); s != "PENDING" {
+		t.Fatalf("want PENDING got %q", s)
+	}
+	if c := idx.Counts(); c["PENDING"] != 2 || c["PAID"] != 1 {
+		t.Fatalf("unexpected counts %v", c)
+	}
+}
+
+func TestProjection(t *testing.T) {
+	def, err := NewDef("p").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		On("back", "B", "A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type visits map[string]int
+	p := NewProjection(visits{}, func(v *visits, id string, from, to StateID, e Event) {
+		(*v)[id+":"+to]++
+	})
+	m := NewMachine[any](def, nil)
+	m.Subscribe(p.Subscriber("m1"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	for _, ev := range []string{"go", "back", "go"} {
+		if err := m.Dispatch(Event{Name: ev}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Read(func(v visits) {
+		if v["m1:B"] != 2 || v["m1:A"] != 1 {
+			t.Fatalf("unexpected model %v", v)
+		}
+	})
+}
+
+func TestStateDirectory_ErrorState(t *testing.T) {
+	def, err := NewDef("orders").
+		State("PENDING", WithInitial()).
+		State("PAID", WithFinal(), WithEntry(func(e Event, _ any) error { return errors.New("ledger down") })).
+		State("FAILED").
+		Current("PENDING").
+		On("pay", "PENDING", "PAID").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := NewStateDirectory()
+	m := NewMachine[any](def, nil, WithFailurePolicy(FailureMoveToErrorState), WithErrorState("FAILED"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	dir.Attach("order-1", m)
+	if err := m.Dispatch(Event{Name: "pay"}); err == nil {
+		t.Fatal("want the entry error")
+	}
+	if s, _ := dir.Latest("order-1"); s != "FAILED" {
+		t.Fatalf("want FAILED got %q", s)
+	}
+	if c := dir.Counts(); c["FAILED"] != 1 || len(c) != 1 {
+		t.Fatalf("unexpected counts %v", c)
+	}
+}
@@ -0,0 +1,231 @@
+package rfsm
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+)
+
+// Queue holds the events dispatched to a machine until its loop handles them, in place of
+// the built-in bounded channel (see WithQueue). Implementations must be safe for concurrent
+// use. Events carry values the machine appends to their Args; use DispatchedEvent to see
+// them as dispatched.
+type Queue interface {
+	// Enqueue adds e. An error, e.g. because the queue is full, is returned to the dispatcher.
+	Enqueue(e Event) error
+	// Dequeue removes and returns the next event to handle, or false if the queue is empty.
+	Dequeue() (Event, bool)
+	// Len returns the number of queued events.
+	Len() int
+	// Close is called once the loop stopped and the events left were answered with
+	// ErrMachineStopped.
+	Close() error
+}
+
+// WithQueue makes the machine queue events in a Queue returned by newQueue, called on every
+// Start and restore, instead of its built-in channel. Unlike the channel, a Queue does not
+// block dispatchers: Enqueue accepts or rejects events at once.
+func WithQueue(newQueue func() Queue) MachineOption {
+	return func(c *machineConfig) { c.newQueue = newQueue }
+}
+
+// DispatchedEvent returns e without the values the machine appends to the Args of queued
+// events, as it was passed to Dispatch.
+func DispatchedEvent(e Event) Event { return userEvent(e) }
+
+// errPushCanceled is returned by push when its cancel channel was closed.
+var errPushCanceled = errors.New("push canceled")
+
+// runQueue holds the queue and channels of one Start-to-Stop run of the event loop.
+type runQueue struct {
+	events chan Event
+	custom Queue         // set with WithQueue; events is then unused
+	wake   chan struct{} // signalled when custom has events
+	done   chan struct{} // closed to stop the loop
+	exited chan struct{} // closed once the loop exited and answered queued events
+}
+
+// openQueue sets up the queue and channels of a new run. Must be called with statusMu held.
+func (m *Machine[C]) openQueue(buf int) {
+	m.events = make(chan Event, buf)
+	m.done = make(chan struct{})
+	m.exited = make(chan struct{})
+	m.custom, m.wake = nil, nil
+	if m.newQueue != nil {
+		m.custom, m.wake = m.newQueue(), make(chan struct{}, 1)
+	}
+}
+
+// run returns the queue of the current run. Must be called with statusMu held, or on the loop.
+func (m *Machine[C]) run() runQueue {
+	return runQueue{events: m.events, custom: m.custom, wake: m.wake, done: m.done, exited: m.exited}
+}
+
+// queue returns the queue of the current run, and false if the machine is not started.
+func (m *Machine[C]) queue() (runQueue, bool) {
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	return m.run(), m.started
+}
+
+// trySend queues e if the built-in channel of a started machine has room, reporting whether
+// it did. The loop answers every event queued so: it only stops once Stop (or FailureAbort)
+// took statusMu, and answers the events left before exiting.
+func (m *Machine[C]) trySend(e Event) bool {
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	if !m.started || m.custom != nil {
+		return false
+	}
+	select {
+	case m.events <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// push queues e, giving up with ErrMachineStopped once the run stopped, or errPushCanceled
+// if cancel is closed first.
+func (q runQueue) push(e Event, cancel <-chan struct{}) error {
+	if q.custom == nil {
+		select {
+		case q.events <- e:
+			return nil
+		case <-q.done:
+			return ErrMachineStopped
+		case <-cancel:
+			return errPushCanceled
+		}
+	}
+	select {
+	case <-q.done:
+		return ErrMachineStopped
+	case <-cancel:
+		return errPushCanceled
+	default:
+	}
+	if err := q.custom.Enqueue(e); err != nil {
+		return err
+	}
+	q.signal()
+	return nil
+}
+
+// signal wakes the loop up to dequeue from the custom queue.
+func (q runQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the next event without blocking.
+func (q runQueue) next() (Event, bool) {
+	if q.custom != nil {
+		return q.custom.Dequeue()
+	}
+	select {
+	case e := <-q.events:
+		return e, true
+	default:
+		return Event{}, false
+	}
+}
+
+// len returns the number of queued events.
+func (q runQueue) len() int {
+	if q.custom != nil {
+		return q.custom.Len()
+	}
+	return len(q.events)
+}
+
+// PriorityQueue is a Queue handing out events by priority, and in dispatch order among
+// events of equal priority. It is unbounded.
+type PriorityQueue struct {
+	mu     sync.Mutex
+	less   func(a, b Event) bool
+	items  priorityItems
+	seq    uint64
+	closed bool
+}
+
+// NewPriorityQueue returns a PriorityQueue where a is handled before b if less(a, b). less
+// receives the events as dispatched (see DispatchedEvent).
+func NewPriorityQueue(less func(a, b Event) bool) *PriorityQueue {
+	q := &PriorityQueue{less: less}
+	q.items.less = less
+	return q
+}
+
+func (q *PriorityQueue) Enqueue(e Event) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrMachineStopped
+	}
+	q.seq++
+	heap.Push(&q.items, priorityItem{event: e, view: DispatchedEvent(e), seq: q.seq})
+	return nil
+}
+
+func (q *PriorityQueue) Dequeue() (Event, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items.items) == 0 {
+		return Event{}, false
+	}
+	return heap.Pop(&q.items).(priorityItem).event, true
+}
+
+func (q *PriorityQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items.items)
+}
+
+func (q *PriorityQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.items.items = nil
+	return nil
+}
+
+type priorityItem struct {
+	event Event
+	view  Event // event as dispatched, passed to less
+	seq   uint64
+}
+
+// priorityItems implements heap.Interface.
+type priorityItems struct {
+	items []priorityItem
+	less  func(a, b Event) bool
+}
+
+func (h priorityItems) Len() int { return len(h.items) }
+
+func (h priorityItems) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.less(a.view, b.view) {
+		return true
+	}
+	if h.less(b.view, a.view) {
+		return false
+	}
+	return a.seq < b.seq
+}
+
+func (h priorityItems) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *priorityItems) Push(x any) { h.items = append(h.items, x.(priorityItem)) }
+
+func (h *priorityItems) Pop() any {
+	n := len(h.items)
+	it := h.items[n-1]
+	h.items[n-1] = priorityItem{}
+	h.items = h.items[:n-1]
+	return it
+}
@@ -0,0 +1,96 @@
+package rfsm
+
+import (
+	"errors"
+	"testing"
+)
+
+// boundedQueue is a FIFO Queue rejecting events beyond its capacity.
+type boundedQueue struct {
+	*PriorityQueue
+	max int
+}
+
+func (q *boundedQueue) Enqueue(e Event) error {
+	if q.Len() >= q.max {
+		return errors.New("queue full")
+	}
+	return q.PriorityQueue.Enqueue(e)
+}
+
+func TestWithQueue_Priority(t *testing.T) {
+	def, err := NewDef("q").
+		State("A", WithInitial(), WithFinal()).
+		Current("A").
+		On("low", "A", "A").
+		On("high", "A", "A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urgent := func(a, b Event) bool { return a.Name == "high" && b.Name != "high" }
+	m := NewMachine[any](def, nil, WithStepMode(), WithQueue(func() Queue { return NewPriorityQueue(urgent) }))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.DispatchAsync(Event{Name: "low", Args: []any{1}})
+	_ = m.DispatchAsync(Event{Name: "low", Args: []any{2}})
+	_ = m.DispatchAsync(Event{Name: "high"})
+	if st := m.MemoryStats(); st.QueueLength != 3 {
+		t.Fatalf("want 3 queued events got %d", st.QueueLength)
+	}
+	var got []any
+	for {
+		r, err := m.Step()
+		if errors.Is(err, ErrNoEventQueued) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, r.Event.Name)
+		if len(r.Event.Args) > 0 {
+			got = append(got, r.Event.Args[0])
+		}
+	}
+	if len(got) != 5 || got[0] != "high" || got[2] != 1 || got[4] != 2 {
+		t.Fatalf("unexpected order %v", got)
+	}
+
+	// events left when the machine stops are answered
+	stopped := make(chan error, 1)
+	_ = m.DispatchAsyncCb(Event{Name: "low"}, func(err error) { stopped <- err })
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-stopped; !errors.Is(err, ErrMachineStopped) {
+		t.Fatalf("want ErrMachineStopped got %v", err)
+	}
+}
+
+func TestWithQueue_Rejects(t *testing.T) {
+	def, err := NewDef("q").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fifo := func(a, b Event) bool { return false }
+	m := NewMachine[any](def, nil, WithQueue(func() Queue { return &boundedQueue{PriorityQueue: NewPriorityQueue(fifo), max: 1} }))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil || m.Current() != "B" {
+		t.Fatalf("want B got %s (%v)", m.Current(), err)
+	}
+	_ = m.Pause()
+	_ = m.DispatchAsync(Event{Name: "go"})
+	if err := m.DispatchAsync(Event{Name: "go"}); err == nil || err.Error() != "queue full" {
+		t.Fatalf("want queue full got %v", err)
+	}
+	m.Resume()
+}
@@ -0,0 +1,98 @@
+package rfsm
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotInTransition is returned by Raise when its context was not passed in by a machine.
+var ErrNotInTransition = errors.New("context does not belong to a machine step")
+
+// raiseKey is the context key under which a machine's raise queue is passed to guards,
+// actions and hooks.
+type raiseKey struct{}
+
+// raiseQueue holds the internal events raised during the current step.
+type raiseQueue struct {
+	mu     sync.Mutex
+	events []Event
+	n      atomic.Int32 // len(events), so popping an empty queue takes no lock
+}
+
+func (q *raiseQueue) push(e Event) {
+	q.mu.Lock()
+	q.events = append(q.events, e)
+	q.n.Store(int32(len(q.events)))
+	q.mu.Unlock()
+}
+
+func (q *raiseQueue) pop() (Event, bool) {
+	if q.n.Load() == 0 {
+		return Event{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.events) == 0 {
+		return Event{}, false
+	}
+	e := q.events[0]
+	q.events[0] = Event{}
+	q.events = q.events[1:]
+	q.n.Store(int32(len(q.events)))
+	return e, true
+}
+
+func (q *raiseQueue) reset() {
+	q.mu.Lock()
+	q.events = nil
+	q.n.Store(0)
+	q.mu.Unlock()
+}
+
+// Raise queues e as an internal event of the machine whose guard, action or hook received
+// cx (see WithActionCtx and WithEntryCtx). Internal events are handled, in the order raised,
+// once the current event's transition completes and before any other queued event, so an
+// action can continue the flow without calling Dispatch, which would deadlock the loop.
+// Their results are reported to subscribers only; Dispatch returns once they are handled.
+// Raise must be called while the guard, action or hook runs.
+func Raise(cx context.Context, e Event) error {
+	q, ok := cx.Value(raiseKey{}).(*raiseQueue)
+	if !ok {
+		return ErrNotInTransition
+	}
+	q.push(e)
+	return nil
+}
+
+// stepContext returns cx carrying the machine's raise queue.
+func (m *Machine[C]) stepContext(cx context.Context) context.Context {
+	if cx == context.Background() {
+		return m.raiseCx
+	}
+	return context.WithValue(cx, raiseKey{}, m.raised)
+}
+
+// drainRaised handles the internal events raised so far, including those raised by them, and
+// returns the first error of appending them to the event store. During ReplayFrom raised
+// events are dropped, as the store holds them already.
+func (m *Machine[C]) drainRaised(cx context.Context) error {
+	if m.replay.Load() != replayOff {
+		m.raised.reset()
+		return nil
+	}
+	var first error
+	for {
+		e, ok := m.raised.pop()
+		if !ok {
+			return first
+		}
+		if err := recovered(func() error { return m.handleEvent(cx, e, time.Time{}) }); err == nil {
+			if err := m.appendEvent(e); first == nil {
+				first = err
+			}
+		}
+	}
+}
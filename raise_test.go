@@ -0,0 +1,71 @@
+package rfsm
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRaise(t *testing.T) {
+	var order []string
+	def, err := NewDef("raise").
+		State("IDLE", WithInitial(), WithEntryCtx[any](func(cx context.Context, e Event, ctx any) error {
+			if e.Name == "" {
+				return Raise(cx, Event{Name: "boot"})
+			}
+			return nil
+		})).
+		State("READY").
+		State("WORKING").
+		State("CHECKED").
+		State("DONE", WithFinal()).
+		Current("IDLE").
+		On("boot", "IDLE", "READY").
+		On("work", "READY", "WORKING", WithActionCtx[any](func(cx context.Context, e Event, ctx any) error {
+			order = append(order, "work")
+			return Raise(cx, Event{Name: "check"})
+		})).
+		On("check", "WORKING", "CHECKED", WithActionCtx[any](func(cx context.Context, e Event, ctx any) error {
+			order = append(order, "check")
+			return Raise(cx, Event{Name: "finish"})
+		})).
+		On("finish", "CHECKED", "DONE", WithAction(func(e Event, ctx any) error {
+			order = append(order, "finish")
+			return nil
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Raise(context.Background(), Event{Name: "x"}); err != ErrNotInTransition {
+		t.Fatalf("want ErrNotInTransition got %v", err)
+	}
+
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	// raised by Start's entry hook, handled before any dispatched event
+	if err := m.Dispatch(Event{Name: "work"}); err != nil {
+		t.Fatal(err)
+	}
+	// raised events chained, all handled before Dispatch returned
+	if m.Current() != "DONE" {
+		t.Fatalf("want DONE got %s", m.Current())
+	}
+	if len(order) != 3 || order[0] != "work" || order[1] != "check" || order[2] != "finish" {
+		t.Fatalf("unexpected order %v", order)
+	}
+
+	// also with a caller context
+	m2 := NewMachine[any](def, nil)
+	if err := m2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	cx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := m2.DispatchContext(cx, Event{Name: "work"}); err != nil || m2.Current() != "DONE" {
+		t.Fatalf("want DONE got %s (%v)", m2.Current(), err)
+	}
+}
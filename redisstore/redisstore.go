@@ -0,0 +1,191 @@
+// Package redisstore implements rfsm.Store on Redis, so stateless pods can hydrate a machine
+// per request. Snapshots, including the remaining time of pending state timeouts, are stored
+// as JSON under "<prefix><machine id>" with an optional TTL.
+//
+// Store is also an rfsm.VersionedStore, for rfsm.WithVersionedPersist: the versions of a machine
+// are kept together as one JSON array under "<prefix>versions:<machine id>", so set a
+// retention with WithRetention to bound its size, and do not use machine ids starting with
+// "versions:".
+//
+// The package does not depend on a Redis library; wrap your client in a Client, e.g. for
+// go-redis:
+//
+//	type client struct{ rdb *redis.Client }
+//
+//	func (c client) Get(ctx context.Context, key string) (string, bool, error) {
+//		v, err := c.rdb.Get(ctx, key).Result()
+//		if errors.Is(err, redis.Nil) {
+//			return "", false, nil
+//		}
+//		return v, err == nil, err
+//	}
+//
+//	func (c client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+//		return c.rdb.Set(ctx, key, value, ttl).Err()
+//	}
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// Client is the subset of a Redis client used by Store.
+type Client interface {
+	// Get returns the value of key, and false if it does not exist.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Set sets key to value, expiring after ttl if ttl > 0.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithPrefix sets the key prefix, "rfsm:" by default.
+func WithPrefix(prefix string) Option {
+	return func(s *Store) { s.prefix = prefix }
+}
+
+// WithTTL expires snapshots ttl after they were last saved, e.g. to drop abandoned sessions.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Store) { s.ttl = ttl }
+}
+
+// WithRetention sets which versions SaveVersion keeps.
+func WithRetention(r rfsm.Retention) Option {
+	return func(s *Store) { s.retention = r }
+}
+
+// Store is an rfsm.Store backed by Redis.
+type Store struct {
+	client    Client
+	prefix    string
+	ttl       time.Duration
+	retention rfsm.Retention
+}
+
+var _ rfsm.VersionedStore = (*Store)(nil)
+
+// version is an element of the versions array of a machine.
+type version struct {
+	rfsm.StoredVersion
+	Snapshot json.RawMessage `json:"snapshot"`
+}
+
+// New creates a Store on client.
+func New(client Client, opts ...Option) *Store {
+	s := &Store{client: client, prefix: "rfsm:"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Save stores snap under id, resetting its TTL.
+func (s *Store) Save(ctx context.Context, id string, snap *rfsm.Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.prefix+id, string(data), s.ttl)
+}
+
+// Load returns the snapshot stored under id, or rfsm.ErrSnapshotNotFound if it does not exist
+// or expired.
+func (s *Store) Load(ctx context.Context, id string) (*rfsm.Snapshot, error) {
+	data, ok, err := s.client.Get(ctx, s.prefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	var snap rfsm.Snapshot
+	if err := json.Unmarshal([]byte(data), &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q: %w", id, err)
+	}
+	return &snap, nil
+}
+
+// SaveVersion saves snap like Save and appends it to the versions of id, dropping those
+// outside the retention. Concurrent saves of the same id may lose versions.
+func (s *Store) SaveVersion(ctx context.Context, id string, snap *rfsm.Snapshot) (int64, error) {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+	vs, err := s.loadVersions(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.client.Set(ctx, s.prefix+id, string(data), s.ttl); err != nil {
+		return 0, err
+	}
+	v := version{StoredVersion: rfsm.StoredVersion{Version: 1, SavedAt: time.Now()}, Snapshot: data}
+	if len(vs) > 0 {
+		v.Version = vs[len(vs)-1].Version + 1
+	}
+	vs = append(vs, v)
+	infos := make([]rfsm.StoredVersion, len(vs))
+	for i := range vs {
+		infos[i] = vs[i].StoredVersion
+	}
+	vs = vs[s.retention.Expired(infos, v.SavedAt):]
+	out, err := json.Marshal(vs)
+	if err != nil {
+		return 0, err
+	}
+	return v.Version, s.client.Set(ctx, s.versionsKey(id), string(out), s.ttl)
+}
+
+// ListVersions returns the versions kept for id, oldest first.
+func (s *Store) ListVersions(ctx context.Context, id string) ([]rfsm.StoredVersion, error) {
+	vs, err := s.loadVersions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]rfsm.StoredVersion, len(vs))
+	for i := range vs {
+		out[i] = vs[i].StoredVersion
+	}
+	return out, nil
+}
+
+// LoadVersion returns a kept version of id, or rfsm.ErrSnapshotNotFound.
+func (s *Store) LoadVersion(ctx context.Context, id string, v int64) (*rfsm.Snapshot, error) {
+	vs, err := s.loadVersions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(vs, func(x version) bool { return x.Version == v })
+	if i < 0 {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	var snap rfsm.Snapshot
+	if err := json.Unmarshal(vs[i].Snapshot, &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q version %d: %w", id, v, err)
+	}
+	return &snap, nil
+}
+
+// versionsKey is the key of the versions of id, inside the store's prefix.
+func (s *Store) versionsKey(id string) string {
+	return s.prefix + "versions:" + id
+}
+
+func (s *Store) loadVersions(ctx context.Context, id string) ([]version, error) {
+	data, ok, err := s.client.Get(ctx, s.versionsKey(id))
+	if err != nil || !ok {
+		return nil, err
+	}
+	var vs []version
+	if err := json.Unmarshal([]byte(data), &vs); err != nil {
+		return nil, fmt.Errorf("failed to decode versions of %q: %w", id, err)
+	}
+	return vs, nil
+}
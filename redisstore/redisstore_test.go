@@ -0,0 +1,134 @@
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// fakeRedis is an in-memory Client honoring TTLs.
+type fakeRedis struct {
+	mu   sync.Mutex
+	vals map[string]string
+	exp  map[string]time.Time
+	ttls map[string]time.Duration
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{vals: map[string]string{}, exp: map[string]time.Time{}, ttls: map[string]time.Duration{}}
+}
+
+func (f *fakeRedis) Get(_ context.Context, key string) (string, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if exp, ok := f.exp[key]; ok && time.Now().After(exp) {
+		delete(f.vals, key)
+	}
+	v, ok := f.vals[key]
+	return v, ok, nil
+}
+
+func (f *fakeRedis) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.vals[key] = value
+	f.ttls[key] = ttl
+	delete(f.exp, key)
+	if ttl > 0 {
+		f.exp[key] = time.Now().Add(ttl)
+	}
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	def, err := rfsm.NewDef("session").
+		State("OPEN", rfsm.WithInitial()).
+		State("QUOTED", rfsm.WithTimeout(time.Hour, "expire")).
+		State("EXPIRED", rfsm.WithFinal()).
+		Current("OPEN").
+		On("quote", "OPEN", "QUOTED").
+		On("expire", "QUOTED", "EXPIRED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb := newFakeRedis()
+	store := New(rdb, WithPrefix("quotes:"), WithTTL(time.Minute))
+	ctx := context.Background()
+
+	// request 1 hydrates nothing and persists its transition
+	if _, err := store.Load(ctx, "s1"); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(store, "s1"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(rfsm.Event{Name: "quote"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+	if rdb.ttls["quotes:s1"] != time.Minute {
+		t.Fatalf("want a one minute TTL got %v", rdb.ttls["quotes:s1"])
+	}
+
+	// request 2 hydrates the machine, pending timeout included
+	snap, err := store.Load(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Current != "QUOTED" || snap.Timers["QUOTED"] <= 0 {
+		t.Fatalf("unexpected snapshot %+v", snap)
+	}
+	m2 := rfsm.NewMachine[any](def, nil)
+	if err := m2.RestoreSnapshot(snap, 0); err != nil {
+		t.Fatal(err)
+	}
+	_ = m2.Stop()
+
+	rdb.exp["quotes:s1"] = time.Now().Add(-time.Second)
+	if _, err := store.Load(ctx, "s1"); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound after expiry, got %v", err)
+	}
+}
+
+func TestStore_Versions(t *testing.T) {
+	rdb := newFakeRedis()
+	store := New(rdb, WithPrefix("quotes:"), WithRetention(rfsm.Retention{MaxVersions: 2}))
+	ctx := context.Background()
+	for _, current := range []rfsm.StateID{"OPEN", "QUOTED", "EXPIRED"} {
+		if _, err := store.SaveVersion(ctx, "s1", &rfsm.Snapshot{Current: current}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vs, err := store.ListVersions(ctx, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || vs[0].Version != 2 || vs[1].Version != 3 {
+		t.Fatalf("want versions 2 and 3 got %+v", vs)
+	}
+	snap, err := store.LoadVersion(ctx, "s1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Current != "QUOTED" {
+		t.Fatalf("want QUOTED got %s", snap.Current)
+	}
+	if _, err := store.LoadVersion(ctx, "s1", 1); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	if snap, err := store.Load(ctx, "s1"); err != nil || snap.Current != "EXPIRED" {
+		t.Fatalf("latest snapshot %v %v", snap, err)
+	}
+	if _, ok := rdb.vals["quotes:versions:s1"]; !ok {
+		t.Fatalf("versions should be stored inside the prefix, keys %v", rdb.vals)
+	}
+	if vs, err := store.ListVersions(ctx, "s2"); err != nil || len(vs) != 0 {
+		t.Fatalf("want no versions got %v %v", vs, err)
+	}
+}
@@ -0,0 +1,96 @@
+package rfsm
+
+import (
+	"math/rand/v2"
+	"strconv"
+)
+
+// WithWeight sets the relative probability of the transition, or of a junction or choice
+// branch, among the alternatives RandomWalk picks from (1 by default, 0 never picks it).
+// Branch weights model how often the branch guards pass. It is stored as MetaWeight
+// metadata, so exporters and analytics can read it too.
+func WithWeight(w float64) TransitionOption {
+	return WithTransitionMetadata(MetaWeight, strconv.FormatFloat(w, 'g', -1, 64))
+}
+
+// Weight returns the transition's MetaWeight, or 1 if it has none or it is not a
+// non-negative number.
+func (t *TransitionDef) Weight() float64 {
+	v, ok := t.Metadata[MetaWeight]
+	if !ok {
+		return 1
+	}
+	w, err := strconv.ParseFloat(v, 64)
+	if err != nil || w < 0 {
+		return 1
+	}
+	return w
+}
+
+// RandomWalk generates a synthetic event sequence of at most maxSteps events, e.g. to drive
+// load tests with realistic traffic. Starting from the initial leaf, it repeatedly picks one
+// of the transitions declared from the leaf or its ancestors with probability proportional
+// to its Weight, follows junction and choice branches the same way, and drills into initial
+// children. It stops at a final state or when no transition is left. Guards are not
+// evaluated and wildcard transitions are skipped, so a machine may still reject some events.
+func (d *Definition) RandomWalk(r *rand.Rand, maxSteps int) []EventID {
+	var events []EventID
+	leaf := d.initialLeaf(d.Current)
+	for len(events) < maxSteps && !d.states[leaf].Final {
+		var alts []TransitionDef
+		for _, s := range d.pathTo(leaf) {
+			for _, k := range d.Outgoing(s) {
+				if !isWildcard(k.Event) {
+					alts = append(alts, d.transitions[k]...)
+				}
+			}
+		}
+		t, ok := pickWeighted(r, alts)
+		if !ok {
+			break
+		}
+		events = append(events, t.Key.Event)
+		to := t.To
+		for st := d.states[to]; st.Junction || st.Choice; st = d.states[to] {
+			b, ok := pickWeighted(r, d.branches[to])
+			if !ok {
+				return events
+			}
+			to = b.To
+		}
+		leaf = d.initialLeaf(to)
+	}
+	return events
+}
+
+// initialLeaf returns the leaf entered when drilling into s through initial children.
+func (d *Definition) initialLeaf(s StateID) StateID {
+	if drill := d.initialDescendants(s); len(drill) > 0 {
+		return drill[len(drill)-1]
+	}
+	return s
+}
+
+// pickWeighted picks one of alts with probability proportional to its Weight.
+func pickWeighted(r *rand.Rand, alts []TransitionDef) (TransitionDef, bool) {
+	var total float64
+	for i := range alts {
+		total += alts[i].Weight()
+	}
+	if total <= 0 {
+		return TransitionDef{}, false
+	}
+	x := r.Float64() * total
+	for i := range alts {
+		if x -= alts[i].Weight(); x < 0 {
+			return alts[i], true
+		}
+	}
+	// rounding: fall back to the last alternative with a weight
+	for i := len(alts) - 1; i >= 0; i-- {
+		if alts[i].Weight() > 0 {
+			return alts[i], true
+		}
+	}
+	return TransitionDef{}, false
+}
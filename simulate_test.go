@@ -0,0 +1,58 @@
+package rfsm
+
+import (
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestRandomWalk(t *testing.T) {
+	def, err := NewDef("checkout").
+		State("CART", WithInitial()).
+		State("PAY", WithJunction()).
+		State("PAID").
+		State("DECLINED").
+		State("ABANDONED", WithFinal()).
+		State("DONE", WithFinal()).
+		Current("CART").
+		On("checkout", "CART", "PAY", WithWeight(3)).
+		On("leave", "CART", "ABANDONED").
+		On("never", "CART", "DONE", WithWeight(0)).
+		Branch("PAY", "PAID", WithWeight(9), WithGuard(func(e Event, ctx any) bool { return e.Name == "checkout" })).
+		Branch("PAY", "DECLINED").
+		On("retry", "DECLINED", "CART").
+		On("ship", "PAID", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transitions := def.Transitions("CART", "checkout")
+	if w := transitions[0].Weight(); w != 3 {
+		t.Fatalf("want weight 3 got %v", w)
+	}
+	if w := def.Transitions("CART", "leave")[0].Weight(); w != 1 {
+		t.Fatalf("want default weight 1 got %v", w)
+	}
+
+	r := rand.New(rand.NewPCG(1, 2))
+	counts := map[EventID]int{}
+	for range 2000 {
+		walk := def.RandomWalk(r, 20)
+		if slices.Contains(walk, "never") {
+			t.Fatal("zero-weight transition taken")
+		}
+		for _, ev := range walk {
+			counts[ev]++
+		}
+	}
+	// checkout is taken 3 times as often as leave; 9 of 10 payments succeed
+	if ratio := float64(counts["checkout"]) / float64(counts["leave"]); ratio < 2.5 || ratio > 3.5 {
+		t.Fatalf("unexpected checkout/leave ratio %.2f (%v)", ratio, counts)
+	}
+	if ratio := float64(counts["ship"]) / float64(counts["retry"]); ratio < 7 || ratio > 11 {
+		t.Fatalf("unexpected ship/retry ratio %.2f (%v)", ratio, counts)
+	}
+	if w := def.RandomWalk(r, 0); len(w) != 0 {
+		t.Fatalf("want no events, got %v", w)
+	}
+}
@@ -0,0 +1,367 @@
+// Package sqlstore implements rfsm.Store on database/sql with optimistic concurrency.
+//
+// Each snapshot row carries a version. A Store remembers the version of every snapshot it
+// loaded or saved, and a Save only succeeds if the row still has that version, so when two
+// workers restore the same machine, the second to persist a transition gets ErrConflict
+// instead of overwriting the first:
+//
+//	store := sqlstore.New(db)
+//	_ = store.CreateTable(ctx)
+//	snap, err := store.Load(ctx, orderID)
+//	m := rfsm.NewMachine(def, order, rfsm.WithAutoPersist(store, orderID))
+//	_ = m.RestoreSnapshot(snap, 0)
+//	if err := m.Dispatch(e); errors.Is(err, sqlstore.ErrConflict) {
+//		// another worker moved the order on: discard m and reload
+//	}
+//
+// Use one Store per worker; workers sharing a Store share its versions and are not protected
+// from each other.
+//
+// Store is also an rfsm.VersionedStore: SaveVersion copies each snapshot, under the row
+// version it was saved with, into a "<table>_versions" table in the same transaction, for
+// rfsm.WithVersionedPersist.
+//
+// For events consumed from a message bus, the store keeps an inbox of the (machine id, event
+// id) pairs already processed, in a "<table>_inbox" table written in the same transaction as
+// the snapshot, so a redelivered event is applied at most once:
+//
+//	if done, err := store.Processed(ctx, orderID, msg.ID); err == nil && done {
+//		return msg.Ack()
+//	}
+//	err := m.DispatchContext(sqlstore.WithInboxEvent(ctx, msg.ID), e)
+//	if errors.Is(err, sqlstore.ErrAlreadyProcessed) || errors.Is(err, sqlstore.ErrConflict) {
+//		// another delivery got there first: discard m and reload
+//	}
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// ErrConflict is returned by Save when the stored snapshot changed since this Store loaded or
+// saved it, or when it saves a new id that another Store created meanwhile.
+var ErrConflict = errors.New("snapshot was modified concurrently")
+
+// ErrAlreadyProcessed is returned by Save and SaveVersion when the inbox already holds the
+// event of their context for the machine, see WithInboxEvent. Nothing is saved.
+var ErrAlreadyProcessed = errors.New("event already processed")
+
+type inboxKey struct{}
+
+// WithInboxEvent returns a context under which Save and SaveVersion record eventID in the
+// inbox of the machine they save, in the same transaction as its snapshot. Pass it to
+// Machine.DispatchContext, which saves under the dispatch context with rfsm.WithAutoPersist
+// or rfsm.WithVersionedPersist.
+func WithInboxEvent(ctx context.Context, eventID string) context.Context {
+	return context.WithValue(ctx, inboxKey{}, eventID)
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithTable sets the table name, "rfsm_snapshots" by default.
+func WithTable(name string) Option {
+	return func(s *Store) { s.table = name }
+}
+
+// WithDollarParams uses $1, $2, ... query parameters (PostgreSQL) instead of ?.
+func WithDollarParams() Option {
+	return func(s *Store) { s.dollar = true }
+}
+
+// WithRetention sets which versions SaveVersion keeps.
+func WithRetention(r rfsm.Retention) Option {
+	return func(s *Store) { s.retention = r }
+}
+
+// Store is an rfsm.Store backed by a SQL table with the columns id, version and snapshot.
+type Store struct {
+	db        *sql.DB
+	table     string
+	dollar    bool
+	retention rfsm.Retention
+
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+var _ rfsm.VersionedStore = (*Store)(nil)
+
+// New creates a Store on db.
+func New(db *sql.DB, opts ...Option) *Store {
+	s := &Store{db: db, table: "rfsm_snapshots", versions: make(map[string]int64)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// query formats q with the table name and rewrites ? parameters for the configured style.
+func (s *Store) query(q string) string {
+	q = fmt.Sprintf(q, s.table)
+	if !s.dollar {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CreateTable creates the snapshot, version and inbox tables if they do not exist.
+func (s *Store) CreateTable(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, s.query(
+		"CREATE TABLE IF NOT EXISTS %s (id VARCHAR(255) PRIMARY KEY, version BIGINT NOT NULL, snapshot TEXT NOT NULL)")); err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, s.query(
+		"CREATE TABLE IF NOT EXISTS %s_versions (id VARCHAR(255) NOT NULL, version BIGINT NOT NULL, saved_at BIGINT NOT NULL, snapshot TEXT NOT NULL, PRIMARY KEY (id, version))")); err != nil {
+		return err
+	}
+	_, err := s.db.ExecContext(ctx, s.query(
+		"CREATE TABLE IF NOT EXISTS %s_inbox (id VARCHAR(255) NOT NULL, event_id VARCHAR(255) NOT NULL, processed_at BIGINT NOT NULL, PRIMARY KEY (id, event_id))"))
+	return err
+}
+
+// Load returns the snapshot stored under id and remembers its version for the next Save.
+func (s *Store) Load(ctx context.Context, id string) (*rfsm.Snapshot, error) {
+	var version int64
+	var data string
+	err := s.db.QueryRowContext(ctx, s.query("SELECT version, snapshot FROM %s WHERE id = ?"), id).Scan(&version, &data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap rfsm.Snapshot
+	if err := json.Unmarshal([]byte(data), &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q: %w", id, err)
+	}
+	s.remember(id, version)
+	return &snap, nil
+}
+
+// Save stores snap under id if the row is still at the version this Store last saw, inserting
+// it if this Store never saw id. It returns ErrConflict otherwise. Under a context from
+// WithInboxEvent, it also records the event in the inbox, in one transaction.
+func (s *Store) Save(ctx context.Context, id string, snap *rfsm.Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Value(inboxKey{}).(string); ok {
+		_, err := s.inTx(ctx, id, func(tx *sql.Tx) (int64, error) {
+			if err := s.receive(ctx, tx, id); err != nil {
+				return 0, err
+			}
+			return s.save(ctx, tx, id, string(data))
+		})
+		return err
+	}
+	version, err := s.save(ctx, s.db, id, string(data))
+	if err != nil {
+		return err
+	}
+	s.remember(id, version)
+	return nil
+}
+
+// querier is what the statements of a Store run on: a *sql.DB or a *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// save writes data under id on q and returns the row's new version, which the caller
+// remembers once q's writes are committed. The database rejects a stale version, so s.mu only
+// guards the versions map and is not held across round trips.
+func (s *Store) save(ctx context.Context, q querier, id string, data string) (int64, error) {
+	s.mu.Lock()
+	version, known := s.versions[id]
+	s.mu.Unlock()
+	if !known {
+		if _, err := q.ExecContext(ctx, s.query("INSERT INTO %s (id, version, snapshot) VALUES (?, 1, ?)"), id, data); err != nil {
+			var exists int
+			if s.db.QueryRowContext(ctx, s.query("SELECT 1 FROM %s WHERE id = ?"), id).Scan(&exists) == nil {
+				return 0, ErrConflict
+			}
+			return 0, err
+		}
+		return 1, nil
+	}
+	res, err := q.ExecContext(ctx, s.query("UPDATE %s SET version = version + 1, snapshot = ? WHERE id = ? AND version = ?"), data, id, version)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrConflict
+	}
+	return version + 1, nil
+}
+
+// remember records version as the one the next Save of id expects.
+func (s *Store) remember(id string, version int64) {
+	s.mu.Lock()
+	s.versions[id] = version
+	s.mu.Unlock()
+}
+
+// SaveVersion saves snap like Save, keeps it under the row's new version and drops the
+// versions outside the retention, all in one transaction with the inbox event of ctx, if any.
+// Version numbers skip the saves made with Save.
+func (s *Store) SaveVersion(ctx context.Context, id string, snap *rfsm.Snapshot) (int64, error) {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+	return s.inTx(ctx, id, func(tx *sql.Tx) (int64, error) {
+		if err := s.receive(ctx, tx, id); err != nil {
+			return 0, err
+		}
+		return s.saveVersion(ctx, tx, id, string(data))
+	})
+}
+
+// inTx runs save, which returns the new row version of id, in a transaction, and remembers
+// the version once it is committed.
+func (s *Store) inTx(ctx context.Context, id string, save func(tx *sql.Tx) (int64, error)) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	version, err := save(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.remember(id, version)
+	return version, nil
+}
+
+// receive records the inbox event of ctx, if any, as processed by id, or returns
+// ErrAlreadyProcessed. A concurrent delivery of the same event fails the insert on the primary
+// key, or the snapshot update on its version.
+func (s *Store) receive(ctx context.Context, tx *sql.Tx, id string) error {
+	eventID, ok := ctx.Value(inboxKey{}).(string)
+	if !ok {
+		return nil
+	}
+	var exists int
+	err := tx.QueryRowContext(ctx, s.query("SELECT 1 FROM %s_inbox WHERE id = ? AND event_id = ?"), id, eventID).Scan(&exists)
+	if err == nil {
+		return ErrAlreadyProcessed
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.query("INSERT INTO %s_inbox (id, event_id, processed_at) VALUES (?, ?, ?)"), id, eventID, time.Now().UnixNano())
+	return err
+}
+
+// Processed reports whether the inbox holds eventID for id, so a redelivered event can be
+// acknowledged without dispatching it.
+func (s *Store) Processed(ctx context.Context, id, eventID string) (bool, error) {
+	var exists int
+	err := s.db.QueryRowContext(ctx, s.query("SELECT 1 FROM %s_inbox WHERE id = ? AND event_id = ?"), id, eventID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PruneInbox drops the inbox entries recorded before t, once the bus no longer redelivers
+// events that old.
+func (s *Store) PruneInbox(ctx context.Context, before time.Time) error {
+	_, err := s.db.ExecContext(ctx, s.query("DELETE FROM %s_inbox WHERE processed_at < ?"), before.UnixNano())
+	return err
+}
+
+func (s *Store) saveVersion(ctx context.Context, tx *sql.Tx, id string, data string) (int64, error) {
+	version, err := s.save(ctx, tx, id, data)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	if _, err := tx.ExecContext(ctx, s.query("INSERT INTO %s_versions (id, version, saved_at, snapshot) VALUES (?, ?, ?, ?)"),
+		id, version, now.UnixNano(), data); err != nil {
+		return 0, err
+	}
+	if s.retention == (rfsm.Retention{}) {
+		return version, nil
+	}
+	vs, err := s.listVersions(ctx, tx, id)
+	if err != nil {
+		return 0, err
+	}
+	if drop := s.retention.Expired(vs, now); drop > 0 {
+		if _, err := tx.ExecContext(ctx, s.query("DELETE FROM %s_versions WHERE id = ? AND version < ?"), id, vs[drop].Version); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+// ListVersions returns the versions kept for id, oldest first.
+func (s *Store) ListVersions(ctx context.Context, id string) ([]rfsm.StoredVersion, error) {
+	return s.listVersions(ctx, s.db, id)
+}
+
+func (s *Store) listVersions(ctx context.Context, q querier, id string) ([]rfsm.StoredVersion, error) {
+	rows, err := q.QueryContext(ctx, s.query("SELECT version, saved_at FROM %s_versions WHERE id = ? ORDER BY version"), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []rfsm.StoredVersion{}
+	for rows.Next() {
+		var version, savedAt int64
+		if err := rows.Scan(&version, &savedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, rfsm.StoredVersion{Version: version, SavedAt: time.Unix(0, savedAt)})
+	}
+	return out, rows.Err()
+}
+
+// LoadVersion returns a kept version of id, or rfsm.ErrSnapshotNotFound. It does not change
+// the version the next Save expects.
+func (s *Store) LoadVersion(ctx context.Context, id string, version int64) (*rfsm.Snapshot, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, s.query("SELECT snapshot FROM %s_versions WHERE id = ? AND version = ?"), id, version).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, rfsm.ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap rfsm.Snapshot
+	if err := json.Unmarshal([]byte(data), &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q version %d: %w", id, version, err)
+	}
+	return &snap, nil
+}
@@ -0,0 +1,462 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/noru/rfsm"
+)
+
+// fakeDB is a minimal database/sql driver understanding exactly the statements of Store.
+type fakeDB struct {
+	mu       sync.Mutex
+	rows     map[string]fakeRow
+	versions map[string][]fakeVersion
+	inbox    map[[2]string]int64 // processed at, by machine and event id
+	// gate, if set, is called with the id of every snapshot insert or update before it runs
+	gate func(id string)
+	// failVersions fails inserts into the versions table
+	failVersions bool
+}
+
+type fakeVersion struct {
+	version, savedAt int64
+	data             string
+}
+
+type fakeRow struct {
+	version int64
+	data    string
+}
+
+func (d *fakeDB) Open(string) (driver.Conn, error) { return fakeConn{d}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(q string) (driver.Stmt, error) { return fakeStmt{c.db, q}, nil }
+func (c fakeConn) Close() error                          { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	tx := &fakeTx{db: c.db, rows: maps.Clone(c.db.rows), versions: make(map[string][]fakeVersion, len(c.db.versions)), inbox: maps.Clone(c.db.inbox)}
+	for id, vs := range c.db.versions {
+		tx.versions[id] = slices.Clone(vs)
+	}
+	return tx, nil
+}
+
+// fakeTx is not isolated from other connections: Rollback restores the state at Begin.
+type fakeTx struct {
+	db       *fakeDB
+	rows     map[string]fakeRow
+	versions map[string][]fakeVersion
+	inbox    map[[2]string]int64
+}
+
+func (t *fakeTx) Commit() error { return nil }
+
+func (t *fakeTx) Rollback() error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	t.db.rows, t.db.versions, t.db.inbox = t.rows, t.versions, t.inbox
+	return nil
+}
+
+type fakeStmt struct {
+	db *fakeDB
+	q  string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	gate := s.db.gate
+	s.db.mu.Unlock()
+	if gate != nil && (strings.HasPrefix(s.q, "INSERT INTO rfsm_snapshots (") || strings.HasPrefix(s.q, "UPDATE")) {
+		gate(args[0].(string))
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.q, "CREATE TABLE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.q, "INSERT INTO rfsm_snapshots_versions"):
+		if s.db.failVersions {
+			return nil, errors.New("disk full")
+		}
+		id := args[0].(string)
+		s.db.versions[id] = append(s.db.versions[id], fakeVersion{args[1].(int64), args[2].(int64), args[3].(string)})
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.q, "DELETE FROM rfsm_snapshots_versions"):
+		id, before := args[0].(string), args[1].(int64)
+		kept := s.db.versions[id][:0]
+		for _, v := range s.db.versions[id] {
+			if v.version >= before {
+				kept = append(kept, v)
+			}
+		}
+		s.db.versions[id] = kept
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.q, "INSERT INTO rfsm_snapshots_inbox"):
+		k := [2]string{args[0].(string), args[1].(string)}
+		if _, ok := s.db.inbox[k]; ok {
+			return nil, fmt.Errorf("duplicate key %v", k)
+		}
+		s.db.inbox[k] = args[2].(int64)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.q, "DELETE FROM rfsm_snapshots_inbox"):
+		for k, at := range s.db.inbox {
+			if at < args[0].(int64) {
+				delete(s.db.inbox, k)
+			}
+		}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.q, "INSERT"):
+		id := args[0].(string)
+		if _, ok := s.db.rows[id]; ok {
+			return nil, fmt.Errorf("duplicate key %q", id)
+		}
+		s.db.rows[id] = fakeRow{version: 1, data: args[1].(string)}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.q, "UPDATE"):
+		id, version := args[1].(string), args[2].(int64)
+		row, ok := s.db.rows[id]
+		if !ok || row.version != version {
+			return driver.RowsAffected(0), nil
+		}
+		s.db.rows[id] = fakeRow{version: version + 1, data: args[0].(string)}
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("unexpected statement %q", s.q)
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.q, "SELECT version, saved_at FROM rfsm_snapshots_versions"):
+		rows := &fakeRows{cols: []string{"version", "saved_at"}}
+		for _, v := range s.db.versions[args[0].(string)] {
+			rows.values = append(rows.values, []driver.Value{v.version, v.savedAt})
+		}
+		return rows, nil
+	case strings.HasPrefix(s.q, "SELECT snapshot FROM rfsm_snapshots_versions"):
+		for _, v := range s.db.versions[args[0].(string)] {
+			if v.version == args[1].(int64) {
+				return &fakeRows{values: [][]driver.Value{{v.data}}, cols: []string{"snapshot"}}, nil
+			}
+		}
+		return &fakeRows{}, nil
+	case strings.HasPrefix(s.q, "SELECT 1 FROM rfsm_snapshots_inbox"):
+		if _, ok := s.db.inbox[[2]string{args[0].(string), args[1].(string)}]; ok {
+			return &fakeRows{values: [][]driver.Value{{int64(1)}}, cols: []string{"1"}}, nil
+		}
+		return &fakeRows{}, nil
+	}
+	row, ok := s.db.rows[args[0].(string)]
+	switch {
+	case !ok:
+		return &fakeRows{}, nil
+	case strings.HasPrefix(s.q, "SELECT version, snapshot"):
+		return &fakeRows{values: [][]driver.Value{{row.version, row.data}}, cols: []string{"version", "snapshot"}}, nil
+	case strings.HasPrefix(s.q, "SELECT 1"):
+		return &fakeRows{values: [][]driver.Value{{int64(1)}}, cols: []string{"1"}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", s.q)
+}
+
+type fakeRows struct {
+	cols   []string
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var (
+	registerOnce sync.Once
+	fake         = &fakeDB{rows: make(map[string]fakeRow), versions: make(map[string][]fakeVersion), inbox: make(map[[2]string]int64)}
+)
+
+func openFake(t *testing.T) *sql.DB {
+	registerOnce.Do(func() { sql.Register("rfsm-fake", fake) })
+	db, err := sql.Open("rfsm-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestStore_OptimisticLocking(t *testing.T) {
+	def, err := rfsm.NewDef("order").
+		State("NEW", rfsm.WithInitial()).
+		State("PAID").
+		State("REFUNDED", rfsm.WithFinal()).
+		State("SHIPPED", rfsm.WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID").
+		On("refund", "PAID", "REFUNDED").
+		On("ship", "PAID", "SHIPPED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openFake(t)
+	ctx := context.Background()
+	if err := New(db).CreateTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first worker creates the order
+	m := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(New(db), "order-1"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Dispatch(rfsm.Event{Name: "pay"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+
+	// two workers resume it and race
+	resume := func() (*rfsm.Machine[any], *Store) {
+		store := New(db)
+		snap, err := store.Load(ctx, "order-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := rfsm.NewMachine[any](def, nil, rfsm.WithAutoPersist(store, "order-1"))
+		if err := w.RestoreSnapshot(snap, 0); err != nil {
+			t.Fatal(err)
+		}
+		return w, store
+	}
+	w1, _ := resume()
+	defer w1.Stop()
+	w2, s2 := resume()
+	defer w2.Stop()
+	if err := w1.Dispatch(rfsm.Event{Name: "ship"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w2.Dispatch(rfsm.Event{Name: "refund"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+	snap, err := s2.Load(ctx, "order-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Current != "SHIPPED" {
+		t.Fatalf("want SHIPPED got %s", snap.Current)
+	}
+
+	// a fresh store cannot silently overwrite an existing id
+	if err := New(db).Save(ctx, "order-1", snap); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+	if _, err := New(db).Load(ctx, "missing"); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+}
+
+func TestStore_Versions(t *testing.T) {
+	def, err := rfsm.NewDef("order").
+		State("NEW", rfsm.WithInitial()).
+		State("PAID").
+		State("PACKED").
+		State("SHIPPED", rfsm.WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID").
+		On("pack", "PAID", "PACKED").
+		On("ship", "PACKED", "SHIPPED").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openFake(t)
+	ctx := context.Background()
+	store := New(db, WithRetention(rfsm.Retention{MaxVersions: 2}))
+	if err := store.CreateTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m := rfsm.NewMachine[any](def, nil, rfsm.WithVersionedPersist(store, "order-v"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []rfsm.EventID{"pay", "pack", "ship"} {
+		if err := m.Dispatch(rfsm.Event{Name: e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = m.Stop()
+
+	vs, err := store.ListVersions(ctx, "order-v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || vs[0].Version != 2 || vs[1].Version != 3 {
+		t.Fatalf("want versions 2 and 3 got %+v", vs)
+	}
+	snap, err := store.LoadVersion(ctx, "order-v", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Current != "PACKED" {
+		t.Fatalf("want PACKED got %s", snap.Current)
+	}
+	if _, err := store.LoadVersion(ctx, "order-v", 1); !errors.Is(err, rfsm.ErrSnapshotNotFound) {
+		t.Fatalf("want ErrSnapshotNotFound got %v", err)
+	}
+	if snap, err := New(db).Load(ctx, "order-v"); err != nil || snap.Current != "SHIPPED" {
+		t.Fatalf("latest snapshot %v %v", snap, err)
+	}
+}
+
+func TestStore_Inbox(t *testing.T) {
+	def, err := rfsm.NewDef("stock").
+		State("OPEN", rfsm.WithInitial()).
+		State("CLOSED", rfsm.WithFinal()).
+		Current("OPEN").
+		On("reserve", "OPEN", "OPEN", rfsm.WithInternal(), rfsm.WithAction(func(e rfsm.Event, n *int) error {
+			*n++
+			return nil
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openFake(t)
+	ctx := context.Background()
+	store := New(db)
+	var reserved int
+	m := rfsm.NewMachine(def, &reserved, rfsm.WithVersionedPersist(store, "stock-1"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if err := m.DispatchContext(WithInboxEvent(ctx, "msg-1"), rfsm.Event{Name: "reserve"}); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := store.Processed(ctx, "stock-1", "msg-1"); err != nil || !done {
+		t.Fatalf("msg-1 should be processed: %v %v", done, err)
+	}
+	// a redelivery is rejected and not saved
+	if err := m.DispatchContext(WithInboxEvent(ctx, "msg-1"), rfsm.Event{Name: "reserve"}); !errors.Is(err, ErrAlreadyProcessed) {
+		t.Fatalf("want ErrAlreadyProcessed got %v", err)
+	}
+	if vs, _ := store.ListVersions(ctx, "stock-1"); len(vs) != 1 {
+		t.Fatalf("the redelivery must not be saved, got versions %+v", vs)
+	}
+
+	// a failed snapshot write does not mark the event processed
+	store2 := New(db)
+	if err := store2.Save(WithInboxEvent(ctx, "msg-2"), "stock-1", &rfsm.Snapshot{Current: "OPEN"}); !errors.Is(err, ErrConflict) {
+		t.Fatalf("want ErrConflict got %v", err)
+	}
+	if done, _ := store.Processed(ctx, "stock-1", "msg-2"); done {
+		t.Fatal("msg-2 must not be processed after a conflict")
+	}
+	if err := store.Save(WithInboxEvent(ctx, "msg-2"), "stock-1", &rfsm.Snapshot{Current: "OPEN"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.PruneInbox(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if done, _ := store.Processed(ctx, "stock-1", "msg-1"); done {
+		t.Fatal("msg-1 should be pruned")
+	}
+}
+
+func TestStore_SaveVersionIsAtomic(t *testing.T) {
+	db := openFake(t)
+	ctx := context.Background()
+	store := New(db)
+	if _, err := store.SaveVersion(ctx, "order-tx", &rfsm.Snapshot{Current: "NEW"}); err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.failVersions = true
+	fake.mu.Unlock()
+	_, err := store.SaveVersion(ctx, "order-tx", &rfsm.Snapshot{Current: "PAID"})
+	fake.mu.Lock()
+	fake.failVersions = false
+	fake.mu.Unlock()
+	if err == nil {
+		t.Fatal("want the versions insert error")
+	}
+	if snap, err := New(db).Load(ctx, "order-tx"); err != nil || snap.Current != "NEW" {
+		t.Fatalf("a failed SaveVersion must not update the snapshot: %v %v", snap, err)
+	}
+	v, err := store.SaveVersion(ctx, "order-tx", &rfsm.Snapshot{Current: "PAID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 {
+		t.Fatalf("want version 2 got %d", v)
+	}
+}
+
+func TestStore_SavesDoNotWaitForEachOther(t *testing.T) {
+	db := openFake(t)
+	ctx := context.Background()
+	entered, release := make(chan struct{}), make(chan struct{})
+	fake.mu.Lock()
+	fake.gate = func(id string) {
+		if id == "slow" {
+			close(entered)
+			<-release
+		}
+	}
+	fake.mu.Unlock()
+	defer func() {
+		fake.mu.Lock()
+		fake.gate = nil
+		fake.mu.Unlock()
+	}()
+
+	store := New(db)
+	slow := make(chan error, 1)
+	go func() { slow <- store.Save(ctx, "slow", &rfsm.Snapshot{Current: "A"}) }()
+	<-entered
+	fast := make(chan error, 1)
+	go func() { fast <- store.Save(ctx, "fast", &rfsm.Snapshot{Current: "A"}) }()
+	select {
+	case err := <-fast:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a save waited for a slow save of another id")
+	}
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStore_DollarParams(t *testing.T) {
+	s := New(nil, WithTable("snaps"), WithDollarParams())
+	if q := s.query("UPDATE %s SET snapshot = ? WHERE id = ? AND version = ?"); q != "UPDATE snaps SET snapshot = $1 WHERE id = $2 AND version = $3" {
+		t.Fatalf("unexpected query %s", q)
+	}
+}
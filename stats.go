@@ -0,0 +1,106 @@
+package rfsm
+
+import (
+	"encoding/json"
+	"time"
+	"unsafe"
+)
+
+// MemoryStats is an approximate breakdown of the memory retained by a single machine.
+// Figures are estimates intended for capacity planning, not exact heap accounting;
+// data shared through the Definition, and strings shared with it such as state and event
+// names, are not included. Neither are the storage of a queue set with WithQueue, beyond the
+// events waiting in it, and the stores the machine persists to.
+type MemoryStats struct {
+	QueueCapacity int // capacity of the events channel, 0 with WithQueue
+	QueueLength   int // events currently waiting in the queue
+	QueueBytes    int // channel capacity, or queued events with WithQueue, * event header size
+	ActivePathLen int
+	VisitedCount  int
+	HistoryCount  int // composite states with a remembered child or leaf
+	CounterCount  int
+	StatusBytes   int // active path, visited set, history and counters
+	TimerCount    int // armed state timeouts, pending DispatchAfter events and recurring schedules
+	TimerBytes    int
+	LogRecords    int // records in the transition log, see WithTransitionLog
+	LogBytes      int // log capacity * record size, plus error messages
+	DedupCount    int // event IDs remembered for WithDuplicateWindow
+	DedupBytes    int
+	ContextBytes  int // size of the JSON-encoded state context, 0 if it cannot be encoded
+	TotalBytes    int
+}
+
+const (
+	stringHeaderSize = int(unsafe.Sizeof(""))
+	sliceHeaderSize  = int(unsafe.Sizeof([]StateID(nil)))
+	eventSize        = int(unsafe.Sizeof(Event{}))
+	recordSize       = int(unsafe.Sizeof(TransitionRecord{}))
+	timerSize        = int(unsafe.Sizeof(time.Timer{}))
+	eventKeySize     = int(unsafe.Sizeof(eventKey{}))
+	timeSize         = int(unsafe.Sizeof(time.Time{}))
+	// rough per-entry cost of a Go map bucket slot: key header, value and overhead
+	mapEntryOverhead = 8
+)
+
+// MemoryStats returns an approximate memory breakdown of the machine's runtime state.
+// The state context is measured through the same JSON codec used by Snapshot.
+func (m *Machine[C]) MemoryStats() MemoryStats {
+	m.statusMu.RLock()
+	q := m.run()
+	st := MemoryStats{
+		QueueLength:   q.len(),
+		ActivePathLen: len(m.activePath),
+		VisitedCount:  len(m.visited),
+		HistoryCount:  len(m.history),
+		CounterCount:  len(m.counters),
+	}
+	if q.custom == nil {
+		st.QueueCapacity = cap(q.events)
+		st.QueueBytes = st.QueueCapacity * eventSize
+	} else {
+		st.QueueBytes = st.QueueLength * eventSize
+	}
+	for range m.timers {
+		st.TimerBytes += int(unsafe.Sizeof(stateTimer{})) + timerSize + stringHeaderSize + mapEntryOverhead
+	}
+	for _, d := range m.delayed {
+		st.TimerBytes += int(unsafe.Sizeof(delayedEvent{})) + timerSize + 8 + mapEntryOverhead + len(d.event.ID)
+	}
+	for range m.recurring {
+		st.TimerBytes += int(unsafe.Sizeof(recurringSchedule{})) + stringHeaderSize + mapEntryOverhead
+	}
+	st.TimerCount = len(m.timers) + len(m.delayed) + len(m.recurring)
+	m.statusMu.RUnlock()
+	ctx := m.GetStateContext()
+
+	st.StatusBytes = sliceHeaderSize + st.ActivePathLen*stringHeaderSize +
+		st.VisitedCount*(stringHeaderSize+1+mapEntryOverhead) +
+		st.HistoryCount*(2*stringHeaderSize+mapEntryOverhead) +
+		st.CounterCount*(stringHeaderSize+8+mapEntryOverhead)
+	if l := m.log; l != nil {
+		l.mu.Lock()
+		st.LogRecords = len(l.records)
+		st.LogBytes = cap(l.records) * recordSize
+		for _, r := range l.records {
+			st.LogBytes += len(r.Error)
+		}
+		l.mu.Unlock()
+	}
+	if d := m.seen; d != nil {
+		d.mu.Lock()
+		st.DedupCount = len(d.at)
+		st.DedupBytes = cap(d.order)*eventKeySize + st.DedupCount*(eventKeySize+timeSize+mapEntryOverhead)
+		for k := range d.at {
+			st.DedupBytes += len(k.id)
+		}
+		d.mu.Unlock()
+	}
+	if any(ctx) != nil {
+		if data, err := json.Marshal(ctx); err == nil {
+			st.ContextBytes = len(data)
+		}
+	}
+	st.TotalBytes = int(unsafe.Sizeof(*m)) + st.QueueBytes + st.StatusBytes + st.TimerBytes +
+		st.LogBytes + st.DedupBytes + st.ContextBytes
+	return st
+}
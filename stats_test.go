@@ -0,0 +1,95 @@
+package rfsm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMachine_MemoryStats(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("mem").
+		State("A", WithSubDef(sub), WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A1", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type ctxT struct {
+		Note string `json:"note"`
+	}
+	m := NewMachine(def, ctxT{Note: "hello"})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	st := m.MemoryStats()
+	if st.QueueCapacity != 8 {
+		t.Fatalf("queue capacity want 8 got %d", st.QueueCapacity)
+	}
+	if st.ActivePathLen != 2 || st.VisitedCount != 2 {
+		t.Fatalf("want path 2 visited 2, got %d %d", st.ActivePathLen, st.VisitedCount)
+	}
+	if st.ContextBytes != len(`{"note":"hello"}`) {
+		t.Fatalf("unexpected context bytes %d", st.ContextBytes)
+	}
+	if st.TotalBytes < st.QueueBytes+st.StatusBytes+st.ContextBytes {
+		t.Fatalf("total %d smaller than its parts", st.TotalBytes)
+	}
+}
+
+func TestMachine_MemoryStatsOptionalState(t *testing.T) {
+	def, err := NewDef("mem").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		On("back", "B", "A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil,
+		WithTransitionLog(16),
+		WithDuplicateWindow(time.Minute),
+		WithQueue(func() Queue { return NewPriorityQueue(nil) }))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	base := m.MemoryStats()
+	if base.QueueCapacity != 0 || base.LogRecords != 0 || base.DedupCount != 0 || base.TimerCount != 0 {
+		t.Fatalf("unexpected fresh stats %+v", base)
+	}
+
+	if err := m.Dispatch(Event{Name: "go", ID: "req-1"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Dispatch(Event{Name: "go", ID: "req-2"}) // fails: logged with its error, not remembered
+	if _, err := m.DispatchAfter(time.Hour, Event{Name: "back"}); err != nil {
+		t.Fatal(err)
+	}
+	st := m.MemoryStats()
+	if st.LogRecords != 2 || st.LogBytes < 2*recordSize+len("no transition matched") {
+		t.Fatalf("want 2 log records, got %d (%d bytes)", st.LogRecords, st.LogBytes)
+	}
+	if st.DedupCount != 1 || st.DedupBytes == 0 {
+		t.Fatalf("want 1 remembered event ID, got %d (%d bytes)", st.DedupCount, st.DedupBytes)
+	}
+	if st.TimerCount != 1 || st.TimerBytes == 0 {
+		t.Fatalf("want 1 delayed event, got %d (%d bytes)", st.TimerCount, st.TimerBytes)
+	}
+	if st.TotalBytes < base.TotalBytes+st.LogBytes+st.DedupBytes+st.TimerBytes {
+		t.Fatalf("total %d does not include the log, dedup window and timers", st.TotalBytes)
+	}
+}
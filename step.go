@@ -0,0 +1,88 @@
+package rfsm
+
+import "errors"
+
+var (
+	// ErrNotPaused is returned by Step when the machine is running freely.
+	ErrNotPaused = errors.New("machine is not paused")
+	// ErrNoEventQueued is returned by Step when there is no event to handle.
+	ErrNoEventQueued = errors.New("no event queued")
+)
+
+// WithStepMode starts the machine paused (see Pause), so queued events are only handled one
+// at a time through Step, e.g. to build a debugger or an approval workflow. Resume lets the
+// machine run freely until it is started again.
+func WithStepMode() MachineOption { return func(c *machineConfig) { c.stepMode = true } }
+
+// StepResult describes the handling of one event by Step.
+type StepResult struct {
+	Event Event   // the event, without the machine's internal args
+	From  StateID // active leaf before the step
+	To    StateID // active leaf after the step
+	// Transitions are the outcomes reported to subscribers, including those of raised events
+	Transitions []TransitionRecord
+	Exited      []StateID // states whose exit hooks succeeded, in order
+	Entered     []StateID // states whose entry hooks succeeded, in order
+	Err         error     // the error returned to the event's dispatcher
+}
+
+// Step handles the next queued event of a paused machine and reports what it did. The
+// event's dispatcher gets its result as usual. Step returns ErrNoEventQueued if the queue is
+// empty, and must not be called from a guard, action or hook of the same machine.
+func (m *Machine[C]) Step() (StepResult, error) {
+	m.statusMu.RLock()
+	started, paused, resume, done := m.started, m.paused, m.resume, m.done
+	m.statusMu.RUnlock()
+	if !started {
+		return StepResult{}, ErrMachineNotStarted
+	}
+	if !paused {
+		return StepResult{}, ErrNotPaused
+	}
+	reply := make(chan stepReply, 1)
+	// the loop only takes this while paused
+	select {
+	case m.stepCh <- reply:
+	case <-resume:
+		return StepResult{}, ErrNotPaused
+	case <-done:
+		return StepResult{}, ErrMachineStopped
+	}
+	r := <-reply
+	return r.result, r.err
+}
+
+type stepReply struct {
+	result StepResult
+	err    error
+}
+
+// step handles one queued event for Step, on the loop.
+func (m *Machine[C]) step() stepReply {
+	e, ok := m.run().next()
+	if !ok {
+		return stepReply{err: ErrNoEventQueued}
+	}
+	rec := &stepRecorder{}
+	m.Subscribe(rec)
+	defer m.unsubscribe(rec)
+	r := StepResult{From: m.leaf()}
+	r.Event, r.Err = m.process(e)
+	r.To = m.leaf()
+	r.Transitions, r.Exited, r.Entered = rec.transitions, rec.exited, rec.entered
+	return stepReply{result: r}
+}
+
+// stepRecorder collects what happens during a step.
+type stepRecorder struct {
+	transitions []TransitionRecord
+	exited      []StateID
+	entered     []StateID
+}
+
+func (r *stepRecorder) OnTransition(from, to StateID, e Event, err error) {
+	r.transitions = append(r.transitions, newTransitionRecord(from, to, e, err))
+}
+
+func (r *stepRecorder) OnStateExited(s StateID, _ Event)  { r.exited = append(r.exited, s) }
+func (r *stepRecorder) OnStateEntered(s StateID, _ Event) { r.entered = append(r.entered, s) }
@@ -0,0 +1,72 @@
+package rfsm
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStep(t *testing.T) {
+	def, err := NewDef("approval").
+		State("DRAFT", WithInitial()).
+		State("REVIEW").
+		State("DONE", WithFinal()).
+		Current("DRAFT").
+		On("submit", "DRAFT", "REVIEW").
+		On("approve", "REVIEW", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil, WithStepMode())
+	if _, err := m.Step(); !errors.Is(err, ErrMachineNotStarted) {
+		t.Fatalf("want ErrMachineNotStarted got %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if !m.Paused() {
+		t.Fatal("step mode should start paused")
+	}
+	if _, err := m.Step(); !errors.Is(err, ErrNoEventQueued) {
+		t.Fatalf("want ErrNoEventQueued got %v", err)
+	}
+
+	submitted := make(chan error, 1)
+	_ = m.DispatchAsyncCb(Event{Name: "submit"}, func(err error) { submitted <- err })
+	_ = m.DispatchAsync(Event{Name: "approve", Args: []any{"alice"}})
+	if m.Current() != "DRAFT" {
+		t.Fatalf("events handled before Step, now at %s", m.Current())
+	}
+
+	r, err := m.Step()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Event.Name != "submit" || r.From != "DRAFT" || r.To != "REVIEW" || r.Err != nil || <-submitted != nil {
+		t.Fatalf("unexpected step %+v", r)
+	}
+	if len(r.Exited) != 1 || r.Exited[0] != "DRAFT" || len(r.Entered) != 1 || r.Entered[0] != "REVIEW" {
+		t.Fatalf("unexpected hooks exited %v entered %v", r.Exited, r.Entered)
+	}
+	if len(r.Transitions) != 1 || r.Transitions[0].To != "REVIEW" {
+		t.Fatalf("unexpected transitions %+v", r.Transitions)
+	}
+
+	// a failed event is reported, not returned as Step's error
+	_ = m.DispatchAsync(Event{Name: "submit"})
+	if r, err = m.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Event.Args) != 1 || r.Event.Args[0] != "alice" || r.To != "DONE" {
+		t.Fatalf("unexpected step %+v", r)
+	}
+	if r, err = m.Step(); err != nil || !errors.Is(r.Err, ErrNoTransition) || r.To != "DONE" {
+		t.Fatalf("want ErrNoTransition got %+v (%v)", r, err)
+	}
+
+	m.Resume()
+	if _, err := m.Step(); !errors.Is(err, ErrNotPaused) {
+		t.Fatalf("want ErrNotPaused got %v", err)
+	}
+}
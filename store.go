@@ -0,0 +1,399 @@
+package rfsm
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSnapshotNotFound is returned by Store.Load when no snapshot is stored under an id.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Store persists machine snapshots by machine id, see WithAutoPersist.
+type Store interface {
+	// Save stores snap under id, replacing any previous snapshot.
+	Save(ctx context.Context, id string, snap *Snapshot) error
+	// Load returns the snapshot stored under id, or ErrSnapshotNotFound.
+	Load(ctx context.Context, id string) (*Snapshot, error)
+}
+
+// VersionedStore is a Store that also keeps past snapshots, so a machine can be restored to an
+// earlier point, e.g. to investigate an incident. See WithVersionedPersist.
+type VersionedStore interface {
+	Store
+	// SaveVersion stores snap under id like Save and keeps it as a new version, returning its
+	// number. Versions of an id are numbered from 1 up and numbers are not reused.
+	SaveVersion(ctx context.Context, id string, snap *Snapshot) (int64, error)
+	// ListVersions returns the versions kept for id, oldest first.
+	ListVersions(ctx context.Context, id string) ([]StoredVersion, error)
+	// LoadVersion returns a kept version of id, or ErrSnapshotNotFound.
+	LoadVersion(ctx context.Context, id string, version int64) (*Snapshot, error)
+}
+
+// StoredVersion describes a snapshot kept by a VersionedStore.
+type StoredVersion struct {
+	Version int64     `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// Retention limits the versions a VersionedStore keeps per id, dropped by SaveVersion, and the
+// folded records a CompactableEventStore keeps. The zero value keeps all of them, and the
+// latest one is always kept.
+type Retention struct {
+	// MaxVersions keeps at most this many versions, if > 0
+	MaxVersions int
+	// MaxAge drops versions saved longer ago than this, if > 0
+	MaxAge time.Duration
+}
+
+// Expired returns how many of versions, sorted oldest first, r drops at now. Stores call it
+// after saving a version.
+func (r Retention) Expired(versions []StoredVersion, now time.Time) int {
+	n := len(versions)
+	k := 0
+	if r.MaxVersions > 0 && n > r.MaxVersions {
+		k = n - r.MaxVersions
+	}
+	if r.MaxAge > 0 {
+		for k < n && now.Sub(versions[k].SavedAt) > r.MaxAge {
+			k++
+		}
+	}
+	return max(min(k, n-1), 0)
+}
+
+// StoreOption configures a MemoryStore or FileStore.
+type StoreOption func(*storeConfig)
+
+type storeConfig struct {
+	retention Retention
+}
+
+// WithRetention sets which versions SaveVersion keeps.
+func WithRetention(r Retention) StoreOption {
+	return func(c *storeConfig) { c.retention = r }
+}
+
+func newStoreConfig(opts []StoreOption) storeConfig {
+	var c storeConfig
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithAutoPersist saves a snapshot of the machine to store under id after every dispatched
+// event whose transitions succeeded, once the events it raised were handled too, and before
+// Dispatch returns. If saving fails, the transition stands and Dispatch returns the error.
+// To resume, Load the snapshot and pass it to RestoreSnapshot.
+func WithAutoPersist(store Store, id string) MachineOption {
+	return func(c *machineConfig) {
+		c.store = store
+		c.storeID = id
+	}
+}
+
+// WithVersionedPersist is WithAutoPersist keeping every saved snapshot as a version of id,
+// subject to the store's retention. Restore an earlier point with LoadVersion and
+// RestoreSnapshot.
+func WithVersionedPersist(store VersionedStore, id string) MachineOption {
+	return func(c *machineConfig) {
+		c.store = store
+		c.storeID = id
+		c.versioned = true
+	}
+}
+
+// persist saves a snapshot to the auto-persist store, if any.
+func (m *Machine[C]) persist(cx context.Context) error {
+	if m.store == nil || m.replay.Load() != replayOff {
+		return nil
+	}
+	if m.versioned {
+		_, err := m.store.(VersionedStore).SaveVersion(cx, m.storeID, m.Snapshot())
+		return err
+	}
+	return m.store.Save(cx, m.storeID, m.Snapshot())
+}
+
+// MemoryStore is an in-memory Store, useful for tests and as a reference implementation.
+// Snapshots are stored as JSON, so callers cannot modify them after Save.
+type MemoryStore struct {
+	mu        sync.Mutex
+	snaps     map[string][]byte
+	versions  map[string][]StoredVersion
+	versioned map[string][][]byte // snapshots of versions, by index in versions
+	retention Retention
+}
+
+var _ VersionedStore = (*MemoryStore)(nil)
+
+func NewMemoryStore(opts ...StoreOption) *MemoryStore {
+	c := newStoreConfig(opts)
+	return &MemoryStore{
+		snaps:     make(map[string][]byte),
+		versions:  make(map[string][]StoredVersion),
+		versioned: make(map[string][][]byte),
+		retention: c.retention,
+	}
+}
+
+func (s *MemoryStore) Save(_ context.Context, id string, snap *Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snaps[id] = data
+	return nil
+}
+
+func (s *MemoryStore) Load(_ context.Context, id string) (*Snapshot, error) {
+	s.mu.Lock()
+	data, ok := s.snaps[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+func (s *MemoryStore) SaveVersion(_ context.Context, id string, snap *Snapshot) (int64, error) {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snaps[id] = data
+	vs := s.versions[id]
+	v := StoredVersion{Version: 1, SavedAt: time.Now()}
+	if len(vs) > 0 {
+		v.Version = vs[len(vs)-1].Version + 1
+	}
+	vs = append(vs, v)
+	drop := s.retention.Expired(vs, v.SavedAt)
+	s.versions[id] = slices.Delete(vs, 0, drop)
+	s.versioned[id] = slices.Delete(append(s.versioned[id], data), 0, drop)
+	return v.Version, nil
+}
+
+func (s *MemoryStore) ListVersions(_ context.Context, id string) ([]StoredVersion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]StoredVersion{}, s.versions[id]...), nil
+}
+
+func (s *MemoryStore) LoadVersion(_ context.Context, id string, version int64) (*Snapshot, error) {
+	s.mu.Lock()
+	i, ok := slices.BinarySearchFunc(s.versions[id], version, compareVersion)
+	var data []byte
+	if ok {
+		data = s.versioned[id][i]
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// FileStore is a Store keeping each snapshot as a JSON file <id>.json in a directory.
+// Files are replaced atomically, so a crash during Save leaves the previous snapshot intact.
+// Versions are kept as <version>-<saved at, in Unix nanoseconds>.json in <id>.versions.
+type FileStore struct {
+	dir       string
+	retention Retention
+	mu        sync.Mutex // serializes SaveVersion
+}
+
+var _ VersionedStore = (*FileStore)(nil)
+
+// NewFileStore creates a FileStore in dir, which is created if missing.
+func NewFileStore(dir string, opts ...StoreOption) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := newStoreConfig(opts)
+	return &FileStore{dir: dir, retention: c.retention}, nil
+}
+
+func (s *FileStore) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("invalid snapshot id %q", id)
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+func (s *FileStore) Save(_ context.Context, id string, snap *Snapshot) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FileStore) Load(_ context.Context, id string) (*Snapshot, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q: %w", id, err)
+	}
+	return &snap, nil
+}
+
+func (s *FileStore) SaveVersion(ctx context.Context, id string, snap *Snapshot) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vs, err := s.ListVersions(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, id+".json"), data); err != nil {
+		return 0, err
+	}
+	v := StoredVersion{Version: 1, SavedAt: time.Now()}
+	if len(vs) > 0 {
+		v.Version = vs[len(vs)-1].Version + 1
+	}
+	dir := filepath.Join(s.dir, id+".versions")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, versionFileName(v)), data); err != nil {
+		return 0, err
+	}
+	vs = append(vs, v)
+	drop := s.retention.Expired(vs, v.SavedAt)
+	for _, old := range vs[:drop] {
+		if err := os.Remove(filepath.Join(dir, versionFileName(old))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return v.Version, err
+		}
+	}
+	return v.Version, nil
+}
+
+func (s *FileStore) ListVersions(_ context.Context, id string) ([]StoredVersion, error) {
+	if _, err := s.path(id); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(s.dir, id+".versions"))
+	if errors.Is(err, os.ErrNotExist) {
+		return []StoredVersion{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := make([]StoredVersion, 0, len(entries))
+	for _, e := range entries {
+		if v, ok := parseVersionFileName(e.Name()); ok {
+			out = append(out, v)
+		}
+	}
+	slices.SortFunc(out, func(a, b StoredVersion) int { return cmp.Compare(a.Version, b.Version) })
+	return out, nil
+}
+
+func (s *FileStore) LoadVersion(ctx context.Context, id string, version int64) (*Snapshot, error) {
+	vs, err := s.ListVersions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := slices.BinarySearchFunc(vs, version, compareVersion)
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".versions", versionFileName(vs[i])))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %q version %d: %w", id, version, err)
+	}
+	return &snap, nil
+}
+
+func compareVersion(v StoredVersion, version int64) int {
+	return cmp.Compare(v.Version, version)
+}
+
+func versionFileName(v StoredVersion) string {
+	return strconv.FormatInt(v.Version, 10) + "-" + strconv.FormatInt(v.SavedAt.UnixNano(), 10) + ".json"
+}
+
+func parseVersionFileName(name string) (StoredVersion, bool) {
+	version, savedAt, ok := strings.Cut(strings.TrimSuffix(name, ".json"), "-")
+	if !ok || !strings.HasSuffix(name, ".json") {
+		return StoredVersion{}, false
+	}
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return StoredVersion{}, false
+	}
+	ns, err := strconv.ParseInt(savedAt, 10, 64)
+	if err != nil {
+		return StoredVersion{}, false
+	}
+	return StoredVersion{Version: v, SavedAt: time.Unix(0, ns)}, true
+}
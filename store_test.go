@@ -0,0 +1,166 @@
+package rfsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAutoPersist(t *testing.T) {
+	def, err := NewDef("order").
+		State("NEW", WithInitial()).
+		State("PAID").
+		State("DONE", WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID").
+		On("close", "PAID", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for name, store := range map[string]Store{"memory": NewMemoryStore(), "file": files} {
+		if _, err := store.Load(ctx, "order-1"); !errors.Is(err, ErrSnapshotNotFound) {
+			t.Fatalf("%s: want ErrSnapshotNotFound got %v", name, err)
+		}
+		m := NewMachine[any](def, nil, WithAutoPersist(store, "order-1"))
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Dispatch(Event{Name: "close"}); !errors.Is(err, ErrNoTransition) {
+			t.Fatalf("%s: want ErrNoTransition got %v", name, err)
+		}
+		if _, err := store.Load(ctx, "order-1"); !errors.Is(err, ErrSnapshotNotFound) {
+			t.Fatalf("%s: failed events should not be persisted: %v", name, err)
+		}
+		if err := m.Dispatch(Event{Name: "pay"}); err != nil {
+			t.Fatal(err)
+		}
+		_ = m.Stop()
+
+		snap, err := store.Load(ctx, "order-1")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		resumed := NewMachine[any](def, nil, WithAutoPersist(store, "order-1"))
+		if err := resumed.RestoreSnapshot(snap, 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := resumed.Dispatch(Event{Name: "close"}); err != nil {
+			t.Fatal(err)
+		}
+		_ = resumed.Stop()
+		if snap, _ := store.Load(ctx, "order-1"); snap.Current != "DONE" {
+			t.Fatalf("%s: want DONE got %s", name, snap.Current)
+		}
+	}
+	if err := files.Save(ctx, "../escape", &Snapshot{}); err == nil {
+		t.Fatal("want error for an id with a path separator")
+	}
+}
+
+func TestVersionedPersist(t *testing.T) {
+	def, err := NewDef("order").
+		State("NEW", WithInitial()).
+		State("PAID").
+		State("DONE", WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID").
+		On("close", "PAID", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for name, store := range map[string]VersionedStore{"memory": NewMemoryStore(), "file": files} {
+		m := NewMachine[any](def, nil, WithVersionedPersist(store, "order-1"))
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range []EventID{"pay", "close"} {
+			if err := m.Dispatch(Event{Name: e}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = m.Stop()
+
+		vs, err := store.ListVersions(ctx, "order-1")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(vs) != 2 || vs[0].Version != 1 || vs[1].Version != 2 || vs[1].SavedAt.Before(vs[0].SavedAt) {
+			t.Fatalf("%s: unexpected versions %+v", name, vs)
+		}
+		if snap, err := store.Load(ctx, "order-1"); err != nil || snap.Current != "DONE" {
+			t.Fatalf("%s: latest snapshot %v %v", name, snap, err)
+		}
+		snap, err := store.LoadVersion(ctx, "order-1", 1)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		restored := NewMachine[any](def, nil)
+		if err := restored.RestoreSnapshot(snap, 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if restored.Current() != "PAID" {
+			t.Fatalf("%s: want PAID got %s", name, restored.Current())
+		}
+		_ = restored.Stop()
+		if _, err := store.LoadVersion(ctx, "order-1", 3); !errors.Is(err, ErrSnapshotNotFound) {
+			t.Fatalf("%s: want ErrSnapshotNotFound got %v", name, err)
+		}
+		if vs, err := store.ListVersions(ctx, "other"); err != nil || len(vs) != 0 {
+			t.Fatalf("%s: want no versions got %v %v", name, vs, err)
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	files, err := NewFileStore(t.TempDir(), WithRetention(Retention{MaxVersions: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for name, store := range map[string]VersionedStore{"memory": NewMemoryStore(WithRetention(Retention{MaxVersions: 2})), "file": files} {
+		for i := range 4 {
+			v, err := store.SaveVersion(ctx, "m", &Snapshot{Current: StateID(fmt.Sprint(i))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != int64(i+1) {
+				t.Fatalf("%s: want version %d got %d", name, i+1, v)
+			}
+		}
+		vs, _ := store.ListVersions(ctx, "m")
+		if len(vs) != 2 || vs[0].Version != 3 || vs[1].Version != 4 {
+			t.Fatalf("%s: want versions 3 and 4 got %+v", name, vs)
+		}
+		if _, err := store.LoadVersion(ctx, "m", 2); !errors.Is(err, ErrSnapshotNotFound) {
+			t.Fatalf("%s: version 2 should be dropped: %v", name, err)
+		}
+		if snap, err := store.LoadVersion(ctx, "m", 3); err != nil || snap.Current != "2" {
+			t.Fatalf("%s: version 3 = %v %v", name, snap, err)
+		}
+	}
+
+	aged := NewMemoryStore(WithRetention(Retention{MaxAge: time.Nanosecond}))
+	for range 3 {
+		if _, err := aged.SaveVersion(ctx, "m", &Snapshot{}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if vs, _ := aged.ListVersions(ctx, "m"); len(vs) != 1 || vs[0].Version != 3 {
+		t.Fatalf("MaxAge should keep only the latest version, got %+v", vs)
+	}
+}
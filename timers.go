@@ -0,0 +1,290 @@
+package rfsm
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// stateTimer is the armed timeout of an active state (see WithTimeout).
+type stateTimer struct {
+	timer    *time.Timer
+	deadline time.Time
+	seq      uint64
+}
+
+// timeoutTick marks a queued timeout event so a timer that fired just before its state was
+// exited can be recognised and dropped.
+type timeoutTick struct {
+	state StateID
+	seq   uint64
+}
+
+// delayedEvent is an event pending in DispatchAfter.
+type delayedEvent struct {
+	timer *time.Timer
+	event Event
+	at    time.Time
+	seq   uint64
+}
+
+// ScheduledEvent is a DispatchAfter event recorded in a snapshot, queued at At.
+type ScheduledEvent struct {
+	Event Event     `json:"event"`
+	At    time.Time `json:"at"`
+}
+
+// recurringSchedule is the running set of recurring events of an active state (see WithRecurring).
+type recurringSchedule struct {
+	stop chan struct{}
+	seq  uint64
+}
+
+// recurringTick marks a queued recurring event so ticks queued before their state was
+// exited are dropped.
+type recurringTick struct {
+	state StateID
+	seq   uint64
+}
+
+// armTimers starts the timeouts and recurring events of the given states, using remaining[s]
+// instead of the declared timeout when present. Must be called with statusMu held.
+func (m *Machine[C]) armTimers(states []StateID, remaining map[StateID]time.Duration) {
+	if !m.def.hasTimers {
+		return
+	}
+	for _, sid := range states {
+		st := m.def.states[sid]
+		m.armRecurring(sid)
+		if st.Timeout <= 0 {
+			continue
+		}
+		d := st.Timeout
+		if r, ok := remaining[sid]; ok {
+			d = r
+		}
+		m.disarmTimer(sid)
+		m.timerSeq++
+		tick := timeoutTick{state: sid, seq: m.timerSeq}
+		ev := Event{Name: st.TimeoutEvent, Args: []any{tick}}
+		q := m.run()
+		if m.timers == nil {
+			m.timers = make(map[StateID]*stateTimer)
+		}
+		m.timers[sid] = &stateTimer{
+			deadline: time.Now().Add(d),
+			seq:      tick.seq,
+			timer: time.AfterFunc(d, func() {
+				_ = q.push(m.stamp(ev, Event{Name: ev.Name}), nil)
+			}),
+		}
+	}
+}
+
+// disarmTimer cancels the timeout and recurring events of sid, if armed. Must be called with statusMu held.
+func (m *Machine[C]) disarmTimer(sid StateID) {
+	if t, ok := m.timers[sid]; ok {
+		t.timer.Stop()
+		delete(m.timers, sid)
+	}
+	m.disarmRecurring(sid)
+}
+
+// disarmAllTimers cancels every armed timeout, recurring schedule and pending delayed event.
+// Must be called with statusMu held.
+func (m *Machine[C]) disarmAllTimers() {
+	for sid := range m.timers {
+		m.disarmTimer(sid)
+	}
+	for sid := range m.recurring {
+		m.disarmRecurring(sid)
+	}
+	for id, d := range m.delayed {
+		d.timer.Stop()
+		delete(m.delayed, id)
+	}
+}
+
+// DispatchAfter queues e on the machine's loop once d has elapsed, like a DispatchAsync issued
+// later. Pending events are discarded by Stop, so they never reach a stopped or restarted machine.
+// cancel prevents a pending event from being queued; it has no effect once the event was queued.
+// Pending events are recorded in snapshots and rescheduled by RestoreSnapshot at their
+// original time (at once, if that has passed); cancel funcs do not survive a restore. Args
+// that do not round-trip through the snapshot encoding arrive decoded (e.g. JSON numbers as
+// float64).
+func (m *Machine[C]) DispatchAfter(d time.Duration, e Event) (cancel func(), err error) {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	if !m.started {
+		return nil, ErrMachineNotStarted
+	}
+	e.Args = append([]any(nil), e.Args...)
+	id := m.scheduleDelayed(time.Now().Add(d), e)
+	return func() {
+		m.statusMu.Lock()
+		defer m.statusMu.Unlock()
+		if p, ok := m.delayed[id]; ok {
+			p.timer.Stop()
+			delete(m.delayed, id)
+		}
+	}, nil
+}
+
+// scheduleDelayed queues e at the given time and returns its id. Must be called with statusMu held.
+func (m *Machine[C]) scheduleDelayed(at time.Time, e Event) uint64 {
+	m.timerSeq++
+	id := m.timerSeq
+	q := m.run()
+	if m.delayed == nil {
+		m.delayed = make(map[uint64]*delayedEvent)
+	}
+	m.delayed[id] = &delayedEvent{
+		event: e,
+		at:    at,
+		seq:   id,
+		timer: time.AfterFunc(max(time.Until(at), 0), func() {
+			m.statusMu.Lock()
+			_, pending := m.delayed[id]
+			delete(m.delayed, id)
+			m.statusMu.Unlock()
+			if !pending {
+				return
+			}
+			_ = q.push(m.stamp(e, e), nil)
+		}),
+	}
+	return id
+}
+
+// pendingDelayed returns the pending DispatchAfter events in the order they were scheduled
+// to be queued. Must be called with statusMu held.
+func (m *Machine[C]) pendingDelayed() []ScheduledEvent {
+	if len(m.delayed) == 0 {
+		return nil
+	}
+	pending := make([]*delayedEvent, 0, len(m.delayed))
+	for _, d := range m.delayed {
+		pending = append(pending, d)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if !pending[i].at.Equal(pending[j].at) {
+			return pending[i].at.Before(pending[j].at)
+		}
+		return pending[i].seq < pending[j].seq
+	})
+	out := make([]ScheduledEvent, len(pending))
+	for i, d := range pending {
+		out[i] = ScheduledEvent{Event: d.event, At: d.at}
+	}
+	return out
+}
+
+// takeTimeout consumes the timer a queued timeout event belongs to. It reports false if the
+// state was exited (or re-entered) after the timer fired, in which case the event is dropped.
+func (m *Machine[C]) takeTimeout(tick timeoutTick) bool {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	t, ok := m.timers[tick.state]
+	if !ok || t.seq != tick.seq {
+		return false
+	}
+	delete(m.timers, tick.state)
+	return slices.Contains(m.activePath, tick.state)
+}
+
+// armRecurring starts the recurring events of sid unless they are paused. Must be called with statusMu held.
+func (m *Machine[C]) armRecurring(sid StateID) {
+	rs := m.def.states[sid].Recurring
+	if len(rs) == 0 || m.recurringPaused {
+		return
+	}
+	m.disarmRecurring(sid)
+	m.timerSeq++
+	sched := &recurringSchedule{stop: make(chan struct{}), seq: m.timerSeq}
+	if m.recurring == nil {
+		m.recurring = make(map[StateID]*recurringSchedule)
+	}
+	m.recurring[sid] = sched
+	q := m.run()
+	tick := recurringTick{state: sid, seq: sched.seq}
+	for _, r := range rs {
+		ev := Event{Name: r.Event, Args: []any{tick}}
+		t := time.NewTicker(r.Every)
+		go func() {
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+				case <-sched.stop:
+					return
+				case <-q.done:
+					return
+				}
+				// a tick rejected by a full custom queue is skipped
+				if err := q.push(m.stamp(ev, Event{Name: ev.Name}), sched.stop); err == ErrMachineStopped || err == errPushCanceled {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// disarmRecurring stops the recurring events of sid, if running. Must be called with statusMu held.
+func (m *Machine[C]) disarmRecurring(sid StateID) {
+	if sched, ok := m.recurring[sid]; ok {
+		close(sched.stop)
+		delete(m.recurring, sid)
+	}
+}
+
+// recurringActive reports whether a queued recurring event still belongs to a running schedule
+// of an active state.
+func (m *Machine[C]) recurringActive(tick recurringTick) bool {
+	m.statusMu.RLock()
+	defer m.statusMu.RUnlock()
+	sched, ok := m.recurring[tick.state]
+	return ok && sched.seq == tick.seq && slices.Contains(m.activePath, tick.state)
+}
+
+// PauseRecurring stops dispatching recurring state events (see WithRecurring) until
+// ResumeRecurring is called. Pausing persists across Stop and Start.
+func (m *Machine[C]) PauseRecurring() {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	m.recurringPaused = true
+	for sid := range m.recurring {
+		m.disarmRecurring(sid)
+	}
+}
+
+// ResumeRecurring restarts the recurring events of the active states. Intervals start over.
+func (m *Machine[C]) ResumeRecurring() {
+	m.statusMu.Lock()
+	defer m.statusMu.Unlock()
+	if !m.recurringPaused {
+		return
+	}
+	m.recurringPaused = false
+	if m.started {
+		for _, sid := range m.activePath {
+			m.armRecurring(sid)
+		}
+	}
+}
+
+// remainingTimeouts returns the time left on every armed timeout. Must be called with statusMu held.
+func (m *Machine[C]) remainingTimeouts() map[StateID]time.Duration {
+	if len(m.timers) == 0 {
+		return nil
+	}
+	now := time.Now()
+	out := make(map[StateID]time.Duration, len(m.timers))
+	for sid, t := range m.timers {
+		r := t.deadline.Sub(now)
+		if r < 0 {
+			r = 0
+		}
+		out[sid] = r
+	}
+	return out
+}
@@ -0,0 +1,334 @@
+package rfsm
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func timeoutDef(t *testing.T, d time.Duration) *Definition {
+	def, err := NewDef("timeout").
+		State("A", WithInitial(), WithTimeout(d, "overdue")).
+		State("B").
+		State("EXPIRED", WithFinal()).
+		State("LATE", WithFinal()).
+		Current("A").
+		On("overdue", "A", "EXPIRED").
+		On("overdue", "B", "LATE").
+		On("go", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return def
+}
+
+func waitForState[C any](t *testing.T, m *Machine[C], want StateID) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for m.Current() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %s got %s", want, m.Current())
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+}
+
+func TestTimeout_DispatchesEvent(t *testing.T) {
+	m := NewMachine[any](timeoutDef(t, 10*time.Millisecond), nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	waitForState(t, m, "EXPIRED")
+}
+
+func TestTimeout_CancelledOnExit(t *testing.T) {
+	m := NewMachine[any](timeoutDef(t, 20*time.Millisecond), nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if m.Current() != "B" {
+		t.Fatalf("A's timeout fired after it was exited, now at %s", m.Current())
+	}
+}
+
+func TestTimeout_CancelledOnParentExit(t *testing.T) {
+	var exited atomic.Bool
+	sub, err := NewDef("sub").
+		State("C", WithInitial(), WithTimeout(30*time.Millisecond, "overdue"),
+			WithExit[any](func(e Event, ctx any) error { exited.Store(true); return nil })).
+		State("D", WithFinal()).
+		Current("C").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("nested-timeout").
+		State("P", WithInitial(), WithSubDef(sub)).
+		State("B").
+		State("X", WithFinal()).
+		Current("P").
+		On("go", "P", "B").
+		On("overdue", "B", "X").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	if !exited.Load() {
+		t.Fatal("leaving P must exit its active child C")
+	}
+	time.Sleep(80 * time.Millisecond)
+	if m.Current() != "B" {
+		t.Fatalf("C's timeout fired after its parent was exited, now at %s", m.Current())
+	}
+}
+
+func TestTimeout_SurvivesSnapshot(t *testing.T) {
+	def := timeoutDef(t, time.Hour)
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	snap := m.Snapshot()
+	_ = m.Stop()
+	if r := snap.Timers["A"]; r <= 59*time.Minute || r > time.Hour {
+		t.Fatalf("unexpected remaining duration %v", r)
+	}
+
+	// pretend the time ran out while the machine was down
+	snap.Timers["A"] = 5 * time.Millisecond
+	m2 := NewMachine[any](def, nil)
+	if err := m2.RestoreSnapshot(snap, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	waitForState(t, m2, "EXPIRED")
+}
+
+func TestDispatchAfter(t *testing.T) {
+	m := NewMachine[any](timeoutDef(t, time.Hour), nil)
+	if _, err := m.DispatchAfter(time.Millisecond, Event{Name: "go"}); err != ErrMachineNotStarted {
+		t.Fatalf("want ErrMachineNotStarted, got %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel, err := m.DispatchAfter(5*time.Millisecond, Event{Name: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	if m.Current() != "A" {
+		t.Fatalf("cancelled event was dispatched, now at %s", m.Current())
+	}
+
+	if _, err := m.DispatchAfter(5*time.Millisecond, Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, m, "B")
+
+	// pending events do not survive Stop
+	if _, err := m.DispatchAfter(10*time.Millisecond, Event{Name: "overdue"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if _, err := m.DispatchAfter(0, Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, m, "B")
+	time.Sleep(20 * time.Millisecond)
+	if m.Current() != "B" {
+		t.Fatalf("event scheduled before Stop reached the restarted machine, now at %s", m.Current())
+	}
+}
+
+func TestTimeout_SnapshotElapsed(t *testing.T) {
+	def := timeoutDef(t, time.Hour)
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	snap := m.Snapshot()
+	_ = m.Stop()
+
+	// the service was down for longer than the time that was left
+	snap.TakenAt = snap.TakenAt.Add(-2 * time.Hour)
+	m2 := NewMachine[any](def, nil)
+	if err := m2.RestoreSnapshot(snap, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	waitForState(t, m2, "EXPIRED")
+}
+
+func TestDispatchAfter_SurvivesSnapshot(t *testing.T) {
+	def := timeoutDef(t, time.Hour)
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.DispatchAfter(24*time.Hour, Event{Name: "go", Args: []any{"expire"}}); err != nil {
+		t.Fatal(err)
+	}
+	cancel, _ := m.DispatchAfter(time.Hour, Event{Name: "overdue"})
+	cancel()
+	data, err := m.SnapshotJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobData, err := m.SnapshotGob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.Delayed) != 1 || snap.Delayed[0].Event.Name != "go" || snap.Delayed[0].Event.Args[0] != "expire" {
+		t.Fatalf("unexpected delayed events %+v", snap.Delayed)
+	}
+	if until := time.Until(snap.Delayed[0].At); until <= 23*time.Hour {
+		t.Fatalf("unexpected due time in %v", until)
+	}
+
+	// the 24h passed while the machine was down
+	snap.Delayed[0].At = time.Now().Add(-time.Minute)
+	m2 := NewMachine[any](def, nil)
+	if err := m2.RestoreSnapshot(&snap, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	waitForState(t, m2, "B")
+
+	m3 := NewMachine[any](def, nil)
+	if err := m3.RestoreSnapshotGob(gobData, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer m3.Stop()
+	if got := m3.Snapshot().Delayed; len(got) != 1 || got[0].Event.Args[0] != "expire" {
+		t.Fatalf("gob snapshot lost the pending event: %+v", got)
+	}
+}
+
+func TestRecurring(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("P1", WithInitial()).
+		State("P2", WithFinal()).
+		Current("P1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var polls atomic.Int32
+	count := WithAction(func(e Event, ctx any) error { polls.Add(1); return nil })
+	def, err := NewDef("recurring").
+		State("PENDING", WithSubDef(sub), WithInitial(), WithRecurring(5*time.Millisecond, "poll")).
+		State("DONE", WithFinal()).
+		Current("PENDING").
+		On("poll", "P1", "P2", count).
+		On("poll", "P2", "P1", count).
+		On("finish", "PENDING", "DONE").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDef("bad").State("A", WithInitial(), WithFinal(), WithRecurring(0, "poll")).Current("A").Build(); err == nil {
+		t.Fatal("want error for a non-positive interval")
+	}
+
+	waitForPolls := func(n int32) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for polls.Load() < n {
+			if time.Now().After(deadline) {
+				t.Fatalf("want %d polls, got %d", n, polls.Load())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	assertStill := func(msg string) {
+		t.Helper()
+		n := polls.Load()
+		time.Sleep(25 * time.Millisecond)
+		if polls.Load() != n {
+			t.Fatal(msg)
+		}
+	}
+
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	// transitions between children keep the composite's schedule running
+	waitForPolls(3)
+
+	m.PauseRecurring()
+	time.Sleep(10 * time.Millisecond) // let ticks already queued drain
+	assertStill("recurring events dispatched while paused")
+	m.ResumeRecurring()
+	waitForPolls(polls.Load() + 2)
+
+	if err := m.Dispatch(Event{Name: "finish"}); err != nil {
+		t.Fatal(err)
+	}
+	assertStill("recurring events dispatched after the state was exited")
+}
+
+func TestRecurring_CancelledOnParentExit(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("C", WithInitial(), WithRecurring(5*time.Millisecond, "poll")).
+		State("D", WithFinal()).
+		Current("C").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var late atomic.Int32
+	def, err := NewDef("nested-recurring").
+		State("P", WithInitial(), WithSubDef(sub)).
+		State("B", WithFinal()).
+		Current("P").
+		On("go", "P", "B").
+		On("poll", "B", "B", WithInternal(), WithAction(func(e Event, ctx any) error { late.Add(1); return nil })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	time.Sleep(15 * time.Millisecond)
+	if err := m.Dispatch(Event{Name: "go"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if n := late.Load(); n != 0 {
+		t.Fatalf("C's recurring event dispatched %d times after its parent was exited", n)
+	}
+}
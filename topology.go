@@ -12,18 +12,27 @@ type GraphTopology struct {
 }
 
 // ComputeTopology builds a topological ordering from transitions.
-// Nodes are all states in the definition (even isolated ones). Edges are transitions From->To.
+// Nodes are all states in the definition (even isolated ones). Edges are transitions From->To
+// and junction branches.
 // Returns ErrCycleDetected if a cycle exists.
 func (d *Definition) ComputeTopology() (*GraphTopology, error) {
 	// Build adjacency and indegree
-	adj := make(map[StateID][]StateID, len(d.States))
-	indeg := make(map[StateID]int, len(d.States))
-	for id := range d.States {
+	adj := make(map[StateID][]StateID, len(d.states))
+	indeg := make(map[StateID]int, len(d.states))
+	for id := range d.states {
 		indeg[id] = 0
 	}
-	for _, t := range d.Transitions {
-		adj[t.Key.From] = append(adj[t.Key.From], t.To)
-		indeg[t.To]++
+	for _, alts := range d.transitions {
+		for _, t := range alts {
+			adj[t.Key.From] = append(adj[t.Key.From], t.To)
+			indeg[t.To]++
+		}
+	}
+	for j, segs := range d.branches {
+		for _, t := range segs {
+			adj[j] = append(adj[j], t.To)
+			indeg[t.To]++
+		}
 	}
 	// Kahn
 	q := make([]StateID, 0, len(indeg))
@@ -0,0 +1,158 @@
+package rfsm
+
+import (
+	"sync"
+	"time"
+)
+
+// TransitionRecord is an entry of the transition log kept with WithTransitionLog.
+type TransitionRecord struct {
+	From  StateID   `json:"from"`
+	To    StateID   `json:"to"`
+	Event EventID   `json:"event"`
+	At    time.Time `json:"at"`
+	// Error is the error message of a failed transition, or of an event that matched none
+	Error string `json:"error,omitempty"`
+}
+
+// Moved reports whether the machine ended up in To: the transition succeeded, or it failed
+// and FailureMoveToErrorState moved the machine to the error state. Other failed records have
+// To equal to From.
+func (r TransitionRecord) Moved() bool {
+	return r.Error == "" || r.From != r.To
+}
+
+// WithTransitionLog makes the machine keep its last size transition outcomes, as reported to
+// subscribers, for Machine.History.
+func WithTransitionLog(size int) MachineOption {
+	return func(c *machineConfig) { c.logSize = size }
+}
+
+// WithTransitionLogInSnapshots includes the transition log in snapshots, and restores it
+// from them.
+func WithTransitionLogInSnapshots() MachineOption {
+	return func(c *machineConfig) { c.logInSnapshots = true }
+}
+
+// transitionLog is a bounded ring of transition records.
+type transitionLog struct {
+	mu      sync.Mutex
+	records []TransitionRecord
+	next    int // index of the oldest record once the ring is full
+	size    int
+}
+
+func (l *transitionLog) add(r TransitionRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) < l.size {
+		l.records = append(l.records, r)
+		return
+	}
+	l.records[l.next] = r
+	l.next = (l.next + 1) % l.size
+}
+
+// last returns up to limit of the most recent records, oldest first; all if limit <= 0.
+func (l *transitionLog) last(limit int) []TransitionRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.records)
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	out := make([]TransitionRecord, 0, limit)
+	for i := n - limit; i < n; i++ {
+		out = append(out, l.records[(l.next+i)%n])
+	}
+	return out
+}
+
+// replace installs records, keeping the most recent ones that fit.
+func (l *transitionLog) replace(records []TransitionRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(records) > l.size {
+		records = records[len(records)-l.size:]
+	}
+	l.records = append(make([]TransitionRecord, 0, l.size), records...)
+	l.next = 0
+}
+
+// History returns up to limit of the most recent transition records, oldest first, or all of
+// them if limit <= 0. It is empty unless the machine was created with WithTransitionLog.
+func (m *Machine[C]) History(limit int) []TransitionRecord {
+	if m.log == nil {
+		return nil
+	}
+	return m.log.last(limit)
+}
+
+// record appends a transition outcome to the log, if enabled.
+func (m *Machine[C]) record(from, to StateID, e Event, err error) {
+	if m.log == nil {
+		return
+	}
+	m.log.add(newTransitionRecord(from, to, e, err))
+}
+
+func newTransitionRecord(from, to StateID, e Event, err error) TransitionRecord {
+	r := TransitionRecord{From: from, To: to, Event: e.Name, At: time.Now()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// History answers point-in-time questions over the transition logs of any number of
+// machines, such as which state an order was in at 14:32. It reads the logs kept with
+// WithTransitionLog when asked, so it only reaches back as far as they do.
+type History struct {
+	mu   sync.RWMutex
+	logs map[string]historian
+}
+
+// historian is what History reads, e.g. a *Machine.
+type historian interface {
+	History(limit int) []TransitionRecord
+}
+
+// NewHistory creates an empty History.
+func NewHistory() *History {
+	return &History{logs: make(map[string]historian)}
+}
+
+// Attach makes the transition log of m available under machineID, replacing the machine
+// attached before, e.g. when it was restored into a new Machine.
+func (h *History) Attach(machineID string, m historian) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.logs[machineID] = m
+}
+
+// StateAt returns the state machineID was in at t: the target of the last record at or before
+// t that moved it, or else the source of the first such record after t. It returns false if
+// the machine is not attached or no record in its log moved it.
+func (h *History) StateAt(machineID string, t time.Time) (StateID, bool) {
+	h.mu.RLock()
+	log, ok := h.logs[machineID]
+	h.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	var state StateID
+	found := false
+	for _, r := range log.History(0) {
+		if !r.Moved() {
+			continue
+		}
+		if r.At.After(t) {
+			if !found {
+				return r.From, true
+			}
+			break
+		}
+		state, found = r.To, true
+	}
+	return state, found
+}
@@ -0,0 +1,153 @@
+package rfsm
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTransitionLog(t *testing.T) {
+	def, err := NewDef("log").
+		State("A", WithInitial()).
+		State("B").
+		State("C", WithFinal()).
+		Current("A").
+		On("go", "A", "B").
+		On("back", "B", "A").
+		On("end", "B", "C").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h := NewMachine[any](def, nil).History(0); h != nil {
+		t.Fatalf("history without WithTransitionLog: %v", h)
+	}
+
+	m := NewMachine[any](def, nil, WithTransitionLog(3), WithTransitionLogInSnapshots())
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range []EventID{"go", "back", "go", "nope"} {
+		_ = m.Dispatch(Event{Name: ev})
+	}
+	h := m.History(0)
+	if len(h) != 3 || h[0].Event != "back" || h[1].Event != "go" || h[2].Event != "nope" {
+		t.Fatalf("unexpected history %v", h)
+	}
+	if h[1].From != "A" || h[1].To != "B" || h[1].Error != "" || h[2].Error != ErrNoTransition.Error() {
+		t.Fatalf("unexpected records %v", h)
+	}
+	if h[0].At.After(h[2].At) {
+		t.Fatal("records not in order")
+	}
+	if last := m.History(1); len(last) != 1 || last[0].Event != "nope" {
+		t.Fatalf("unexpected limited history %v", last)
+	}
+
+	data, err := m.SnapshotGob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Stop()
+	m2 := NewMachine[any](def, nil, WithTransitionLog(2), WithTransitionLogInSnapshots())
+	if err := m2.RestoreSnapshotGob(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer m2.Stop()
+	if err := m2.Dispatch(Event{Name: "end"}); err != nil {
+		t.Fatal(err)
+	}
+	if h := m2.History(0); len(h) != 2 || h[0].Event != "nope" || h[1].Event != "end" {
+		t.Fatalf("unexpected restored history %v", h)
+	}
+}
+
+type fixedLog []TransitionRecord
+
+func (l fixedLog) History(int) []TransitionRecord { return l }
+
+func TestHistory_StateAt(t *testing.T) {
+	base := time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)
+	at := func(min int) time.Time { return base.Add(time.Duration(min) * time.Minute) }
+	h := NewHistory()
+	h.Attach("order-1", fixedLog{
+		{From: "NEW", To: "PAID", Event: "pay", At: at(10)},
+		{From: "PAID", To: "PAID", Event: "ship", At: at(20), Error: "guard rejected"},
+		{From: "PAID", To: "SHIPPED", Event: "ship", At: at(30)},
+	})
+	for _, c := range []struct {
+		min  int
+		want StateID
+	}{{5, "NEW"}, {10, "PAID"}, {25, "PAID"}, {32, "SHIPPED"}} {
+		if got, ok := h.StateAt("order-1", at(c.min)); !ok || got != c.want {
+			t.Fatalf("at 14:%02d want %s got %q %v", c.min, c.want, got, ok)
+		}
+	}
+	if _, ok := h.StateAt("order-2", at(0)); ok {
+		t.Fatal("unattached machine should be unknown")
+	}
+	h.Attach("order-3", fixedLog{{From: "NEW", To: "NEW", Event: "pay", At: at(1), Error: "no transition"}})
+	if _, ok := h.StateAt("order-3", at(5)); ok {
+		t.Fatal("a log without state changes should be unknown")
+	}
+}
+
+func TestHistory_AttachMachine(t *testing.T) {
+	def, err := NewDef("order").
+		State("NEW", WithInitial()).
+		State("PAID", WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil, WithTransitionLog(10))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	h := NewHistory()
+	h.Attach("order-1", m)
+	before := time.Now()
+	time.Sleep(time.Millisecond)
+	if err := m.Dispatch(Event{Name: "pay"}); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := h.StateAt("order-1", before); s != "NEW" {
+		t.Fatalf("want NEW got %q", s)
+	}
+	if s, _ := h.StateAt("order-1", time.Now()); s != "PAID" {
+		t.Fatalf("want PAID got %q", s)
+	}
+}
+
+func TestHistory_StateAtErrorState(t *testing.T) {
+	def, err := NewDef("order").
+		State("NEW", WithInitial()).
+		State("PAID").
+		State("FAILED", WithFinal()).
+		Current("NEW").
+		On("pay", "NEW", "PAID", WithAction[any](func(Event, any) error { return errors.New("card declined") })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine[any](def, nil, WithTransitionLog(10), WithFailurePolicy(FailureMoveToErrorState), WithErrorState("FAILED"))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	h := NewHistory()
+	h.Attach("order-1", m)
+	if err := m.Dispatch(Event{Name: "pay"}); err == nil {
+		t.Fatal("want the action error")
+	}
+	if m.Current() != "FAILED" {
+		t.Fatalf("want FAILED got %s", m.Current())
+	}
+	if s, ok := h.StateAt("order-1", time.Now()); !ok || s != "FAILED" {
+		t.Fatalf("want FAILED got %q %v", s, ok)
+	}
+}
@@ -0,0 +1,125 @@
+package rfsm
+
+import (
+	"context"
+	"fmt"
+)
+
+// TypedBuilder declares a definition with user-defined state and event types, so misspelled
+// states and events are compile errors instead of ErrNoTransition at runtime:
+//
+//	type OrderState int // with a String method
+//	const (Pending OrderState = iota; Paid)
+//	def, err := rfsm.NewTypedDef[OrderState, OrderEvent]("order").
+//		State(Pending, rfsm.WithInitial()).State(Paid, rfsm.WithFinal()).
+//		Current(Pending).On(Pay, Pending, Paid).Build()
+//
+// States and events are stored under their fmt.Sprint names (String() if implemented, the
+// underlying value otherwise), so distinct values must have distinct names.
+type TypedBuilder[S, E comparable] struct {
+	b      DefinitionBuilder
+	states map[StateID]S
+}
+
+// NewTypedDef starts a definition over the state type S and event type E.
+func NewTypedDef[S, E comparable](name string) *TypedBuilder[S, E] {
+	return &TypedBuilder[S, E]{b: NewDef(name), states: make(map[StateID]S)}
+}
+
+func (t *TypedBuilder[S, E]) name(s S) StateID {
+	id := fmt.Sprint(s)
+	t.states[id] = s
+	return id
+}
+
+// State declares a state, see DefinitionBuilder.State.
+func (t *TypedBuilder[S, E]) State(id S, opts ...StateOption) *TypedBuilder[S, E] {
+	t.b.State(t.name(id), opts...)
+	return t
+}
+
+// Composite declares a composite state whose children are the states of sub.
+func (t *TypedBuilder[S, E]) Composite(id S, sub *TypedDefinition[S, E], opts ...StateOption) *TypedBuilder[S, E] {
+	for name, s := range sub.states {
+		t.states[name] = s
+	}
+	t.b.State(t.name(id), append([]StateOption{WithSubDef(sub.Definition)}, opts...)...)
+	return t
+}
+
+// On declares a transition, see DefinitionBuilder.On.
+func (t *TypedBuilder[S, E]) On(event E, from, to S, opts ...TransitionOption) *TypedBuilder[S, E] {
+	t.b.On(fmt.Sprint(event), t.name(from), t.name(to), opts...)
+	return t
+}
+
+// Current sets the root state the machine starts in.
+func (t *TypedBuilder[S, E]) Current(id S) *TypedBuilder[S, E] {
+	t.b.Current(t.name(id))
+	return t
+}
+
+// InitialChild sets the initial child of a composite state.
+func (t *TypedBuilder[S, E]) InitialChild(parent, child S) *TypedBuilder[S, E] {
+	t.b.InitialChild(t.name(parent), t.name(child))
+	return t
+}
+
+// Branch adds a branch to a junction or choice state, see DefinitionBuilder.Branch.
+func (t *TypedBuilder[S, E]) Branch(junction, to S, opts ...TransitionOption) *TypedBuilder[S, E] {
+	t.b.Branch(t.name(junction), t.name(to), opts...)
+	return t
+}
+
+// Build validates and returns the definition.
+func (t *TypedBuilder[S, E]) Build() (*TypedDefinition[S, E], error) {
+	def, err := t.b.Build()
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[StateID]S, len(t.states))
+	for name, s := range t.states {
+		states[name] = s
+	}
+	return &TypedDefinition[S, E]{Definition: def, states: states}, nil
+}
+
+// TypedDefinition is a Definition built by a TypedBuilder. It can be used wherever a
+// *Definition is expected through its embedded field.
+type TypedDefinition[S, E comparable] struct {
+	*Definition
+	states map[StateID]S
+}
+
+// StateOf returns the typed state stored under id.
+func (d *TypedDefinition[S, E]) StateOf(id StateID) (S, bool) {
+	s, ok := d.states[id]
+	return s, ok
+}
+
+// TypedMachine is a Machine whose current state and events use the definition's types.
+type TypedMachine[C any, S, E comparable] struct {
+	*Machine[C]
+	def *TypedDefinition[S, E]
+}
+
+// NewTypedMachine creates a machine for a typed definition.
+func NewTypedMachine[C any, S, E comparable](def *TypedDefinition[S, E], ctx C, opts ...MachineOption) *TypedMachine[C, S, E] {
+	return &TypedMachine[C, S, E]{Machine: NewMachine(def.Definition, ctx, opts...), def: def}
+}
+
+// State returns the current state (see Machine.Current), or the zero S before Start.
+func (m *TypedMachine[C, S, E]) State() S {
+	s, _ := m.def.StateOf(m.Current())
+	return s
+}
+
+// Send dispatches event synchronously with args, see Machine.Dispatch.
+func (m *TypedMachine[C, S, E]) Send(event E, args ...any) error {
+	return m.Dispatch(Event{Name: fmt.Sprint(event), Args: args})
+}
+
+// SendContext is Send with a context, see Machine.DispatchContext.
+func (m *TypedMachine[C, S, E]) SendContext(cx context.Context, event E, args ...any) error {
+	return m.DispatchContext(cx, Event{Name: fmt.Sprint(event), Args: args})
+}
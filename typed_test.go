@@ -0,0 +1,71 @@
+package rfsm
+
+import "testing"
+
+type orderState int
+
+const (
+	pending orderState = iota
+	review
+	reviewing
+	approved
+	paid
+)
+
+func (s orderState) String() string {
+	return [...]string{"PENDING", "REVIEW", "REVIEWING", "APPROVED", "PAID"}[s]
+}
+
+type orderEvent string
+
+const (
+	pay     orderEvent = "pay"
+	check   orderEvent = "check"
+	approve orderEvent = "approve"
+)
+
+func TestTypedDefinition(t *testing.T) {
+	sub, err := NewTypedDef[orderState, orderEvent]("review").
+		State(reviewing, WithInitial()).
+		State(approved, WithFinal()).
+		Current(reviewing).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewTypedDef[orderState, orderEvent]("order").
+		State(pending, WithInitial()).
+		Composite(review, sub).
+		State(paid, WithFinal()).
+		Current(pending).
+		On(check, pending, review).
+		On(approve, reviewing, approved).
+		On(pay, review, paid).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := def.State("PENDING"); !ok {
+		t.Fatal("states are stored under their String names")
+	}
+
+	m := NewTypedMachine[any](def, nil)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if m.State() != pending {
+		t.Fatalf("want pending got %v", m.State())
+	}
+	for _, c := range []struct {
+		ev   orderEvent
+		want orderState
+	}{{check, reviewing}, {approve, approved}, {pay, paid}} {
+		if err := m.Send(c.ev); err != nil {
+			t.Fatalf("%s: %v", c.ev, err)
+		}
+		if m.State() != c.want {
+			t.Fatalf("after %s want %v got %v", c.ev, c.want, m.State())
+		}
+	}
+}
@@ -1,11 +1,27 @@
 package rfsm
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
 
 // Basic event type
 type Event struct {
 	Name string
 	Args []any
+	// ID, if set, identifies the event for WithDuplicateWindow, which rejects a second event
+	// with the same Name and ID received within its window.
+	ID string
+	// Scope, if set, restricts matching to transitions owned by states nested inside this
+	// composite, so local events cannot trigger transitions of the composite or its ancestors.
+	// An event scoped to an inactive composite matches nothing.
+	Scope StateID
+	// Budget, if > 0, bounds the time from queueing the event until its transition runs. An
+	// event still waiting, or still being matched, when the budget runs out is skipped and
+	// reported with ErrEventExpired.
+	Budget time.Duration
 }
 
 // Hooks, actions, and guards (generic for type-safe state context)
@@ -13,10 +29,59 @@ type GuardFunc[C any] func(e Event, ctx C) bool
 type ActionFunc[C any] func(e Event, ctx C) error
 type HookFunc[C any] func(e Event, ctx C) error
 
+// Context-aware variants receive the context of the dispatch (see Machine.DispatchContext),
+// context.Background() for events without one. Hooks bounded by WithHookTimeout receive a
+// context that is cancelled when the timeout expires.
+type GuardCtxFunc[C any] func(cx context.Context, e Event, ctx C) bool
+type ActionCtxFunc[C any] func(cx context.Context, e Event, ctx C) error
+type HookCtxFunc[C any] func(cx context.Context, e Event, ctx C) error
+
+// GuardContextFunc is a guard that also receives the evaluation context of the transition.
+type GuardContextFunc[C any] func(e Event, g GuardContext, ctx C) bool
+
+// GuardContext describes the transition a guard is evaluated for.
+type GuardContext struct {
+	Source     StateID   // state owning the transition (the leaf or an ancestor it bubbled to)
+	Target     StateID   // candidate target state
+	ActivePath []StateID // active path from root to leaf; must not be modified
+	MachineID  string    // ID set with WithMachineID, empty if none
+	machine    guardMachine
+	reason     *string
+}
+
+// guardMachine is the machine a GuardContext reads visited states and counters from; an
+// interface rather than method values, which would be allocated for every guard call.
+type guardMachine interface {
+	HasVisited(StateID) bool
+	Counter(string) int
+}
+
+// Reject records why the guard rejects the transition and returns false, so a guard can end
+// with return g.Reject("insufficient funds"). See WithGuardRejectedErrors.
+func (g GuardContext) Reject(reason string) bool {
+	if g.reason != nil {
+		*g.reason = reason
+	}
+	return false
+}
+
+// HasVisited reports whether the machine has activated s since Start.
+func (g GuardContext) HasVisited(s StateID) bool {
+	return g.machine != nil && g.machine.HasVisited(s)
+}
+
+// Counter returns the value of a machine counter (see WithCounterIncrement).
+func (g GuardContext) Counter(name string) int {
+	if g.machine == nil {
+		return 0
+	}
+	return g.machine.Counter(name)
+}
+
 // Internal storage uses any for compatibility across different state context types
-type guardFuncAny func(e Event, ctx any) bool
-type actionFuncAny func(e Event, ctx any) error
-type hookFuncAny func(e Event, ctx any) error
+type guardFuncAny func(cx context.Context, e Event, g GuardContext, ctx any) bool
+type actionFuncAny func(cx context.Context, e Event, ctx any) error
+type hookFuncAny func(cx context.Context, e Event, ctx any) error
 
 // State ID
 type StateID = string
@@ -32,12 +97,44 @@ type StateDef struct {
 	Parent       StateID   // empty means no parent (top-level)
 	Children     []StateID // non-empty => composite state
 	InitialChild StateID   // valid only if Children non-empty
+	// History makes a composite re-enter the child (or, for DeepHistory, the whole nested
+	// path) that was active when it was last exited
+	History HistoryKind
 	// Build-time: optional sub-definition to merge into this composite state
 	SubDef *Definition
 	// Initial indicates this is a entry state (no incoming transitions by convention)
 	Initial bool
 	// Final indicates this is a terminal state (no outgoing transitions by convention)
 	Final bool
+	// Junction marks a pseudo-state that is never entered: transitions into it continue
+	// along its first Branch whose guard passes, composed into one compound transition
+	Junction bool
+	// Choice marks a pseudo-state whose Branch guards are evaluated dynamically, after the
+	// action of the transition into it, continuing to the first enabled branch's target
+	Choice bool
+	// Metadata holds free-form annotations (e.g. MetaTooltip, MetaURL) used by exporters and tooling
+	Metadata map[string]string
+	// HookTimeout bounds the entry and exit hooks of this state (0 = unbounded)
+	HookTimeout time.Duration
+	// Timeout, if > 0, dispatches TimeoutEvent when the state has been active that long
+	Timeout      time.Duration
+	TimeoutEvent EventID
+	// Recurring events are dispatched periodically while the state is active
+	Recurring []RecurringEvent
+	// Tags group states for bulk wiring (see DefinitionBuilder.OnTagged) and tooling
+	Tags []string
+	// ResetCounters are zeroed whenever the state is exited (see WithCounterResetOnExit)
+	ResetCounters []string
+	// SuppressReentry skips the entry hook when the state is re-entered by a self-transition,
+	// or within ReentryWindow of the last run of its entry hook (see WithEntryDebounce)
+	SuppressReentry bool
+	ReentryWindow   time.Duration
+}
+
+// RecurringEvent dispatches Event every Every while its state is active (see WithRecurring).
+type RecurringEvent struct {
+	Every time.Duration
+	Event EventID
 }
 
 type TransitionKey struct {
@@ -51,20 +148,178 @@ type TransitionDef struct {
 	To     StateID
 	Guard  guardFuncAny
 	Action actionFuncAny
+	// Metadata holds free-form annotations used by exporters and tooling
+	Metadata map[string]string
+	// Propagate offers the event to still-active ancestors of the source after this transition
+	// completes, instead of consuming it at the level where it matched
+	Propagate bool
+	// OnFailure overrides the machine's FailurePolicy for this transition (FailureDefault = inherit)
+	OnFailure FailurePolicy
+	// Internal transitions stay in their source state: no state is exited or entered, and
+	// timers keep running (see WithInternal)
+	Internal bool
+	// GuardName and ActionName describe Guard and Action in diagrams (see WithGuardName)
+	GuardName  string
+	ActionName string
+	// counter updates applied, in order, when the transition commits
+	counters []counterOp
+	// conditions are built-in guards that must all pass besides Guard (see IfVisited)
+	conditions []guardFuncAny
+	// attempts and backoff retry a failing Action within the transition (see WithRetry)
+	attempts int
+	backoff  BackoffFunc
+}
+
+// hasGuard reports whether the transition is guarded by Guard or a built-in condition.
+func (t *TransitionDef) hasGuard() bool { return t.Guard != nil || len(t.conditions) > 0 }
+
+// BackoffFunc returns how long to wait before retry number retry (1 for the first retry).
+type BackoffFunc func(retry int) time.Duration
+
+// ConstantBackoff waits d before every retry.
+func ConstantBackoff(d time.Duration) BackoffFunc {
+	return func(int) time.Duration { return d }
+}
+
+// ExponentialBackoff waits base, 2*base, 4*base, ... capped at max (if > 0).
+func ExponentialBackoff(base, max time.Duration) BackoffFunc {
+	return func(retry int) time.Duration {
+		d := base
+		for i := 1; i < retry && (max <= 0 || d < max); i++ {
+			d *= 2
+		}
+		if max > 0 && d > max {
+			d = max
+		}
+		return d
+	}
 }
 
-// Definition is the built, read-only state machine definition
+// FailurePolicy decides what happens when an action or an entry/exit hook fails part way
+// through a transition.
+type FailurePolicy int
+
+const (
+	// FailureDefault uses the machine's policy: WithFailurePolicy if set, else
+	// FailureMoveToErrorState for definitions with OnError, else FailureRollback.
+	FailureDefault FailurePolicy = iota
+	// FailureRollback exits the states entered so far and re-enters the exited ones, running
+	// their hooks again, so the machine is back in the source state.
+	FailureRollback
+	// FailureStayAndIgnore leaves the machine in the source state without running any further
+	// hooks; hooks that already ran are not compensated.
+	FailureStayAndIgnore
+	// FailureMoveToErrorState moves the machine to the state set with WithErrorState or
+	// DefinitionBuilder.OnError, running only the entry hooks of that state and its newly
+	// entered ancestors (their errors are ignored); they receive the error returned by the
+	// failing action or hook as the last event arg. Without an error state it behaves like FailureRollback.
+	FailureMoveToErrorState
+	// FailureAbort stops the machine in the source state without running any further hooks,
+	// as if by Stop but without exit hooks.
+	FailureAbort
+)
+
+// counterOp increments (or, with reset, zeroes) a named machine counter.
+type counterOp struct {
+	name  string
+	reset bool
+}
+
+// Well-known metadata keys understood by the exporters
+const (
+	MetaTooltip = "tooltip"
+	MetaURL     = "url"
+	// MetaWeight is a transition's relative probability for RandomWalk (see WithWeight)
+	MetaWeight = "weight"
+)
+
+// HistoryKind selects how a composite state chooses its child on re-entry.
+type HistoryKind int
+
+const (
+	// NoHistory always drills down through InitialChild (default).
+	NoHistory HistoryKind = iota
+	// ShallowHistory re-enters the direct child that was active when the composite was last
+	// exited; below that child, initial children are used.
+	ShallowHistory
+	// DeepHistory re-enters the full nested path, down to the leaf, that was active when the
+	// composite was last exited.
+	DeepHistory
+)
+
+// EffectOrder controls when a transition's action runs relative to the exit hooks.
+type EffectOrder int
+
+const (
+	// ExitActionEntry runs exit hooks, then the action, then entry hooks (UML order, default).
+	// A failing action re-enters the exited states.
+	ExitActionEntry EffectOrder = iota
+	// ActionExitEntry runs the action before any exit hook, so a failing action
+	// leaves the machine untouched and no rollback hooks run.
+	ActionExitEntry
+)
+
+// BubbleOrder controls in which order the active states are offered an event.
+type BubbleOrder int
+
+const (
+	// LeafFirst offers the event to the active leaf first, then to its ancestors, so child
+	// handlers override their parents' (default).
+	LeafFirst BubbleOrder = iota
+	// RootFirst offers the event to the outermost active state first, so parent handlers
+	// override their children's.
+	RootFirst
+)
+
+// Definition is the built, read-only state machine definition.
+// Its states and transitions are only reachable through accessors returning copies, so a
+// definition shared by running machines cannot be changed under them; use Edit or Clone
+// to derive a modified one.
 type Definition struct {
 	Name        string
-	States      map[StateID]StateDef
-	Transitions map[TransitionKey]TransitionDef
 	Current     StateID
+	EffectOrder EffectOrder
+	BubbleOrder BubbleOrder
+	// ErrorState, if set, is where failed transitions go by default (see DefinitionBuilder.OnError)
+	ErrorState StateID
+	states     map[StateID]StateDef
+	// transitions holds, per state and event, the alternatives in declaration order;
+	// the first whose guard passes is taken
+	transitions map[TransitionKey][]TransitionDef
+	// branches holds the ordered outgoing segments of each junction and choice state
+	branches map[StateID][]TransitionDef
+	// aliases maps alternative event names to the event they stand for
+	aliases map[EventID]EventID
 	// cached topology (computed on demand)
 	topology *GraphTopology
-	// OutgoingTransitions maps each state to its outgoing transition keys for fast lookup
-	OutgoingTransitions map[StateID][]TransitionKey
+	// fingerprint is computed at Build, see Fingerprint
+	fingerprint string
+	// outgoing maps each state to its outgoing transition keys for fast lookup
+	outgoing map[StateID][]TransitionKey
+	// interned state and event names, shared by all machines of this definition
+	stateNames *internTable
+	eventNames *internTable
+	// hierarchy indexes computed once at Build and shared read-only by all machines
+	paths     map[StateID][]StateID // root -> state (inclusive)
+	drillDown map[StateID][]StateID // initial descendants below a state, top -> leaf
+	// hasHistory is set when any state uses a HistoryKind other than NoHistory
+	hasHistory bool
+	// hasWildcards is set when any transition uses a namespace wildcard event such as "fiat.*"
+	hasWildcards bool
+	// hasTimers is set when any state has a timeout or recurring events
+	hasTimers bool
+	// hasReentry is set when any state suppresses re-entry (see WithEntryDebounce)
+	hasReentry bool
+	// hasCounterResets is set when any state resets counters on exit (see WithCounterResetOnExit)
+	hasCounterResets bool
+	// junction chains flattened at Build, in branch priority order
+	junctions map[StateID][]junctionPath
 }
 
+// junctionPath is one way through a chain of junctions: every segment guard must pass
+// for the path to be taken, and it ends at the To of its last segment.
+type junctionPath []TransitionDef
+
 // Runtime errors
 var (
 	ErrMachineNotStarted     = errors.New("machine not started")
@@ -74,4 +329,45 @@ var (
 	ErrActionFailed          = errors.New("action failed")
 	ErrMultipleTransitions   = errors.New("multiple transitions available, cannot auto-advance")
 	ErrNoAvailableTransition = errors.New("no available transition from current state")
+	ErrNoChoiceBranch        = errors.New("no choice branch enabled")
+	ErrHookTimeout           = errors.New("hook timed out")
+	ErrEventExpired          = errors.New("event processing budget exceeded")
+	ErrActionPanicked        = errors.New("action panicked")
+	ErrDefinitionMismatch    = errors.New("snapshot was taken with a different definition")
+	ErrGuardRejected         = errors.New("transition rejected by guard")
 )
+
+// GuardRejectedError reports that an event had a matching transition but its guard rejected
+// it (see WithGuardRejectedErrors). It matches ErrGuardRejected, not ErrNoTransition.
+type GuardRejectedError struct {
+	Source StateID // state owning the rejected transition
+	Target StateID
+	Event  EventID
+	Reason string // set by the guard with GuardContext.Reject, empty otherwise
+}
+
+func (e *GuardRejectedError) Error() string {
+	msg := fmt.Sprintf("%v: %s -> %s on %s", ErrGuardRejected, e.Source, e.Target, e.Event)
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+func (e *GuardRejectedError) Unwrap() error { return ErrGuardRejected }
+
+// PanicError reports a panic recovered from an action, hook, guard or subscriber while an
+// event was handled. It matches ErrActionPanicked with errors.Is, and the panic value too
+// if that is an error.
+type PanicError struct {
+	Value any // the value passed to panic
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("%v: %v", ErrActionPanicked, e.Value) }
+
+func (e *PanicError) Unwrap() []error {
+	if err, ok := e.Value.(error); ok {
+		return []error{ErrActionPanicked, err}
+	}
+	return []error{ErrActionPanicked}
+}
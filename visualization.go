@@ -2,12 +2,35 @@ package rfsm
 
 import (
 	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 type VisualOptions struct {
 	ShowGuards  bool
 	ShowActions bool
+	// ClickHandler is the JavaScript callback bound to nodes in Mermaid flowcharts (empty disables it)
+	ClickHandler string
+	// BundleEdges merges transitions sharing the same from/to pair into one edge with a combined label
+	BundleEdges bool
+	// BundleSeparator joins bundled labels; defaults to ", "
+	BundleSeparator string
+	// MaxLabelLen truncates edge labels longer than this many runes with an ellipsis (0 = unlimited)
+	MaxLabelLen int
+	// FromState restricts rendering to the sub-graph reachable from this state (empty = whole definition)
+	FromState StateID
+}
+
+// visualEdge is a rendered edge after optional bundling
+type visualEdge struct {
+	From  StateID
+	To    StateID
+	Label string
+	Meta  map[string]string
 }
 
 // ToMermaid renders the definition as a Mermaid stateDiagram-v2 DSL.
@@ -15,15 +38,17 @@ type VisualOptions struct {
 func (d *Definition) ToMermaid() string { return d.ToMermaidOpts(VisualOptions{}) }
 
 // ToMermaidOpts renders Mermaid with options.
-// Edge label format: "event [guard] / action" (markers included when enabled and present)
+// Edge label format: "event [guard] / action" (markers included when enabled and present;
+// names set with WithGuardName/WithActionName replace the generic markers)
 func (d *Definition) ToMermaidOpts(opts VisualOptions) string {
+	d = d.visualSubset(opts)
 	var buf bytes.Buffer
 	buf.WriteString("stateDiagram-v2\n")
 
 	// build parent -> children map and root list
 	childrenOf := make(map[StateID][]StateID)
-	roots := make([]StateID, 0, len(d.States))
-	for id, st := range d.States {
+	roots := make([]StateID, 0, len(d.states))
+	for id, st := range d.states {
 		if st.Parent == "" {
 			roots = append(roots, id)
 		} else {
@@ -46,7 +71,7 @@ func (d *Definition) ToMermaidOpts(opts VisualOptions) string {
 		buf.WriteString(" {\n")
 		// render children
 		for _, c := range childrenOf[id] {
-			if len(d.States[c].Children) > 0 {
+			if len(d.states[c].Children) > 0 {
 				renderComposite(c, indent+"\t")
 			} else {
 				// declare leaf inside composite to ensure visibility
@@ -54,9 +79,12 @@ func (d *Definition) ToMermaidOpts(opts VisualOptions) string {
 				buf.WriteByte('\t')
 				buf.WriteString("state ")
 				buf.WriteString(string(c))
+				if pseudoKind(d.states[c]) != "" {
+					buf.WriteString(" <<choice>>")
+				}
 				buf.WriteByte('\n')
 				// final leaf inside composite: draw edge to local terminal
-				if d.States[c].Final {
+				if d.states[c].Final {
 					buf.WriteString(indent)
 					buf.WriteByte('\t')
 					buf.WriteString(string(c))
@@ -64,9 +92,9 @@ func (d *Definition) ToMermaidOpts(opts VisualOptions) string {
 				}
 			}
 		}
-		// render initial pointers for all Initial=true children
+		// render the initial pointer to the composite's initial child
 		for _, c := range childrenOf[id] {
-			if d.States[c].Initial {
+			if d.isInitial(c) {
 				buf.WriteString(indent)
 				buf.WriteByte('\t')
 				buf.WriteString("[*] --> ")
@@ -86,17 +114,20 @@ func (d *Definition) ToMermaidOpts(opts VisualOptions) string {
 			// declare leaf root to ensure visibility if it has no transitions
 			buf.WriteString("state ")
 			buf.WriteString(string(r))
+			if pseudoKind(d.states[r]) != "" {
+				buf.WriteString(" <<choice>>")
+			}
 			buf.WriteByte('\n')
-			if d.States[r].Final {
+			if d.states[r].Final {
 				buf.WriteString(string(r))
 				buf.WriteString(" --> [*]\n")
 			}
 		}
 	}
 
-	// render initial pointers for all Initial=true root states
+	// render the initial pointer to the state the machine starts in
 	for _, r := range roots {
-		if d.States[r].Initial && d.States[r].Parent == "" {
+		if d.isInitial(r) {
 			buf.WriteString("[*] --> ")
 			buf.WriteString(string(r))
 			buf.WriteByte('\n')
@@ -104,41 +135,13 @@ func (d *Definition) ToMermaidOpts(opts VisualOptions) string {
 	}
 
 	// render transitions
-	for _, t := range d.Transitions {
-		buf.WriteString(string(t.Key.From))
+	for _, e := range d.edges(opts) {
+		buf.WriteString(e.From)
 		buf.WriteString(" --> ")
-		buf.WriteString(string(t.To))
-		// label
-		var needLabel bool
-		if t.Key.Event != "" {
-			needLabel = true
-		}
-		if opts.ShowGuards && t.Guard != nil {
-			needLabel = true
-		}
-		if opts.ShowActions && t.Action != nil {
-			needLabel = true
-		}
-		if needLabel {
+		buf.WriteString(e.To)
+		if e.Label != "" {
 			buf.WriteString(" : ")
-			first := true
-			if t.Key.Event != "" {
-				buf.WriteString(t.Key.Event)
-				first = false
-			}
-			if opts.ShowGuards && t.Guard != nil {
-				if !first {
-					buf.WriteString(" ")
-				}
-				buf.WriteString("[guard]")
-				first = false
-			}
-			if opts.ShowActions && t.Action != nil {
-				if !first {
-					buf.WriteString(" ")
-				}
-				buf.WriteString("/ action")
-			}
+			buf.WriteString(e.Label)
 		}
 		buf.WriteByte('\n')
 	}
@@ -150,6 +153,7 @@ func (d *Definition) ToMermaidOpts(opts VisualOptions) string {
 func (d *Definition) ToDOT() string { return d.ToDOTOpts(VisualOptions{}) }
 
 func (d *Definition) ToDOTOpts(opts VisualOptions) string {
+	d = d.visualSubset(opts)
 	var buf bytes.Buffer
 	buf.WriteString("digraph fsm {\n")
 	buf.WriteString("  rankdir=LR;\n")
@@ -157,8 +161,8 @@ func (d *Definition) ToDOTOpts(opts VisualOptions) string {
 
 	// grouping children
 	childrenOf := make(map[StateID][]StateID)
-	roots := make([]StateID, 0, len(d.States))
-	for id, st := range d.States {
+	roots := make([]StateID, 0, len(d.states))
+	for id, st := range d.states {
 		if st.Parent == "" {
 			roots = append(roots, id)
 		} else {
@@ -183,23 +187,27 @@ func (d *Definition) ToDOTOpts(opts VisualOptions) string {
 		buf.WriteString("  label=\"")
 		buf.WriteString(string(id))
 		buf.WriteString("\";\n")
+		for _, a := range d.stateDOTAttrs(id) {
+			buf.WriteString(indent)
+			buf.WriteString("  ")
+			buf.WriteString(a)
+			buf.WriteString(";\n")
+		}
 		for _, c := range childrenOf[id] {
-			if len(d.States[c].Children) > 0 {
+			if len(d.states[c].Children) > 0 {
 				renderCluster(c, indent+"  ")
 			} else {
 				buf.WriteString(indent)
 				buf.WriteString("  \"")
 				buf.WriteString(string(c))
 				buf.WriteString("\"")
-				if d.States[c].Final {
-					buf.WriteString(" [shape=doublecircle]")
-				}
+				buf.WriteString(dotAttrs(d.stateDOTAttrs(c)))
 				buf.WriteString(";\n")
 			}
 		}
-		// render initial pointers for all Initial=true children
+		// render the initial pointer to the composite's initial child
 		for _, c := range childrenOf[id] {
-			if d.States[c].Initial {
+			if d.isInitial(c) {
 				buf.WriteString(indent)
 				buf.WriteString("  __init_")
 				buf.WriteString(string(id))
@@ -228,16 +236,14 @@ func (d *Definition) ToDOTOpts(opts VisualOptions) string {
 			buf.WriteString("  \"")
 			buf.WriteString(string(r))
 			buf.WriteString("\"")
-			if d.States[r].Final {
-				buf.WriteString(" [shape=doublecircle]")
-			}
+			buf.WriteString(dotAttrs(d.stateDOTAttrs(r)))
 			buf.WriteString(";\n")
 		}
 	}
 
-	// render initial pointers for all Initial=true root states
+	// render the initial pointer to the state the machine starts in
 	for _, r := range roots {
-		if d.States[r].Initial && d.States[r].Parent == "" {
+		if d.isInitial(r) {
 			buf.WriteString("  __init_")
 			buf.WriteString(string(r))
 			buf.WriteString(" [shape=point,label=\"\"];\n")
@@ -250,48 +256,516 @@ func (d *Definition) ToDOTOpts(opts VisualOptions) string {
 	}
 
 	// transitions
-	for _, t := range d.Transitions {
+	for _, e := range d.edges(opts) {
 		buf.WriteString("  \"")
-		buf.WriteString(string(t.Key.From))
+		buf.WriteString(e.From)
 		buf.WriteString("\" -> \"")
-		buf.WriteString(string(t.To))
+		buf.WriteString(e.To)
 		buf.WriteString("\"")
-		// label
-		var need bool
-		if t.Key.Event != "" {
-			need = true
-		}
-		if opts.ShowGuards && t.Guard != nil {
-			need = true
-		}
-		if opts.ShowActions && t.Action != nil {
-			need = true
-		}
-		if need {
-			buf.WriteString(" [label=\"")
-			first := true
-			if t.Key.Event != "" {
-				buf.WriteString(t.Key.Event)
-				first = false
+		var attrs []string
+		if e.Label != "" {
+			attrs = append(attrs, "label="+dotQuote(e.Label))
+		}
+		attrs = append(attrs, metaDOTAttrs(e.Meta)...)
+		buf.WriteString(dotAttrs(attrs))
+		buf.WriteString(";\n")
+	}
+
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+// ToMermaidFlowchart renders the definition as a Mermaid `graph TD` flowchart.
+// Composite states become subgraphs and states are styled through classDef classes
+// (initial, final, composite), which renders more reliably than stateDiagram-v2 for deep nesting.
+func (d *Definition) ToMermaidFlowchart() string {
+	return d.ToMermaidFlowchartOpts(VisualOptions{})
+}
+
+// ToMermaidFlowchartOpts renders the flowchart with options.
+// If opts.ClickHandler is set, every node gets a `click` binding calling that JavaScript function with the state ID.
+func (d *Definition) ToMermaidFlowchartOpts(opts VisualOptions) string {
+	d = d.visualSubset(opts)
+	var buf bytes.Buffer
+	buf.WriteString("graph TD\n")
+	buf.WriteString("\tclassDef initial stroke-width:3px\n")
+	buf.WriteString("\tclassDef final stroke-width:3px,stroke-dasharray:4 2\n")
+	buf.WriteString("\tclassDef composite fill:#f4f4f4\n")
+
+	roots, childrenOf := d.hierarchy()
+	ids := d.sortedStateIDs()
+	node := flowchartIDs(ids)
+
+	var renderNode func(id StateID, indent string)
+	renderNode = func(id StateID, indent string) {
+		if len(childrenOf[id]) > 0 {
+			buf.WriteString(indent)
+			buf.WriteString("subgraph ")
+			buf.WriteString(node[id])
+			buf.WriteString(" [")
+			buf.WriteString(flowchartLabel(id))
+			buf.WriteString("]\n")
+			for _, c := range childrenOf[id] {
+				renderNode(c, indent+"\t")
 			}
-			if opts.ShowGuards && t.Guard != nil {
-				if !first {
-					buf.WriteString(" ")
-				}
-				buf.WriteString("[guard]")
-				first = false
+			buf.WriteString(indent)
+			buf.WriteString("end\n")
+			return
+		}
+		buf.WriteString(indent)
+		buf.WriteString(node[id])
+		buf.WriteString("[")
+		buf.WriteString(flowchartLabel(id))
+		buf.WriteString("]\n")
+	}
+	for _, r := range roots {
+		renderNode(r, "\t")
+	}
+
+	// transitions
+	for _, e := range d.edges(opts) {
+		buf.WriteByte('\t')
+		buf.WriteString(node[e.From])
+		if e.Label != "" {
+			buf.WriteString(" -->|")
+			buf.WriteString(flowchartLabel(e.Label))
+			buf.WriteString("| ")
+		} else {
+			buf.WriteString(" --> ")
+		}
+		buf.WriteString(node[e.To])
+		buf.WriteByte('\n')
+	}
+
+	// class assignments
+	for _, id := range ids {
+		st := d.states[id]
+		var classes []string
+		if len(st.Children) > 0 {
+			classes = append(classes, "composite")
+		}
+		if d.isInitial(id) {
+			classes = append(classes, "initial")
+		}
+		if st.Final {
+			classes = append(classes, "final")
+		}
+		for _, c := range classes {
+			buf.WriteString("\tclass ")
+			buf.WriteString(node[id])
+			buf.WriteByte(' ')
+			buf.WriteString(c)
+			buf.WriteByte('\n')
+		}
+	}
+
+	if opts.ClickHandler != "" {
+		for _, id := range ids {
+			buf.WriteString("\tclick ")
+			buf.WriteString(node[id])
+			buf.WriteString(" call ")
+			buf.WriteString(opts.ClickHandler)
+			buf.WriteString("(")
+			buf.WriteString(dotQuote(id))
+			buf.WriteString(")\n")
+		}
+	}
+	return buf.String()
+}
+
+// flowchartIDs maps states to Mermaid flowchart node ids. Names made of letters, digits and
+// underscores are used as is; others (and the keyword "end") get a hex-encoded id, suffixed
+// with underscores if it clashes with another state's name.
+func flowchartIDs(ids []StateID) map[StateID]string {
+	out := make(map[StateID]string, len(ids))
+	used := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if flowchartPlain(id) {
+			out[id] = id
+			used[id] = true
+		}
+	}
+	for _, id := range ids {
+		if _, ok := out[id]; ok {
+			continue
+		}
+		n := "s_" + hex.EncodeToString([]byte(id))
+		for used[n] {
+			n += "_"
+		}
+		out[id] = n
+		used[n] = true
+	}
+	return out
+}
+
+func flowchartPlain(s string) bool {
+	if s == "" || s == "end" {
+		return false
+	}
+	for _, r := range s {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+var flowchartEscaper = strings.NewReplacer(`#`, "#35;", `"`, "#quot;", `|`, "#124;")
+
+// flowchartLabel quotes s as Mermaid text, using entity codes for the characters that would
+// still end or break the quoted string.
+func flowchartLabel(s string) string {
+	return `"` + flowchartEscaper.Replace(s) + `"`
+}
+
+// hierarchy returns sorted root states and a sorted parent -> children map.
+func (d *Definition) hierarchy() ([]StateID, map[StateID][]StateID) {
+	childrenOf := make(map[StateID][]StateID)
+	roots := make([]StateID, 0, len(d.states))
+	for id, st := range d.states {
+		if st.Parent == "" {
+			roots = append(roots, id)
+		} else {
+			childrenOf[st.Parent] = append(childrenOf[st.Parent], id)
+		}
+	}
+	sort.Strings(roots)
+	for parent := range childrenOf {
+		sort.Strings(childrenOf[parent])
+	}
+	return roots, childrenOf
+}
+
+func (d *Definition) sortedStateIDs() []StateID {
+	ids := make([]StateID, 0, len(d.states))
+	for id := range d.states {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// sortedTransitions returns transitions ordered by source, event and target, followed by junction branches.
+func (d *Definition) sortedTransitions() []TransitionDef {
+	ts := make([]TransitionDef, 0, len(d.transitions))
+	for _, alts := range d.transitions {
+		ts = append(ts, alts...)
+	}
+	sort.Slice(ts, func(i, j int) bool {
+		if ts[i].Key.From != ts[j].Key.From {
+			return ts[i].Key.From < ts[j].Key.From
+		}
+		if ts[i].Key.Event != ts[j].Key.Event {
+			return ts[i].Key.Event < ts[j].Key.Event
+		}
+		return ts[i].To < ts[j].To
+	})
+	// junction branches follow, by junction, in their priority order
+	junctions := make([]StateID, 0, len(d.branches))
+	for j := range d.branches {
+		junctions = append(junctions, j)
+	}
+	sort.Strings(junctions)
+	for _, j := range junctions {
+		ts = append(ts, d.branches[j]...)
+	}
+	return ts
+}
+
+// transitionLabel formats an edge label as "event [guard] / action", using the names set
+// with WithGuardName and WithActionName when present.
+func transitionLabel(t TransitionDef, opts VisualOptions) string {
+	var parts []string
+	if t.Key.Event != "" {
+		parts = append(parts, t.Key.Event)
+	}
+	if opts.ShowGuards && t.hasGuard() {
+		name := t.GuardName
+		if name == "" {
+			name = "guard"
+		}
+		parts = append(parts, "["+name+"]")
+	}
+	if opts.ShowActions && t.Action != nil {
+		name := t.ActionName
+		if name == "" {
+			name = "action"
+		}
+		parts = append(parts, "/ "+name)
+	}
+	return strings.Join(parts, " ")
+}
+
+// edges returns the edges to render in stable order, bundled and truncated per opts.
+func (d *Definition) edges(opts VisualOptions) []visualEdge {
+	var out []visualEdge
+	if !opts.BundleEdges {
+		for _, t := range d.sortedTransitions() {
+			out = append(out, visualEdge{From: t.Key.From, To: t.To, Label: transitionLabel(t, opts), Meta: t.Metadata})
+		}
+	} else {
+		sep := opts.BundleSeparator
+		if sep == "" {
+			sep = ", "
+		}
+		type pair struct{ from, to StateID }
+		index := make(map[pair]int)
+		var labels [][]string
+		for _, t := range d.sortedTransitions() {
+			p := pair{t.Key.From, t.To}
+			i, ok := index[p]
+			if !ok {
+				i = len(out)
+				index[p] = i
+				out = append(out, visualEdge{From: p.from, To: p.to})
+				labels = append(labels, nil)
 			}
-			if opts.ShowActions && t.Action != nil {
-				if !first {
-					buf.WriteString(" ")
+			if l := transitionLabel(t, opts); l != "" {
+				labels[i] = append(labels[i], l)
+			}
+			// bundled edges take the first value of each metadata key
+			for k, v := range t.Metadata {
+				if _, ok := out[i].Meta[k]; !ok {
+					if out[i].Meta == nil {
+						out[i].Meta = make(map[string]string)
+					}
+					out[i].Meta[k] = v
 				}
-				buf.WriteString("/ action")
 			}
-			buf.WriteString("\"]")
+		}
+		for i := range out {
+			out[i].Label = strings.Join(labels[i], sep)
+		}
+	}
+	if opts.MaxLabelLen > 0 {
+		for i := range out {
+			out[i].Label = truncateLabel(out[i].Label, opts.MaxLabelLen)
+		}
+	}
+	return out
+}
+
+func truncateLabel(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	if max == 1 {
+		return "…"
+	}
+	return string(r[:max-1]) + "…"
+}
+
+// stateDOTAttrs returns DOT attributes of a state node: final shape plus tooltip/URL from metadata.
+// The state description is used as tooltip when no MetaTooltip is set.
+func (d *Definition) stateDOTAttrs(id StateID) []string {
+	st := d.states[id]
+	var attrs []string
+	if st.Final && len(st.Children) == 0 {
+		attrs = append(attrs, "shape=doublecircle")
+	}
+	if _, ok := st.Metadata[MetaTooltip]; !ok && st.Description != "" {
+		attrs = append(attrs, "tooltip="+dotQuote(st.Description))
+	}
+	return append(attrs, metaDOTAttrs(st.Metadata)...)
+}
+
+func metaDOTAttrs(meta map[string]string) []string {
+	var attrs []string
+	if v, ok := meta[MetaTooltip]; ok {
+		attrs = append(attrs, "tooltip="+dotQuote(v))
+	}
+	if v, ok := meta[MetaURL]; ok {
+		attrs = append(attrs, "URL="+dotQuote(v))
+	}
+	return attrs
+}
+
+func dotAttrs(attrs []string) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(attrs, ",") + "]"
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+// visualSubset returns d itself, or a shallow view restricted to the states reachable from opts.FromState.
+// Being in a state also makes its ancestors active, so their transitions are followed too;
+// entering a state activates its ancestors and initial descendants.
+func (d *Definition) visualSubset(opts VisualOptions) *Definition {
+	if opts.FromState == "" {
+		return d
+	}
+	reach := make(map[StateID]bool)
+	var queue []StateID
+	mark := func(ids []StateID) {
+		for _, s := range ids {
+			if !reach[s] {
+				reach[s] = true
+				queue = append(queue, s)
+			}
+		}
+	}
+	activate := func(id StateID) {
+		mark(d.pathTo(id))
+		mark(d.initialDescendants(id))
+	}
+	if _, ok := d.states[opts.FromState]; ok {
+		activate(opts.FromState)
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for _, tk := range d.outgoing[s] {
+			for _, t := range d.transitions[tk] {
+				activate(t.To)
+			}
+		}
+		for _, t := range d.branches[s] {
+			activate(t.To)
+		}
+	}
+
+	sub := *d
+	sub.states = make(map[StateID]StateDef, len(reach))
+	for id := range reach {
+		sub.states[id] = d.states[id]
+	}
+	sub.transitions = make(map[TransitionKey][]TransitionDef)
+	for k, alts := range d.transitions {
+		if reach[k.From] {
+			sub.transitions[k] = alts
+		}
+	}
+	sub.branches = make(map[StateID][]TransitionDef)
+	for j, segs := range d.branches {
+		if reach[j] {
+			sub.branches[j] = segs
+		}
+	}
+	return &sub
+}
+
+// ToCSV writes the transition table as CSV with a header row: from,event,to,guard,action.
+// Rows are sorted by source state, event and target; guard/action columns report whether one is set.
+func (d *Definition) ToCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"from", "event", "to", "guard", "action"}); err != nil {
+		return err
+	}
+	for _, t := range d.sortedTransitions() {
+		row := []string{
+			t.Key.From,
+			t.Key.Event,
+			t.To,
+			strconv.FormatBool(t.hasGuard()),
+			strconv.FormatBool(t.Action != nil),
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ToSMCat renders the definition in the state-machine-cat (smcat) DSL.
+// Composite states become nested machines; initial/final markers are emitted as
+// smcat pseudo-states named "initial"/"final" (suffixed with the parent ID when nested).
+func (d *Definition) ToSMCat() string { return d.ToSMCatOpts(VisualOptions{}) }
+
+// ToSMCatOpts renders smcat with options.
+func (d *Definition) ToSMCatOpts(opts VisualOptions) string {
+	d = d.visualSubset(opts)
+	roots, childrenOf := d.hierarchy()
+
+	var buf bytes.Buffer
+	buf.WriteString(d.smcatMachine("", roots, childrenOf, ""))
+	for _, e := range d.edges(opts) {
+		buf.WriteString(smcatName(e.From))
+		buf.WriteString(" => ")
+		buf.WriteString(smcatName(e.To))
+		if e.Label != "" {
+			buf.WriteString(": ")
+			buf.WriteString(e.Label)
 		}
 		buf.WriteString(";\n")
 	}
+	return buf.String()
+}
 
-	buf.WriteString("}\n")
+// smcatMachine renders the state declarations of one (possibly nested) machine
+// followed by its initial/final pseudo-state edges.
+func (d *Definition) smcatMachine(parent StateID, ids []StateID, childrenOf map[StateID][]StateID, indent string) string {
+	initial, final := "initial", "final"
+	if parent != "" {
+		initial += "." + parent
+		final += "." + parent
+	}
+	var initials, finals []StateID
+	for _, id := range ids {
+		if d.isInitial(id) {
+			initials = append(initials, id)
+		}
+		if d.states[id].Final && len(childrenOf[id]) == 0 {
+			finals = append(finals, id)
+		}
+	}
+
+	var decls []string
+	if len(initials) > 0 {
+		decls = append(decls, smcatName(initial))
+	}
+	for _, id := range ids {
+		decl := smcatName(id)
+		if kids := childrenOf[id]; len(kids) > 0 {
+			decl += " {\n" + d.smcatMachine(id, kids, childrenOf, indent+"  ") + indent + "}"
+		}
+		decls = append(decls, decl)
+	}
+	if len(finals) > 0 {
+		decls = append(decls, smcatName(final))
+	}
+
+	var buf bytes.Buffer
+	for i, decl := range decls {
+		buf.WriteString(indent)
+		buf.WriteString(decl)
+		if i < len(decls)-1 {
+			buf.WriteString(",\n")
+		} else {
+			buf.WriteString(";\n")
+		}
+	}
+	for _, id := range initials {
+		buf.WriteString(indent + smcatName(initial) + " => " + smcatName(id) + ";\n")
+	}
+	for _, id := range finals {
+		buf.WriteString(indent + smcatName(id) + " => " + smcatName(final) + ";\n")
+	}
 	return buf.String()
 }
+
+// isInitial reports whether a machine enters id first at its level: the definition's Current
+// for top-level states and the parent's InitialChild for nested ones. WithInitial only marks
+// that a state may start the machine.
+func (d *Definition) isInitial(id StateID) bool {
+	if p := d.states[id].Parent; p != "" {
+		return d.states[p].InitialChild == id
+	}
+	return id == d.Current
+}
+
+// smcatName quotes a name unless it only contains characters smcat accepts unquoted.
+func smcatName(s string) string {
+	for _, r := range s {
+		if !(r == '_' || r == '.' || r == '-' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+		}
+	}
+	return s
+}
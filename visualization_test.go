@@ -1,6 +1,9 @@
 package rfsm
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
 func TestToMermaid_NestedAndTransitions(t *testing.T) {
 	sub, err := NewDef("sub").
@@ -69,6 +72,71 @@ func TestToMermaid_WithMarkers_And_DOT(t *testing.T) {
 	}
 }
 
+func TestTransitionLabel_GuardAndActionNames(t *testing.T) {
+	def, err := NewDef("hedge").
+		State("OPEN", WithInitial()).State("HEDGED", WithFinal()).
+		Current("OPEN").
+		On("hedge", "OPEN", "HEDGED",
+			WithGuard[any](func(e Event, ctx any) bool { return true }), WithGuardName("balance>=amount"),
+			WithAction[any](func(e Event, ctx any) error { return nil }), WithActionName("executeHedge")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := def.ToMermaidOpts(VisualOptions{ShowGuards: true, ShowActions: true})
+	if want := "OPEN --> HEDGED : hedge [balance>=amount] / executeHedge"; !contains(ms, want) {
+		t.Fatalf("mermaid missing names: %q in %q", want, ms)
+	}
+	ds := def.ToDOTOpts(VisualOptions{ShowGuards: true, ShowActions: true})
+	if want := `"OPEN" -> "HEDGED" [label="hedge [balance>=amount] / executeHedge"]`; !contains(ds, want) {
+		t.Fatalf("dot missing names: %q in %q", want, ds)
+	}
+	// names are only rendered with their markers enabled
+	if s := def.ToMermaid(); contains(s, "executeHedge") || contains(s, "balance") {
+		t.Fatalf("names rendered without ShowGuards/ShowActions: %q", s)
+	}
+}
+
+func TestToMermaidFlowchart_EscapesNames(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("in [1]", WithInitial()).
+		State("end", WithFinal()).
+		Current("in [1]").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("root").
+		State("wait-for \"ack\"", WithSubDef(sub), WithInitial()).
+		State("a|b", WithFinal()).
+		State("s_656e64").
+		Current("wait-for \"ack\"").
+		On("go | #1", "in [1]", "a|b").
+		On("x", "s_656e64", "end").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := def.ToMermaidFlowchartOpts(VisualOptions{ClickHandler: "openState"})
+	for _, want := range []string{
+		"subgraph s_77616974",
+		`["wait-for #quot;ack#quot;"]`,
+		`s_696e205b315d["in [1]"]`,
+		`s_656e64_["end"]`,
+		`s_656e64["s_656e64"]`,
+		`s_696e205b315d -->|"go #124; #35;1"| s_617c62`,
+		`s_656e64 -->|"x"| s_656e64_`,
+		`class s_617c62 final`,
+		`click s_617c62 call openState("a|b")`,
+	} {
+		if !contains(s, want) {
+			t.Fatalf("flowchart missing %q in\n%s", want, s)
+		}
+	}
+}
+
 func TestToDOT(t *testing.T) {
 	def, err := NewDef("test").
 		State("A", WithInitial()).
@@ -89,6 +157,245 @@ func TestToDOT(t *testing.T) {
 	}
 }
 
+func TestToMermaidFlowchart(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("root").
+		State("A", WithSubDef(sub), WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A1", "B", WithGuard[any](func(e Event, ctx any) bool { return true })).
+		On("back", "B", "A").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := def.ToMermaidFlowchartOpts(VisualOptions{ShowGuards: true, ClickHandler: "openState"})
+	for _, want := range []string{
+		"graph TD",
+		`subgraph A ["A"]`,
+		"\t\tA1[\"A1\"]",
+		`A1 -->|"go [guard]"| B`,
+		`B -->|"back"| A`,
+		"class A composite",
+		"class B final",
+		"classDef initial",
+		"click B call openState(\"B\")",
+	} {
+		if !contains(s, want) {
+			t.Fatalf("flowchart missing %q in\n%s", want, s)
+		}
+	}
+	if contains(def.ToMermaidFlowchart(), "click ") {
+		t.Fatalf("click bindings rendered without handler")
+	}
+}
+
+func TestVisual_BundleEdges(t *testing.T) {
+	def, err := NewDef("bundle").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("approve", "A", "B").
+		On("force", "A", "B").
+		On("skip", "A", "B").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := def.ToMermaid()
+	if !contains(plain, "A --> B : approve") || !contains(plain, "A --> B : skip") {
+		t.Fatalf("unbundled output should keep one edge per transition:\n%s", plain)
+	}
+
+	opts := VisualOptions{BundleEdges: true, BundleSeparator: " | "}
+	if s := def.ToMermaidOpts(opts); !contains(s, "A --> B : approve | force | skip") {
+		t.Fatalf("mermaid missing bundled edge:\n%s", s)
+	}
+	if s := def.ToDOTOpts(opts); !contains(s, "\"A\" -> \"B\" [label=\"approve | force | skip\"]") {
+		t.Fatalf("dot missing bundled edge:\n%s", s)
+	}
+
+	opts.MaxLabelLen = 10
+	if s := def.ToMermaidFlowchartOpts(opts); !contains(s, `A -->|"approve #124;…"| B`) {
+		t.Fatalf("flowchart missing truncated label:\n%s", s)
+	}
+}
+
+func TestToDOT_MetadataTooltipsAndURLs(t *testing.T) {
+	def, err := NewDef("meta").
+		State("A", WithInitial(), WithDescription("waiting for \"deposit\"")).
+		State("B", WithFinal(), WithMetadata(MetaURL, "https://runbooks/b"), WithMetadata(MetaTooltip, "done")).
+		Current("A").
+		On("go", "A", "B", WithTransitionMetadata(MetaURL, "https://runbooks/go")).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dot := def.ToDOT()
+	for _, want := range []string{
+		`"A" [tooltip="waiting for \"deposit\""];`,
+		`"B" [shape=doublecircle,tooltip="done",URL="https://runbooks/b"];`,
+		`"A" -> "B" [label="go",URL="https://runbooks/go"];`,
+	} {
+		if !contains(dot, want) {
+			t.Fatalf("dot missing %q in\n%s", want, dot)
+		}
+	}
+}
+
+func TestVisual_FromStateSubset(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("F1", WithInitial()).
+		State("F2", WithFinal()).
+		Current("F1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("reach").
+		State("INIT", WithInitial()).
+		State("FIAT", WithSubDef(sub)).
+		State("DONE", WithFinal()).
+		State("EXPIRED", WithFinal()).
+		State("ORPHAN").
+		Current("INIT").
+		On("start", "INIT", "FIAT").
+		On("next", "F1", "F2").
+		On("overdue", "FIAT", "EXPIRED").
+		On("ok", "F2", "DONE").
+		On("revive", "ORPHAN", "INIT").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// from F2: bubbling through FIAT reaches EXPIRED, F2 reaches DONE; INIT and ORPHAN are unreachable
+	s := def.ToMermaidOpts(VisualOptions{FromState: "F2"})
+	for _, want := range []string{"FIAT --> EXPIRED : overdue", "F2 --> DONE : ok", "state FIAT {"} {
+		if !contains(s, want) {
+			t.Fatalf("subset missing %q in\n%s", want, s)
+		}
+	}
+	for _, unwanted := range []string{"INIT", "ORPHAN", "start"} {
+		if contains(s, unwanted) {
+			t.Fatalf("subset should not contain %q:\n%s", unwanted, s)
+		}
+	}
+	if dot := def.ToDOTOpts(VisualOptions{FromState: "F2"}); contains(dot, "ORPHAN") {
+		t.Fatalf("dot subset contains unreachable state")
+	}
+}
+
+func TestToCSV(t *testing.T) {
+	def, err := NewDef("csv").
+		State("A", WithInitial()).
+		State("B", WithFinal()).
+		Current("A").
+		On("go", "A", "B", WithGuard[any](func(e Event, ctx any) bool { return true })).
+		On("back, again", "B", "A", WithAction[any](func(e Event, ctx any) error { return nil })).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := def.ToCSV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "from,event,to,guard,action\n" +
+		"A,go,B,true,false\n" +
+		"B,\"back, again\",A,false,true\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("csv mismatch\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestToSMCat(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("A1", WithInitial()).
+		State("A2", WithFinal()).
+		Current("A1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("root").
+		State("A", WithSubDef(sub), WithInitial()).
+		State("B b", WithFinal()).
+		Current("A").
+		On("go", "A1", "B b").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "initial,\n" +
+		"A {\n" +
+		"  initial.A,\n" +
+		"  A1,\n" +
+		"  A2,\n" +
+		"  final.A;\n" +
+		"  initial.A => A1;\n" +
+		"  A2 => final.A;\n" +
+		"},\n" +
+		"\"B b\",\n" +
+		"final;\n" +
+		"initial => A;\n" +
+		"\"B b\" => final;\n" +
+		"A1 => \"B b\": go;\n"
+	if got := def.ToSMCat(); got != want {
+		t.Fatalf("smcat mismatch\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestInitialMarkersFollowCurrentAndInitialChild(t *testing.T) {
+	sub, err := NewDef("sub").
+		State("C1", WithInitial()).
+		State("C2", WithFinal()).
+		Current("C1").
+		On("next", "C1", "C2").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	def, err := NewDef("m").
+		State("P", WithSubDef(sub)).
+		State("Q", WithInitial(), WithFinal()).
+		InitialChild("P", "C2").
+		Current("P").
+		On("go", "C2", "Q").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	smcat := def.ToSMCat()
+	for _, want := range []string{"initial.P => C2;", "initial => P;"} {
+		if !contains(smcat, want) {
+			t.Fatalf("smcat missing %q:\n%s", want, smcat)
+		}
+	}
+	for _, bad := range []string{"initial.P => C1;", "initial => Q;"} {
+		if contains(smcat, bad) {
+			t.Fatalf("smcat has %q:\n%s", bad, smcat)
+		}
+	}
+	mermaid := def.ToMermaid()
+	if !contains(mermaid, "[*] --> C2") || contains(mermaid, "[*] --> C1") || contains(mermaid, "[*] --> Q") {
+		t.Fatalf("mermaid initial markers wrong:\n%s", mermaid)
+	}
+}
+
 func contains(s, sub string) bool {
 	return len(s) >= len(sub) && (func() bool { return (len(find(s, sub)) > 0) })()
 }